@@ -3,16 +3,22 @@ package main
 import (
 	"avito-testovoe/config"
 	"avito-testovoe/handler"
+	"avito-testovoe/internal/auth"
 	c "avito-testovoe/internal/cache"
 	"avito-testovoe/internal/logger"
 	"avito-testovoe/internal/storage"
+	"avito-testovoe/internal/tracking"
 	"context"
+	"errors"
+	"fmt"
+	"github.com/redis/go-redis/v9"
 	"golang.org/x/sync/errgroup"
 	"log/slog"
 	_ "modernc.org/sqlite"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 )
 
@@ -20,9 +26,78 @@ func main() {
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
 
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		os.Exit(migrate(ctx, os.Args[2:]))
+	}
+
 	os.Exit(run(ctx))
 }
 
+// migrate управляет схемой базы данных:
+// migrate [up | down | to <version> | status]
+func migrate(ctx context.Context, args []string) int {
+	log := logger.SettUpLogger()
+
+	cfg := config.MustLoad()
+
+	storage, err := sqlite.Open(cfg.StorageDriver, cfg.StoragePath)
+	if err != nil {
+		log.Error("Ошибка подключения к базе данных", slog.Any("err", err))
+		return 1
+	}
+	defer storage.Db.Close()
+
+	migrations, err := sqlite.Migrations(storage.Driver)
+	if err != nil {
+		log.Error("Ошибка чтения миграций", slog.Any("err", err))
+		return 1
+	}
+
+	current, err := storage.SchemaVersion(ctx)
+	if err != nil {
+		log.Error("Ошибка чтения версии базы данных", slog.Any("err", err))
+		return 1
+	}
+
+	command := "up"
+	if len(args) > 0 {
+		command = args[0]
+	}
+
+	target := len(migrations)
+	switch command {
+	case "up":
+	case "down":
+		target = current - 1
+	case "to":
+		if len(args) < 2 {
+			log.Error("Не указана версия: migrate to <version>")
+			return 1
+		}
+		target, err = strconv.Atoi(args[1])
+		if err != nil {
+			log.Error("Некорректная версия", slog.Any("err", err))
+			return 1
+		}
+	case "status":
+		log.Info("Версия базы данных", slog.Int("current", current), slog.Int("latest", len(migrations)))
+		return 0
+	default:
+		log.Error("Неизвестная команда, ожидается up, down, to <version> или status", slog.String("command", command))
+		return 1
+	}
+
+	err = storage.MigrateTo(ctx, target)
+	if err != nil {
+		log.Error("Ошибка миграции", slog.Any("err", err))
+		return 1
+	}
+
+	log.Info("Миграции применены", slog.Int("from", current), slog.Int("to", target))
+
+	return 0
+}
+
 func run(ctx context.Context) int {
 	log := logger.SettUpLogger()
 
@@ -34,11 +109,15 @@ func run(ctx context.Context) int {
 
 	log.Info("Конфиг прочитан")
 
-	cache := c.New(cfg.DefaultExpiration, cfg.CleanupInterval)
+	cache, err := newCache(cfg, ctx)
+	if err != nil {
+		log.Error("Ошибка настройки кэша", slog.Any("err", err))
+		return 1
+	}
 
 	log.Info("Кэш контейнет создан")
 
-	storage, err := sqlite.New(cfg.StoragePath, log, ctx)
+	storage, err := sqlite.New(cfg.StorageDriver, cfg.StoragePath, log, ctx)
 	if err != nil {
 		log.Error("Ошибка подключения к базе данных")
 		os.Exit(1)
@@ -46,35 +125,134 @@ func run(ctx context.Context) int {
 
 	log.Info("База данных подключена")
 
+	storage.Retention = sqlite.Retention{
+		Policy:   cfg.Versions.Retention,
+		MaxCount: cfg.Versions.MaxCount,
+		MaxAge:   cfg.Versions.MaxAge,
+	}
+	if err = storage.Retention.Validate(); err != nil {
+		log.Error("Некорректная политика хранения версий", slog.Any("err", err))
+		return 1
+	}
+
+	if !bootstrapAdmin(ctx, log, cfg, storage) {
+		return 1
+	}
+
+	jwtVerifier, err := auth.New(cfg.JWT.HMACSecret, cfg.JWT.JWKSFile, cfg.JWT.Issuer, cfg.JWT.Audience)
+	if err != nil {
+		log.Error("Ошибка настройки проверки JWT", slog.Any("err", err))
+		return 1
+	}
+	if jwtVerifier != nil {
+		log.Info("Проверка JWT включена")
+	}
+
+	snapshot, _ := cache.(c.Snapshotter)
+	if snapshot != nil && cfg.CacheSnapshot != "" {
+		restored, err := c.LoadSnapshot(cfg.CacheSnapshot, snapshot)
+		if err != nil {
+			log.Error("Снимок кэша не загружен", slog.Any("err", err))
+		} else {
+			log.Info("Кэш восстановлен из снимка", slog.Int("restored", restored))
+		}
+	}
+
+	if cfg.WarmUp.Enabled {
+		warmUp(ctx, log, cfg, storage, cache)
+	}
+
+	resolution := sqlite.Resolution(cfg.TagResolution)
+	if err = resolution.Validate(); err != nil {
+		log.Error("Некорректная стратегия выбора баннера по тегам", slog.Any("err", err))
+		return 1
+	}
+
+	opts := []handler.Option{handler.WithJWT(jwtVerifier), handler.WithTagResolution(resolution)}
+	servers := []*http.Server{}
+
+	var events *tracking.Writer
+	if cfg.Tracking.Enabled {
+		events = tracking.New(storage, log, cfg.Tracking.Buffer, cfg.Tracking.BatchSize, cfg.Tracking.FlushInterval)
+		events.Start()
+		opts = append(opts, handler.WithTracking(events))
+		log.Info("Учет показов и кликов баннеров включен")
+	}
+
+	switch cfg.Invalidation.Transport {
+	case "", c.TransportNone:
+	case c.TransportHTTP:
+		if cfg.Invalidation.Secret == "" {
+			log.Error("Для транспорта инвалидации http нужен секрет: invalidation.secret или INVALIDATION_SECRET")
+			return 1
+		}
+		bus := c.NewHTTPTransport(cfg.Invalidation.Peers, cfg.Invalidation.Secret, cfg.Invalidation.Timeout)
+		opts = append(opts, handler.WithInvalidation(bus))
+		servers = append(servers, &http.Server{
+			Addr:         cfg.Invalidation.Listen,
+			ReadTimeout:  cfg.Timeout,
+			WriteTimeout: cfg.Timeout,
+			IdleTimeout:  cfg.IdleTimeout,
+			Handler:      bus,
+		})
+		log.Info("Инвалидация кэша между репликами включена", slog.Int("peers", len(cfg.Invalidation.Peers)))
+	default:
+		log.Error("Неизвестный транспорт инвалидации кэша", slog.String("transport", cfg.Invalidation.Transport))
+		return 1
+	}
+
 	srv := &http.Server{
 		Addr:         cfg.Address,
 		ReadTimeout:  cfg.Timeout,
 		WriteTimeout: cfg.Timeout,
 		IdleTimeout:  cfg.IdleTimeout,
-		Handler:      handler.NewServer(log, storage, cache, ctx),
+		Handler:      handler.NewServer(log, storage, cache, ctx, opts...),
 	}
+	servers = append(servers, srv)
 
 	g, gCtx := errgroup.WithContext(ctx)
 
-	g.Go(func() error {
-		log.Info("Запускаем сервер:", slog.String("server", cfg.Address))
+	for _, srv := range servers {
+		srv := srv
+
+		g.Go(func() error {
+			log.Info("Запускаем сервер:", slog.String("server", srv.Addr))
 
-		return srv.ListenAndServe()
-	})
+			return srv.ListenAndServe()
+		})
 
-	g.Go(func() error {
-		<-gCtx.Done()
-		log.Info("Остановка сервера")
+		g.Go(func() error {
+			<-gCtx.Done()
+			log.Info("Остановка сервера", slog.String("server", srv.Addr))
 
-		shutCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
-		defer cancel()
+			shutCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+			defer cancel()
 
-		return srv.Shutdown(shutCtx)
-	})
+			return srv.Shutdown(shutCtx)
+		})
+	}
 
 	err = g.Wait()
+
+	// сервер остановлен, поэтому новых событий нет, и принятые дописываются в хранилище
+	if events != nil {
+		events.Close()
+	}
+
+	if snapshot != nil && cfg.CacheSnapshot != "" {
+		if err := c.SaveSnapshot(cfg.CacheSnapshot, snapshot); err != nil {
+			log.Error("Ошибка сохранения снимка кэша", slog.Any("err", err))
+		}
+	}
+
+	if cfg.WarmUp.Enabled && cfg.WarmUp.HitsFile != "" {
+		if err := c.SaveHits(cfg.WarmUp.HitsFile, cache.Entries(), cfg.WarmUp.MaxKeys); err != nil {
+			log.Error("Ошибка сохранения запрашиваемых ключей кэша", slog.Any("err", err))
+		}
+	}
+
 	if err != nil && err != http.ErrServerClosed {
-		log.Error("Сервер остановился с ошибкой: ", err)
+		log.Error("Сервер остановился с ошибкой: ", slog.Any("err", err))
 		return 1
 	}
 
@@ -82,3 +260,88 @@ func run(ctx context.Context) int {
 
 	return 0
 }
+
+// warmUp загружает в кэш баннеры до запуска сервера. Ошибки прогрева не мешают запуску
+func warmUp(ctx context.Context, log *slog.Logger, cfg *config.Config, storage *sqlite.Storage, cache c.Cache) {
+	ctx, cancel := context.WithTimeout(ctx, cfg.WarmUp.Timeout)
+	defer cancel()
+
+	keys, source, err := handler.WarmUpKeys(storage, cfg.WarmUp.HitsFile, cfg.WarmUp.MaxActive, ctx)
+	if err != nil {
+		log.Error("Ошибка выбора ключей для прогрева кэша", slog.Any("err", err))
+		return
+	}
+
+	loaded := handler.WarmUp(log, storage, cache, keys, ctx)
+	log.Info("Кэш прогрет", slog.String("source", source), slog.Int("keys", len(keys)), slog.Int("loaded", loaded))
+}
+
+// newCache создает кэш выбранного в cache_backend вида: в памяти процесса или в Redis
+func newCache(cfg *config.Config, ctx context.Context) (c.Cache, error) {
+	switch cfg.CacheBackend {
+	case "", "memory":
+		policy, err := c.PolicyByName(cfg.CachePolicy)
+		if err != nil {
+			return nil, err
+		}
+
+		return c.New(cfg.DefaultExpiration, cfg.CleanupInterval,
+			c.WithShards(cfg.CacheShards),
+			c.WithStaleGrace(cfg.StaleGrace),
+			c.WithPolicy(policy),
+			c.WithMaxEntries(cfg.CacheMaxEntries),
+			c.WithMaxBytes(cfg.CacheMaxBytes)), nil
+	case "redis":
+		client := redis.NewClient(&redis.Options{
+			Addr:     cfg.Redis.Addr,
+			Password: cfg.Redis.Password,
+			DB:       cfg.Redis.DB,
+		})
+		if err := client.Ping(ctx).Err(); err != nil {
+			client.Close()
+			return nil, err
+		}
+
+		return c.NewRedis(client, cfg.Redis.Prefix, cfg.DefaultExpiration, cfg.StaleGrace), nil
+	default:
+		return nil, fmt.Errorf("unknown cache backend %q", cfg.CacheBackend)
+	}
+}
+
+// bootstrapAdmin выпускает токен администратора из admin_token, если в базе нет действующего токена роли admin.
+// Начальные токены прежних версий опубликованы в репозитории и отзываются миграциями, их нужно заменить
+func bootstrapAdmin(ctx context.Context, log *slog.Logger, cfg *config.Config, storage *sqlite.Storage) bool {
+	active, err := storage.CountActiveTokensInStorage(handler.AdminRole, ctx)
+	if err != nil {
+		log.Error("Ошибка чтения токенов", slog.Any("err", err))
+		return false
+	}
+	if active > 0 {
+		return true
+	}
+
+	if cfg.AdminToken == "" {
+		log.Warn("Нет действующего токена администратора: начальные токены отозваны, " +
+			"задайте admin_token или ADMIN_TOKEN, чтобы выпустить новый")
+		return true
+	}
+
+	created, err := storage.BootstrapTokenInStorage(sqlite.Token{
+		Name:  "bootstrap admin",
+		Role:  handler.AdminRole,
+		Token: cfg.AdminToken,
+	}, ctx)
+	if errors.Is(err, sqlite.ErrTokenRevoked) {
+		log.Error("Токен из admin_token отозван, задайте новое значение", slog.Any("err", err))
+		return false
+	}
+	if err != nil {
+		log.Error("Ошибка выпуска токена администратора", slog.Any("err", err))
+		return false
+	}
+	if created {
+		log.Warn("Выпущен токен администратора из admin_token: выпустите постоянные токены через /token и уберите admin_token")
+	}
+
+	return true
+}
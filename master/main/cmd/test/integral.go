@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"os"
 	"strconv"
 )
 
@@ -20,6 +21,14 @@ type Banner struct {
 }
 
 func main() {
+	// начальные токены опубликованы и отозваны, поэтому тест берет токен администратора,
+	// с которым запущен сервер: он выпускается из ADMIN_TOKEN при первом запуске
+	adminToken := os.Getenv("ADMIN_TOKEN")
+	if adminToken == "" {
+		fmt.Println("не задан ADMIN_TOKEN: запустите сервер и тест с одним и тем же токеном администратора")
+		os.Exit(1)
+	}
+
 	tests := []struct {
 		name           string
 		nameFunc       string
@@ -34,7 +43,7 @@ func main() {
 		{
 			name:     "PostBanner101 active",
 			nameFunc: "PostBanner",
-			token:    "c1c224b03cd9bc7b6a86d77f5dace40191766c485cd55dc48caf9ac873335d6f",
+			token:    adminToken,
 			method:   "POST",
 			url:      "http://localhost:8181/banner",
 			body: Banner{
@@ -52,7 +61,7 @@ func main() {
 		{
 			name:     "PostBanner102 active",
 			nameFunc: "PostBanner",
-			token:    "c1c224b03cd9bc7b6a86d77f5dace40191766c485cd55dc48caf9ac873335d6f",
+			token:    adminToken,
 			method:   "POST",
 			url:      "http://localhost:8181/banner",
 			body: Banner{
@@ -70,7 +79,7 @@ func main() {
 		{
 			name:     "PostBanner103 active",
 			nameFunc: "PostBanner",
-			token:    "c1c224b03cd9bc7b6a86d77f5dace40191766c485cd55dc48caf9ac873335d6f",
+			token:    adminToken,
 			method:   "POST",
 			url:      "http://localhost:8181/banner",
 			body: Banner{
@@ -88,7 +97,7 @@ func main() {
 		{
 			name:     "PostBanner104 not active",
 			nameFunc: "PostBanner",
-			token:    "c1c224b03cd9bc7b6a86d77f5dace40191766c485cd55dc48caf9ac873335d6f",
+			token:    adminToken,
 			method:   "POST",
 			url:      "http://localhost:8181/banner",
 			body: Banner{
@@ -106,7 +115,7 @@ func main() {
 		{
 			name:     "PostBanner105 not active",
 			nameFunc: "PostBanner",
-			token:    "c1c224b03cd9bc7b6a86d77f5dace40191766c485cd55dc48caf9ac873335d6f",
+			token:    adminToken,
 			method:   "POST",
 			url:      "http://localhost:8181/banner",
 			body: Banner{
@@ -124,7 +133,7 @@ func main() {
 		{
 			name:     "PostBanner106 not active",
 			nameFunc: "PostBanner",
-			token:    "c1c224b03cd9bc7b6a86d77f5dace40191766c485cd55dc48caf9ac873335d6f",
+			token:    adminToken,
 			method:   "POST",
 			url:      "http://localhost:8181/banner",
 			body: Banner{
@@ -142,7 +151,7 @@ func main() {
 		{
 			name:     "PostBanner107 active",
 			nameFunc: "PostBanner",
-			token:    "c1c224b03cd9bc7b6a86d77f5dace40191766c485cd55dc48caf9ac873335d6f",
+			token:    adminToken,
 			method:   "POST",
 			url:      "http://localhost:8181/banner",
 			body: Banner{
@@ -160,7 +169,7 @@ func main() {
 		{
 			name:     "PostBanner108 active",
 			nameFunc: "PostBanner",
-			token:    "c1c224b03cd9bc7b6a86d77f5dace40191766c485cd55dc48caf9ac873335d6f",
+			token:    adminToken,
 			method:   "POST",
 			url:      "http://localhost:8181/banner",
 			body: Banner{
@@ -178,7 +187,7 @@ func main() {
 		{
 			name:     "PostBanner109 not active",
 			nameFunc: "PostBanner",
-			token:    "c1c224b03cd9bc7b6a86d77f5dace40191766c485cd55dc48caf9ac873335d6f",
+			token:    adminToken,
 			method:   "POST",
 			url:      "http://localhost:8181/banner",
 			body: Banner{
@@ -196,7 +205,7 @@ func main() {
 		{
 			name:     "PostBanner110 active",
 			nameFunc: "PostBanner",
-			token:    "c1c224b03cd9bc7b6a86d77f5dace40191766c485cd55dc48caf9ac873335d6f",
+			token:    adminToken,
 			method:   "POST",
 			url:      "http://localhost:8181/banner",
 			body: Banner{
@@ -251,7 +260,7 @@ func main() {
 		{
 			name:     "PostBanner with wrong featureId",
 			nameFunc: "PostBanner",
-			token:    "c1c224b03cd9bc7b6a86d77f5dace40191766c485cd55dc48caf9ac873335d6f",
+			token:    adminToken,
 			method:   "POST",
 			url:      "http://localhost:8181/banner",
 			body: Banner{
@@ -270,7 +279,7 @@ func main() {
 		{
 			name:     "GetBanner 101 101",
 			nameFunc: "GetBanner",
-			token:    "c1c224b03cd9bc7b6a86d77f5dace40191766c485cd55dc48caf9ac873335d6f",
+			token:    adminToken,
 			method:   "GET",
 			url:      "http://localhost:8181/user_banner?tag_id=101&feature_id=101&use_last_revision=true",
 			body:     Banner{},
@@ -301,7 +310,7 @@ func main() {
 		{
 			name:           "GetBanner that not exist",
 			nameFunc:       "GetBanner",
-			token:          "c1c224b03cd9bc7b6a86d77f5dace40191766c485cd55dc48caf9ac873335d6f",
+			token:          adminToken,
 			method:         "GET",
 			url:            "http://localhost:8181/user_banner?tag_id=1000&feature_id=1000&use_last_revision=true",
 			body:           Banner{},
@@ -310,7 +319,7 @@ func main() {
 		{
 			name:           "DeleteBanner101",
 			nameFunc:       "DeleteBanner",
-			token:          "c1c224b03cd9bc7b6a86d77f5dace40191766c485cd55dc48caf9ac873335d6f",
+			token:          adminToken,
 			method:         "DELETE",
 			url:            "http://localhost:8181/banner/",
 			expectedStatus: http.StatusNoContent,
@@ -318,7 +327,7 @@ func main() {
 		{
 			name:           "DeleteBanner102",
 			nameFunc:       "DeleteBanner",
-			token:          "c1c224b03cd9bc7b6a86d77f5dace40191766c485cd55dc48caf9ac873335d6f",
+			token:          adminToken,
 			method:         "DELETE",
 			url:            "http://localhost:8181/banner/",
 			expectedStatus: http.StatusNoContent,
@@ -326,7 +335,7 @@ func main() {
 		{
 			name:           "DeleteBanner103",
 			nameFunc:       "DeleteBanner",
-			token:          "c1c224b03cd9bc7b6a86d77f5dace40191766c485cd55dc48caf9ac873335d6f",
+			token:          adminToken,
 			method:         "DELETE",
 			url:            "http://localhost:8181/banner/",
 			expectedStatus: http.StatusNoContent,
@@ -334,7 +343,7 @@ func main() {
 		{
 			name:           "DeleteBanner104",
 			nameFunc:       "DeleteBanner",
-			token:          "c1c224b03cd9bc7b6a86d77f5dace40191766c485cd55dc48caf9ac873335d6f",
+			token:          adminToken,
 			method:         "DELETE",
 			url:            "http://localhost:8181/banner/",
 			expectedStatus: http.StatusNoContent,
@@ -342,7 +351,7 @@ func main() {
 		{
 			name:           "DeleteBanner105",
 			nameFunc:       "DeleteBanner",
-			token:          "c1c224b03cd9bc7b6a86d77f5dace40191766c485cd55dc48caf9ac873335d6f",
+			token:          adminToken,
 			method:         "DELETE",
 			url:            "http://localhost:8181/banner/",
 			expectedStatus: http.StatusNoContent,
@@ -350,7 +359,7 @@ func main() {
 		{
 			name:           "DeleteBanner106",
 			nameFunc:       "DeleteBanner",
-			token:          "c1c224b03cd9bc7b6a86d77f5dace40191766c485cd55dc48caf9ac873335d6f",
+			token:          adminToken,
 			method:         "DELETE",
 			url:            "http://localhost:8181/banner/",
 			expectedStatus: http.StatusNoContent,
@@ -358,7 +367,7 @@ func main() {
 		{
 			name:           "DeleteBanner107",
 			nameFunc:       "DeleteBanner",
-			token:          "c1c224b03cd9bc7b6a86d77f5dace40191766c485cd55dc48caf9ac873335d6f",
+			token:          adminToken,
 			method:         "DELETE",
 			url:            "http://localhost:8181/banner/",
 			expectedStatus: http.StatusNoContent,
@@ -366,7 +375,7 @@ func main() {
 		{
 			name:           "DeleteBanner108",
 			nameFunc:       "DeleteBanner",
-			token:          "c1c224b03cd9bc7b6a86d77f5dace40191766c485cd55dc48caf9ac873335d6f",
+			token:          adminToken,
 			method:         "DELETE",
 			url:            "http://localhost:8181/banner/",
 			expectedStatus: http.StatusNoContent,
@@ -374,7 +383,7 @@ func main() {
 		{
 			name:           "DeleteBanner109",
 			nameFunc:       "DeleteBanner",
-			token:          "c1c224b03cd9bc7b6a86d77f5dace40191766c485cd55dc48caf9ac873335d6f",
+			token:          adminToken,
 			method:         "DELETE",
 			url:            "http://localhost:8181/banner/",
 			expectedStatus: http.StatusNoContent,
@@ -382,7 +391,7 @@ func main() {
 		{
 			name:           "DeleteBanner110",
 			nameFunc:       "DeleteBanner",
-			token:          "c1c224b03cd9bc7b6a86d77f5dace40191766c485cd55dc48caf9ac873335d6f",
+			token:          adminToken,
 			method:         "DELETE",
 			url:            "http://localhost:8181/banner/",
 			expectedStatus: http.StatusNoContent,
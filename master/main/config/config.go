@@ -8,13 +8,85 @@ import (
 )
 
 type Config struct {
+	StorageDriver     string        `yaml:"storage_driver" env-default:"sqlite"`
 	StoragePath       string        `yaml:"storage_path"`
 	Address           string        `yaml:"address"`
 	Timeout           time.Duration `yaml:"timeout"`
 	IdleTimeout       time.Duration `yaml:"idle_timeout"`
 	DefaultExpiration time.Duration `yaml:"default_expiration"`
+	StaleGrace        time.Duration `yaml:"stale_while_revalidate"`
 	CleanupInterval   time.Duration `yaml:"cleanup_interval"`
+	CacheBackend      string        `yaml:"cache_backend" env-default:"memory"`
+	CacheShards       int           `yaml:"cache_shards" env-default:"32"`
+	CachePolicy       string        `yaml:"cache_policy" env-default:"tinylfu"`
+	CacheMaxEntries   int           `yaml:"cache_max_entries" env-default:"10000"`
+	CacheMaxBytes     int64         `yaml:"cache_max_bytes" env-default:"67108864"`
+	CacheSnapshot     string        `yaml:"cache_snapshot"`
+	TagResolution     string        `yaml:"tag_resolution" env-default:"first"`
 	ShutdownTimeout   time.Duration `yaml:"shutdown_timeout"`
+	AdminToken        string        `yaml:"admin_token" env:"ADMIN_TOKEN"`
+	JWT               JWT           `yaml:"jwt"`
+	Redis             Redis         `yaml:"redis"`
+	Invalidation      Invalidation  `yaml:"invalidation"`
+	WarmUp            WarmUp        `yaml:"warmup"`
+	Versions          Versions      `yaml:"versions"`
+	Tracking          Tracking      `yaml:"tracking"`
+}
+
+// JWT настройки проверки токенов из заголовка Authorization: Bearer.
+// Если не заданы ни hmac_secret, ни jwks_file, JWT не принимаются
+type JWT struct {
+	HMACSecret string `yaml:"hmac_secret" env:"JWT_HMAC_SECRET"`
+	JWKSFile   string `yaml:"jwks_file"`
+	Issuer     string `yaml:"issuer"`
+	Audience   string `yaml:"audience"`
+}
+
+// Redis подключение к Redis-совместимому серверу для cache_backend: redis.
+// Кэш в нем общий для всех реплик, поэтому изменение баннера на одной реплике видно остальным
+type Redis struct {
+	Addr     string `yaml:"addr" env-default:"localhost:6379"`
+	Password string `yaml:"password" env:"REDIS_PASSWORD"`
+	DB       int    `yaml:"db"`
+	Prefix   string `yaml:"prefix" env-default:"banner:"`
+}
+
+// Invalidation рассылка удаленных ключей кэша между репликами: none или http.
+// При http реплика принимает ключи на listen и отправляет их на адреса peers остальных реплик
+type Invalidation struct {
+	Transport string        `yaml:"transport" env-default:"none"`
+	Listen    string        `yaml:"listen" env-default:":8182"`
+	Peers     []string      `yaml:"peers"`
+	Secret    string        `yaml:"secret" env:"INVALIDATION_SECRET"`
+	Timeout   time.Duration `yaml:"timeout" env-default:"2s"`
+}
+
+// WarmUp прогрев кэша перед запуском сервера. Ключи берутся из hits_file, куда при остановке
+// сохраняются max_keys самых запрашиваемых ключей, а если его нет - из всех показываемых баннеров,
+// когда их ключей не больше max_active. Прогрев длится не дольше timeout
+type WarmUp struct {
+	Enabled   bool          `yaml:"enabled"`
+	HitsFile  string        `yaml:"hits_file" env-default:"cache_hits.json"`
+	MaxKeys   int           `yaml:"max_keys" env-default:"1000"`
+	MaxActive int           `yaml:"max_active" env-default:"5000"`
+	Timeout   time.Duration `yaml:"timeout" env-default:"30s"`
+}
+
+// Versions политика хранения истории версий баннеров: count (последние max_count версий),
+// age (версии моложе max_age) или unlimited
+type Versions struct {
+	Retention string        `yaml:"retention" env-default:"count"`
+	MaxCount  int           `yaml:"max_count" env-default:"3"`
+	MaxAge    time.Duration `yaml:"max_age" env-default:"720h"`
+}
+
+// Tracking учет показов и кликов баннеров. События копятся в буфере на buffer событий
+// и записываются пачками по batch_size событий, но не реже раза в flush_interval
+type Tracking struct {
+	Enabled       bool          `yaml:"enabled"`
+	Buffer        int           `yaml:"buffer" env-default:"10000"`
+	BatchSize     int           `yaml:"batch_size" env-default:"500"`
+	FlushInterval time.Duration `yaml:"flush_interval" env-default:"5s"`
 }
 
 func MustLoad() *Config {
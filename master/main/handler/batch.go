@@ -0,0 +1,189 @@
+package handler
+
+import (
+	sqlite "avito-testovoe/internal/storage"
+	"avito-testovoe/internal/tracking"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// maxBatchItems наибольшее количество ключей "фича тег" в одном пакетном запросе
+const maxBatchItems = 100
+
+// BatchRequest пакетный запрос баннеров пользователя: один тег и список фич
+// или список пар фича и тег в Items. UserId, как и в GET /user_banner, включает эксперименты
+type BatchRequest struct {
+	TagId      int            `json:"tag_id,omitempty"`
+	FeatureIds []int          `json:"feature_ids,omitempty"`
+	Items      []sqlite.Query `json:"items,omitempty"`
+	Revision   bool           `json:"use_last_revision,omitempty"`
+	UserId     string         `json:"user_id,omitempty"`
+}
+
+// BatchResult результат по одному ключу: код ответа, который вернул бы GET /user_banner, и баннер при коде 200.
+// VariantId - вариант эксперимента, если баннер выбран экспериментом
+type BatchResult struct {
+	Status    int             `json:"status"`
+	Content   json.RawMessage `json:"content,omitempty"`
+	VariantId int             `json:"variant_id,omitempty"`
+}
+
+// GetBannerBatch Получение баннеров пользователя для нескольких фич одним запросом.
+// Ответ - результаты по ключам "фича тег", баннеры, которых нет в кэше, читаются одним запросом к хранилищу
+func (h *Handler) GetBannerBatch(w http.ResponseWriter, r *http.Request) {
+	token := requestToken(r)
+
+	var p Principal
+	ok := h.verify(token, w, func(principal Principal) bool {
+		p = principal
+		return p.can(ReadPermission)
+	})
+
+	if !ok {
+		return
+	}
+
+	var req BatchRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		h.Log.Error("Некорректные данные:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	queries, ok := batchQueries(req)
+	if !ok {
+		h.Log.Error("Некорректные данные пакетного запроса")
+		http.Error(w, fmt.Sprintf("Некорректные данные: нужны tag_id и feature_ids или items, не больше %d ключей", maxBatchItems), http.StatusBadRequest)
+		return
+	}
+
+	results := make(map[string]BatchResult, len(queries))
+	loaded := map[string]bannerLoad{}
+	fromStorage := map[string]bool{}
+	// ключи кэша берутся до чтения хранилища: если поколение фичи изменится во время чтения,
+	// прочитанный баннер попадет под прежний ключ и не будет отдан
+	cacheKeys := map[string]string{}
+	variants := map[string]sqlite.Variant{}
+	var allowed, misses []sqlite.Query
+
+	for _, query := range queries {
+		key := fmt.Sprintf("%d %d", query.FeatureId, query.TagId)
+		if !p.allows(ReadPermission, query.FeatureId) || !p.inScope(query.FeatureId, query.TagId) {
+			results[key] = BatchResult{Status: http.StatusForbidden}
+			continue
+		}
+
+		variant, _, experiment, err := h.experimentVariant(query.FeatureId, []int{query.TagId}, req.UserId, req.Revision)
+		if err != nil {
+			h.Log.Error("Внутренняя ошибка сервера:", slog.Any("err", err))
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if experiment {
+			variants[key] = variant
+		}
+		allowed = append(allowed, query)
+		cacheKey, err := h.bannerKey(query.FeatureId, []int{query.TagId})
+		if err != nil {
+			h.Log.Error("Кэш недоступен, баннер читается из базы:", slog.Any("err", err))
+			misses = append(misses, query)
+			continue
+		}
+		cacheKeys[key] = cacheKey
+
+		if req.Revision {
+			misses = append(misses, query)
+			continue
+		}
+
+		banner, fresh, found := h.cachedBanner(cacheKey)
+		if !found {
+			misses = append(misses, query)
+			continue
+		}
+		loaded[key] = banner
+		if !fresh {
+			go h.refreshBanner(cacheKey, query)
+		}
+	}
+
+	banners, err := h.S.GetUserBannersFromStorage(misses, h.Ctx)
+	if err != nil {
+		h.Log.Error("Внутренняя ошибка сервера:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, banner := range banners {
+		key := fmt.Sprintf("%d %d", banner.FeatureId, banner.TagId)
+		load := bannerLoad{BannerId: banner.BannerId, Content: json.RawMessage(banner.Content), Active: banner.Active}
+		if cacheKey, ok := cacheKeys[key]; ok {
+			h.cacheBanner(cacheKey, load, banner.Window.Next(time.Now()))
+		}
+		loaded[key] = load
+		fromStorage[key] = true
+	}
+
+	for _, query := range allowed {
+		key := fmt.Sprintf("%d %d", query.FeatureId, query.TagId)
+		banner, found := loaded[key]
+		variant, experiment := variants[key]
+		switch {
+		// вариант эксперимента заменяет баннер, только пока тот показывается пользователям
+		case found && banner.Active && experiment:
+			results[key] = BatchResult{Status: http.StatusOK, Content: variant.Content, VariantId: variant.VariantId}
+		case !found:
+			results[key] = BatchResult{Status: http.StatusNotFound}
+		case !banner.Active && !p.allows(WritePermission, query.FeatureId):
+			results[key] = BatchResult{Status: http.StatusForbidden}
+		default:
+			results[key] = BatchResult{Status: http.StatusOK, Content: banner.Content}
+			h.track(tracking.Event{
+				Kind:      tracking.Impression,
+				BannerId:  banner.BannerId,
+				FeatureId: query.FeatureId,
+				TagId:     query.TagId,
+				FromCache: !fromStorage[key],
+			})
+		}
+	}
+
+	h.writeJSON(w, http.StatusOK, results)
+	h.Log.Info("Получены баннеры пользователя пакетом", slog.Int("keys", len(queries)), slog.Int("storage", len(misses)))
+}
+
+// batchQueries возвращает различные пары фича и тег пакетного запроса, ok = false если запрос некорректен
+func batchQueries(req BatchRequest) (queries []sqlite.Query, ok bool) {
+	items := req.Items
+	if len(items) > 0 {
+		if req.TagId != 0 || len(req.FeatureIds) > 0 {
+			return nil, false
+		}
+	} else {
+		for _, featureId := range req.FeatureIds {
+			items = append(items, sqlite.Query{FeatureId: featureId, TagId: req.TagId})
+		}
+	}
+
+	if len(items) == 0 || len(items) > maxBatchItems {
+		return nil, false
+	}
+
+	seen := map[[2]int]bool{}
+	for _, item := range items {
+		if item.FeatureId <= 0 || item.TagId <= 0 {
+			return nil, false
+		}
+		pair := [2]int{item.FeatureId, item.TagId}
+		if seen[pair] {
+			continue
+		}
+		seen[pair] = true
+		queries = append(queries, sqlite.Query{FeatureId: item.FeatureId, TagId: item.TagId})
+	}
+
+	return queries, true
+}
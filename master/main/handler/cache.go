@@ -0,0 +1,174 @@
+package handler
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// GetCacheStats Получение счетчиков кэша: попадания, промахи, вытеснения, истечения и текущий размер
+func (h *Handler) GetCacheStats(w http.ResponseWriter, r *http.Request) {
+	token := requestToken(r)
+
+	ok := h.Verify(token, WritePermission, w)
+
+	if !ok {
+		return
+	}
+
+	h.writeJSON(w, http.StatusOK, h.C.Stats())
+	h.Log.Info("Получены счетчики кэша по запросу пользователя")
+}
+
+// GetCacheEntries Получение ключей кэша со сроком жизни и числом попаданий
+func (h *Handler) GetCacheEntries(w http.ResponseWriter, r *http.Request) {
+	token := requestToken(r)
+
+	ok := h.Verify(token, WritePermission, w)
+
+	if !ok {
+		return
+	}
+
+	h.writeJSON(w, http.StatusOK, h.C.Entries())
+	h.Log.Info("Получены ключи кэша по запросу пользователя")
+}
+
+// PurgeCacheKey Удаление из кэша одного ключа "фича тег"
+func (h *Handler) PurgeCacheKey(w http.ResponseWriter, r *http.Request) {
+	token := requestToken(r)
+
+	ok := h.Verify(token, WritePermission, w)
+
+	if !ok {
+		return
+	}
+
+	featureId, errFeature := strconv.Atoi(r.URL.Query().Get("feature_id"))
+	tagId, errTag := strconv.Atoi(r.URL.Query().Get("tag_id"))
+	if errFeature != nil || errTag != nil {
+		h.Log.Error("Некорректные данные: нужны feature_id и tag_id")
+		http.Error(w, "Некорректные данные: нужны feature_id и tag_id", http.StatusBadRequest)
+		return
+	}
+
+	key, err := h.bannerKey(featureId, []int{tagId})
+	if err != nil {
+		h.Log.Error("Кэш недоступен:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !h.C.Purge(key) {
+		h.Log.Error("Ключ кэша не найден: " + key)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	h.Log.Info("Удален ключ кэша по запросу пользователя: " + key)
+}
+
+// FlushCache Очистка всего кэша
+func (h *Handler) FlushCache(w http.ResponseWriter, r *http.Request) {
+	token := requestToken(r)
+
+	ok := h.Verify(token, WritePermission, w)
+
+	if !ok {
+		return
+	}
+
+	removed := h.C.Flush()
+
+	h.writeJSON(w, http.StatusOK, map[string]int{"removed": removed})
+	h.Log.Info("Очищен кэш по запросу пользователя", slog.Int("removed", removed))
+}
+
+// invalidate удаляет ключи из кэша и рассылает их остальным репликам
+func (h *Handler) invalidate(keys []string) {
+	h.dropKeys(keys)
+	h.publish(keys)
+}
+
+// receive применяет ключи, полученные от остальных реплик: служебные ключи сбрасывают
+// локальные кэши обработчика, остальные удаляются из кэша баннеров
+func (h *Handler) receive(keys []string) {
+	res := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if feature, ok := strings.CutPrefix(key, experimentsPrefix); ok {
+			if featureId, err := strconv.Atoi(feature); err == nil {
+				h.resetExperiments(featureId)
+			}
+			continue
+		}
+
+		switch key {
+		case rolesKey:
+			h.resetRoles()
+		default:
+			res = append(res, key)
+		}
+	}
+
+	h.dropKeys(res)
+}
+
+// dropKeys удаляет из кэша ключи "фича тег" текущего поколения и увеличивает поколения их фич.
+// После этого прежние ключи фичи не читаются и истекают сами, поэтому sqlite.DefaultKey,
+// ключи нескольких тегов и тегов без своего баннера не нужно искать среди записей кэша
+func (h *Handler) dropKeys(keys []string) {
+	var features []int
+	res := make([]string, 0, len(keys))
+	for _, key := range keys {
+		feature, tag, _ := strings.Cut(key, " ")
+		featureId, err := strconv.Atoi(feature)
+		if err != nil {
+			continue
+		}
+		// без поколения ключ не удалить, но после увеличения поколения он все равно не читается
+		if tagId, err := strconv.Atoi(tag); err == nil {
+			if key, err := h.bannerKey(featureId, []int{tagId}); err == nil {
+				res = append(res, key)
+			}
+		}
+		if !slices.Contains(features, featureId) {
+			features = append(features, featureId)
+		}
+	}
+
+	h.C.Delete(res)
+	h.C.NextGeneration(features)
+}
+
+// bannerKey ключ кэша баннера для тегов пользователя: "фича t1,t2 #поколение". Поколение фичи увеличивается
+// при любом изменении ее баннеров, поэтому прежние ключи фичи больше не читаются и истекают сами.
+// Если поколение прочитать не удалось, ключа нет и кэш для фичи нужно обойти
+func (h *Handler) bannerKey(featureId int, tags []int) (string, error) {
+	generation, err := h.C.Generation(featureId)
+	if err != nil {
+		return "", err
+	}
+
+	parts := make([]string, len(tags))
+	for i, tag := range tags {
+		parts[i] = strconv.Itoa(tag)
+	}
+
+	return fmt.Sprintf("%d %s #%d", featureId, strings.Join(parts, ","), generation), nil
+}
+
+// publish рассылает ключи остальным репликам. Ошибка рассылки не отменяет изменение:
+// на недоступных репликах ключи истекут по default_expiration
+func (h *Handler) publish(keys []string) {
+	if h.Bus == nil || len(keys) == 0 {
+		return
+	}
+
+	err := h.Bus.Publish(keys)
+	if err != nil {
+		h.Log.Error("Ошибка рассылки инвалидации кэша:", slog.Any("err", err))
+	}
+}
@@ -0,0 +1,252 @@
+package handler
+
+import (
+	sqlite "avito-testovoe/internal/storage"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CurrentVersion обозначает текущее состояние баннера в параметрах from и to
+const CurrentVersion = "current"
+
+// Change изменение значения
+type Change struct {
+	From any `json:"from"`
+	To   any `json:"to"`
+}
+
+// ContentDiff изменения контента. Ключи - пути JSON Pointer, вложенные объекты сравниваются по ключам
+type ContentDiff struct {
+	Added   map[string]any    `json:"added"`
+	Removed map[string]any    `json:"removed"`
+	Changed map[string]Change `json:"changed"`
+}
+
+// TagsDiff изменения набора тегов
+type TagsDiff struct {
+	Added   []int `json:"added"`
+	Removed []int `json:"removed"`
+}
+
+// BannerDiff разница между двумя состояниями баннера
+type BannerDiff struct {
+	From        string      `json:"from"`
+	To          string      `json:"to"`
+	Content     ContentDiff `json:"content"`
+	Tags        TagsDiff    `json:"tags"`
+	Feature     *Change     `json:"feature,omitempty"`
+	IsActive    *Change     `json:"is_active,omitempty"`
+	ActiveFrom  *Change     `json:"active_from,omitempty"`
+	ActiveUntil *Change     `json:"active_until,omitempty"`
+	Priority    *Change     `json:"priority,omitempty"`
+	IsDefault   *Change     `json:"is_default,omitempty"`
+}
+
+// GetBannerDiff Получение разницы между двумя версиями баннера или версией и текущим баннером
+func (h *Handler) GetBannerDiff(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	token := requestToken(r)
+
+	ok := h.VerifyAny(token, WritePermission, w)
+
+	if !ok {
+		return
+	}
+
+	idInt, err := strconv.Atoi(id)
+	if err != nil {
+		h.Log.Error("Некорректные данные:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	from := r.URL.Query().Get("from")
+	to := r.URL.Query().Get("to")
+	if to == "" {
+		to = CurrentVersion
+	}
+	if from == "" {
+		h.Log.Error("Некорректные данные: не указана версия from")
+		http.Error(w, "Некорректные данные: не указана версия from", http.StatusBadRequest)
+		return
+	}
+
+	current, err := h.S.GetBannerByIdFromStorage(idInt, h.Ctx)
+	if errors.Is(err, sql.ErrNoRows) {
+		h.Log.Error("Баннер не найден:", slog.Any("err", err))
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		h.Log.Error("Внутренняя ошибка сервера:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	versions, err := h.S.GetBannerVersionsFromStorage(idInt, h.Ctx)
+	if err != nil {
+		h.Log.Error("Внутренняя ошибка сервера:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	states := make([]sqlite.Banner, 0, 2)
+	for _, v := range []string{from, to} {
+		if v == CurrentVersion {
+			states = append(states, current)
+			continue
+		}
+
+		versionId, err := strconv.Atoi(v)
+		if err != nil {
+			h.Log.Error("Некорректные данные:", slog.Any("err", err))
+			http.Error(w, "Некорректные данные: версия должна быть числом или current", http.StatusBadRequest)
+			return
+		}
+
+		i := slices.IndexFunc(versions, func(b sqlite.Banner) bool { return b.BannerId == versionId })
+		if i < 0 {
+			h.Log.Error("Версия баннера не найдена")
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		states = append(states, versions[i])
+	}
+
+	if !h.Verify(token, WritePermission, w, current.FeatureId, states[0].FeatureId, states[1].FeatureId) {
+		return
+	}
+
+	diff, err := diffBanners(states[0], states[1])
+	if err != nil {
+		h.Log.Error("Внутренняя ошибка сервера:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	diff.From, diff.To = from, to
+
+	h.writeJSON(w, http.StatusOK, diff)
+	h.Log.Info("Получена разница версий баннера по запросу пользователя под номером:" + id)
+}
+
+// diffBanners сравнивает два состояния баннера
+func diffBanners(from, to sqlite.Banner) (BannerDiff, error) {
+	diff := BannerDiff{
+		Content: ContentDiff{Added: map[string]any{}, Removed: map[string]any{}, Changed: map[string]Change{}},
+		Tags:    TagsDiff{Added: []int{}, Removed: []int{}},
+	}
+
+	fromContent, err := decodeContent(from.Content)
+	if err != nil {
+		return BannerDiff{}, err
+	}
+	toContent, err := decodeContent(to.Content)
+	if err != nil {
+		return BannerDiff{}, err
+	}
+	diffValues("", fromContent, toContent, &diff.Content)
+
+	for _, tag := range to.TagIds {
+		if !slices.Contains(from.TagIds, tag) {
+			diff.Tags.Added = append(diff.Tags.Added, tag)
+		}
+	}
+	for _, tag := range from.TagIds {
+		if !slices.Contains(to.TagIds, tag) {
+			diff.Tags.Removed = append(diff.Tags.Removed, tag)
+		}
+	}
+	slices.Sort(diff.Tags.Added)
+	slices.Sort(diff.Tags.Removed)
+
+	if from.FeatureId != to.FeatureId {
+		diff.Feature = &Change{From: from.FeatureId, To: to.FeatureId}
+	}
+	if from.IsActive != to.IsActive {
+		diff.IsActive = &Change{From: from.IsActive, To: to.IsActive}
+	}
+	if !sameTime(from.ActiveFrom, to.ActiveFrom) {
+		diff.ActiveFrom = &Change{From: from.ActiveFrom, To: to.ActiveFrom}
+	}
+	if !sameTime(from.ActiveUntil, to.ActiveUntil) {
+		diff.ActiveUntil = &Change{From: from.ActiveUntil, To: to.ActiveUntil}
+	}
+	if from.Priority != to.Priority {
+		diff.Priority = &Change{From: from.Priority, To: to.Priority}
+	}
+	if from.IsDefault != to.IsDefault {
+		diff.IsDefault = &Change{From: from.IsDefault, To: to.IsDefault}
+	}
+
+	return diff, nil
+}
+
+// diffValues рекурсивно сравнивает объекты по ключам, остальные значения сравниваются целиком
+func diffValues(path string, from, to any, res *ContentDiff) {
+	fromObj, fromIsObj := from.(map[string]any)
+	toObj, toIsObj := to.(map[string]any)
+
+	if !fromIsObj || !toIsObj {
+		if !reflect.DeepEqual(from, to) {
+			res.Changed[path] = Change{From: from, To: to}
+		}
+		return
+	}
+
+	for key, toValue := range toObj {
+		keyPath := path + "/" + escapePointer(key)
+		fromValue, ok := fromObj[key]
+		if !ok {
+			res.Added[keyPath] = toValue
+			continue
+		}
+		diffValues(keyPath, fromValue, toValue, res)
+	}
+
+	for key, fromValue := range fromObj {
+		if _, ok := toObj[key]; !ok {
+			res.Removed[path+"/"+escapePointer(key)] = fromValue
+		}
+	}
+}
+
+// decodeContent разбирает контент, сохраняя числа без потери точности
+func decodeContent(content json.RawMessage) (any, error) {
+	if len(content) == 0 {
+		return nil, nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+
+	return value, nil
+}
+
+// escapePointer экранирует ключ для JSON Pointer (RFC 6901)
+func escapePointer(key string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(key, "~", "~0"), "/", "~1")
+}
+
+func sameTime(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	return a.Equal(*b)
+}
@@ -0,0 +1,45 @@
+package handler
+
+import (
+	sqlite "avito-testovoe/internal/storage"
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestDiffBanners(t *testing.T) {
+	from := sqlite.Banner{
+		FeatureId: 1,
+		TagIds:    []int{1, 2},
+		IsActive:  true,
+		Content:   json.RawMessage(`{"title": "old", "price": 10, "meta": {"color": "red", "size": 1}, "gone": true, "a/b": [1]}`),
+	}
+	to := sqlite.Banner{
+		FeatureId: 2,
+		TagIds:    []int{2, 3},
+		IsActive:  true,
+		Content:   json.RawMessage(`{"title": "new", "price": 10, "meta": {"color": "blue", "extra": null}, "a/b": [1, 2]}`),
+	}
+
+	diff, err := diffBanners(from, to)
+	require.NoError(t, err)
+
+	require.Equal(t, map[string]any{"/meta/extra": nil}, diff.Content.Added)
+	require.Equal(t, map[string]any{"/gone": true, "/meta/size": json.Number("1")}, diff.Content.Removed)
+	require.Equal(t, map[string]Change{
+		"/title":      {From: "old", To: "new"},
+		"/meta/color": {From: "red", To: "blue"},
+		"/a~1b":       {From: []any{json.Number("1")}, To: []any{json.Number("1"), json.Number("2")}},
+	}, diff.Content.Changed)
+	require.Equal(t, TagsDiff{Added: []int{3}, Removed: []int{1}}, diff.Tags)
+	require.Equal(t, &Change{From: 1, To: 2}, diff.Feature)
+	require.Nil(t, diff.IsActive)
+
+	diff, err = diffBanners(from, from)
+	require.NoError(t, err)
+	require.Empty(t, diff.Content.Added)
+	require.Empty(t, diff.Content.Removed)
+	require.Empty(t, diff.Content.Changed)
+	require.Empty(t, diff.Tags.Added)
+	require.Nil(t, diff.Feature)
+}
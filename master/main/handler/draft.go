@@ -0,0 +1,370 @@
+package handler
+
+import (
+	sqlite "avito-testovoe/internal/storage"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+)
+
+// Workflow настройка согласования изменений баннеров фичи
+type Workflow struct {
+	FeatureId      int  `json:"feature_id"`
+	ReviewRequired bool `json:"review_required"`
+}
+
+// draftReview тело запроса на согласование или отклонение черновика
+type draftReview struct {
+	Comment string `json:"comment"`
+}
+
+var draftStatuses = []string{sqlite.DraftPending, sqlite.DraftApproved, sqlite.DraftRejected}
+
+// GetWorkflow Получение настройки согласования изменений баннеров фичи
+func (h *Handler) GetWorkflow(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	token := requestToken(r)
+
+	ok := h.VerifyAny(token, ManagePermission, w)
+
+	if !ok {
+		return
+	}
+
+	featureId, err := strconv.Atoi(id)
+	if err != nil || featureId < 1 {
+		h.Log.Error("Некорректные данные:", slog.Any("err", err))
+		http.Error(w, "Некорректные данные", http.StatusBadRequest)
+		return
+	}
+
+	if !h.Verify(token, ManagePermission, w, featureId) {
+		return
+	}
+
+	review, err := h.S.GetFeatureWorkflowFromStorage(featureId, h.Ctx)
+	if err != nil {
+		h.Log.Error("Внутренняя ошибка сервера:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h.writeJSON(w, http.StatusOK, Workflow{FeatureId: featureId, ReviewRequired: review})
+	h.Log.Info("Получена настройка согласования фичи по запросу пользователя под номером:" + id)
+}
+
+// PutWorkflow Включение или выключение согласования изменений баннеров фичи
+func (h *Handler) PutWorkflow(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	token := requestToken(r)
+
+	ok := h.VerifyAny(token, ManagePermission, w)
+
+	if !ok {
+		return
+	}
+
+	featureId, err := strconv.Atoi(id)
+	if err != nil || featureId < 1 {
+		h.Log.Error("Некорректные данные:", slog.Any("err", err))
+		http.Error(w, "Некорректные данные", http.StatusBadRequest)
+		return
+	}
+
+	if !h.Verify(token, ManagePermission, w, featureId) {
+		return
+	}
+
+	var workflow Workflow
+	var buf bytes.Buffer
+
+	_, err = buf.ReadFrom(r.Body)
+	if err != nil {
+		h.Log.Error("Некорректные данные:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err = json.Unmarshal(buf.Bytes(), &workflow); err != nil {
+		h.Log.Error("Некорректные данные:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	workflow.FeatureId = featureId
+
+	err = h.S.PutFeatureWorkflowToStorage(featureId, workflow.ReviewRequired, h.Ctx)
+	if err != nil {
+		h.Log.Error("Внутренняя ошибка сервера:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h.writeJSON(w, http.StatusOK, workflow)
+	h.Log.Info("Сохранена настройка согласования фичи по запросу пользователя под номером:" + id)
+}
+
+// GetDrafts Получение черновиков изменений баннера, необязательно с фильтром по статусу
+func (h *Handler) GetDrafts(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	token := requestToken(r)
+
+	ok := h.verify(token, w, func(p Principal) bool {
+		return p.can(WritePermission) || p.can(ApprovePermission)
+	})
+
+	if !ok {
+		return
+	}
+
+	idInt, err := strconv.Atoi(id)
+	if err != nil {
+		h.Log.Error("Некорректные данные:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	status := r.URL.Query().Get("status")
+	if status != "" && !slices.Contains(draftStatuses, status) {
+		h.Log.Error("Некорректные данные: неизвестный статус черновика")
+		http.Error(w, "Некорректные данные: неизвестный статус черновика", http.StatusBadRequest)
+		return
+	}
+
+	featureId, ok := h.bannerFeature(idInt, w)
+	if !ok || !h.verify(token, w, func(p Principal) bool {
+		return p.allows(WritePermission, featureId) || p.allows(ApprovePermission, featureId)
+	}) {
+		return
+	}
+
+	drafts, err := h.S.GetDraftsFromStorage(idInt, status, h.Ctx)
+	if err != nil {
+		h.Log.Error("Внутренняя ошибка сервера:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h.writeJSON(w, http.StatusOK, drafts)
+	h.Log.Info("Получены черновики баннера по запросу пользователя под номером:" + id)
+}
+
+// ApproveDraft Согласование черновика: изменение применяется к баннеру
+func (h *Handler) ApproveDraft(w http.ResponseWriter, r *http.Request) {
+	token := requestToken(r)
+
+	draft, banner, review, ok := h.reviewDraft(token, w, r)
+	if !ok {
+		return
+	}
+
+	if banner.ContentChanged() && !h.validateContent(banner.FeatureId, banner.Content, w) {
+		return
+	}
+
+	err := h.S.UpdateDraftStatusInStorage(draft.Id, sqlite.DraftPending, sqlite.DraftApproved, review.reviewer, review.Comment, h.Ctx)
+	if errors.Is(err, sql.ErrNoRows) {
+		h.Log.Error("Черновик уже рассмотрен:", slog.Any("err", err))
+		http.Error(w, "Черновик уже рассмотрен", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		h.Log.Error("Внутренняя ошибка сервера:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !h.applyBannerUpdate(banner, w) {
+		err = h.S.UpdateDraftStatusInStorage(draft.Id, sqlite.DraftApproved, sqlite.DraftPending, "", "", h.Ctx)
+		if err != nil {
+			h.Log.Error("Не удалось вернуть черновик в ожидание:", slog.Any("err", err))
+		}
+		return
+	}
+
+	h.writeReviewedDraft(draft, w)
+	h.Log.Info("Согласован черновик " + strconv.Itoa(draft.Id) + " баннера под номером:" + strconv.Itoa(draft.BannerId))
+}
+
+// RejectDraft Отклонение черновика с необязательным комментарием
+func (h *Handler) RejectDraft(w http.ResponseWriter, r *http.Request) {
+	token := requestToken(r)
+
+	draft, _, review, ok := h.reviewDraft(token, w, r)
+	if !ok {
+		return
+	}
+
+	err := h.S.UpdateDraftStatusInStorage(draft.Id, sqlite.DraftPending, sqlite.DraftRejected, review.reviewer, review.Comment, h.Ctx)
+	if errors.Is(err, sql.ErrNoRows) {
+		h.Log.Error("Черновик уже рассмотрен:", slog.Any("err", err))
+		http.Error(w, "Черновик уже рассмотрен", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		h.Log.Error("Внутренняя ошибка сервера:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h.writeReviewedDraft(draft, w)
+	h.Log.Info("Отклонен черновик " + strconv.Itoa(draft.Id) + " баннера под номером:" + strconv.Itoa(draft.BannerId))
+}
+
+// reviewRequired сообщает, требует ли согласования изменение, затрагивающее фичи features
+func (h *Handler) reviewRequired(features ...int) (bool, error) {
+	for _, featureId := range features {
+		review, err := h.S.GetFeatureWorkflowFromStorage(featureId, h.Ctx)
+		if err != nil || review {
+			return review, err
+		}
+	}
+
+	return false, nil
+}
+
+// createDraft сохраняет проверенное изменение баннера как черновик и отвечает 202
+func (h *Handler) createDraft(token string, bannerId int, changes json.RawMessage, w http.ResponseWriter) {
+	p, err := h.principal(token)
+	if err != nil {
+		h.Log.Error("Внутренняя ошибка сервера:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	draft, err := h.S.CreateDraftInStorage(sqlite.Draft{BannerId: bannerId, Changes: changes, Author: p.Subject}, h.Ctx)
+	if err != nil {
+		h.Log.Error("Внутренняя ошибка сервера:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h.writeJSON(w, http.StatusAccepted, draft)
+	h.Log.Info("Создан черновик " + strconv.Itoa(draft.Id) + " баннера под номером:" + strconv.Itoa(bannerId))
+}
+
+// pendingReview решение по черновику: рецензент и его комментарий
+type pendingReview struct {
+	draftReview
+	reviewer string
+}
+
+// reviewDraft загружает ожидающий черновик и проверяет, что субъект может его рассмотреть:
+// у него есть право approve на фичи баннера и черновика, и он не автор черновика и не действует от имени автора
+func (h *Handler) reviewDraft(token string, w http.ResponseWriter, r *http.Request) (draft sqlite.Draft, banner sqlite.BannerUpdate, review pendingReview, ok bool) {
+	ok = h.VerifyAny(token, ApprovePermission, w)
+
+	if !ok {
+		return
+	}
+
+	bannerId, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		h.Log.Error("Некорректные данные:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return draft, banner, review, false
+	}
+
+	draftId, err := strconv.Atoi(chi.URLParam(r, "draft_id"))
+	if err != nil {
+		h.Log.Error("Некорректные данные:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return draft, banner, review, false
+	}
+
+	var buf bytes.Buffer
+
+	_, err = buf.ReadFrom(r.Body)
+	if err != nil {
+		h.Log.Error("Некорректные данные:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return draft, banner, review, false
+	}
+
+	if buf.Len() > 0 {
+		if err = json.Unmarshal(buf.Bytes(), &review.draftReview); err != nil {
+			h.Log.Error("Некорректные данные:", slog.Any("err", err))
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return draft, banner, review, false
+		}
+	}
+
+	featureId, ok := h.bannerFeature(bannerId, w)
+	if !ok {
+		return draft, banner, review, false
+	}
+
+	draft, err = h.S.GetDraftFromStorage(bannerId, draftId, h.Ctx)
+	if errors.Is(err, sql.ErrNoRows) {
+		h.Log.Error("Черновик не найден:", slog.Any("err", err))
+		w.WriteHeader(http.StatusNotFound)
+		return draft, banner, review, false
+	}
+	if err != nil {
+		h.Log.Error("Внутренняя ошибка сервера:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return draft, banner, review, false
+	}
+
+	if draft.Status != sqlite.DraftPending {
+		h.Log.Error("Черновик уже рассмотрен")
+		http.Error(w, "Черновик уже рассмотрен", http.StatusConflict)
+		return draft, banner, review, false
+	}
+
+	if err = json.Unmarshal(draft.Changes, &banner); err != nil {
+		h.Log.Error("Внутренняя ошибка сервера:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return draft, banner, review, false
+	}
+	banner.BannerId = bannerId
+	if banner.FeatureId == 0 {
+		banner.FeatureId = featureId
+	}
+
+	if !h.Verify(token, ApprovePermission, w, featureId, banner.FeatureId) {
+		return draft, banner, review, false
+	}
+
+	p, err := h.principal(token)
+	if err != nil {
+		h.Log.Error("Внутренняя ошибка сервера:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return draft, banner, review, false
+	}
+
+	own, err := h.sameOwner(p.Subject, draft.Author)
+	if err != nil {
+		h.Log.Error("Внутренняя ошибка сервера:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return draft, banner, review, false
+	}
+	if own {
+		h.Log.Error("Автор не может рассматривать свой черновик")
+		http.Error(w, "Автор не может рассматривать свой черновик", http.StatusForbidden)
+		return draft, banner, review, false
+	}
+	review.reviewer = p.Subject
+
+	return draft, banner, review, true
+}
+
+// writeReviewedDraft отвечает черновиком после изменения его статуса
+func (h *Handler) writeReviewedDraft(draft sqlite.Draft, w http.ResponseWriter) {
+	draft, err := h.S.GetDraftFromStorage(draft.BannerId, draft.Id, h.Ctx)
+	if err != nil {
+		h.Log.Error("Внутренняя ошибка сервера:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h.writeJSON(w, http.StatusOK, draft)
+}
@@ -0,0 +1,345 @@
+package handler
+
+import (
+	sqlite "avito-testovoe/internal/storage"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// VariantHeader заголовок ответа GET /user_banner с идентификатором варианта эксперимента, который получил пользователь
+const VariantHeader = "X-Banner-Variant"
+
+// experimentCacheTTL как долго включенные эксперименты фичи берутся из кэша. Реплика, изменившая эксперимент,
+// рассылает остальным experimentsKey, а TTL ограничивает срок, в который реплика без рассылки отдает прежние варианты
+const experimentCacheTTL = 30 * time.Second
+
+// experimentsPrefix начало служебного ключа рассылки между репликами: эксперименты фичи изменились
+const experimentsPrefix = "!experiments "
+
+// experimentsKey служебный ключ рассылки об изменении экспериментов фичи
+func experimentsKey(featureId int) string {
+	return experimentsPrefix + strconv.Itoa(featureId)
+}
+
+// experimentCache включенные эксперименты по фичам. Хранится отдельно от кэша баннеров,
+// поэтому не учитывается его ограничениями и не попадает в список ключей и снимок
+type experimentCache struct {
+	mu       sync.RWMutex
+	features map[int]featureExperiments
+}
+
+// featureExperiments включенные эксперименты фичи и момент их загрузки
+type featureExperiments struct {
+	experiments []sqlite.Experiment
+	loaded      time.Time
+}
+
+// runningExperiments возвращает включенные эксперименты фичи. Они кэшируются на experimentCacheTTL,
+// поэтому запрос с идентификатором пользователя не обращается к хранилищу, пока они не устарели
+func (h *Handler) runningExperiments(featureId int, revision bool) ([]sqlite.Experiment, error) {
+	if !revision {
+		h.experiments.mu.RLock()
+		cached, ok := h.experiments.features[featureId]
+		h.experiments.mu.RUnlock()
+		if ok && time.Since(cached.loaded) < experimentCacheTTL {
+			return cached.experiments, nil
+		}
+	}
+
+	experiments, err := h.S.GetExperimentsFromStorage(featureId, h.Ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	running := []sqlite.Experiment{}
+	for _, experiment := range experiments {
+		if experiment.IsActive {
+			running = append(running, experiment)
+		}
+	}
+
+	h.experiments.mu.Lock()
+	if h.experiments.features == nil {
+		h.experiments.features = map[int]featureExperiments{}
+	}
+	h.experiments.features[featureId] = featureExperiments{experiments: running, loaded: time.Now()}
+	h.experiments.mu.Unlock()
+
+	return running, nil
+}
+
+// experimentVariant выбирает вариант для пользователя userId в эксперименте первого из тегов,
+// у которого есть включенный эксперимент, и возвращает этот тег. ok = false если userId пустой или экспериментов нет
+func (h *Handler) experimentVariant(featureId int, tags []int, userId string, revision bool) (variant sqlite.Variant, tag int, ok bool, err error) {
+	if userId == "" {
+		return sqlite.Variant{}, 0, false, nil
+	}
+
+	experiments, err := h.runningExperiments(featureId, revision)
+	if err != nil {
+		return sqlite.Variant{}, 0, false, err
+	}
+
+	for _, tag := range tags {
+		for _, experiment := range experiments {
+			if experiment.TagId == tag {
+				variant, ok = experiment.Assign(userId)
+				return variant, tag, ok, nil
+			}
+		}
+	}
+
+	return sqlite.Variant{}, 0, false, nil
+}
+
+// resetExperiments сбрасывает закэшированные эксперименты фичи после их изменения
+func (h *Handler) resetExperiments(featureId int) {
+	h.experiments.mu.Lock()
+	delete(h.experiments.features, featureId)
+	h.experiments.mu.Unlock()
+}
+
+// invalidateExperiments сбрасывает эксперименты фичи у себя и на остальных репликах
+func (h *Handler) invalidateExperiments(featureId int) {
+	h.resetExperiments(featureId)
+	h.publish([]string{experimentsKey(featureId)})
+}
+
+// GetExperiments Получение экспериментов фичи с вариантами
+func (h *Handler) GetExperiments(w http.ResponseWriter, r *http.Request) {
+	token := requestToken(r)
+
+	ok := h.VerifyAny(token, WritePermission, w)
+
+	if !ok {
+		return
+	}
+
+	featureId, err := strconv.Atoi(r.URL.Query().Get("feature_id"))
+	if err != nil || featureId < 1 {
+		h.Log.Error("Некорректные данные: нужен feature_id")
+		http.Error(w, "Некорректные данные: нужен feature_id", http.StatusBadRequest)
+		return
+	}
+
+	if !h.Verify(token, WritePermission, w, featureId) {
+		return
+	}
+
+	experiments, err := h.S.GetExperimentsFromStorage(featureId, h.Ctx)
+	if err != nil {
+		h.Log.Error("Внутренняя ошибка сервера:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h.writeJSON(w, http.StatusOK, experiments)
+	h.Log.Info("Получены эксперименты фичи по запросу пользователя", slog.Int("feature_id", featureId))
+}
+
+// PostExperiment Создание эксперимента с вариантами для пары фича-тег
+func (h *Handler) PostExperiment(w http.ResponseWriter, r *http.Request) {
+	token := requestToken(r)
+
+	ok := h.VerifyAny(token, WritePermission, w)
+
+	if !ok {
+		return
+	}
+
+	var experiment sqlite.Experiment
+	var buf bytes.Buffer
+
+	_, err := buf.ReadFrom(r.Body)
+	if err != nil {
+		h.Log.Error("Некорректные данные:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err = json.Unmarshal(buf.Bytes(), &experiment); err != nil {
+		h.Log.Error("Некорректные данные:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !validExperiment(experiment) {
+		h.Log.Error("Некорректные данные эксперимента")
+		http.Error(w, "Некорректные данные: нужны feature_id, tag_id, name и не меньше двух вариантов с контентом и неотрицательным весом, сумма весов больше нуля", http.StatusBadRequest)
+		return
+	}
+
+	if !h.Verify(token, WritePermission, w, experiment.FeatureId) {
+		return
+	}
+
+	for _, variant := range experiment.Variants {
+		if !h.validateContent(experiment.FeatureId, variant.Content, w) {
+			return
+		}
+	}
+
+	id, err := h.S.PostExperimentToStorage(experiment, h.Ctx)
+	if errors.Is(err, sqlite.ErrExperimentConflict) {
+		h.Log.Error("Конфликт экспериментов:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		h.Log.Error("Внутренняя ошибка сервера:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.invalidateExperiments(experiment.FeatureId)
+
+	h.writeJSON(w, http.StatusCreated, map[string]int{"experiment_id": id})
+	h.Log.Info("Создан эксперимент по запросу пользователя под номером:" + strconv.Itoa(id))
+}
+
+// PatchExperiment Включение, выключение эксперимента и изменение весов его вариантов
+func (h *Handler) PatchExperiment(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	token := requestToken(r)
+
+	ok := h.VerifyAny(token, WritePermission, w)
+
+	if !ok {
+		return
+	}
+
+	var update sqlite.ExperimentUpdate
+	var buf bytes.Buffer
+
+	_, err := buf.ReadFrom(r.Body)
+	if err != nil {
+		h.Log.Error("Некорректные данные:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err = json.Unmarshal(buf.Bytes(), &update); err != nil {
+		h.Log.Error("Некорректные данные:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	update.ExperimentId, err = strconv.Atoi(id)
+	if err != nil {
+		h.Log.Error("Некорректные данные:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	for _, variant := range update.Variants {
+		if variant.VariantId < 1 || variant.Weight < 0 {
+			h.Log.Error("Некорректные данные: нужны variant_id и неотрицательный weight")
+			http.Error(w, "Некорректные данные: нужны variant_id и неотрицательный weight", http.StatusBadRequest)
+			return
+		}
+	}
+
+	experiment, ok := h.experiment(update.ExperimentId, w)
+	if !ok || !h.Verify(token, WritePermission, w, experiment.FeatureId) {
+		return
+	}
+
+	err = h.S.UpdateExperimentInStorage(update, h.Ctx)
+	if errors.Is(err, sql.ErrNoRows) {
+		h.Log.Error("Эксперимент или вариант не найден:", slog.Any("err", err))
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		h.Log.Error("Внутренняя ошибка сервера:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.invalidateExperiments(experiment.FeatureId)
+
+	w.WriteHeader(http.StatusOK)
+	h.Log.Info("Обновлен эксперимент по запросу пользователя под номером:" + id)
+}
+
+// DeleteExperiment Удаление эксперимента с вариантами
+func (h *Handler) DeleteExperiment(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	token := requestToken(r)
+
+	ok := h.VerifyAny(token, WritePermission, w)
+
+	if !ok {
+		return
+	}
+
+	idInt, err := strconv.Atoi(id)
+	if err != nil {
+		h.Log.Error("Некорректные данные:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	experiment, ok := h.experiment(idInt, w)
+	if !ok || !h.Verify(token, WritePermission, w, experiment.FeatureId) {
+		return
+	}
+
+	err = h.S.DeleteExperimentFromStorage(idInt, h.Ctx)
+	if errors.Is(err, sql.ErrNoRows) {
+		h.Log.Error("Эксперимент не найден:", slog.Any("err", err))
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		h.Log.Error("Внутренняя ошибка сервера:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.invalidateExperiments(experiment.FeatureId)
+
+	w.WriteHeader(http.StatusNoContent)
+	h.Log.Info("Удален эксперимент по запросу пользователя под номером:" + id)
+}
+
+// experiment возвращает эксперимент для проверки прав, отвечает 404 если его нет
+func (h *Handler) experiment(id int, w http.ResponseWriter) (experiment sqlite.Experiment, ok bool) {
+	experiment, err := h.S.GetExperimentFromStorage(id, h.Ctx)
+	if errors.Is(err, sql.ErrNoRows) {
+		h.Log.Error("Эксперимент не найден:", slog.Any("err", err))
+		w.WriteHeader(http.StatusNotFound)
+		return sqlite.Experiment{}, false
+	}
+	if err != nil {
+		h.Log.Error("Внутренняя ошибка сервера:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return sqlite.Experiment{}, false
+	}
+
+	return experiment, true
+}
+
+// validExperiment проверяет пару фича-тег, название и варианты нового эксперимента
+func validExperiment(experiment sqlite.Experiment) bool {
+	if experiment.FeatureId < 1 || experiment.TagId < 1 || experiment.Name == "" || len(experiment.Variants) < 2 {
+		return false
+	}
+
+	total := 0
+	for _, variant := range experiment.Variants {
+		if variant.Weight < 0 || len(variant.Content) == 0 || string(variant.Content) == "null" {
+			return false
+		}
+		total += variant.Weight
+	}
+
+	return total > 0
+}
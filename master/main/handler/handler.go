@@ -2,35 +2,38 @@ package handler
 
 import (
 	sqlite "avito-testovoe/internal/storage"
+	"avito-testovoe/internal/tracking"
 	"bytes"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/go-chi/chi/v5"
+	"log/slog"
 	"net/http"
+	"slices"
 	"strconv"
+	"strings"
+	"time"
 )
 
 // GetBanner Получение баннера для пользователя
 func (h *Handler) GetBanner(w http.ResponseWriter, r *http.Request) {
-	h.rwMu.Lock()
-	defer h.rwMu.Unlock()
-	token := r.Header.Get("token")
-
-	ok := h.Verify(token, ReadPermission, w)
-
-	if !ok {
-		return
-	}
+	token := requestToken(r)
 
 	var query sqlite.Query
 
-	tag, err := strconv.Atoi(r.URL.Query().Get("tag_id"))
+	tags, err := parseTags(r.URL.Query()["tag_id"])
 	if err != nil {
 		h.Log.Error("Некорректный тег")
 		http.Error(w, "Некорректные данные", http.StatusBadRequest)
 		return
 	}
-	query.TagId = tag
+	query.TagId = tags[0]
+	if len(tags) > 1 {
+		query.TagIds = tags
+		query.Resolution = h.Resolution
+	}
 
 	query.FeatureId, err = strconv.Atoi(r.URL.Query().Get("feature_id"))
 	if err != nil {
@@ -53,85 +56,211 @@ func (h *Handler) GetBanner(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	key := fmt.Sprintf("%d %d", query.FeatureId, query.TagId)
-
-	bannerCache, activeCache, ok := h.C.Get(key)
-	if ok && !query.Revision {
-		if !activeCache {
-			ok = h.Verify(token, WritePermission, w)
-			if !ok {
-				return
-			}
-		}
+	ok := h.Verify(token, ReadPermission, w, query.FeatureId)
 
-		resp, err := json.Marshal(bannerCache)
-		if err != nil {
-			h.Log.Error("Внутренняя ошибка сервера:", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+	if !ok {
+		return
+	}
+	for _, tag := range tags {
+		if !h.VerifyScope(token, query.FeatureId, tag, w) {
 			return
 		}
+	}
 
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		_, err = w.Write(resp)
-		if err != nil {
-			h.Log.Error("Внутренняя ошибка сервера:", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		h.Log.Info("Получен баннер пользователя из кэша")
+	variant, experimentTag, experiment, err := h.experimentVariant(query.FeatureId, tags, r.URL.Query().Get("user_id"), query.Revision)
+	if err != nil {
+		h.Log.Error("Внутренняя ошибка сервера:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	banner, active, err := h.S.GetBannerFromStorage(query, h.Ctx)
+	banner, fromCache, err := h.loadBanner(query, tags)
+	source := "базы данных"
+	if fromCache {
+		source = "кэша"
+	}
+
+	// вариант эксперимента заменяет баннер тега эксперимента, только пока тот показывается пользователям
+	if experiment {
+		shown := err == nil && banner.Active
+		if len(tags) > 1 {
+			tagQuery := sqlite.Query{TagId: experimentTag, FeatureId: query.FeatureId, Revision: query.Revision}
+			tagBanner, _, tagErr := h.loadBanner(tagQuery, []int{experimentTag})
+			shown = tagErr == nil && tagBanner.Active
+		}
+		experiment = shown
+	}
+	if experiment {
+		banner, err = bannerLoad{Content: variant.Content, Active: true}, nil
+		source = "эксперимента, вариант " + strconv.Itoa(variant.VariantId)
+		w.Header().Set(VariantHeader, strconv.Itoa(variant.VariantId))
+	}
 	if err != nil {
-		h.Log.Error("Баннер не найден:", err)
+		h.Log.Error("Баннер не найден:", slog.Any("err", err))
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
 
-	if !active {
-		ok = h.Verify(token, WritePermission, w)
+	if !banner.Active {
+		ok = h.Verify(token, WritePermission, w, query.FeatureId)
 		if !ok {
 			return
 		}
 	}
 
-	var content map[string]string
-	err = json.Unmarshal([]byte(banner), &content)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(banner.Content)
 	if err != nil {
-		h.Log.Error("Внутренняя ошибка сервера:", err)
+		h.Log.Error("Внутренняя ошибка сервера:", slog.Any("err", err))
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	resp, err := json.Marshal(content)
+	// показы вариантов эксперимента не относятся к баннеру и не учитываются
+	if !experiment {
+		h.track(tracking.Event{
+			Kind:      tracking.Impression,
+			BannerId:  banner.BannerId,
+			FeatureId: query.FeatureId,
+			TagId:     query.TagId,
+			FromCache: fromCache,
+		})
+	}
+
+	h.Log.Info("Получен баннер пользователя из " + source)
+}
+
+// loadBanner возвращает баннер для тегов пользователя: из кэша, а если его там нет или запрошена последняя версия,
+// из хранилища. Устаревший баннер из кэша отдается сразу и обновляется в фоне. Если кэш недоступен,
+// баннер читается из хранилища без кэша. fromCache = false, если баннер прочитан из хранилища
+func (h *Handler) loadBanner(query sqlite.Query, tags []int) (banner bannerLoad, fromCache bool, err error) {
+	key, err := h.bannerKey(query.FeatureId, tags)
 	if err != nil {
-		h.Log.Error("Внутренняя ошибка сервера:", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		h.Log.Error("Кэш недоступен, баннер читается из базы:", slog.Any("err", err))
+		banner, _, err = h.storedBanner(query)
+		return banner, false, err
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	_, err = w.Write(resp)
+	if query.Revision {
+		banner, err = h.fetchBanner(key, query)
+		return banner, false, err
+	}
+
+	if cached, fresh, found := h.cachedBanner(key); found {
+		if !fresh {
+			go h.refreshBanner(key, query)
+		}
+		return cached, true, nil
+	}
+
+	banner, err, _ = h.fetchShared(key, query)
+	return banner, false, err
+}
+
+// maxUserTags наибольшее количество тегов пользователя в одном запросе
+const maxUserTags = 50
+
+// parseTags читает теги пользователя из параметров tag_id=1,2 или tag_id=1&tag_id=2.
+// Порядок сохраняется, так как он задает приоритет тегов, повторы отбрасываются
+func parseTags(values []string) ([]int, error) {
+	var tags []int
+	for _, value := range values {
+		for _, part := range strings.Split(value, ",") {
+			tag, err := strconv.Atoi(strings.TrimSpace(part))
+			if err != nil {
+				return nil, err
+			}
+			if tag <= 0 {
+				return nil, fmt.Errorf("invalid tag %d", tag)
+			}
+			if !slices.Contains(tags, tag) {
+				tags = append(tags, tag)
+			}
+		}
+	}
+
+	if len(tags) == 0 || len(tags) > maxUserTags {
+		return nil, fmt.Errorf("expected from 1 to %d tags", maxUserTags)
+	}
+
+	return tags, nil
+}
+
+// bannerLoad баннер пользователя, прочитанный из кэша или хранилища. BannerId нужен для учета показов
+type bannerLoad struct {
+	BannerId int             `json:"banner_id"`
+	Content  json.RawMessage `json:"content"`
+	Active   bool            `json:"-"`
+}
+
+// cacheBanner сохраняет баннер в кэш вместе с идентификатором. Контент вставляется как есть,
+// без переформатирования, чтобы из кэша отдавались те же байты, что из хранилища
+func (h *Handler) cacheBanner(key string, banner bannerLoad, until time.Time) {
+	value := fmt.Appendf(nil, `{"banner_id":%d,"content":%s}`, banner.BannerId, banner.Content)
+	h.C.SetUntil(key, banner.Active, value, until)
+}
+
+// cachedBanner читает баннер из кэша, как GetStale. Значение без идентификатора баннера считается промахом
+func (h *Handler) cachedBanner(key string) (banner bannerLoad, fresh, ok bool) {
+	value, active, fresh, ok := h.C.GetStale(key)
+	if !ok {
+		return bannerLoad{}, false, false
+	}
+	if err := json.Unmarshal(value, &banner); err != nil || banner.BannerId == 0 {
+		return bannerLoad{}, false, false
+	}
+	banner.Active = active
+
+	return banner, fresh, true
+}
+
+// storedBanner читает баннер из хранилища вместе с периодом показа
+func (h *Handler) storedBanner(query sqlite.Query) (bannerLoad, sqlite.Window, error) {
+	id, content, active, window, err := h.S.GetBannerFromStorage(query, h.Ctx)
 	if err != nil {
-		h.Log.Error("Внутренняя ошибка сервера:", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return bannerLoad{}, window, err
 	}
 
-	h.C.Set(key, active, content)
-	h.Log.Info("Получен баннер пользователя из базы данных")
+	return bannerLoad{BannerId: id, Content: json.RawMessage(content), Active: active}, window, nil
+}
+
+// fetchBanner читает баннер из хранилища и сохраняет его в кэш
+func (h *Handler) fetchBanner(key string, query sqlite.Query) (bannerLoad, error) {
+	banner, window, err := h.storedBanner(query)
+	if err != nil {
+		return bannerLoad{}, err
+	}
+
+	h.cacheBanner(key, banner, window.Next(time.Now()))
+
+	return banner, nil
+}
+
+// fetchShared читает баннер из хранилища через fetchBanner, объединяя параллельные чтения одного ключа
+// в один запрос. shared сообщает, что результат получен из чужого чтения
+func (h *Handler) fetchShared(key string, query sqlite.Query) (banner bannerLoad, err error, shared bool) {
+	v, err, shared := h.loads.Do(key, func() (any, error) {
+		return h.fetchBanner(key, query)
+	})
+	banner, _ = v.(bannerLoad)
+	return banner, err, shared
+}
+
+// refreshBanner обновляет устаревшую запись кэша в фоне. Параллельные обновления
+// и промахи по тому же ключу объединяются в один запрос к хранилищу
+func (h *Handler) refreshBanner(key string, query sqlite.Query) {
+	_, err, shared := h.fetchShared(key, query)
+	if err != nil && !shared {
+		h.Log.Error("Не удалось обновить баннер в кэше:", slog.Any("err", err))
+	}
 }
 
 // GetAllBanners Получение всех баннеров c фильтрацией по фиче и/или тегу
 func (h *Handler) GetAllBanners(w http.ResponseWriter, r *http.Request) {
-	h.rwMu.Lock()
-	defer h.rwMu.Unlock()
-	token := r.Header.Get("token")
+	token := requestToken(r)
 
-	ok := h.Verify(token, WritePermission, w)
+	ok := h.VerifyAny(token, WritePermission, w)
 
 	if !ok {
 		return
@@ -188,16 +317,25 @@ func (h *Handler) GetAllBanners(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if query.FeatureId > 0 {
+		ok = h.Verify(token, WritePermission, w, query.FeatureId)
+	} else {
+		ok = h.Verify(token, WritePermission, w)
+	}
+	if !ok {
+		return
+	}
+
 	banners, err := h.S.GetAllBannersFromStorage(query, h.Ctx)
 	if err != nil {
-		h.Log.Error("Внутренняя ошибка сервера:", err)
+		h.Log.Error("Внутренняя ошибка сервера:", slog.Any("err", err))
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	resp, err := json.Marshal(banners)
 	if err != nil {
-		h.Log.Error("Внутренняя ошибка сервера:", err)
+		h.Log.Error("Внутренняя ошибка сервера:", slog.Any("err", err))
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -206,7 +344,7 @@ func (h *Handler) GetAllBanners(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	_, err = w.Write(resp)
 	if err != nil {
-		h.Log.Error("Внутренняя ошибка сервера:", err)
+		h.Log.Error("Внутренняя ошибка сервера:", slog.Any("err", err))
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -216,11 +354,9 @@ func (h *Handler) GetAllBanners(w http.ResponseWriter, r *http.Request) {
 
 // PostBanner Создание нового баннера
 func (h *Handler) PostBanner(w http.ResponseWriter, r *http.Request) {
-	h.rwMu.Lock()
-	defer h.rwMu.Unlock()
-	token := r.Header.Get("token")
+	token := requestToken(r)
 
-	ok := h.Verify(token, WritePermission, w)
+	ok := h.VerifyAny(token, WritePermission, w)
 
 	if !ok {
 		return
@@ -231,18 +367,19 @@ func (h *Handler) PostBanner(w http.ResponseWriter, r *http.Request) {
 
 	_, err := buf.ReadFrom(r.Body)
 	if err != nil {
-		h.Log.Error("Некорректные данные:", err)
+		h.Log.Error("Некорректные данные:", slog.Any("err", err))
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
 	if err = json.Unmarshal(buf.Bytes(), &banner); err != nil {
-		h.Log.Error("Некорректные данные:", err)
+		h.Log.Error("Некорректные данные:", slog.Any("err", err))
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	if banner.FeatureId < 1 {
+	// фича 0 означает, что фича баннера не меняется
+	if banner.FeatureId < 0 {
 		w.WriteHeader(http.StatusBadRequest)
 		h.Log.Error("Некорректные данные")
 		return
@@ -256,20 +393,50 @@ func (h *Handler) PostBanner(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	if !banner.Window.Valid() {
+		w.WriteHeader(http.StatusBadRequest)
+		h.Log.Error("Некорректные данные: active_from должен быть раньше active_until")
+		return
+	}
+
+	if !h.Verify(token, WritePermission, w, banner.FeatureId) {
+		return
+	}
+
+	if !h.validateContent(banner.FeatureId, banner.Content, w) {
+		return
+	}
+
 	idLastBanner, err := h.S.PostBannerToStorage(banner, h.Ctx)
+	if errors.Is(err, sqlite.ErrDefaultConflict) {
+		h.Log.Error("Конфликт баннеров по умолчанию:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
 	if err != nil {
-		h.Log.Error("Внутренняя ошибка сервера:", err)
+		h.Log.Error("Внутренняя ошибка сервера:", slog.Any("err", err))
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	// новый баннер может выиграть у баннеров других тегов фичи в ключах нескольких тегов,
+	// а баннер по умолчанию - заменить закэшированные промахи тегов фичи
+	keys := make([]string, len(banner.TagIds))
+	for i, tag := range banner.TagIds {
+		keys[i] = fmt.Sprintf("%d %d", banner.FeatureId, tag)
+	}
+	if banner.IsDefault {
+		keys = append(keys, sqlite.DefaultKey(banner.FeatureId))
+	}
+	h.invalidate(keys)
+
 	stringId := fmt.Sprint(idLastBanner)
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	_, err = w.Write([]byte(stringId))
 	if err != nil {
-		h.Log.Error("Внутренняя ошибка сервера:", err)
+		h.Log.Error("Внутренняя ошибка сервера:", slog.Any("err", err))
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -279,13 +446,11 @@ func (h *Handler) PostBanner(w http.ResponseWriter, r *http.Request) {
 
 // PatchBanner Обновление содержимого баннера
 func (h *Handler) PatchBanner(w http.ResponseWriter, r *http.Request) {
-	h.rwMu.Lock()
-	defer h.rwMu.Unlock()
 	id := chi.URLParam(r, "id")
 
-	token := r.Header.Get("token")
+	token := requestToken(r)
 
-	ok := h.Verify(token, WritePermission, w)
+	ok := h.VerifyAny(token, WritePermission, w)
 
 	if !ok {
 		return
@@ -297,63 +462,112 @@ func (h *Handler) PatchBanner(w http.ResponseWriter, r *http.Request) {
 	_, err := buf.ReadFrom(r.Body)
 
 	if err != nil {
-		h.Log.Error("Некорректные данные:", err)
+		h.Log.Error("Некорректные данные:", slog.Any("err", err))
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
 	if err = json.Unmarshal(buf.Bytes(), &banner); err != nil {
-		h.Log.Error("Некорректные данные:", err)
+		h.Log.Error("Некорректные данные:", slog.Any("err", err))
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
 	banner.BannerId, err = strconv.Atoi(id)
 	if err != nil {
-		h.Log.Error("Некорректные данные:", err)
+		h.Log.Error("Некорректные данные:", slog.Any("err", err))
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	if banner.FeatureId < 1 {
-		w.WriteHeader(http.StatusBadRequest)
-		h.Log.Error("Некорректные данные")
+	if !h.validBannerUpdate(banner, w) {
 		return
 	}
 
-	for _, tag := range banner.TagIds {
-		if tag < 1 {
-			w.WriteHeader(http.StatusBadRequest)
-			h.Log.Error("Некорректные данные")
-			return
-		}
+	featureId, ok := h.bannerFeature(banner.BannerId, w)
+	if !ok {
+		return
+	}
+	if banner.FeatureId == 0 {
+		banner.FeatureId = featureId
+	}
+	if !h.Verify(token, WritePermission, w, featureId, banner.FeatureId) {
+		return
 	}
 
-	err = h.S.UpdateBannerInStorage(banner, h.Ctx)
+	if banner.ContentChanged() && !h.validateContent(banner.FeatureId, banner.Content, w) {
+		return
+	}
+
+	review, err := h.reviewRequired(featureId, banner.FeatureId)
 	if err != nil {
-		h.Log.Error("Баннер не найден:", err)
-		http.Error(w, err.Error(), http.StatusNotFound)
+		h.Log.Error("Внутренняя ошибка сервера:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if review {
+		h.createDraft(token, banner.BannerId, buf.Bytes(), w)
 		return
 	}
 
-	for _, tag := range banner.TagIds {
-		key := fmt.Sprintf("%d %d", banner.FeatureId, tag)
-		h.C.Set(key, banner.IsActive, banner.Content)
+	if !h.applyBannerUpdate(banner, w) {
+		return
 	}
 
 	w.WriteHeader(http.StatusOK)
 	h.Log.Info("Обновлен баннер по запросу пользователя под номером:" + id)
 }
 
+// applyBannerUpdate сохраняет изменение баннера и обновляет кэш его тегов.
+// Ключи прежних тегов удаляются, а поколение фичи увеличивается, поэтому прежние ключи фичи больше не читаются
+func (h *Handler) applyBannerUpdate(banner sqlite.BannerUpdate, w http.ResponseWriter) (ok bool) {
+	keys, err := h.S.UpdateBannerInStorage(banner, h.Ctx)
+	if errors.Is(err, sqlite.ErrEmptyWindow) {
+		h.Log.Error("Некорректные данные:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	if errors.Is(err, sqlite.ErrDefaultConflict) {
+		h.Log.Error("Конфликт баннеров по умолчанию:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusConflict)
+		return false
+	}
+	if err != nil {
+		h.Log.Error("Баннер не найден:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return false
+	}
+
+	h.dropKeys(keys)
+	// без нового контента, активности или обеих границ периода в изменении значение для тегов неизвестно,
+	// они загрузятся из базы при следующем запросе
+	window, full := banner.WindowUpdate.Window()
+	for _, tag := range banner.TagIds {
+		if !banner.ContentChanged() || banner.IsActive == nil || !full {
+			break
+		}
+		key, err := h.bannerKey(banner.FeatureId, []int{tag})
+		if err != nil {
+			break
+		}
+		h.cacheBanner(key, bannerLoad{
+			BannerId: banner.BannerId,
+			Content:  banner.Content,
+			Active:   *banner.IsActive && window.Contains(time.Now()),
+		}, window.Next(time.Now()))
+	}
+	h.publish(keys)
+
+	return true
+}
+
 // DeleteBanner Удаление баннера по идентификатору
 func (h *Handler) DeleteBanner(w http.ResponseWriter, r *http.Request) {
-	h.rwMu.Lock()
-	defer h.rwMu.Unlock()
 	id := chi.URLParam(r, "id")
 
-	token := r.Header.Get("token")
+	token := requestToken(r)
 
-	ok := h.Verify(token, WritePermission, w)
+	ok := h.VerifyAny(token, WritePermission, w)
 
 	if !ok {
 		return
@@ -361,18 +575,23 @@ func (h *Handler) DeleteBanner(w http.ResponseWriter, r *http.Request) {
 
 	idInt, err := strconv.Atoi(id)
 	if err != nil {
-		h.Log.Error("Некорректные данные:", err)
+		h.Log.Error("Некорректные данные:", slog.Any("err", err))
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
+	featureId, ok := h.bannerFeature(idInt, w)
+	if !ok || !h.Verify(token, WritePermission, w, featureId) {
+		return
+	}
+
 	keys, err := h.S.DeleteBannerFromStorage(idInt, h.Ctx)
 	if err != nil {
-		h.Log.Error("Баннер не найден:", err)
+		h.Log.Error("Баннер не найден:", slog.Any("err", err))
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
-	h.C.Delete(keys)
+	h.invalidate(keys)
 
 	w.WriteHeader(http.StatusNoContent)
 	h.Log.Info("Удален баннер по запросу пользователя под номером:" + id)
@@ -380,11 +599,9 @@ func (h *Handler) DeleteBanner(w http.ResponseWriter, r *http.Request) {
 
 // DeleteBannerByTagOrFeature Удаление баннера по тэгу или фиче
 func (h *Handler) DeleteBannerByTagOrFeature(w http.ResponseWriter, r *http.Request) {
-	h.rwMu.Lock()
-	defer h.rwMu.Unlock()
-	token := r.Header.Get("token")
+	token := requestToken(r)
 
-	ok := h.Verify(token, WritePermission, w)
+	ok := h.VerifyAny(token, WritePermission, w)
 
 	if !ok {
 		return
@@ -420,6 +637,21 @@ func (h *Handler) DeleteBannerByTagOrFeature(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
+	features := []int{query.FeatureId}
+	if query.FeatureId == 0 {
+		var err error
+		features, err = h.S.GetTagFeaturesFromStorage(query.TagId, h.Ctx)
+		if err != nil {
+			h.Log.Error("Внутренняя ошибка сервера:", slog.Any("err", err))
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if len(features) > 0 && !h.Verify(token, WritePermission, w, features...) {
+		return
+	}
+
 	w.WriteHeader(http.StatusNoContent)
 	h.Log.Info("Удалены баннеры по запросу пользователя")
 
@@ -428,30 +660,28 @@ func (h *Handler) DeleteBannerByTagOrFeature(w http.ResponseWriter, r *http.Requ
 		if query.FeatureId > 0 {
 			keys1, err := h.S.DeleteBannerFromStorageByFeature(query.FeatureId, h.Ctx)
 			if err != nil {
-				h.Log.Error("Баннер не найден по фиче:", err)
+				h.Log.Error("Баннер не найден по фиче:", slog.Any("err", err))
 			}
 			keys = keys1
 		} else {
 			keys2, err := h.S.DeleteBannerFromStorageByTag(query.TagId, h.Ctx)
 			if err != nil {
-				h.Log.Error("Баннер не найден по тегу:", err)
+				h.Log.Error("Баннер не найден по тегу:", slog.Any("err", err))
 			}
 			keys = keys2
 		}
-		h.C.Delete(keys)
+		h.invalidate(keys)
 	}()
 
 }
 
 // GetBannerVersions Получение старыйх версий баннера
 func (h *Handler) GetBannerVersions(w http.ResponseWriter, r *http.Request) {
-	h.rwMu.Lock()
-	defer h.rwMu.Unlock()
 	id := chi.URLParam(r, "id")
 
-	token := r.Header.Get("token")
+	token := requestToken(r)
 
-	ok := h.Verify(token, WritePermission, w)
+	ok := h.VerifyAny(token, WritePermission, w)
 
 	if !ok {
 		return
@@ -459,21 +689,26 @@ func (h *Handler) GetBannerVersions(w http.ResponseWriter, r *http.Request) {
 
 	idInt, err := strconv.Atoi(id)
 	if err != nil {
-		h.Log.Error("Некорректные данные:", err)
+		h.Log.Error("Некорректные данные:", slog.Any("err", err))
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
+	featureId, ok := h.bannerFeature(idInt, w)
+	if !ok || !h.Verify(token, WritePermission, w, featureId) {
+		return
+	}
+
 	banners, err := h.S.GetBannerVersionsFromStorage(idInt, h.Ctx)
 	if err != nil {
-		h.Log.Error("Внутренняя ошибка сервера:", err)
+		h.Log.Error("Внутренняя ошибка сервера:", slog.Any("err", err))
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	resp, err := json.Marshal(banners)
 	if err != nil {
-		h.Log.Error("Внутренняя ошибка сервера:", err)
+		h.Log.Error("Внутренняя ошибка сервера:", slog.Any("err", err))
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -482,7 +717,7 @@ func (h *Handler) GetBannerVersions(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 	_, err = w.Write(resp)
 	if err != nil {
-		h.Log.Error("Внутренняя ошибка сервера:", err)
+		h.Log.Error("Внутренняя ошибка сервера:", slog.Any("err", err))
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -490,3 +725,146 @@ func (h *Handler) GetBannerVersions(w http.ResponseWriter, r *http.Request) {
 	h.Log.Info("Получены старые версии баннера по запросу пользователя")
 
 }
+
+// RollbackBanner Откат баннера к одной из сохраненных версий
+func (h *Handler) RollbackBanner(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	token := requestToken(r)
+
+	ok := h.VerifyAny(token, WritePermission, w)
+
+	if !ok {
+		return
+	}
+
+	idInt, err := strconv.Atoi(id)
+	if err != nil {
+		h.Log.Error("Некорректные данные:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	versionId, err := strconv.Atoi(chi.URLParam(r, "version_id"))
+	if err != nil {
+		h.Log.Error("Некорректные данные:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	featureId, ok := h.bannerFeature(idInt, w)
+	if !ok {
+		return
+	}
+
+	versions, err := h.S.GetBannerVersionsFromStorage(idInt, h.Ctx)
+	if err != nil {
+		h.Log.Error("Внутренняя ошибка сервера:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	i := slices.IndexFunc(versions, func(v sqlite.Banner) bool { return v.BannerId == versionId })
+	if i < 0 {
+		h.Log.Error("Версия баннера не найдена")
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if !h.Verify(token, WritePermission, w, featureId, versions[i].FeatureId) {
+		return
+	}
+
+	keys, err := h.S.RollbackBannerInStorage(idInt, versionId, h.Ctx)
+	if errors.Is(err, sqlite.ErrTagConflict) || errors.Is(err, sqlite.ErrDefaultConflict) {
+		h.Log.Error("Конфликт с другим баннером:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		h.Log.Error("Версия баннера не найдена:", slog.Any("err", err))
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		h.Log.Error("Внутренняя ошибка сервера:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.invalidate(keys)
+
+	w.WriteHeader(http.StatusOK)
+	h.Log.Info("Баннер " + id + " откачен к версии " + strconv.Itoa(versionId))
+}
+
+// PruneVersions Очистка истории версий всех баннеров по настроенной политике хранения
+func (h *Handler) PruneVersions(w http.ResponseWriter, r *http.Request) {
+	token := requestToken(r)
+
+	ok := h.Verify(token, ManagePermission, w)
+
+	if !ok {
+		return
+	}
+
+	removed, err := h.S.PruneVersionsInStorage(h.Ctx)
+	if err != nil {
+		h.Log.Error("Внутренняя ошибка сервера:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h.writeJSON(w, http.StatusOK, map[string]int64{"removed": removed})
+	h.Log.Info("Очищена история версий по запросу пользователя", slog.Int64("removed", removed))
+}
+
+// bannerFeature возвращает фичу баннера для проверки прав, отвечает 404 если баннера нет
+func (h *Handler) bannerFeature(id int, w http.ResponseWriter) (featureId int, ok bool) {
+	featureId, err := h.S.GetBannerFeatureFromStorage(id, h.Ctx)
+	if errors.Is(err, sql.ErrNoRows) {
+		h.Log.Error("Баннер не найден:", slog.Any("err", err))
+		w.WriteHeader(http.StatusNotFound)
+		return 0, false
+	}
+	if err != nil {
+		h.Log.Error("Внутренняя ошибка сервера:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return 0, false
+	}
+
+	return featureId, true
+}
+
+// validBannerUpdate проверяет фичу, теги и период показа изменения баннера, отвечает 400 если они некорректны
+func (h *Handler) validBannerUpdate(banner sqlite.BannerUpdate, w http.ResponseWriter) bool {
+	// фича 0 означает, что фича баннера не меняется
+	if banner.FeatureId < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		h.Log.Error("Некорректные данные")
+		return false
+	}
+
+	for _, tag := range banner.TagIds {
+		if tag < 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			h.Log.Error("Некорректные данные")
+			return false
+		}
+	}
+
+	// период, заданный одной границей, проверяется вместе с сохраненной границей при записи
+	if window, ok := banner.WindowUpdate.Window(); ok && !window.Valid() {
+		w.WriteHeader(http.StatusBadRequest)
+		h.Log.Error("Некорректные данные: active_from должен быть раньше active_until")
+		return false
+	}
+
+	// контент не меняется, только если поле не указано, а null баннером быть не может
+	if string(banner.Content) == "null" {
+		w.WriteHeader(http.StatusBadRequest)
+		h.Log.Error("Некорректные данные: content не может быть null")
+		return false
+	}
+
+	return true
+}
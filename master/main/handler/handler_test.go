@@ -0,0 +1,1293 @@
+package handler
+
+import (
+	"avito-testovoe/internal/auth"
+	"avito-testovoe/internal/cache"
+	sqlite "avito-testovoe/internal/storage"
+	"avito-testovoe/internal/tracking"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	testAdminToken = "test-admin-token"
+	testUserToken  = "test-user-token"
+)
+
+// testStorage открывает чистую sqlite базу, а если задана переменная окружения POSTGRES_DSN - базу postgres,
+// из которой удаляются данные прошлых тестов, как в тестах хранилища. В базе выпускаются токены
+// testAdminToken и testUserToken
+func testStorage(t *testing.T) *sqlite.Storage {
+	t.Helper()
+
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ctx := context.Background()
+
+	var storage *sqlite.Storage
+	var err error
+	if dsn := os.Getenv("POSTGRES_DSN"); dsn == "" {
+		storage, err = sqlite.New(sqlite.SqliteDriver, filepath.Join(t.TempDir(), "handler.db"), log, ctx)
+		require.NoError(t, err)
+		t.Cleanup(func() { storage.Db.Close() })
+	} else {
+		storage, err = sqlite.New(sqlite.PostgresDriver, dsn, log, ctx)
+		require.NoError(t, err)
+		t.Cleanup(func() { storage.Db.Close() })
+		cleanPostgres(t, storage)
+	}
+
+	for _, token := range []sqlite.Token{
+		{Name: "test admin", Role: AdminRole, Token: testAdminToken},
+		{Name: "test user", Role: UserRole, Token: testUserToken},
+	} {
+		_, err = storage.CreateTokenInStorage(token, ctx)
+		require.NoError(t, err)
+	}
+
+	return storage
+}
+
+// cleanPostgres удаляет из базы postgres данные прошлых тестов
+func cleanPostgres(t *testing.T, storage *sqlite.Storage) {
+	t.Helper()
+
+	for _, q := range []string{
+		"DELETE FROM banner_stats",
+		"DELETE FROM experiment_variants",
+		"DELETE FROM experiments",
+		"DELETE FROM banner_drafts",
+		"DELETE FROM feature_workflows",
+		"DELETE FROM banner_versions_tags",
+		"DELETE FROM banner_versions",
+		"DELETE FROM banner_tags",
+		"DELETE FROM banners",
+		"DELETE FROM feature_schemas",
+		"DELETE FROM tokens",
+		"DELETE FROM role_grants WHERE role NOT IN ('admin', 'user')",
+		"DELETE FROM roles WHERE name NOT IN ('admin', 'user')",
+	} {
+		_, err := storage.Db.Exec(q)
+		require.NoError(t, err)
+	}
+}
+
+// newTestServer поднимает сервер на чистой базе testStorage
+func newTestServer(t *testing.T, opts ...Option) http.Handler {
+	t.Helper()
+
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	return NewServer(log, testStorage(t), cache.New(time.Minute, 0), context.Background(), opts...)
+}
+
+// do выполняет запрос к серверу и возвращает код ответа и тело.
+// JWT передается в заголовке Authorization, остальные токены в заголовке token
+func do(t *testing.T, srv http.Handler, method, url, token, body string) (int, string) {
+	t.Helper()
+
+	req := httptest.NewRequest(method, url, strings.NewReader(body))
+	if auth.IsJWT(token) {
+		req.Header.Set("Authorization", "Bearer "+token)
+	} else if token != "" {
+		req.Header.Set("token", token)
+	}
+
+	rec := httptest.NewRecorder()
+	srv.ServeHTTP(rec, req)
+
+	return rec.Code, rec.Body.String()
+}
+
+func TestTokenManagement(t *testing.T) {
+	srv := newTestServer(t)
+
+	code, _ := do(t, srv, http.MethodPost, "/token", testUserToken, `{"name": "editor", "role": "user"}`)
+	require.Equal(t, http.StatusForbidden, code)
+
+	code, _ = do(t, srv, http.MethodPost, "/token", testAdminToken, `{"name": "editor", "role": "superuser"}`)
+	require.Equal(t, http.StatusBadRequest, code)
+
+	code, body := do(t, srv, http.MethodPost, "/token", testAdminToken, `{"name": "editor", "role": "user"}`)
+	require.Equal(t, http.StatusCreated, code)
+
+	var issued sqlite.Token
+	require.NoError(t, json.Unmarshal([]byte(body), &issued))
+	require.NotEmpty(t, issued.Token)
+
+	code, _ = do(t, srv, http.MethodGet, "/user_banner?tag_id=1&feature_id=1", issued.Token, "")
+	require.Equal(t, http.StatusNotFound, code)
+
+	code, body = do(t, srv, http.MethodGet, "/token", testAdminToken, "")
+	require.Equal(t, http.StatusOK, code)
+	require.NotContains(t, body, issued.Token)
+
+	code, body = do(t, srv, http.MethodPost, "/token/"+strconv.Itoa(issued.Id)+"/rotate", testAdminToken, "")
+	require.Equal(t, http.StatusOK, code)
+
+	var rotated sqlite.Token
+	require.NoError(t, json.Unmarshal([]byte(body), &rotated))
+
+	code, _ = do(t, srv, http.MethodGet, "/user_banner?tag_id=1&feature_id=1", issued.Token, "")
+	require.Equal(t, http.StatusForbidden, code)
+
+	code, _ = do(t, srv, http.MethodDelete, "/token/"+strconv.Itoa(issued.Id), testAdminToken, "")
+	require.Equal(t, http.StatusNoContent, code)
+
+	code, _ = do(t, srv, http.MethodGet, "/user_banner?tag_id=1&feature_id=1", rotated.Token, "")
+	require.Equal(t, http.StatusForbidden, code)
+}
+
+func TestJWTBearer(t *testing.T) {
+	verifier, err := auth.New("secret", "", "", "")
+	require.NoError(t, err)
+
+	srv := newTestServer(t, WithJWT(verifier))
+
+	sign := func(secret string, c auth.Claims) string {
+		c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(time.Hour))
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, c).SignedString([]byte(secret))
+		require.NoError(t, err)
+		return token
+	}
+
+	admin := sign("secret", auth.Claims{Role: AdminRole})
+	code, _ := do(t, srv, http.MethodPost, "/banner", admin, `{"tag_ids": [1, 2], "feature_id": 1, "content": {"title": "a"}, "is_active": true}`)
+	require.Equal(t, http.StatusCreated, code)
+
+	code, body := do(t, srv, http.MethodGet, "/user_banner?tag_id=1&feature_id=1", sign("secret", auth.Claims{Role: UserRole}), "")
+	require.Equal(t, http.StatusOK, code)
+	require.JSONEq(t, `{"title": "a"}`, body)
+
+	scoped := sign("secret", auth.Claims{Role: UserRole, Tags: []int{2}, Features: []int{1}})
+	code, _ = do(t, srv, http.MethodGet, "/user_banner?tag_id=2&feature_id=1", scoped, "")
+	require.Equal(t, http.StatusOK, code)
+
+	code, _ = do(t, srv, http.MethodGet, "/user_banner?tag_id=1&feature_id=1", scoped, "")
+	require.Equal(t, http.StatusForbidden, code)
+
+	code, _ = do(t, srv, http.MethodPost, "/banner", sign("secret", auth.Claims{Role: UserRole}), `{"tag_ids": [3], "feature_id": 1, "content": {}, "is_active": true}`)
+	require.Equal(t, http.StatusForbidden, code)
+
+	code, _ = do(t, srv, http.MethodGet, "/user_banner?tag_id=1&feature_id=1", sign("other", auth.Claims{Role: AdminRole}), "")
+	require.Equal(t, http.StatusForbidden, code)
+}
+
+func TestJWTDisabled(t *testing.T) {
+	srv := newTestServer(t)
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, auth.Claims{Role: AdminRole}).SignedString([]byte("secret"))
+	require.NoError(t, err)
+
+	code, _ := do(t, srv, http.MethodGet, "/user_banner?tag_id=1&feature_id=1", token, "")
+	require.Equal(t, http.StatusForbidden, code)
+}
+
+func TestFeatureScopedEditor(t *testing.T) {
+	srv := newTestServer(t)
+
+	code, _ := do(t, srv, http.MethodPut, "/role/editor", testUserToken, `{"grants": []}`)
+	require.Equal(t, http.StatusForbidden, code)
+
+	code, _ = do(t, srv, http.MethodPut, "/role/editor", testAdminToken, `{"grants": [{"permission": "write", "feature_from": 20, "feature_to": 12}]}`)
+	require.Equal(t, http.StatusBadRequest, code)
+
+	code, _ = do(t, srv, http.MethodPut, "/role/editor", testAdminToken,
+		`{"grants": [{"permission": "read"}, {"permission": "write", "feature_from": 12, "feature_to": 20}]}`)
+	require.Equal(t, http.StatusOK, code)
+
+	code, body := do(t, srv, http.MethodPost, "/token", testAdminToken, `{"name": "team", "role": "editor"}`)
+	require.Equal(t, http.StatusCreated, code)
+
+	var editor sqlite.Token
+	require.NoError(t, json.Unmarshal([]byte(body), &editor))
+
+	code, body = do(t, srv, http.MethodPost, "/banner", editor.Token, `{"tag_ids": [1], "feature_id": 12, "content": {}, "is_active": true}`)
+	require.Equal(t, http.StatusCreated, code)
+	inScope := body
+
+	code, _ = do(t, srv, http.MethodPost, "/banner", editor.Token, `{"tag_ids": [1], "feature_id": 21, "content": {}, "is_active": true}`)
+	require.Equal(t, http.StatusForbidden, code)
+
+	code, body = do(t, srv, http.MethodPost, "/banner", testAdminToken, `{"tag_ids": [1], "feature_id": 30, "content": {}, "is_active": true}`)
+	require.Equal(t, http.StatusCreated, code)
+	outOfScope := body
+
+	code, _ = do(t, srv, http.MethodPatch, "/banner/"+inScope, editor.Token, `{"tag_ids": [2], "feature_id": 15, "content": {"a": 1}, "is_active": true}`)
+	require.Equal(t, http.StatusOK, code)
+
+	code, _ = do(t, srv, http.MethodPatch, "/banner/"+inScope, editor.Token, `{"tag_ids": [2], "feature_id": 30, "content": {"a": 1}, "is_active": true}`)
+	require.Equal(t, http.StatusForbidden, code)
+
+	code, _ = do(t, srv, http.MethodPatch, "/banner/"+outOfScope, editor.Token, `{"tag_ids": [1], "feature_id": 15, "content": {}, "is_active": true}`)
+	require.Equal(t, http.StatusForbidden, code)
+
+	code, _ = do(t, srv, http.MethodGet, "/banner?tag_id=1", editor.Token, "")
+	require.Equal(t, http.StatusForbidden, code)
+
+	code, _ = do(t, srv, http.MethodGet, "/banner?feature_id=15", editor.Token, "")
+	require.Equal(t, http.StatusOK, code)
+
+	code, _ = do(t, srv, http.MethodDelete, "/banner?tag_id=1", editor.Token, "")
+	require.Equal(t, http.StatusForbidden, code)
+
+	code, _ = do(t, srv, http.MethodDelete, "/banner?feature_id=30", editor.Token, "")
+	require.Equal(t, http.StatusForbidden, code)
+
+	code, _ = do(t, srv, http.MethodDelete, "/banner/"+outOfScope, editor.Token, "")
+	require.Equal(t, http.StatusForbidden, code)
+
+	code, _ = do(t, srv, http.MethodDelete, "/banner/"+inScope, editor.Token, "")
+	require.Equal(t, http.StatusNoContent, code)
+
+	code, _ = do(t, srv, http.MethodGet, "/token", editor.Token, "")
+	require.Equal(t, http.StatusForbidden, code)
+
+	code, _ = do(t, srv, http.MethodDelete, "/role/editor", testAdminToken, "")
+	require.Equal(t, http.StatusConflict, code)
+}
+
+func TestActivationWindow(t *testing.T) {
+	srv := newTestServer(t)
+
+	until := time.Now().Add(300 * time.Millisecond).UTC().Format(time.RFC3339Nano)
+	code, _ := do(t, srv, http.MethodPost, "/banner", testAdminToken,
+		`{"tag_ids": [1], "feature_id": 1, "content": {"title": "sale"}, "is_active": true, "active_until": "`+until+`"}`)
+	require.Equal(t, http.StatusCreated, code)
+
+	code, _ = do(t, srv, http.MethodGet, "/user_banner?tag_id=1&feature_id=1", testUserToken, "")
+	require.Equal(t, http.StatusOK, code)
+
+	time.Sleep(400 * time.Millisecond)
+
+	code, _ = do(t, srv, http.MethodGet, "/user_banner?tag_id=1&feature_id=1", testUserToken, "")
+	require.Equal(t, http.StatusForbidden, code)
+
+	code, _ = do(t, srv, http.MethodGet, "/user_banner?tag_id=1&feature_id=1", testAdminToken, "")
+	require.Equal(t, http.StatusOK, code)
+
+	code, _ = do(t, srv, http.MethodPost, "/banner", testAdminToken,
+		`{"tag_ids": [2], "feature_id": 1, "content": {}, "is_active": true, "active_from": "2030-01-02T00:00:00Z", "active_until": "2030-01-01T00:00:00Z"}`)
+	require.Equal(t, http.StatusBadRequest, code)
+}
+
+// TestPatchWindow PATCH без active_from и active_until не меняет период показа, null снимает границу,
+// а граница, с которой сохраненный период становится пустым, не принимается
+func TestPatchWindow(t *testing.T) {
+	srv := newTestServer(t)
+
+	until := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	code, id := do(t, srv, http.MethodPost, "/banner", testAdminToken,
+		`{"tag_ids": [1], "feature_id": 1, "content": {"v": 1}, "is_active": true, "active_until": "`+until.Format(time.RFC3339)+`"}`)
+	require.Equal(t, http.StatusCreated, code)
+
+	activeUntil := func() *time.Time {
+		code, body := do(t, srv, http.MethodGet, "/banner?feature_id=1", testAdminToken, "")
+		require.Equal(t, http.StatusOK, code)
+		var banners []sqlite.Banner
+		require.NoError(t, json.Unmarshal([]byte(body), &banners))
+		require.Len(t, banners, 1)
+		return banners[0].ActiveUntil
+	}
+
+	code, _ = do(t, srv, http.MethodPatch, "/banner/"+id, testAdminToken, `{"tag_ids": [1], "feature_id": 1, "content": {"v": 2}, "is_active": true}`)
+	require.Equal(t, http.StatusOK, code)
+	require.NotNil(t, activeUntil())
+	assert.True(t, until.Equal(*activeUntil()))
+
+	code, _ = do(t, srv, http.MethodPatch, "/banner/"+id, testAdminToken,
+		`{"tag_ids": [1], "feature_id": 1, "is_active": true, "active_from": "`+until.Add(time.Hour).Format(time.RFC3339)+`"}`)
+	require.Equal(t, http.StatusBadRequest, code)
+
+	code, _ = do(t, srv, http.MethodPatch, "/banner/"+id, testAdminToken, `{"tag_ids": [1], "feature_id": 1, "is_active": true, "active_until": null}`)
+	require.Equal(t, http.StatusOK, code)
+	assert.Nil(t, activeUntil())
+
+	code, body := do(t, srv, http.MethodGet, "/user_banner?tag_id=1&feature_id=1", testUserToken, "")
+	require.Equal(t, http.StatusOK, code)
+	assert.JSONEq(t, `{"v": 2}`, body)
+}
+
+// TestPatchContent PATCH без content не меняет контент ни в базе, ни в кэше, {} сохраняется как есть, а null не принимается
+func TestPatchContent(t *testing.T) {
+	srv := newTestServer(t)
+
+	code, id := do(t, srv, http.MethodPost, "/banner", testAdminToken, `{"tag_ids": [1], "feature_id": 1, "content": {"title": "first"}, "is_active": true}`)
+	require.Equal(t, http.StatusCreated, code)
+
+	code, _ = do(t, srv, http.MethodPatch, "/banner/"+id, testAdminToken, `{"tag_ids": [1], "feature_id": 1, "is_active": true}`)
+	require.Equal(t, http.StatusOK, code)
+
+	code, body := do(t, srv, http.MethodGet, "/user_banner?tag_id=1&feature_id=1", testUserToken, "")
+	require.Equal(t, http.StatusOK, code)
+	assert.JSONEq(t, `{"title": "first"}`, body)
+
+	code, _ = do(t, srv, http.MethodPatch, "/banner/"+id, testAdminToken, `{"tag_ids": [1], "feature_id": 1, "content": null, "is_active": true}`)
+	require.Equal(t, http.StatusBadRequest, code)
+
+	code, _ = do(t, srv, http.MethodPatch, "/banner/"+id, testAdminToken, `{"tag_ids": [1], "feature_id": 1, "content": {}, "is_active": true}`)
+	require.Equal(t, http.StatusOK, code)
+
+	for _, revision := range []string{"false", "true"} {
+		code, body = do(t, srv, http.MethodGet, "/user_banner?tag_id=1&feature_id=1&use_last_revision="+revision, testUserToken, "")
+		require.Equal(t, http.StatusOK, code)
+		assert.Equal(t, `{}`, body)
+	}
+}
+
+// TestPatchIsActive PATCH без is_active не меняет активность баннера, false выключает его для пользователей
+func TestPatchIsActive(t *testing.T) {
+	srv := newTestServer(t)
+
+	code, id := do(t, srv, http.MethodPost, "/banner", testAdminToken, `{"tag_ids": [1], "feature_id": 1, "content": {"v": 1}, "is_active": true}`)
+	require.Equal(t, http.StatusCreated, code)
+
+	code, _ = do(t, srv, http.MethodPatch, "/banner/"+id, testAdminToken, `{"tag_ids": [1], "feature_id": 1, "content": {"v": 2}}`)
+	require.Equal(t, http.StatusOK, code)
+
+	for _, revision := range []string{"false", "true"} {
+		code, body := do(t, srv, http.MethodGet, "/user_banner?tag_id=1&feature_id=1&use_last_revision="+revision, testUserToken, "")
+		require.Equal(t, http.StatusOK, code)
+		assert.JSONEq(t, `{"v": 2}`, body)
+	}
+
+	code, _ = do(t, srv, http.MethodPatch, "/banner/"+id, testAdminToken, `{"tag_ids": [1], "feature_id": 1, "is_active": false}`)
+	require.Equal(t, http.StatusOK, code)
+
+	code, _ = do(t, srv, http.MethodGet, "/user_banner?tag_id=1&feature_id=1&use_last_revision=true", testUserToken, "")
+	assert.Equal(t, http.StatusForbidden, code)
+}
+
+func TestRollbackBanner(t *testing.T) {
+	srv := newTestServer(t)
+
+	code, id := do(t, srv, http.MethodPost, "/banner", testAdminToken, `{"tag_ids": [1], "feature_id": 1, "content": {"title": "first"}, "is_active": true}`)
+	require.Equal(t, http.StatusCreated, code)
+
+	code, body := do(t, srv, http.MethodGet, "/user_banner?tag_id=1&feature_id=1", testUserToken, "")
+	require.Equal(t, http.StatusOK, code)
+	require.JSONEq(t, `{"title": "first"}`, body)
+
+	code, _ = do(t, srv, http.MethodPatch, "/banner/"+id, testAdminToken, `{"tag_ids": [1], "feature_id": 1, "content": {"title": "second"}, "is_active": true}`)
+	require.Equal(t, http.StatusOK, code)
+
+	code, body = do(t, srv, http.MethodGet, "/banner/"+id, testAdminToken, "")
+	require.Equal(t, http.StatusOK, code)
+
+	var versions []sqlite.Banner
+	require.NoError(t, json.Unmarshal([]byte(body), &versions))
+	require.Len(t, versions, 1)
+	version := strconv.Itoa(versions[0].BannerId)
+
+	code, _ = do(t, srv, http.MethodPost, "/banner/"+id+"/rollback/"+version, testUserToken, "")
+	require.Equal(t, http.StatusForbidden, code)
+
+	code, _ = do(t, srv, http.MethodPost, "/banner/"+id+"/rollback/999", testAdminToken, "")
+	require.Equal(t, http.StatusNotFound, code)
+
+	code, _ = do(t, srv, http.MethodPost, "/banner/"+id+"/rollback/"+version, testAdminToken, "")
+	require.Equal(t, http.StatusOK, code)
+
+	code, body = do(t, srv, http.MethodGet, "/user_banner?tag_id=1&feature_id=1", testUserToken, "")
+	require.Equal(t, http.StatusOK, code)
+	require.JSONEq(t, `{"title": "first"}`, body)
+}
+
+func TestPruneVersions(t *testing.T) {
+	srv := newTestServer(t)
+
+	code, _ := do(t, srv, http.MethodPost, "/admin/versions/prune", testUserToken, "")
+	require.Equal(t, http.StatusForbidden, code)
+
+	code, body := do(t, srv, http.MethodPost, "/admin/versions/prune", testAdminToken, "")
+	require.Equal(t, http.StatusOK, code)
+	require.JSONEq(t, `{"removed": 0}`, body)
+}
+
+func TestBannerDiff(t *testing.T) {
+	srv := newTestServer(t)
+
+	code, id := do(t, srv, http.MethodPost, "/banner", testAdminToken, `{"tag_ids": [1, 2], "feature_id": 1, "content": {"title": "first", "text": "a"}, "is_active": true}`)
+	require.Equal(t, http.StatusCreated, code)
+
+	code, _ = do(t, srv, http.MethodPatch, "/banner/"+id, testAdminToken, `{"tag_ids": [2, 3], "feature_id": 1, "content": {"title": "second", "url": "b"}, "is_active": false}`)
+	require.Equal(t, http.StatusOK, code)
+
+	code, body := do(t, srv, http.MethodGet, "/banner/"+id, testAdminToken, "")
+	require.Equal(t, http.StatusOK, code)
+
+	var versions []sqlite.Banner
+	require.NoError(t, json.Unmarshal([]byte(body), &versions))
+	require.Len(t, versions, 1)
+	version := strconv.Itoa(versions[0].BannerId)
+
+	code, body = do(t, srv, http.MethodGet, "/banner/"+id+"/diff?from="+version, testAdminToken, "")
+	require.Equal(t, http.StatusOK, code)
+	require.JSONEq(t, `{
+		"from": "`+version+`",
+		"to": "current",
+		"content": {
+			"added": {"/url": "b"},
+			"removed": {"/text": "a"},
+			"changed": {"/title": {"from": "first", "to": "second"}}
+		},
+		"tags": {"added": [3], "removed": [1]},
+		"is_active": {"from": true, "to": false}
+	}`, body)
+
+	code, body = do(t, srv, http.MethodGet, "/banner/"+id+"/diff?from=current&to="+version, testAdminToken, "")
+	require.Equal(t, http.StatusOK, code)
+	require.Contains(t, body, `"added":[1]`)
+
+	code, _ = do(t, srv, http.MethodGet, "/banner/"+id+"/diff?from=999", testAdminToken, "")
+	require.Equal(t, http.StatusNotFound, code)
+
+	code, _ = do(t, srv, http.MethodGet, "/banner/"+id+"/diff", testAdminToken, "")
+	require.Equal(t, http.StatusBadRequest, code)
+
+	code, _ = do(t, srv, http.MethodGet, "/banner/"+id+"/diff?from="+version, testUserToken, "")
+	require.Equal(t, http.StatusForbidden, code)
+}
+
+func TestDraftWorkflow(t *testing.T) {
+	srv := newTestServer(t)
+
+	code, _ := do(t, srv, http.MethodPut, "/feature/1/workflow", testUserToken, `{"review_required": true}`)
+	require.Equal(t, http.StatusForbidden, code)
+
+	code, body := do(t, srv, http.MethodPut, "/feature/1/workflow", testAdminToken, `{"review_required": true}`)
+	require.Equal(t, http.StatusOK, code)
+	require.JSONEq(t, `{"feature_id": 1, "review_required": true}`, body)
+
+	code, _ = do(t, srv, http.MethodPut, "/role/approver", testAdminToken, `{"grants": [{"permission": "read"}, {"permission": "approve"}]}`)
+	require.Equal(t, http.StatusOK, code)
+
+	code, body = do(t, srv, http.MethodPost, "/token", testAdminToken, `{"name": "reviewer", "role": "approver"}`)
+	require.Equal(t, http.StatusCreated, code)
+
+	var approver sqlite.Token
+	require.NoError(t, json.Unmarshal([]byte(body), &approver))
+
+	code, _ = do(t, srv, http.MethodPut, "/role/editor", testAdminToken, `{"grants": [{"permission": "read"}, {"permission": "write"}]}`)
+	require.Equal(t, http.StatusOK, code)
+
+	code, body = do(t, srv, http.MethodPost, "/token", testAdminToken, `{"name": "author", "role": "editor"}`)
+	require.Equal(t, http.StatusCreated, code)
+
+	var editor sqlite.Token
+	require.NoError(t, json.Unmarshal([]byte(body), &editor))
+
+	code, id := do(t, srv, http.MethodPost, "/banner", testAdminToken, `{"tag_ids": [1], "feature_id": 1, "content": {"title": "first"}, "is_active": true}`)
+	require.Equal(t, http.StatusCreated, code)
+
+	code, body = do(t, srv, http.MethodPatch, "/banner/"+id, editor.Token, `{"tag_ids": [1], "feature_id": 1, "content": {"title": "second"}, "is_active": true}`)
+	require.Equal(t, http.StatusAccepted, code)
+
+	var draft sqlite.Draft
+	require.NoError(t, json.Unmarshal([]byte(body), &draft))
+	require.Equal(t, sqlite.DraftPending, draft.Status)
+	approve := "/banner/" + id + "/drafts/" + strconv.Itoa(draft.Id) + "/approve"
+
+	code, body = do(t, srv, http.MethodGet, "/user_banner?tag_id=1&feature_id=1&use_last_revision=true", testUserToken, "")
+	require.Equal(t, http.StatusOK, code)
+	require.JSONEq(t, `{"title": "first"}`, body)
+
+	code, _ = do(t, srv, http.MethodPost, approve, testAdminToken, "")
+	require.Equal(t, http.StatusForbidden, code)
+
+	code, _ = do(t, srv, http.MethodPost, approve, testUserToken, "")
+	require.Equal(t, http.StatusForbidden, code)
+
+	code, body = do(t, srv, http.MethodPost, approve, approver.Token, `{"comment": "ok"}`)
+	require.Equal(t, http.StatusOK, code)
+	require.NoError(t, json.Unmarshal([]byte(body), &draft))
+	require.Equal(t, sqlite.DraftApproved, draft.Status)
+	require.Equal(t, "ok", draft.Comment)
+
+	code, _ = do(t, srv, http.MethodPost, approve, approver.Token, "")
+	require.Equal(t, http.StatusConflict, code)
+
+	code, body = do(t, srv, http.MethodGet, "/user_banner?tag_id=1&feature_id=1", testUserToken, "")
+	require.Equal(t, http.StatusOK, code)
+	require.JSONEq(t, `{"title": "second"}`, body)
+
+	code, body = do(t, srv, http.MethodPatch, "/banner/"+id, editor.Token, `{"tag_ids": [1], "feature_id": 1, "content": {"title": "third"}, "is_active": true}`)
+	require.Equal(t, http.StatusAccepted, code)
+	require.NoError(t, json.Unmarshal([]byte(body), &draft))
+
+	code, _ = do(t, srv, http.MethodPost, "/banner/"+id+"/drafts/"+strconv.Itoa(draft.Id)+"/reject", approver.Token, `{"comment": "no"}`)
+	require.Equal(t, http.StatusOK, code)
+
+	code, body = do(t, srv, http.MethodGet, "/banner/"+id+"/drafts?status=rejected", approver.Token, "")
+	require.Equal(t, http.StatusOK, code)
+
+	var drafts []sqlite.Draft
+	require.NoError(t, json.Unmarshal([]byte(body), &drafts))
+	require.Len(t, drafts, 1)
+	require.Equal(t, "no", drafts[0].Comment)
+
+	code, body = do(t, srv, http.MethodGet, "/banner/"+id+"/drafts", testAdminToken, "")
+	require.Equal(t, http.StatusOK, code)
+	require.NoError(t, json.Unmarshal([]byte(body), &drafts))
+	require.Len(t, drafts, 2)
+
+	code, body = do(t, srv, http.MethodGet, "/user_banner?tag_id=1&feature_id=1&use_last_revision=true", testUserToken, "")
+	require.Equal(t, http.StatusOK, code)
+	require.JSONEq(t, `{"title": "second"}`, body)
+
+	code, _ = do(t, srv, http.MethodPut, "/feature/1/workflow", testAdminToken, `{"review_required": false}`)
+	require.Equal(t, http.StatusOK, code)
+
+	code, _ = do(t, srv, http.MethodPatch, "/banner/"+id, testAdminToken, `{"tag_ids": [1], "feature_id": 1, "content": {"title": "third"}, "is_active": true}`)
+	require.Equal(t, http.StatusOK, code)
+}
+
+// TestDraftSelfApproval автор не может согласовать свой черновик токеном, который он выпустил,
+// и токеном, которым был выпущен его собственный
+func TestDraftSelfApproval(t *testing.T) {
+	srv := newTestServer(t)
+
+	code, _ := do(t, srv, http.MethodPut, "/feature/1/workflow", testAdminToken, `{"review_required": true}`)
+	require.Equal(t, http.StatusOK, code)
+
+	code, id := do(t, srv, http.MethodPost, "/banner", testAdminToken, `{"tag_ids": [1], "feature_id": 1, "content": {"v": 1}, "is_active": true}`)
+	require.Equal(t, http.StatusCreated, code)
+
+	mint := func(token, name string) sqlite.Token {
+		code, body := do(t, srv, http.MethodPost, "/token", token, `{"name": "`+name+`", "role": "admin"}`)
+		require.Equal(t, http.StatusCreated, code)
+		var minted sqlite.Token
+		require.NoError(t, json.Unmarshal([]byte(body), &minted))
+		return minted
+	}
+	second := mint(testAdminToken, "second")
+	third := mint(second.Token, "third")
+
+	draft := func(token string) string {
+		code, body := do(t, srv, http.MethodPatch, "/banner/"+id, token, `{"tag_ids": [1], "feature_id": 1, "content": {"v": 2}, "is_active": true}`)
+		require.Equal(t, http.StatusAccepted, code)
+		var d sqlite.Draft
+		require.NoError(t, json.Unmarshal([]byte(body), &d))
+		return "/banner/" + id + "/drafts/" + strconv.Itoa(d.Id) + "/approve"
+	}
+
+	approve := draft(testAdminToken)
+	for _, token := range []string{testAdminToken, second.Token, third.Token} {
+		code, _ = do(t, srv, http.MethodPost, approve, token, "")
+		assert.Equal(t, http.StatusForbidden, code)
+	}
+
+	approve = draft(third.Token)
+	code, _ = do(t, srv, http.MethodPost, approve, testAdminToken, "")
+	assert.Equal(t, http.StatusForbidden, code)
+
+	code, _ = do(t, srv, http.MethodPut, "/role/approver", testAdminToken, `{"grants": [{"permission": "read"}, {"permission": "approve"}]}`)
+	require.Equal(t, http.StatusOK, code)
+	code, body := do(t, srv, http.MethodPost, "/token", testAdminToken, `{"name": "reviewer", "role": "approver"}`)
+	require.Equal(t, http.StatusCreated, code)
+	var reviewer sqlite.Token
+	require.NoError(t, json.Unmarshal([]byte(body), &reviewer))
+
+	code, _ = do(t, srv, http.MethodPost, approve, reviewer.Token, "")
+	assert.Equal(t, http.StatusOK, code)
+}
+
+// TestConcurrentRequests запросы обрабатываются параллельно без общей блокировки обработчика
+func TestConcurrentRequests(t *testing.T) {
+	srv := newTestServer(t)
+
+	var wg sync.WaitGroup
+	for g := 1; g <= 8; g++ {
+		wg.Add(1)
+		go func(feature string) {
+			defer wg.Done()
+
+			code, id := do(t, srv, http.MethodPost, "/banner", testAdminToken, `{"tag_ids": [1], "feature_id": `+feature+`, "content": {"v": 0}, "is_active": true}`)
+			assert.Equal(t, http.StatusCreated, code)
+
+			for i := 1; i <= 5; i++ {
+				v := strconv.Itoa(i)
+				code, _ = do(t, srv, http.MethodPatch, "/banner/"+id, testAdminToken, `{"tag_ids": [1], "feature_id": `+feature+`, "content": {"v": `+v+`}, "is_active": true}`)
+				assert.Equal(t, http.StatusOK, code)
+
+				code, body := do(t, srv, http.MethodGet, "/user_banner?tag_id=1&feature_id="+feature, testUserToken, "")
+				assert.Equal(t, http.StatusOK, code)
+				assert.JSONEq(t, `{"v": `+v+`}`, body)
+			}
+		}(strconv.Itoa(g))
+	}
+	wg.Wait()
+}
+
+func TestCacheAdmin(t *testing.T) {
+	srv := newTestServer(t)
+
+	code, _ := do(t, srv, http.MethodPost, "/banner", testAdminToken, `{"tag_ids": [1, 2], "feature_id": 3, "content": {"title": "cached"}, "is_active": true}`)
+	require.Equal(t, http.StatusCreated, code)
+
+	for _, tag := range []string{"1", "1", "2", "2,1"} {
+		code, _ = do(t, srv, http.MethodGet, "/user_banner?tag_id="+tag+"&feature_id=3", testUserToken, "")
+		require.Equal(t, http.StatusOK, code)
+	}
+
+	code, _ = do(t, srv, http.MethodGet, "/admin/cache/keys", testUserToken, "")
+	require.Equal(t, http.StatusForbidden, code)
+
+	code, body := do(t, srv, http.MethodGet, "/admin/cache/keys", testAdminToken, "")
+	require.Equal(t, http.StatusOK, code)
+
+	var entries []cache.Entry
+	require.NoError(t, json.Unmarshal([]byte(body), &entries))
+	// поколение фичи для ключа нескольких тегов не попадает в список ключей
+	require.Len(t, entries, 3)
+	require.Equal(t, "3 1 #1", entries[0].Key)
+	require.Equal(t, "3 2,1 #1", entries[2].Key)
+	require.Equal(t, 1, entries[0].Hits)
+	require.True(t, entries[0].ExpiresAt.After(time.Now()))
+
+	code, body = do(t, srv, http.MethodGet, "/admin/cache/stats", testAdminToken, "")
+	require.Equal(t, http.StatusOK, code)
+
+	var stats cache.Stats
+	require.NoError(t, json.Unmarshal([]byte(body), &stats))
+	require.Equal(t, uint64(1), stats.Hits)
+	require.Equal(t, 3, stats.Entries)
+
+	code, _ = do(t, srv, http.MethodDelete, "/admin/cache/key?feature_id=3&tag_id=1", testAdminToken, "")
+	require.Equal(t, http.StatusNoContent, code)
+
+	code, _ = do(t, srv, http.MethodDelete, "/admin/cache/key?feature_id=3&tag_id=1", testAdminToken, "")
+	require.Equal(t, http.StatusNotFound, code)
+
+	code, _ = do(t, srv, http.MethodDelete, "/admin/cache/key?feature_id=3", testAdminToken, "")
+	require.Equal(t, http.StatusBadRequest, code)
+
+	code, body = do(t, srv, http.MethodDelete, "/admin/cache", testAdminToken, "")
+	require.Equal(t, http.StatusOK, code)
+	require.JSONEq(t, `{"removed": 2}`, body)
+
+	code, body = do(t, srv, http.MethodGet, "/admin/cache/stats", testAdminToken, "")
+	require.Equal(t, http.StatusOK, code)
+	require.NoError(t, json.Unmarshal([]byte(body), &stats))
+	require.Equal(t, 0, stats.Entries)
+}
+
+// slowStorage считает чтения баннера пользователя и замедляет их, чтобы запросы успели совпасть
+type slowStorage struct {
+	*sqlite.Storage
+	reads atomic.Int64
+}
+
+func (s *slowStorage) GetBannerFromStorage(query sqlite.Query, ctx context.Context) (int, string, bool, sqlite.Window, error) {
+	s.reads.Add(1)
+	time.Sleep(50 * time.Millisecond)
+	return s.Storage.GetBannerFromStorage(query, ctx)
+}
+
+func TestBannerCoalescingAndStale(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ctx := context.Background()
+
+	storage := testStorage(t)
+
+	_, err := storage.PostBannerToStorage(sqlite.Banner{TagIds: []int{1}, FeatureId: 1, Content: json.RawMessage(`{"v": 1}`), IsActive: true}, ctx)
+	require.NoError(t, err)
+
+	s := &slowStorage{Storage: storage}
+	h := &Handler{S: s, Log: log, C: cache.New(100*time.Millisecond, 0, cache.WithStaleGrace(time.Minute)), Ctx: ctx}
+	srv := http.HandlerFunc(h.GetBanner)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			code, body := do(t, srv, http.MethodGet, "/user_banner?tag_id=1&feature_id=1", testUserToken, "")
+			assert.Equal(t, http.StatusOK, code)
+			assert.JSONEq(t, `{"v": 1}`, body)
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, int64(1), s.reads.Load())
+
+	time.Sleep(150 * time.Millisecond)
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		code, body := do(t, srv, http.MethodGet, "/user_banner?tag_id=1&feature_id=1", testUserToken, "")
+		require.Equal(t, http.StatusOK, code)
+		require.JSONEq(t, `{"v": 1}`, body)
+	}
+	require.Less(t, time.Since(start), 50*time.Millisecond)
+
+	key, err := h.bannerKey(1, []int{1})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		_, _, ok := h.C.Get(key)
+		return ok
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, int64(2), s.reads.Load())
+}
+
+// TestRedisReplicas реплики с общим Redis кэшем: изменение баннера на одной реплике сразу видно на другой,
+// а при недоступном Redis баннеры отдаются из базы
+func TestRedisReplicas(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ctx := context.Background()
+
+	storage := testStorage(t)
+
+	server := miniredis.RunT(t)
+	newReplica := func() http.Handler {
+		client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+		t.Cleanup(func() { client.Close() })
+		return NewServer(log, storage, cache.NewRedis(client, "", time.Minute, 0), ctx)
+	}
+	a, b := newReplica(), newReplica()
+
+	code, id := do(t, a, http.MethodPost, "/banner", testAdminToken, `{"tag_ids": [1], "feature_id": 1, "content": {"v": 1}, "is_active": true}`)
+	require.Equal(t, http.StatusCreated, code)
+
+	code, body := do(t, b, http.MethodGet, "/user_banner?tag_id=1&feature_id=1", testUserToken, "")
+	require.Equal(t, http.StatusOK, code)
+	require.JSONEq(t, `{"v": 1}`, body)
+
+	code, _ = do(t, a, http.MethodPatch, "/banner/"+id, testAdminToken, `{"tag_ids": [1], "feature_id": 1, "content": {"v": 2}, "is_active": true}`)
+	require.Equal(t, http.StatusOK, code)
+
+	code, body = do(t, b, http.MethodGet, "/user_banner?tag_id=1&feature_id=1", testUserToken, "")
+	require.Equal(t, http.StatusOK, code)
+	assert.JSONEq(t, `{"v": 2}`, body)
+
+	// без Redis поколение фичи неизвестно, и баннеры читаются из базы в обход кэша
+	server.Close()
+	code, _ = do(t, a, http.MethodPatch, "/banner/"+id, testAdminToken, `{"tag_ids": [1], "feature_id": 1, "content": {"v": 3}, "is_active": true}`)
+	require.Equal(t, http.StatusOK, code)
+	code, body = do(t, b, http.MethodGet, "/user_banner?tag_id=1&feature_id=1", testUserToken, "")
+	require.Equal(t, http.StatusOK, code)
+	assert.JSONEq(t, `{"v": 3}`, body)
+	code, body = do(t, b, http.MethodPost, "/user_banner/batch", testUserToken, `{"tag_id": 1, "feature_ids": [1]}`)
+	require.Equal(t, http.StatusOK, code)
+	assert.JSONEq(t, `{"1 1": {"status": 200, "content": {"v": 3}}}`, body)
+}
+
+// TestInvalidationBus реплики с кэшем в памяти: изменение и удаление баннера на одной реплике
+// удаляет его ключи из кэша другой
+func TestInvalidationBus(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ctx := context.Background()
+
+	storage := testStorage(t)
+
+	var hub cache.MemoryHub
+	newReplica := func() http.Handler {
+		return NewServer(log, storage, cache.New(time.Minute, 0), ctx, WithInvalidation(hub.Join()))
+	}
+	a, b := newReplica(), newReplica()
+
+	code, id := do(t, a, http.MethodPost, "/banner", testAdminToken, `{"tag_ids": [1, 2], "feature_id": 1, "content": {"v": 1}, "is_active": true}`)
+	require.Equal(t, http.StatusCreated, code)
+
+	for _, tag := range []string{"1", "2"} {
+		code, body := do(t, b, http.MethodGet, "/user_banner?tag_id="+tag+"&feature_id=1", testUserToken, "")
+		require.Equal(t, http.StatusOK, code)
+		require.JSONEq(t, `{"v": 1}`, body)
+	}
+
+	code, _ = do(t, a, http.MethodPatch, "/banner/"+id, testAdminToken, `{"tag_ids": [1, 2], "feature_id": 1, "content": {"v": 2}, "is_active": true}`)
+	require.Equal(t, http.StatusOK, code)
+
+	code, body := do(t, b, http.MethodGet, "/user_banner?tag_id=1&feature_id=1", testUserToken, "")
+	require.Equal(t, http.StatusOK, code)
+	assert.JSONEq(t, `{"v": 2}`, body)
+
+	code, _ = do(t, a, http.MethodDelete, "/banner/"+id, testAdminToken, "")
+	require.Equal(t, http.StatusNoContent, code)
+
+	code, _ = do(t, b, http.MethodGet, "/user_banner?tag_id=2&feature_id=1", testUserToken, "")
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+// TestRoleInvalidation изменение роли на одной реплике сбрасывает кэш ролей другой,
+// и JWT с этой ролью проверяется по новым правам
+func TestRoleInvalidation(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ctx := context.Background()
+
+	storage := testStorage(t)
+	verifier, err := auth.New("secret", "", "", "")
+	require.NoError(t, err)
+
+	var hub cache.MemoryHub
+	newReplica := func() http.Handler {
+		return NewServer(log, storage, cache.New(time.Minute, 0), ctx, WithJWT(verifier), WithInvalidation(hub.Join()))
+	}
+	a, b := newReplica(), newReplica()
+
+	code, _ := do(t, a, http.MethodPut, "/role/editor", testAdminToken, `{"grants": [{"permission": "read"}, {"permission": "write"}]}`)
+	require.Equal(t, http.StatusOK, code)
+
+	editor, err := jwt.NewWithClaims(jwt.SigningMethodHS256, auth.Claims{
+		Role:             "editor",
+		RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))},
+	}).SignedString([]byte("secret"))
+	require.NoError(t, err)
+
+	code, _ = do(t, b, http.MethodPost, "/banner", editor, `{"tag_ids": [1], "feature_id": 1, "content": {}, "is_active": true}`)
+	require.Equal(t, http.StatusCreated, code)
+
+	code, _ = do(t, a, http.MethodPut, "/role/editor", testAdminToken, `{"grants": [{"permission": "read"}]}`)
+	require.Equal(t, http.StatusOK, code)
+
+	code, _ = do(t, b, http.MethodPost, "/banner", editor, `{"tag_ids": [2], "feature_id": 1, "content": {}, "is_active": true}`)
+	assert.Equal(t, http.StatusForbidden, code)
+}
+
+// TestExperimentInvalidation эксперименты кэшируются отдельно от баннеров: создание эксперимента
+// на одной реплике сбрасывает закэшированные эксперименты фичи на другой
+func TestExperimentInvalidation(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ctx := context.Background()
+
+	storage := testStorage(t)
+
+	var hub cache.MemoryHub
+	a := NewServer(log, storage, cache.New(time.Minute, 0), ctx, WithInvalidation(hub.Join()))
+	bCache := cache.New(time.Minute, 0)
+	b := NewServer(log, storage, bCache, ctx, WithInvalidation(hub.Join()))
+
+	code, _ := do(t, a, http.MethodPost, "/banner", testAdminToken, `{"tag_ids": [1], "feature_id": 1, "content": {"v": "banner"}, "is_active": true}`)
+	require.Equal(t, http.StatusCreated, code)
+
+	code, body := do(t, b, http.MethodGet, "/user_banner?tag_id=1&feature_id=1&user_id=user1", testUserToken, "")
+	require.Equal(t, http.StatusOK, code)
+	assert.JSONEq(t, `{"v": "banner"}`, body)
+
+	entries := bCache.Entries()
+	require.Len(t, entries, 1)
+	assert.Equal(t, "1 1 #1", entries[0].Key)
+
+	code, _ = do(t, a, http.MethodPost, "/experiment", testAdminToken, `{"feature_id": 1, "tag_id": 1, "name": "design", "is_active": true,
+		"variants": [{"name": "a", "content": {"v": "a"}, "weight": 1}, {"name": "b", "content": {"v": "a"}, "weight": 1}]}`)
+	require.Equal(t, http.StatusCreated, code)
+
+	code, body = do(t, b, http.MethodGet, "/user_banner?tag_id=1&feature_id=1&user_id=user1", testUserToken, "")
+	require.Equal(t, http.StatusOK, code)
+	assert.JSONEq(t, `{"v": "a"}`, body)
+}
+
+// TestWarmUp прогрев берет ключи из файла запрашиваемых ключей, а без него - все показываемые баннеры,
+// если их не больше порога
+func TestWarmUp(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ctx := context.Background()
+
+	storage := testStorage(t)
+
+	for feature := 1; feature <= 3; feature++ {
+		_, err := storage.PostBannerToStorage(sqlite.Banner{TagIds: []int{1}, FeatureId: feature, Content: json.RawMessage(`{"v": 1}`), IsActive: true}, ctx)
+		require.NoError(t, err)
+	}
+
+	hitsFile := filepath.Join(t.TempDir(), "hits.json")
+
+	keys, source, err := WarmUpKeys(storage, hitsFile, 2, ctx)
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+
+	keys, source, err = WarmUpKeys(storage, hitsFile, 3, ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "active", source)
+	assert.Equal(t, []string{"1 1", "2 1", "3 1"}, keys)
+
+	require.NoError(t, cache.SaveHits(hitsFile, []cache.Entry{
+		{Key: "2 1 #4", Hits: 7, Active: true},
+		{Key: "2 1,3 #4", Hits: 5, Active: true},
+		{Key: "9 9 #0", Hits: 3, Active: true},
+		{Key: "2 1 #3", Hits: 2, Active: true},
+	}, 10))
+	keys, source, err = WarmUpKeys(storage, hitsFile, 3, ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "hits", source)
+	assert.Equal(t, []string{"2 1 #4", "2 1,3 #4", "9 9 #0", "2 1 #3"}, keys)
+
+	// сохраненные поколения не важны: баннер загружается под ключом текущего поколения, повторы и ключи нескольких тегов пропускаются
+	c := cache.New(time.Minute, 0)
+	assert.Equal(t, 1, WarmUp(log, storage, c, keys, ctx))
+
+	value, _, ok := c.Get("2 1 #0")
+	require.True(t, ok)
+	assert.JSONEq(t, `{"banner_id": 2, "content": {"v": 1}}`, string(value))
+	assert.Equal(t, 1, c.Stats().Entries)
+}
+
+// TestBannerBatch пакетный запрос возвращает результат по каждому ключу с кодом, как у GET /user_banner,
+// а повторный запрос отдается из кэша
+func TestBannerBatch(t *testing.T) {
+	srv := newTestServer(t)
+
+	for _, banner := range []string{
+		`{"tag_ids": [1, 2], "feature_id": 1, "content": {"v": 1}, "is_active": true}`,
+		`{"tag_ids": [1], "feature_id": 2, "content": {"v": 2}, "is_active": false}`,
+		`{"tag_ids": [1], "feature_id": 3, "content": {"v": 3}, "is_active": true}`,
+	} {
+		code, _ := do(t, srv, http.MethodPost, "/banner", testAdminToken, banner)
+		require.Equal(t, http.StatusCreated, code)
+	}
+
+	expected := `{
+		"1 1": {"status": 200, "content": {"v": 1}},
+		"2 1": {"status": 403},
+		"3 1": {"status": 200, "content": {"v": 3}},
+		"4 1": {"status": 404}
+	}`
+	code, body := do(t, srv, http.MethodPost, "/user_banner/batch", testUserToken, `{"tag_id": 1, "feature_ids": [1, 2, 3, 4, 1]}`)
+	require.Equal(t, http.StatusOK, code)
+	assert.JSONEq(t, expected, body)
+
+	code, body = do(t, srv, http.MethodPost, "/user_banner/batch", testUserToken, `{"tag_id": 1, "feature_ids": [1, 2, 3, 4]}`)
+	require.Equal(t, http.StatusOK, code)
+	assert.JSONEq(t, expected, body)
+
+	_, body = do(t, srv, http.MethodGet, "/admin/cache/stats", testAdminToken, "")
+	var stats cache.Stats
+	require.NoError(t, json.Unmarshal([]byte(body), &stats))
+	assert.Equal(t, uint64(3), stats.Hits)
+	assert.Equal(t, 3, stats.Entries)
+
+	code, body = do(t, srv, http.MethodPost, "/user_banner/batch", testAdminToken, `{"items": [{"feature_id": 2, "tag_id": 1}, {"feature_id": 1, "tag_id": 2}], "use_last_revision": true}`)
+	require.Equal(t, http.StatusOK, code)
+	assert.JSONEq(t, `{"2 1": {"status": 200, "content": {"v": 2}}, "1 2": {"status": 200, "content": {"v": 1}}}`, body)
+
+	for _, req := range []string{
+		`{"tag_id": 1}`,
+		`{"feature_ids": [1]}`,
+		`{"tag_id": 1, "feature_ids": [0]}`,
+		`{"tag_id": 1, "items": [{"feature_id": 1, "tag_id": 1}]}`,
+		`{"items": []}`,
+		`[`,
+	} {
+		code, _ = do(t, srv, http.MethodPost, "/user_banner/batch", testUserToken, req)
+		assert.Equal(t, http.StatusBadRequest, code, req)
+	}
+
+	code, _ = do(t, srv, http.MethodPost, "/user_banner/batch", "", `{"tag_id": 1, "feature_ids": [1]}`)
+	assert.Equal(t, http.StatusUnauthorized, code)
+}
+
+// TestMultiTagBanner несколько тегов пользователя: баннер выбирается по порядку тегов, а кэш
+// ключей нескольких тегов сбрасывается при изменении, удалении и добавлении баннеров фичи
+func TestMultiTagBanner(t *testing.T) {
+	srv := newTestServer(t, WithTagResolution(sqlite.ResolveFirst))
+
+	code, first := do(t, srv, http.MethodPost, "/banner", testAdminToken, `{"tag_ids": [1], "feature_id": 1, "content": {"v": 1}, "is_active": true}`)
+	require.Equal(t, http.StatusCreated, code)
+	code, second := do(t, srv, http.MethodPost, "/banner", testAdminToken, `{"tag_ids": [2], "feature_id": 1, "content": {"v": 2}, "is_active": true}`)
+	require.Equal(t, http.StatusCreated, code)
+
+	get := func(query string) string {
+		t.Helper()
+		code, body := do(t, srv, http.MethodGet, "/user_banner?feature_id=1&"+query, testUserToken, "")
+		require.Equal(t, http.StatusOK, code, query)
+		return body
+	}
+
+	assert.JSONEq(t, `{"v": 2}`, get("tag_id=2,1"))
+	assert.JSONEq(t, `{"v": 1}`, get("tag_id=1&tag_id=2"))
+	assert.JSONEq(t, `{"v": 1}`, get("tag_id=3,1"))
+
+	code, _ = do(t, srv, http.MethodPatch, "/banner/"+first, testAdminToken, `{"tag_ids": [1], "feature_id": 1, "content": {"v": 3}, "is_active": true}`)
+	require.Equal(t, http.StatusOK, code)
+	assert.JSONEq(t, `{"v": 3}`, get("tag_id=1,2"))
+
+	code, _ = do(t, srv, http.MethodPost, "/banner", testAdminToken, `{"tag_ids": [3], "feature_id": 1, "content": {"v": 4}, "is_active": true}`)
+	require.Equal(t, http.StatusCreated, code)
+	assert.JSONEq(t, `{"v": 4}`, get("tag_id=3,1"))
+
+	assert.JSONEq(t, `{"v": 2}`, get("tag_id=2,1"))
+	code, _ = do(t, srv, http.MethodDelete, "/banner/"+second, testAdminToken, "")
+	require.Equal(t, http.StatusNoContent, code)
+	assert.JSONEq(t, `{"v": 3}`, get("tag_id=2,1"))
+
+	code, _ = do(t, srv, http.MethodGet, "/user_banner?feature_id=1&tag_id=8,9", testUserToken, "")
+	assert.Equal(t, http.StatusNotFound, code)
+
+	for _, tags := range []string{"1,x", "0", "1,", ""} {
+		code, _ = do(t, srv, http.MethodGet, "/user_banner?feature_id=1&tag_id="+tags, testUserToken, "")
+		assert.Equal(t, http.StatusBadRequest, code, tags)
+	}
+}
+
+func TestDefaultBanner(t *testing.T) {
+	srv := newTestServer(t, WithTagResolution(sqlite.ResolvePriority))
+
+	code, def := do(t, srv, http.MethodPost, "/banner", testAdminToken, `{"tag_ids": [1], "feature_id": 1, "content": {"v": "default"}, "is_active": true, "is_default": true}`)
+	require.Equal(t, http.StatusCreated, code)
+	code, _ = do(t, srv, http.MethodPost, "/banner", testAdminToken, `{"tag_ids": [2], "feature_id": 1, "content": {}, "is_active": true, "is_default": true}`)
+	assert.Equal(t, http.StatusConflict, code)
+
+	get := func(query string) (int, string) {
+		t.Helper()
+		return do(t, srv, http.MethodGet, "/user_banner?feature_id=1&"+query, testUserToken, "")
+	}
+
+	code, body := get("tag_id=7")
+	require.Equal(t, http.StatusOK, code)
+	assert.JSONEq(t, `{"v": "default"}`, body)
+
+	code, tag := do(t, srv, http.MethodPost, "/banner", testAdminToken, `{"tag_ids": [7], "feature_id": 1, "content": {"v": "tag"}, "is_active": true}`)
+	require.Equal(t, http.StatusCreated, code)
+	_, body = get("tag_id=7")
+	assert.JSONEq(t, `{"v": "tag"}`, body)
+
+	// без feature_id конфликт проверяется в прежней фиче баннера, а без tag_ids теги баннера не меняются
+	code, _ = do(t, srv, http.MethodPatch, "/banner/"+tag, testAdminToken, `{"is_default": true}`)
+	assert.Equal(t, http.StatusConflict, code)
+	code, _ = do(t, srv, http.MethodPatch, "/banner/"+tag, testAdminToken, `{"priority": 1}`)
+	require.Equal(t, http.StatusOK, code)
+	_, body = get("tag_id=7")
+	assert.JSONEq(t, `{"v": "tag"}`, body)
+
+	// изменение баннера по умолчанию сбрасывает закэшированные ключи тегов без своего баннера
+	_, body = get("tag_id=9")
+	assert.JSONEq(t, `{"v": "default"}`, body)
+	code, _ = do(t, srv, http.MethodPatch, "/banner/"+def, testAdminToken, `{"tag_ids": [1], "feature_id": 1, "content": {"v": "new default"}, "is_active": true, "priority": 10}`)
+	require.Equal(t, http.StatusOK, code)
+	_, body = get("tag_id=9")
+	assert.JSONEq(t, `{"v": "new default"}`, body)
+	_, body = get("tag_id=7,1")
+	assert.JSONEq(t, `{"v": "new default"}`, body)
+
+	code, body = do(t, srv, http.MethodGet, "/banner?feature_id=1&tag_id=1", testAdminToken, "")
+	require.Equal(t, http.StatusOK, code)
+	var banners []sqlite.Banner
+	require.NoError(t, json.Unmarshal([]byte(body), &banners))
+	require.Len(t, banners, 1)
+	assert.Equal(t, 10, banners[0].Priority)
+	assert.True(t, banners[0].IsDefault)
+
+	code, _ = do(t, srv, http.MethodPatch, "/banner/"+def, testAdminToken, `{"tag_ids": [1], "feature_id": 1, "is_active": true, "is_default": false}`)
+	require.Equal(t, http.StatusOK, code)
+	code, _ = get("tag_id=9")
+	assert.Equal(t, http.StatusNotFound, code)
+	_, body = get("tag_id=1")
+	assert.JSONEq(t, `{"v": "new default"}`, body)
+}
+
+// TestExperiment пользователь с идентификатором получает один и тот же вариант эксперимента и его номер в заголовке,
+// изменение весов и выключение эксперимента сразу видны, а без идентификатора отдается баннер
+func TestExperiment(t *testing.T) {
+	srv := newTestServer(t)
+
+	code, _ := do(t, srv, http.MethodPost, "/banner", testAdminToken, `{"tag_ids": [1], "feature_id": 1, "content": {"v": "banner"}, "is_active": true}`)
+	require.Equal(t, http.StatusCreated, code)
+
+	code, body := do(t, srv, http.MethodPost, "/experiment", testAdminToken, `{"feature_id": 1, "tag_id": 1, "name": "design", "is_active": true,
+		"variants": [{"name": "a", "content": {"v": "a"}, "weight": 1}, {"name": "b", "content": {"v": "b"}, "weight": 1}]}`)
+	require.Equal(t, http.StatusCreated, code)
+	var created map[string]int
+	require.NoError(t, json.Unmarshal([]byte(body), &created))
+	id := strconv.Itoa(created["experiment_id"])
+
+	code, _ = do(t, srv, http.MethodPost, "/experiment", testAdminToken, `{"feature_id": 1, "tag_id": 1, "name": "again",
+		"variants": [{"name": "a", "content": {}, "weight": 1}, {"name": "b", "content": {}, "weight": 1}]}`)
+	assert.Equal(t, http.StatusConflict, code)
+
+	code, body = do(t, srv, http.MethodGet, "/experiment?feature_id=1", testAdminToken, "")
+	require.Equal(t, http.StatusOK, code)
+	var experiments []sqlite.Experiment
+	require.NoError(t, json.Unmarshal([]byte(body), &experiments))
+	require.Len(t, experiments, 1)
+	variants := experiments[0].Variants
+	require.Len(t, variants, 2)
+
+	get := func(userId string) (variant, content string) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/user_banner?feature_id=1&tag_id=1&user_id="+userId, nil)
+		req.Header.Set("token", testUserToken)
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code)
+		return rec.Header().Get(VariantHeader), rec.Body.String()
+	}
+
+	seen := map[string]bool{}
+	for i := 0; i < 20; i++ {
+		userId := "user" + strconv.Itoa(i)
+		variant, content := get(userId)
+		require.NotEmpty(t, variant)
+		again, _ := get(userId)
+		assert.Equal(t, variant, again)
+		if variant == strconv.Itoa(variants[0].VariantId) {
+			assert.JSONEq(t, `{"v": "a"}`, content)
+		} else {
+			assert.JSONEq(t, `{"v": "b"}`, content)
+		}
+		seen[variant] = true
+	}
+	assert.Len(t, seen, 2)
+
+	variant, content := get("")
+	assert.Empty(t, variant)
+	assert.JSONEq(t, `{"v": "banner"}`, content)
+
+	code, body = do(t, srv, http.MethodPost, "/user_banner/batch", testUserToken, `{"tag_id": 1, "feature_ids": [1], "user_id": "user1"}`)
+	require.Equal(t, http.StatusOK, code)
+	var results map[string]BatchResult
+	require.NoError(t, json.Unmarshal([]byte(body), &results))
+	expected, _ := get("user1")
+	assert.Equal(t, expected, strconv.Itoa(results["1 1"].VariantId))
+
+	code, _ = do(t, srv, http.MethodPatch, "/experiment/"+id, testAdminToken, fmt.Sprintf(`{"variants": [{"variant_id": %d, "weight": 0}]}`, variants[0].VariantId))
+	require.Equal(t, http.StatusOK, code)
+	for i := 0; i < 20; i++ {
+		variant, _ = get("user" + strconv.Itoa(i))
+		assert.Equal(t, strconv.Itoa(variants[1].VariantId), variant)
+	}
+
+	code, _ = do(t, srv, http.MethodPatch, "/experiment/"+id, testAdminToken, `{"is_active": false}`)
+	require.Equal(t, http.StatusOK, code)
+	variant, content = get("user1")
+	assert.Empty(t, variant)
+	assert.JSONEq(t, `{"v": "banner"}`, content)
+
+	code, _ = do(t, srv, http.MethodPost, "/experiment", testAdminToken, `{"feature_id": 1, "tag_id": 2, "name": "single", "variants": [{"name": "a", "content": {}, "weight": 1}]}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = do(t, srv, http.MethodPost, "/experiment", testUserToken, `{}`)
+	assert.Equal(t, http.StatusForbidden, code)
+
+	code, _ = do(t, srv, http.MethodDelete, "/experiment/"+id, testAdminToken, "")
+	require.Equal(t, http.StatusNoContent, code)
+	code, _ = do(t, srv, http.MethodDelete, "/experiment/"+id, testAdminToken, "")
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+// TestExperimentHiddenBanner вариант эксперимента отдается, только пока баннер тега эксперимента показывается пользователям:
+// без баннера, до начала его периода показа и при выключенном баннере запрос отвечает так же, как без эксперимента
+func TestExperimentHiddenBanner(t *testing.T) {
+	srv := newTestServer(t)
+
+	code, id := do(t, srv, http.MethodPost, "/banner", testAdminToken, `{"tag_ids": [1], "feature_id": 1, "content": {"v": "banner"}, "is_active": true, "active_from": "2100-01-01T00:00:00Z"}`)
+	require.Equal(t, http.StatusCreated, code)
+	code, _ = do(t, srv, http.MethodPost, "/banner", testAdminToken, `{"tag_ids": [3], "feature_id": 1, "content": {"v": "other"}, "is_active": true}`)
+	require.Equal(t, http.StatusCreated, code)
+	for _, tag := range []string{"1", "2"} {
+		code, _ = do(t, srv, http.MethodPost, "/experiment", testAdminToken, `{"feature_id": 1, "tag_id": `+tag+`, "name": "design", "is_active": true,
+			"variants": [{"name": "a", "content": {"v": "a"}, "weight": 1}, {"name": "b", "content": {"v": "b"}, "weight": 0}]}`)
+		require.Equal(t, http.StatusCreated, code)
+	}
+
+	get := func(tags, token string) (int, string, string) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/user_banner?feature_id=1&tag_id="+tags+"&user_id=user1", nil)
+		req.Header.Set("token", token)
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, req)
+		return rec.Code, rec.Header().Get(VariantHeader), rec.Body.String()
+	}
+
+	code, variant, _ := get("1", testUserToken)
+	assert.Equal(t, http.StatusForbidden, code)
+	assert.Empty(t, variant)
+	code, variant, body := get("1", testAdminToken)
+	require.Equal(t, http.StatusOK, code)
+	assert.Empty(t, variant)
+	assert.JSONEq(t, `{"v": "banner"}`, body)
+	code, _, _ = get("2", testUserToken)
+	assert.Equal(t, http.StatusNotFound, code)
+	code, variant, body = get("3,1", testUserToken)
+	require.Equal(t, http.StatusOK, code)
+	assert.Empty(t, variant)
+	assert.JSONEq(t, `{"v": "other"}`, body)
+
+	code, body = do(t, srv, http.MethodPost, "/user_banner/batch", testUserToken, `{"tag_id": 1, "feature_ids": [1], "user_id": "user1"}`)
+	require.Equal(t, http.StatusOK, code)
+	var results map[string]BatchResult
+	require.NoError(t, json.Unmarshal([]byte(body), &results))
+	assert.Equal(t, BatchResult{Status: http.StatusForbidden}, results["1 1"])
+
+	code, _ = do(t, srv, http.MethodPatch, "/banner/"+id, testAdminToken, `{"active_from": null}`)
+	require.Equal(t, http.StatusOK, code)
+	for _, tags := range []string{"1", "3,1"} {
+		code, variant, body = get(tags, testUserToken)
+		require.Equal(t, http.StatusOK, code)
+		assert.NotEmpty(t, variant)
+		assert.JSONEq(t, `{"v": "a"}`, body)
+	}
+}
+
+// TestTracking показы из базы и кэша и клики записываются пачкой в счетчики баннера за день
+func TestTracking(t *testing.T) {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ctx := context.Background()
+
+	storage := testStorage(t)
+
+	events := tracking.New(storage, log, 100, 100, time.Hour)
+	events.Start()
+	srv := NewServer(log, storage, cache.New(time.Minute, 0), ctx, WithTracking(events))
+
+	code, id := do(t, srv, http.MethodPost, "/banner", testAdminToken, `{"tag_ids": [1, 2], "feature_id": 1, "content": {"v": 1}, "is_active": true}`)
+	require.Equal(t, http.StatusCreated, code)
+
+	for i := 0; i < 2; i++ {
+		code, _ = do(t, srv, http.MethodGet, "/user_banner?tag_id=1&feature_id=1", testUserToken, "")
+		require.Equal(t, http.StatusOK, code)
+	}
+	code, _ = do(t, srv, http.MethodPost, "/user_banner/batch", testUserToken, `{"tag_id": 2, "feature_ids": [1, 2]}`)
+	require.Equal(t, http.StatusOK, code)
+
+	code, _ = do(t, srv, http.MethodPost, "/banner/"+id+"/click", testUserToken, "")
+	require.Equal(t, http.StatusNoContent, code)
+	code, _ = do(t, srv, http.MethodPost, "/banner/999/click", testUserToken, "")
+	assert.Equal(t, http.StatusNotFound, code)
+
+	// показ учитывается отданному баннеру, даже если до записи пачки тег получил другой баннер
+	code, replaced := do(t, srv, http.MethodPost, "/banner", testAdminToken, `{"tag_ids": [3], "feature_id": 1, "content": {"v": 2}, "is_active": true}`)
+	require.Equal(t, http.StatusCreated, code)
+	code, _ = do(t, srv, http.MethodGet, "/user_banner?tag_id=3&feature_id=1", testUserToken, "")
+	require.Equal(t, http.StatusOK, code)
+	code, _ = do(t, srv, http.MethodDelete, "/banner/"+replaced, testAdminToken, "")
+	require.Equal(t, http.StatusNoContent, code)
+	code, replacement := do(t, srv, http.MethodPost, "/banner", testAdminToken, `{"tag_ids": [3], "feature_id": 1, "content": {"v": 3}, "is_active": true}`)
+	require.Equal(t, http.StatusCreated, code)
+
+	events.Close()
+
+	day := time.Now().UTC().Format(sqlite.DayLayout)
+	code, body := do(t, srv, http.MethodGet, "/banner/"+id+"/stats?from="+day, testAdminToken, "")
+	require.Equal(t, http.StatusOK, code)
+	assert.JSONEq(t, fmt.Sprintf(`[{"banner_id": %s, "day": %q, "impressions": 3, "cached": 1, "clicks": 1}]`, id, day), body)
+
+	code, body = do(t, srv, http.MethodGet, "/banner/"+replacement+"/stats", testAdminToken, "")
+	require.Equal(t, http.StatusOK, code)
+	assert.JSONEq(t, `[]`, body)
+
+	code, body = do(t, srv, http.MethodGet, "/admin/stats?to=2000-01-01", testAdminToken, "")
+	require.Equal(t, http.StatusOK, code)
+	assert.JSONEq(t, `[]`, body)
+
+	code, _ = do(t, srv, http.MethodGet, "/admin/stats?from=yesterday", testAdminToken, "")
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = do(t, srv, http.MethodGet, "/admin/stats", testUserToken, "")
+	assert.Equal(t, http.StatusForbidden, code)
+	code, _ = do(t, srv, http.MethodGet, "/banner/"+id+"/stats", testUserToken, "")
+	assert.Equal(t, http.StatusForbidden, code)
+}
@@ -0,0 +1,120 @@
+package handler
+
+import (
+	sqlite "avito-testovoe/internal/storage"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"github.com/go-chi/chi/v5"
+	"log/slog"
+	"net/http"
+	"slices"
+)
+
+// GetRoles Получение списка ролей и их прав
+func (h *Handler) GetRoles(w http.ResponseWriter, r *http.Request) {
+	token := requestToken(r)
+
+	ok := h.Verify(token, ManagePermission, w)
+
+	if !ok {
+		return
+	}
+
+	roles, err := h.S.GetRolesFromStorage(h.Ctx)
+	if err != nil {
+		h.Log.Error("Внутренняя ошибка сервера:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h.writeJSON(w, http.StatusOK, roles)
+	h.Log.Info("Получен список ролей по запросу пользователя")
+}
+
+// PutRole Создание роли или замена всех ее прав
+func (h *Handler) PutRole(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+
+	token := requestToken(r)
+
+	ok := h.Verify(token, ManagePermission, w)
+
+	if !ok {
+		return
+	}
+
+	var role sqlite.Role
+	var buf bytes.Buffer
+
+	_, err := buf.ReadFrom(r.Body)
+	if err != nil {
+		h.Log.Error("Некорректные данные:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err = json.Unmarshal(buf.Bytes(), &role); err != nil {
+		h.Log.Error("Некорректные данные:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	role.Name = name
+
+	for _, grant := range role.Grants {
+		if !slices.Contains(permissions, grant.Permission) ||
+			(grant.FeatureFrom != nil && *grant.FeatureFrom < 1) ||
+			(grant.FeatureTo != nil && *grant.FeatureTo < 1) ||
+			(grant.FeatureFrom != nil && grant.FeatureTo != nil && *grant.FeatureFrom > *grant.FeatureTo) {
+			h.Log.Error("Некорректные данные: неизвестное право или неверный диапазон фич")
+			http.Error(w, "Некорректные данные: неизвестное право или неверный диапазон фич", http.StatusBadRequest)
+			return
+		}
+	}
+
+	err = h.S.PutRoleToStorage(role, h.Ctx)
+	if err != nil {
+		h.Log.Error("Внутренняя ошибка сервера:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.rolesChanged()
+
+	w.WriteHeader(http.StatusOK)
+	h.Log.Info("Сохранена роль по запросу пользователя: " + name)
+}
+
+// DeleteRole Удаление роли, на которую не выписаны действующие токены
+func (h *Handler) DeleteRole(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+
+	token := requestToken(r)
+
+	ok := h.Verify(token, ManagePermission, w)
+
+	if !ok {
+		return
+	}
+
+	err := h.S.DeleteRoleFromStorage(name, h.Ctx)
+	if errors.Is(err, sqlite.ErrRoleInUse) {
+		h.Log.Error("Роль используется:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		h.Log.Error("Роль не найдена:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		h.Log.Error("Внутренняя ошибка сервера:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.rolesChanged()
+
+	w.WriteHeader(http.StatusNoContent)
+	h.Log.Info("Удалена роль по запросу пользователя: " + name)
+}
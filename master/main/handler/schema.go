@@ -0,0 +1,310 @@
+package handler
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// schemaCache скомпилированные схемы фич. Схема перекомпилируется, только если ее текст в хранилище
+// изменился, поэтому схема, замененная на другой реплике, не отдается из кэша
+type schemaCache struct {
+	mu      sync.RWMutex
+	schemas map[int]compiledSchema
+}
+
+type compiledSchema struct {
+	raw      string
+	compiled *jsonschema.Schema
+}
+
+// featureSchema возвращает скомпилированную схему фичи по ее тексту из хранилища
+func (h *Handler) featureSchema(featureId int, raw json.RawMessage) (*jsonschema.Schema, error) {
+	h.schemas.mu.RLock()
+	cached, ok := h.schemas.schemas[featureId]
+	h.schemas.mu.RUnlock()
+	if ok && cached.raw == string(raw) {
+		return cached.compiled, nil
+	}
+
+	compiled, err := compileSchema(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	h.schemas.mu.Lock()
+	if h.schemas.schemas == nil {
+		h.schemas.schemas = map[int]compiledSchema{}
+	}
+	h.schemas.schemas[featureId] = compiledSchema{raw: string(raw), compiled: compiled}
+	h.schemas.mu.Unlock()
+
+	return compiled, nil
+}
+
+// resetSchema удаляет скомпилированную схему фичи после ее замены или удаления
+func (h *Handler) resetSchema(featureId int) {
+	h.schemas.mu.Lock()
+	delete(h.schemas.schemas, featureId)
+	h.schemas.mu.Unlock()
+}
+
+// Violation нарушение JSON Schema в контенте баннера
+type Violation struct {
+	Path    string `json:"path"`
+	Keyword string `json:"keyword"`
+	Message string `json:"message"`
+}
+
+type violationsResponse struct {
+	Error      string      `json:"error"`
+	Violations []Violation `json:"violations"`
+}
+
+// GetFeatureSchema Получение JSON Schema контента баннеров фичи
+func (h *Handler) GetFeatureSchema(w http.ResponseWriter, r *http.Request) {
+	token := requestToken(r)
+
+	ok := h.VerifyAny(token, WritePermission, w)
+
+	if !ok {
+		return
+	}
+
+	featureId, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil || featureId < 1 {
+		h.Log.Error("Некорректная фича")
+		http.Error(w, "Некорректные данные", http.StatusBadRequest)
+		return
+	}
+
+	if !h.Verify(token, WritePermission, w, featureId) {
+		return
+	}
+
+	schema, err := h.S.GetFeatureSchemaFromStorage(featureId, h.Ctx)
+	if errors.Is(err, sql.ErrNoRows) {
+		h.Log.Error("Схема не найдена:", slog.Any("err", err))
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		h.Log.Error("Внутренняя ошибка сервера:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resp, err := json.Marshal(schema)
+	if err != nil {
+		h.Log.Error("Внутренняя ошибка сервера:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(resp)
+	if err != nil {
+		h.Log.Error("Внутренняя ошибка сервера:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h.Log.Info("Получена схема фичи по запросу пользователя")
+}
+
+// PutFeatureSchema Создание или замена JSON Schema контента баннеров фичи
+func (h *Handler) PutFeatureSchema(w http.ResponseWriter, r *http.Request) {
+	token := requestToken(r)
+
+	ok := h.VerifyAny(token, WritePermission, w)
+
+	if !ok {
+		return
+	}
+
+	featureId, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil || featureId < 1 {
+		h.Log.Error("Некорректная фича")
+		http.Error(w, "Некорректные данные", http.StatusBadRequest)
+		return
+	}
+
+	if !h.Verify(token, WritePermission, w, featureId) {
+		return
+	}
+
+	var buf bytes.Buffer
+
+	_, err = buf.ReadFrom(r.Body)
+	if err != nil {
+		h.Log.Error("Некорректные данные:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	_, err = compileSchema(buf.Bytes())
+	if err != nil {
+		h.Log.Error("Некорректная схема:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = h.S.PutFeatureSchemaToStorage(featureId, buf.Bytes(), h.Ctx)
+	if err != nil {
+		h.Log.Error("Внутренняя ошибка сервера:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.resetSchema(featureId)
+
+	w.WriteHeader(http.StatusOK)
+	h.Log.Info("Сохранена схема фичи по запросу пользователя под номером:" + strconv.Itoa(featureId))
+}
+
+// DeleteFeatureSchema Удаление JSON Schema фичи, после чего контент баннеров фичи не проверяется
+func (h *Handler) DeleteFeatureSchema(w http.ResponseWriter, r *http.Request) {
+	token := requestToken(r)
+
+	ok := h.VerifyAny(token, WritePermission, w)
+
+	if !ok {
+		return
+	}
+
+	featureId, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil || featureId < 1 {
+		h.Log.Error("Некорректная фича")
+		http.Error(w, "Некорректные данные", http.StatusBadRequest)
+		return
+	}
+
+	if !h.Verify(token, WritePermission, w, featureId) {
+		return
+	}
+
+	err = h.S.DeleteFeatureSchemaFromStorage(featureId, h.Ctx)
+	if err != nil {
+		h.Log.Error("Схема не найдена:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	h.resetSchema(featureId)
+
+	w.WriteHeader(http.StatusNoContent)
+	h.Log.Info("Удалена схема фичи по запросу пользователя под номером:" + strconv.Itoa(featureId))
+}
+
+// validateContent проверяет контент баннера по схеме фичи.
+// Если схема для фичи не задана, контент считается корректным
+func (h *Handler) validateContent(featureId int, content json.RawMessage, w http.ResponseWriter) (valid bool) {
+	schema, err := h.S.GetFeatureSchemaFromStorage(featureId, h.Ctx)
+	if errors.Is(err, sql.ErrNoRows) {
+		return true
+	}
+	if err != nil {
+		h.Log.Error("Внутренняя ошибка сервера:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+
+	compiled, err := h.featureSchema(featureId, schema.Schema)
+	if err != nil {
+		h.Log.Error("Внутренняя ошибка сервера:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+
+	violations, err := validate(compiled, content)
+	if err != nil {
+		h.Log.Error("Внутренняя ошибка сервера:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+
+	if len(violations) == 0 {
+		return true
+	}
+
+	h.Log.Error("Контент не соответствует схеме фичи", slog.Int("feature_id", featureId), slog.Int("violations", len(violations)))
+
+	resp, err := json.Marshal(violationsResponse{Error: "Контент не соответствует схеме фичи", Violations: violations})
+	if err != nil {
+		h.Log.Error("Внутренняя ошибка сервера:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	_, _ = w.Write(resp)
+
+	return false
+}
+
+// compileSchema компилирует схему фичи. Схема не может ссылаться на внешние документы:
+// загрузка по $ref, в том числе file://, запрещена, чтобы схема не читала файлы и адреса сервера
+func compileSchema(schema json.RawMessage) (*jsonschema.Schema, error) {
+	c := jsonschema.NewCompiler()
+	c.LoadURL = func(url string) (io.ReadCloser, error) {
+		return nil, fmt.Errorf("external schema %q is not allowed", url)
+	}
+
+	err := c.AddResource("feature.json", bytes.NewReader(schema))
+	if err != nil {
+		return nil, err
+	}
+
+	return c.Compile("feature.json")
+}
+
+// validate возвращает список нарушений схемы, пустой если контент корректен
+func validate(compiled *jsonschema.Schema, content json.RawMessage) ([]Violation, error) {
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return []Violation{{Path: "", Keyword: "", Message: err.Error()}}, nil
+	}
+
+	err := compiled.Validate(value)
+	if err == nil {
+		return nil, nil
+	}
+
+	var validationErr *jsonschema.ValidationError
+	if !errors.As(err, &validationErr) {
+		return nil, err
+	}
+
+	var violations []Violation
+	collectViolations(validationErr, &violations)
+
+	return violations, nil
+}
+
+// collectViolations собирает листовые ошибки дерева ValidationError
+func collectViolations(err *jsonschema.ValidationError, res *[]Violation) {
+	if len(err.Causes) == 0 {
+		*res = append(*res, Violation{
+			Path:    err.InstanceLocation,
+			Keyword: err.KeywordLocation,
+			Message: err.Message,
+		})
+		return
+	}
+
+	for _, cause := range err.Causes {
+		collectViolations(cause, res)
+	}
+}
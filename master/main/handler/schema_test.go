@@ -0,0 +1,74 @@
+package handler
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	schema := json.RawMessage(`{
+		"type": "object",
+		"required": ["title", "items"],
+		"properties": {
+			"title": {"type": "string"},
+			"items": {"type": "array", "items": {"type": "integer"}}
+		}
+	}`)
+
+	tests := []struct {
+		name    string
+		content string
+		paths   []string
+	}{
+		{
+			name:    "Корректный контент",
+			content: `{"title": "t", "items": [1, 2, 3], "extra": {"a": true}}`,
+		},
+		{
+			name:    "Нет обязательного поля",
+			content: `{"items": []}`,
+			paths:   []string{""},
+		},
+		{
+			name:    "Неверные типы",
+			content: `{"title": 1, "items": [1, "2"]}`,
+			paths:   []string{"/title", "/items/1"},
+		},
+	}
+
+	compiled, err := compileSchema(schema)
+	require.NoError(t, err)
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			violations, err := validate(compiled, json.RawMessage(tt.content))
+			require.NoError(t, err)
+
+			var paths []string
+			for _, v := range violations {
+				paths = append(paths, v.Path)
+				assert.NotEmpty(t, v.Message)
+			}
+			assert.ElementsMatch(t, tt.paths, paths)
+		})
+	}
+}
+
+func TestCompileSchemaInvalid(t *testing.T) {
+	_, err := compileSchema(json.RawMessage(`{"type": 12}`))
+	assert.Error(t, err)
+
+	_, err = compileSchema(json.RawMessage(`not json`))
+	assert.Error(t, err)
+}
+
+// TestCompileSchemaExternalRef схема не может загрузить внешний документ по $ref
+func TestCompileSchemaExternalRef(t *testing.T) {
+	for _, ref := range []string{"file:///etc/passwd", "http://127.0.0.1/schema.json"} {
+		_, err := compileSchema(json.RawMessage(`{"$ref": "` + ref + `"}`))
+		assert.Error(t, err, ref)
+	}
+}
@@ -1,36 +1,111 @@
 package handler
 
 import (
+	"avito-testovoe/internal/auth"
 	"avito-testovoe/internal/cache"
 	sqlite "avito-testovoe/internal/storage"
+	"avito-testovoe/internal/tracking"
 	"context"
+	"encoding/json"
 	"github.com/go-chi/chi/v5"
+	"golang.org/x/sync/singleflight"
 	"log/slog"
 	"net/http"
-	"sync"
 )
 
 type StorageI interface {
-	GetBannerFromStorage(query sqlite.Query, ctx context.Context) (content string, active bool, err error)
+	GetBannerFromStorage(query sqlite.Query, ctx context.Context) (id int, content string, active bool, window sqlite.Window, err error)
 	GetAllBannersFromStorage(query sqlite.Query, ctx context.Context) (banners []sqlite.Banner, err error)
+	GetUserBannersFromStorage(queries []sqlite.Query, ctx context.Context) (banners []sqlite.UserBanner, err error)
+	GetActiveKeysFromStorage(limit int, ctx context.Context) (keys []string, err error)
 	PostBannerToStorage(banner sqlite.Banner, ctx context.Context) (id int, err error)
-	UpdateBannerInStorage(banner sqlite.BannerUpdate, ctx context.Context) (err error)
+	UpdateBannerInStorage(banner sqlite.BannerUpdate, ctx context.Context) (keys []string, err error)
 	DeleteBannerFromStorage(id int, ctx context.Context) (keys []string, err error)
 	DeleteBannerFromStorageByFeature(featureId int, ctx context.Context) (keys []string, err error)
 	DeleteBannerFromStorageByTag(tag int, ctx context.Context) (keys []string, err error)
 	GetBannerVersionsFromStorage(id int, ctx context.Context) (banners []sqlite.Banner, err error)
-	CheckToken(token string, ctx context.Context) (role string, err error)
+	GetBannerByIdFromStorage(id int, ctx context.Context) (banner sqlite.Banner, err error)
+	RollbackBannerInStorage(id, versionId int, ctx context.Context) (keys []string, err error)
+	PruneVersionsInStorage(ctx context.Context) (removed int64, err error)
+	CheckToken(token string, ctx context.Context) (role string, id int, err error)
+	GetFeatureSchemaFromStorage(featureId int, ctx context.Context) (schema sqlite.FeatureSchema, err error)
+	PutFeatureSchemaToStorage(featureId int, schema json.RawMessage, ctx context.Context) (err error)
+	DeleteFeatureSchemaFromStorage(featureId int, ctx context.Context) (err error)
+	CreateTokenInStorage(token sqlite.Token, ctx context.Context) (id int, err error)
+	GetTokensFromStorage(ctx context.Context) (tokens []sqlite.Token, err error)
+	GetTokenCreatorFromStorage(id int, ctx context.Context) (createdBy string, err error)
+	RotateTokenInStorage(id int, token string, ctx context.Context) (err error)
+	RevokeTokenInStorage(id int, ctx context.Context) (err error)
+	GetRolesFromStorage(ctx context.Context) (roles []sqlite.Role, err error)
+	PutRoleToStorage(role sqlite.Role, ctx context.Context) (err error)
+	DeleteRoleFromStorage(name string, ctx context.Context) (err error)
+	GetBannerFeatureFromStorage(id int, ctx context.Context) (featureId int, err error)
+	GetTagFeaturesFromStorage(tag int, ctx context.Context) (features []int, err error)
+	CreateDraftInStorage(draft sqlite.Draft, ctx context.Context) (created sqlite.Draft, err error)
+	GetDraftsFromStorage(bannerId int, status string, ctx context.Context) (drafts []sqlite.Draft, err error)
+	GetDraftFromStorage(bannerId, id int, ctx context.Context) (draft sqlite.Draft, err error)
+	UpdateDraftStatusInStorage(id int, from, to, reviewer, comment string, ctx context.Context) (err error)
+	GetFeatureWorkflowFromStorage(featureId int, ctx context.Context) (reviewRequired bool, err error)
+	PutFeatureWorkflowToStorage(featureId int, reviewRequired bool, ctx context.Context) (err error)
+	PostExperimentToStorage(experiment sqlite.Experiment, ctx context.Context) (id int, err error)
+	GetExperimentsFromStorage(featureId int, ctx context.Context) (experiments []sqlite.Experiment, err error)
+	GetExperimentFromStorage(id int, ctx context.Context) (experiment sqlite.Experiment, err error)
+	UpdateExperimentInStorage(update sqlite.ExperimentUpdate, ctx context.Context) (err error)
+	DeleteExperimentFromStorage(id int, ctx context.Context) (err error)
+	GetBannerStatsFromStorage(bannerId int, from, to string, ctx context.Context) (stats []sqlite.BannerStat, err error)
 }
 
 type Handler struct {
-	rwMu sync.RWMutex
-	S    StorageI
-	Log  *slog.Logger
-	C    *cache.Cache
-	Ctx  context.Context
+	S   StorageI
+	Log *slog.Logger
+	C   cache.Cache
+	Ctx context.Context
+	JWT *auth.Verifier
+	Bus cache.Transport
+	// Resolution стратегия выбора баннера для нескольких тегов пользователя
+	Resolution sqlite.Resolution
+	// Events фоновая запись показов и кликов, nil если она выключена
+	Events *tracking.Writer
+
+	roles       roleCache
+	schemas     schemaCache
+	experiments experimentCache
+	loads       singleflight.Group
+}
+
+// Option дополнительная настройка Handler
+type Option func(h *Handler)
+
+// WithJWT включает проверку JWT из заголовка Authorization: Bearer
+func WithJWT(v *auth.Verifier) Option {
+	return func(h *Handler) {
+		h.JWT = v
+	}
+}
+
+// WithInvalidation рассылает удаленные ключи кэша остальным репликам через bus
+// и удаляет из кэша ключи, полученные от них
+func WithInvalidation(bus cache.Transport) Option {
+	return func(h *Handler) {
+		h.Bus = bus
+	}
+}
+
+// WithTagResolution задает стратегию выбора баннера, когда GET /user_banner получает несколько тегов
+func WithTagResolution(resolution sqlite.Resolution) Option {
+	return func(h *Handler) {
+		h.Resolution = resolution
+	}
 }
 
-func NewServer(log *slog.Logger, storage *sqlite.Storage, c *cache.Cache, ctx context.Context) http.Handler {
+// WithTracking передает показы и клики баннеров на фоновую запись в events
+func WithTracking(events *tracking.Writer) Option {
+	return func(h *Handler) {
+		h.Events = events
+	}
+}
+
+func NewServer(log *slog.Logger, storage *sqlite.Storage, c cache.Cache, ctx context.Context, opts ...Option) http.Handler {
 	h := Handler{
 		S:   storage,
 		Log: log,
@@ -38,15 +113,69 @@ func NewServer(log *slog.Logger, storage *sqlite.Storage, c *cache.Cache, ctx co
 		Ctx: ctx,
 	}
 
+	for _, opt := range opts {
+		opt(&h)
+	}
+	if h.Bus != nil {
+		h.Bus.Subscribe(h.receive)
+	}
+
 	r := chi.NewRouter()
 
 	r.Get("/user_banner", h.GetBanner)
+	r.Post("/user_banner/batch", h.GetBannerBatch)
 	r.Get("/banner", h.GetAllBanners)
 	r.Post("/banner", h.PostBanner)
 	r.Patch("/banner/{id}", h.PatchBanner)
 	r.Delete("/banner/{id}", h.DeleteBanner)
 	r.Delete("/banner", h.DeleteBannerByTagOrFeature)
 	r.Get("/banner/{id}", h.GetBannerVersions)
+	r.Post("/banner/{id}/rollback/{version_id}", h.RollbackBanner)
+	r.Get("/banner/{id}/diff", h.GetBannerDiff)
+	r.Post("/banner/{id}/click", h.PostClick)
+	r.Get("/banner/{id}/stats", h.GetBannerStats)
+	r.Get("/banner/{id}/drafts", h.GetDrafts)
+	r.Post("/banner/{id}/drafts/{draft_id}/approve", h.ApproveDraft)
+	r.Post("/banner/{id}/drafts/{draft_id}/reject", h.RejectDraft)
+	r.Get("/experiment", h.GetExperiments)
+	r.Post("/experiment", h.PostExperiment)
+	r.Patch("/experiment/{id}", h.PatchExperiment)
+	r.Delete("/experiment/{id}", h.DeleteExperiment)
+	r.Post("/admin/versions/prune", h.PruneVersions)
+	r.Get("/admin/stats", h.GetStats)
+	r.Get("/admin/cache/stats", h.GetCacheStats)
+	r.Get("/admin/cache/keys", h.GetCacheEntries)
+	r.Delete("/admin/cache/key", h.PurgeCacheKey)
+	r.Delete("/admin/cache", h.FlushCache)
+	r.Get("/feature/{id}/schema", h.GetFeatureSchema)
+	r.Put("/feature/{id}/schema", h.PutFeatureSchema)
+	r.Delete("/feature/{id}/schema", h.DeleteFeatureSchema)
+	r.Get("/feature/{id}/workflow", h.GetWorkflow)
+	r.Put("/feature/{id}/workflow", h.PutWorkflow)
+	r.Get("/token", h.GetTokens)
+	r.Post("/token", h.PostToken)
+	r.Post("/token/{id}/rotate", h.RotateToken)
+	r.Delete("/token/{id}", h.RevokeToken)
+	r.Get("/role", h.GetRoles)
+	r.Put("/role/{name}", h.PutRole)
+	r.Delete("/role/{name}", h.DeleteRole)
 
 	return r
 }
+
+// writeJSON отправляет ответ в формате JSON
+func (h *Handler) writeJSON(w http.ResponseWriter, status int, v any) {
+	resp, err := json.Marshal(v)
+	if err != nil {
+		h.Log.Error("Внутренняя ошибка сервера:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, err = w.Write(resp)
+	if err != nil {
+		h.Log.Error("Внутренняя ошибка сервера:", slog.Any("err", err))
+	}
+}
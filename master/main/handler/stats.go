@@ -0,0 +1,141 @@
+package handler
+
+import (
+	sqlite "avito-testovoe/internal/storage"
+	"avito-testovoe/internal/tracking"
+	"github.com/go-chi/chi/v5"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// track передает событие баннера на фоновую запись, если она включена
+func (h *Handler) track(e tracking.Event) {
+	if h.Events == nil {
+		return
+	}
+	h.Events.Record(e)
+}
+
+// PostClick Учет клика пользователя по баннеру
+func (h *Handler) PostClick(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	token := requestToken(r)
+
+	ok := h.VerifyAny(token, ReadPermission, w)
+
+	if !ok {
+		return
+	}
+
+	idInt, err := strconv.Atoi(id)
+	if err != nil {
+		h.Log.Error("Некорректные данные:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	featureId, ok := h.bannerFeature(idInt, w)
+	if !ok || !h.Verify(token, ReadPermission, w, featureId) {
+		return
+	}
+
+	h.track(tracking.Event{Kind: tracking.Click, BannerId: idInt, FeatureId: featureId})
+
+	w.WriteHeader(http.StatusNoContent)
+	h.Log.Info("Учтен клик по баннеру под номером:" + id)
+}
+
+// GetBannerStats Получение показов и кликов баннера по дням
+func (h *Handler) GetBannerStats(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	token := requestToken(r)
+
+	ok := h.VerifyAny(token, WritePermission, w)
+
+	if !ok {
+		return
+	}
+
+	idInt, err := strconv.Atoi(id)
+	if err != nil {
+		h.Log.Error("Некорректные данные:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	from, to, ok := h.statsRange(r, w)
+	if !ok {
+		return
+	}
+
+	featureId, ok := h.bannerFeature(idInt, w)
+	if !ok || !h.Verify(token, WritePermission, w, featureId) {
+		return
+	}
+
+	h.writeStats(w, idInt, from, to)
+	h.Log.Info("Получены показы и клики баннера по запросу пользователя под номером:" + id)
+}
+
+// GetStats Получение показов и кликов всех баннеров или баннера banner_id по дням
+func (h *Handler) GetStats(w http.ResponseWriter, r *http.Request) {
+	token := requestToken(r)
+
+	ok := h.Verify(token, WritePermission, w)
+
+	if !ok {
+		return
+	}
+
+	bannerId := 0
+	if value := r.URL.Query().Get("banner_id"); value != "" {
+		var err error
+		bannerId, err = strconv.Atoi(value)
+		if err != nil || bannerId < 1 {
+			h.Log.Error("Некорректный баннер")
+			http.Error(w, "Некорректные данные: banner_id", http.StatusBadRequest)
+			return
+		}
+	}
+
+	from, to, ok := h.statsRange(r, w)
+	if !ok {
+		return
+	}
+
+	h.writeStats(w, bannerId, from, to)
+	h.Log.Info("Получены показы и клики баннеров по запросу пользователя")
+}
+
+// statsRange читает границы дней from и to в формате 2006-01-02, отвечает 400 если они некорректны
+func (h *Handler) statsRange(r *http.Request, w http.ResponseWriter) (from, to string, ok bool) {
+	from, to = r.URL.Query().Get("from"), r.URL.Query().Get("to")
+
+	for _, day := range []string{from, to} {
+		if day == "" {
+			continue
+		}
+		if _, err := time.Parse(sqlite.DayLayout, day); err != nil {
+			h.Log.Error("Некорректный день:", slog.Any("err", err))
+			http.Error(w, "Некорректные данные: from и to в формате "+sqlite.DayLayout, http.StatusBadRequest)
+			return "", "", false
+		}
+	}
+
+	return from, to, true
+}
+
+func (h *Handler) writeStats(w http.ResponseWriter, bannerId int, from, to string) {
+	stats, err := h.S.GetBannerStatsFromStorage(bannerId, from, to, h.Ctx)
+	if err != nil {
+		h.Log.Error("Внутренняя ошибка сервера:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h.writeJSON(w, http.StatusOK, stats)
+}
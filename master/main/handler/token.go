@@ -0,0 +1,186 @@
+package handler
+
+import (
+	sqlite "avito-testovoe/internal/storage"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/go-chi/chi/v5"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// GetTokens Получение списка токенов без их значений
+func (h *Handler) GetTokens(w http.ResponseWriter, r *http.Request) {
+	token := requestToken(r)
+
+	ok := h.Verify(token, ManagePermission, w)
+
+	if !ok {
+		return
+	}
+
+	tokens, err := h.S.GetTokensFromStorage(h.Ctx)
+	if err != nil {
+		h.Log.Error("Внутренняя ошибка сервера:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h.writeJSON(w, http.StatusOK, tokens)
+	h.Log.Info("Получен список токенов по запросу пользователя")
+}
+
+// PostToken Выпуск нового токена. Значение токена возвращается только в ответе на этот запрос
+func (h *Handler) PostToken(w http.ResponseWriter, r *http.Request) {
+	token := requestToken(r)
+
+	ok := h.Verify(token, ManagePermission, w)
+
+	if !ok {
+		return
+	}
+
+	var newToken sqlite.Token
+	var buf bytes.Buffer
+
+	_, err := buf.ReadFrom(r.Body)
+	if err != nil {
+		h.Log.Error("Некорректные данные:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err = json.Unmarshal(buf.Bytes(), &newToken); err != nil {
+		h.Log.Error("Некорректные данные:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	_, ok, err = h.roleGrants(newToken.Role)
+	if err != nil {
+		h.Log.Error("Внутренняя ошибка сервера:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !ok || newToken.Name == "" {
+		h.Log.Error("Некорректные данные: неизвестная роль или пустое имя")
+		http.Error(w, "Некорректные данные: неизвестная роль или пустое имя", http.StatusBadRequest)
+		return
+	}
+
+	if newToken.ExpiresAt != nil && newToken.ExpiresAt.Before(time.Now()) {
+		h.Log.Error("Некорректные данные: срок действия токена уже истек")
+		http.Error(w, "Некорректные данные: срок действия токена уже истек", http.StatusBadRequest)
+		return
+	}
+
+	newToken.Token, err = generateToken()
+	if err != nil {
+		h.Log.Error("Внутренняя ошибка сервера:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	newToken.RevokedAt = nil
+
+	// токен принадлежит выпустившему его субъекту: им нельзя согласовать черновик этого субъекта
+	p, err := h.principal(token)
+	if err != nil {
+		h.Log.Error("Внутренняя ошибка сервера:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	newToken.CreatedBy = p.Subject
+
+	newToken.Id, err = h.S.CreateTokenInStorage(newToken, h.Ctx)
+	if err != nil {
+		h.Log.Error("Внутренняя ошибка сервера:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	newToken.CreatedAt = time.Now().UTC().Format(time.RFC3339)
+
+	h.writeJSON(w, http.StatusCreated, newToken)
+	h.Log.Info("Выпущен токен по запросу пользователя под номером:" + strconv.Itoa(newToken.Id))
+}
+
+// RotateToken Замена значения токена, старое значение перестает действовать
+func (h *Handler) RotateToken(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	token := requestToken(r)
+
+	ok := h.Verify(token, ManagePermission, w)
+
+	if !ok {
+		return
+	}
+
+	idInt, err := strconv.Atoi(id)
+	if err != nil {
+		h.Log.Error("Некорректные данные:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	newValue, err := generateToken()
+	if err != nil {
+		h.Log.Error("Внутренняя ошибка сервера:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = h.S.RotateTokenInStorage(idInt, newValue, h.Ctx)
+	if err != nil {
+		h.Log.Error("Токен не найден:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	h.writeJSON(w, http.StatusOK, sqlite.Token{Id: idInt, Token: newValue})
+	h.Log.Info("Заменен токен по запросу пользователя под номером:" + id)
+}
+
+// RevokeToken Отзыв токена
+func (h *Handler) RevokeToken(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+
+	token := requestToken(r)
+
+	ok := h.Verify(token, ManagePermission, w)
+
+	if !ok {
+		return
+	}
+
+	idInt, err := strconv.Atoi(id)
+	if err != nil {
+		h.Log.Error("Некорректные данные:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = h.S.RevokeTokenInStorage(idInt, h.Ctx)
+	if err != nil {
+		h.Log.Error("Токен не найден:", slog.Any("err", err))
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	h.Log.Info("Отозван токен по запросу пользователя под номером:" + id)
+}
+
+// generateToken возвращает случайное значение токена из 32 байт в hex
+func generateToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
@@ -1,55 +1,305 @@
 package handler
 
 import (
+	"avito-testovoe/internal/auth"
+	sqlite "avito-testovoe/internal/storage"
+	"database/sql"
+	"errors"
+	"log/slog"
 	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 const (
-	ReadPermission  = "read"
-	WritePermission = "write"
+	ReadPermission    = "read"
+	WritePermission   = "write"
+	ManagePermission  = "manage"
+	ApprovePermission = "approve"
 
 	AdminRole = "admin"
 	UserRole  = "user"
 )
 
 var (
-	rolePermissions = map[string][]string{
-		AdminRole: {ReadPermission, WritePermission},
-		UserRole:  {ReadPermission},
-	}
+	permissions = []string{ReadPermission, WritePermission, ManagePermission, ApprovePermission}
 )
 
-var (
-	userRoles = map[string][]string{
-		"User":  {UserRole},
-		"Admin": {AdminRole},
+// roleCacheTTL как долго права ролей берутся из кэша. Реплика, изменившая роль, рассылает остальным
+// rolesKey, а TTL ограничивает срок, в который реплика без рассылки проверяет по отозванным правам
+const roleCacheTTL = 30 * time.Second
+
+// rolesKey служебный ключ рассылки между репликами: роли изменились, кэш ролей нужно сбросить
+const rolesKey = "!roles"
+
+// Principal субъект запроса: роль, ее права и ограничения по тегам и фичам из JWT.
+// Пустые Tags или Features означают отсутствие ограничений.
+// Subject идентифицирует автора изменений: token:<id> для токенов из хранилища, jwt:<sub> для JWT.
+// Токены, выпущенные субъектом, принадлежат ему же, их связывает Handler.sameOwner
+type Principal struct {
+	Subject  string
+	Role     string
+	Grants   []sqlite.Grant
+	Tags     []int
+	Features []int
+}
+
+// can проверяет, что у субъекта есть право permission хотя бы на часть фич
+func (p Principal) can(permission string) bool {
+	return slices.ContainsFunc(p.Grants, func(g sqlite.Grant) bool {
+		return g.Permission == permission
+	})
+}
+
+// allows проверяет право permission на каждую из фич features.
+// Без фич требуется право, не ограниченное диапазоном фич
+func (p Principal) allows(permission string, features ...int) bool {
+	if len(features) == 0 {
+		return len(p.Features) == 0 && slices.ContainsFunc(p.Grants, func(g sqlite.Grant) bool {
+			return g.Permission == permission && !g.Scoped()
+		})
+	}
+
+	for _, featureId := range features {
+		if len(p.Features) > 0 && !slices.Contains(p.Features, featureId) {
+			return false
+		}
+		if !slices.ContainsFunc(p.Grants, func(g sqlite.Grant) bool {
+			return g.Permission == permission && g.Covers(featureId)
+		}) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// inScope проверяет, что фича и тег входят в ограничения субъекта
+func (p Principal) inScope(featureId, tagId int) bool {
+	return (len(p.Features) == 0 || slices.Contains(p.Features, featureId)) &&
+		(len(p.Tags) == 0 || slices.Contains(p.Tags, tagId))
+}
+
+// roleCache права ролей из хранилища. Загружается при первой проверке, перечитывается через roleCacheTTL
+// и сбрасывается при изменении ролей на любой реплике, поэтому JWT проверяется без обращения к базе
+type roleCache struct {
+	mu     sync.RWMutex
+	grants map[string][]sqlite.Grant
+	loaded time.Time
+}
+
+// fresh проверяет, что права загружены и не старше roleCacheTTL
+func (c *roleCache) fresh() bool {
+	return c.grants != nil && time.Since(c.loaded) < roleCacheTTL
+}
+
+// roleGrants возвращает права роли, ok = false если роли нет
+func (h *Handler) roleGrants(role string) (grants []sqlite.Grant, ok bool, err error) {
+	h.roles.mu.RLock()
+	if h.roles.fresh() {
+		grants, ok = h.roles.grants[role]
+		h.roles.mu.RUnlock()
+		return grants, ok, nil
+	}
+	h.roles.mu.RUnlock()
+
+	h.roles.mu.Lock()
+	defer h.roles.mu.Unlock()
+
+	if !h.roles.fresh() {
+		roles, err := h.S.GetRolesFromStorage(h.Ctx)
+		if err != nil {
+			return nil, false, err
+		}
+
+		h.roles.grants = make(map[string][]sqlite.Grant, len(roles))
+		for _, r := range roles {
+			h.roles.grants[r.Name] = r.Grants
+		}
+		h.roles.loaded = time.Now()
+	}
+
+	grants, ok = h.roles.grants[role]
+	return grants, ok, nil
+}
+
+// resetRoles сбрасывает кэш ролей после их изменения
+func (h *Handler) resetRoles() {
+	h.roles.mu.Lock()
+	h.roles.grants = nil
+	h.roles.mu.Unlock()
+}
+
+// rolesChanged сбрасывает кэш ролей у себя и на остальных репликах
+func (h *Handler) rolesChanged() {
+	h.resetRoles()
+	h.publish([]string{rolesKey})
+}
+
+// tokenSubject субъект токена из хранилища
+func tokenSubject(id int) string {
+	return "token:" + strconv.Itoa(id)
+}
+
+// maxLineage наибольшая длина цепочки токенов, выпущенных друг другом
+const maxLineage = 32
+
+// lineage возвращает субъект и тех, кто выпустил его токен, по цепочке до токена без выпустившего.
+// Токен, выпущенный субъектом, считается его токеном, поэтому цепочка связывает все токены одного владельца
+func (h *Handler) lineage(subject string) ([]string, error) {
+	res := []string{subject}
+	for len(res) < maxLineage {
+		value, ok := strings.CutPrefix(subject, "token:")
+		if !ok {
+			break
+		}
+		id, err := strconv.Atoi(value)
+		if err != nil {
+			break
+		}
+
+		creator, err := h.S.GetTokenCreatorFromStorage(id, h.Ctx)
+		if errors.Is(err, sql.ErrNoRows) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if creator == "" || slices.Contains(res, creator) {
+			break
+		}
+
+		res = append(res, creator)
+		subject = creator
 	}
-)
 
-func (h *Handler) Verify(token string, permission string, w http.ResponseWriter) (autorization bool) {
+	return res, nil
+}
+
+// sameOwner проверяет, что субъекты a и b действуют от имени одного владельца:
+// это один субъект, или один из них выпустил токен другого, напрямую или через выпущенные им токены
+func (h *Handler) sameOwner(a, b string) (bool, error) {
+	lineageA, err := h.lineage(a)
+	if err != nil {
+		return false, err
+	}
+	lineageB, err := h.lineage(b)
+	if err != nil {
+		return false, err
+	}
+
+	return slices.Contains(lineageA, b) || slices.Contains(lineageB, a), nil
+}
+
+// requestToken возвращает токен из заголовка token или из заголовка Authorization: Bearer
+func requestToken(r *http.Request) string {
+	if token := r.Header.Get("token"); token != "" {
+		return token
+	}
+
+	return strings.TrimSpace(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+}
+
+// principal определяет субъект по токену: JWT проверяется локально, остальные токены ищутся в хранилище
+func (h *Handler) principal(token string) (Principal, error) {
+	var p Principal
+
+	if auth.IsJWT(token) {
+		if h.JWT == nil {
+			return Principal{}, errors.New("jwt authentication is not configured")
+		}
+
+		claims, err := h.JWT.Parse(token)
+		if err != nil {
+			return Principal{}, err
+		}
+
+		subject := claims.Subject
+		if subject == "" {
+			subject = sqlite.HashToken(token)
+		}
+
+		p = Principal{Subject: "jwt:" + subject, Role: claims.Role, Tags: claims.Tags, Features: claims.Features}
+	} else {
+		role, id, err := h.S.CheckToken(token, h.Ctx)
+		if err != nil {
+			return Principal{}, err
+		}
+
+		p = Principal{Subject: tokenSubject(id), Role: role}
+	}
+
+	grants, _, err := h.roleGrants(p.Role)
+	if err != nil {
+		return Principal{}, err
+	}
+	p.Grants = grants
+
+	return p, nil
+}
+
+// Verify проверяет право permission на фичи features.
+// Без фич требуется право, не ограниченное диапазоном фич
+func (h *Handler) Verify(token string, permission string, w http.ResponseWriter, features ...int) (autorization bool) {
+	return h.verify(token, w, func(p Principal) bool {
+		return p.allows(permission, features...)
+	})
+}
+
+// VerifyAny проверяет, что право permission есть хотя бы на часть фич.
+// Используется до того, как известны фичи, которые затрагивает запрос
+func (h *Handler) VerifyAny(token string, permission string, w http.ResponseWriter) (autorization bool) {
+	return h.verify(token, w, func(p Principal) bool {
+		return p.can(permission)
+	})
+}
+
+func (h *Handler) verify(token string, w http.ResponseWriter, check func(p Principal) bool) (autorization bool) {
 	if token == "" {
 		w.WriteHeader(http.StatusUnauthorized)
 		h.Log.Error("Пользователь не авторизован")
 		return false
 	}
 
-	role, err := h.S.CheckToken(token, h.Ctx)
+	p, err := h.principal(token)
 	if err != nil {
 		w.WriteHeader(http.StatusForbidden)
-		h.Log.Error("Пользователь не имеет доступа", err)
+		h.Log.Error("Пользователь не имеет доступа", slog.Any("err", err))
 		return false
 	}
 
-	for _, roles := range userRoles[role] {
-		for _, storedPermission := range rolePermissions[roles] {
-			if permission == storedPermission {
-				h.Log.Info("Пользователь успешно авторизован")
-				return true
-			}
-		}
+	if check(p) {
+		h.Log.Info("Пользователь успешно авторизован")
+		return true
 	}
 
 	w.WriteHeader(http.StatusForbidden)
 	h.Log.Error("Пользователь не имеет доступа")
 	return false
 }
+
+// VerifyScope проверяет, что тег и фича входят в ограничения токена.
+// Ограничения бывают только у JWT, поэтому для остальных токенов хранилище не запрашивается
+func (h *Handler) VerifyScope(token string, featureId, tagId int, w http.ResponseWriter) (autorization bool) {
+	if !auth.IsJWT(token) {
+		return true
+	}
+
+	p, err := h.principal(token)
+	if err != nil {
+		w.WriteHeader(http.StatusForbidden)
+		h.Log.Error("Пользователь не имеет доступа", slog.Any("err", err))
+		return false
+	}
+
+	if !p.inScope(featureId, tagId) {
+		w.WriteHeader(http.StatusForbidden)
+		h.Log.Error("Пользователь не имеет доступа к фиче или тегу")
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,74 @@
+package handler
+
+import (
+	"avito-testovoe/internal/cache"
+	sqlite "avito-testovoe/internal/storage"
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+)
+
+// WarmUpKeys выбирает ключи "фича тег" (с поколением фичи, если они взяты из hitsFile) для прогрева кэша: самые запрашиваемые ключи из hitsFile,
+// сохраненного при прошлой остановке, а если его нет - все показываемые баннеры,
+// когда их ключей не больше maxActive. Иначе возвращает пустой список
+func WarmUpKeys(s StorageI, hitsFile string, maxActive int, ctx context.Context) (keys []string, source string, err error) {
+	if hitsFile != "" {
+		keys, err = cache.LoadHits(hitsFile)
+		if err != nil || len(keys) > 0 {
+			return keys, "hits", err
+		}
+	}
+
+	if maxActive <= 0 {
+		return nil, "", nil
+	}
+
+	keys, err = s.GetActiveKeysFromStorage(maxActive+1, ctx)
+	if err != nil || len(keys) > maxActive {
+		return nil, "", err
+	}
+
+	return keys, "active", nil
+}
+
+// WarmUp загружает в кэш баннеры по ключам "фича тег" и возвращает количество загруженных.
+// Вызывается до запуска сервера, ключи без баннера пропускаются. Прерывается при отмене ctx
+func WarmUp(log *slog.Logger, s StorageI, c cache.Cache, keys []string, ctx context.Context) (loaded int) {
+	h := &Handler{S: s, Log: log, C: c, Ctx: ctx}
+	seen := map[[2]int]bool{}
+
+	for _, key := range keys {
+		if ctx.Err() != nil {
+			break
+		}
+
+		// ключи нескольких тегов не прогреваются, поколение в сохраненных ключах заменяется текущим
+		if strings.Contains(key, ",") {
+			continue
+		}
+
+		var query sqlite.Query
+		if _, err := fmt.Sscanf(key, "%d %d", &query.FeatureId, &query.TagId); err != nil {
+			log.Error("Некорректный ключ прогрева кэша: " + key)
+			continue
+		}
+		pair := [2]int{query.FeatureId, query.TagId}
+		if seen[pair] {
+			continue
+		}
+		seen[pair] = true
+
+		key, err := h.bannerKey(query.FeatureId, []int{query.TagId})
+		if err != nil {
+			log.Error("Кэш недоступен, прогрев остановлен:", slog.Any("err", err))
+			break
+		}
+		if _, err := h.fetchBanner(key, query); err != nil {
+			continue
+		}
+		loaded++
+	}
+
+	return loaded
+}
@@ -0,0 +1,222 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt/v5"
+	"math/big"
+	"os"
+	"strings"
+)
+
+// Claims утверждения JWT, которые использует сервис.
+// Пустые Tags или Features означают отсутствие ограничений
+type Claims struct {
+	Role     string `json:"role"`
+	Tags     []int  `json:"tags,omitempty"`
+	Features []int  `json:"features,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// Verifier проверяет подпись и срок действия JWT локально, без обращения к хранилищу
+type Verifier struct {
+	secret   []byte
+	keys     map[string]crypto.PublicKey
+	methods  []string
+	issuer   string
+	audience string
+}
+
+// New создает Verifier по HMAC секрету и/или JWKS файлу с публичными ключами RSA и ECDSA.
+// Если не задано ни то ни другое, возвращается nil
+func New(secret, jwksFile, issuer, audience string) (*Verifier, error) {
+	if secret == "" && jwksFile == "" {
+		return nil, nil
+	}
+
+	v := &Verifier{
+		secret:   []byte(secret),
+		keys:     map[string]crypto.PublicKey{},
+		issuer:   issuer,
+		audience: audience,
+	}
+
+	if secret != "" {
+		v.methods = append(v.methods, "HS256", "HS384", "HS512")
+	}
+
+	if jwksFile != "" {
+		data, err := os.ReadFile(jwksFile)
+		if err != nil {
+			return nil, err
+		}
+
+		v.keys, err = ParseJWKS(data)
+		if err != nil {
+			return nil, err
+		}
+
+		v.methods = append(v.methods, "RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512")
+	}
+
+	return v, nil
+}
+
+// IsJWT отличает JWT от непрозрачного токена из хранилища
+func IsJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// Parse проверяет токен и возвращает его утверждения
+func (v *Verifier) Parse(token string) (*Claims, error) {
+	opts := []jwt.ParserOption{jwt.WithValidMethods(v.methods), jwt.WithExpirationRequired()}
+	if v.issuer != "" {
+		opts = append(opts, jwt.WithIssuer(v.issuer))
+	}
+	if v.audience != "" {
+		opts = append(opts, jwt.WithAudience(v.audience))
+	}
+
+	claims := &Claims{}
+	_, err := jwt.ParseWithClaims(token, claims, v.key, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.Role == "" {
+		return nil, errors.New("jwt: role claim is missing")
+	}
+
+	return claims, nil
+}
+
+func (v *Verifier) key(token *jwt.Token) (any, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok {
+		if len(v.secret) == 0 {
+			return nil, errors.New("jwt: hmac secret is not configured")
+		}
+		return v.secret, nil
+	}
+
+	if kid, ok := token.Header["kid"].(string); ok {
+		if key, ok := v.keys[kid]; ok {
+			return key, nil
+		}
+		return nil, fmt.Errorf("jwt: unknown key id %q", kid)
+	}
+
+	if len(v.keys) == 1 {
+		for _, key := range v.keys {
+			return key, nil
+		}
+	}
+
+	return nil, errors.New("jwt: key id is required")
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// ParseJWKS разбирает набор публичных ключей в формате JWKS (RFC 7517), ключи индексируются по kid
+func ParseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for i, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		var key crypto.PublicKey
+		var err error
+		switch k.Kty {
+		case "RSA":
+			key, err = rsaKey(k)
+		case "EC":
+			key, err = ecKey(k)
+		default:
+			err = fmt.Errorf("unsupported key type %q", k.Kty)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("jwks key %d: %w", i, err)
+		}
+
+		keys[k.Kid] = key
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("jwks: no signing keys")
+	}
+
+	return keys, nil
+}
+
+func rsaKey(k jwk) (*rsa.PublicKey, error) {
+	n, err := decodeBigInt(k.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := decodeBigInt(k.E)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+}
+
+func ecKey(k jwk) (*ecdsa.PublicKey, error) {
+	var curve elliptic.Curve
+	switch k.Crv {
+	case "P-256":
+		curve = elliptic.P256()
+	case "P-384":
+		curve = elliptic.P384()
+	case "P-521":
+		curve = elliptic.P521()
+	default:
+		return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+	}
+
+	x, err := decodeBigInt(k.X)
+	if err != nil {
+		return nil, err
+	}
+	y, err := decodeBigInt(k.Y)
+	if err != nil {
+		return nil, err
+	}
+
+	if !curve.IsOnCurve(x, y) {
+		return nil, errors.New("point is not on curve")
+	}
+
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,139 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/require"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func claims(role string, exp time.Duration) Claims {
+	return Claims{
+		Role:             role,
+		Tags:             []int{1, 2},
+		RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(exp))},
+	}
+}
+
+func sign(t *testing.T, method jwt.SigningMethod, kid string, c Claims, key any) string {
+	t.Helper()
+
+	token := jwt.NewWithClaims(method, c)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+
+	s, err := token.SignedString(key)
+	require.NoError(t, err)
+
+	return s
+}
+
+func b64(i *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(i.Bytes())
+}
+
+func writeJWKS(t *testing.T, keys ...map[string]string) string {
+	t.Helper()
+
+	data, err := json.Marshal(map[string]any{"keys": keys})
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	require.NoError(t, os.WriteFile(path, data, 0o600))
+
+	return path
+}
+
+func TestNewDisabled(t *testing.T) {
+	v, err := New("", "", "", "")
+	require.NoError(t, err)
+	require.Nil(t, v)
+}
+
+func TestIsJWT(t *testing.T) {
+	require.True(t, IsJWT("a.b.c"))
+	require.False(t, IsJWT("c1c224b03cd9bc7b6a86d77f5dace40191766c485cd55dc48caf9ac873335d6f"))
+}
+
+func TestParseHMAC(t *testing.T) {
+	v, err := New("secret", "", "banners", "")
+	require.NoError(t, err)
+
+	c := claims("user", time.Hour)
+	c.Issuer = "banners"
+
+	parsed, err := v.Parse(sign(t, jwt.SigningMethodHS256, "", c, []byte("secret")))
+	require.NoError(t, err)
+	require.Equal(t, "user", parsed.Role)
+	require.Equal(t, []int{1, 2}, parsed.Tags)
+
+	_, err = v.Parse(sign(t, jwt.SigningMethodHS256, "", c, []byte("other")))
+	require.Error(t, err)
+
+	expired := claims("user", -time.Minute)
+	expired.Issuer = "banners"
+	_, err = v.Parse(sign(t, jwt.SigningMethodHS256, "", expired, []byte("secret")))
+	require.ErrorIs(t, err, jwt.ErrTokenExpired)
+
+	_, err = v.Parse(sign(t, jwt.SigningMethodHS256, "", claims("user", time.Hour), []byte("secret")))
+	require.ErrorIs(t, err, jwt.ErrTokenRequiredClaimMissing)
+
+	noRole := claims("", time.Hour)
+	noRole.Issuer = "banners"
+	_, err = v.Parse(sign(t, jwt.SigningMethodHS256, "", noRole, []byte("secret")))
+	require.Error(t, err)
+}
+
+func TestParseJWKS(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	path := writeJWKS(t,
+		map[string]string{"kty": "RSA", "kid": "rsa", "use": "sig", "n": b64(rsaKey.N), "e": b64(big.NewInt(int64(rsaKey.E)))},
+		map[string]string{"kty": "EC", "kid": "ec", "crv": "P-256", "x": b64(ecKey.X), "y": b64(ecKey.Y)},
+	)
+
+	v, err := New("", path, "", "")
+	require.NoError(t, err)
+
+	parsed, err := v.Parse(sign(t, jwt.SigningMethodRS256, "rsa", claims("admin", time.Hour), rsaKey))
+	require.NoError(t, err)
+	require.Equal(t, "admin", parsed.Role)
+
+	parsed, err = v.Parse(sign(t, jwt.SigningMethodES256, "ec", claims("user", time.Hour), ecKey))
+	require.NoError(t, err)
+	require.Equal(t, "user", parsed.Role)
+
+	_, err = v.Parse(sign(t, jwt.SigningMethodES256, "rsa", claims("user", time.Hour), ecKey))
+	require.Error(t, err)
+
+	_, err = v.Parse(sign(t, jwt.SigningMethodES256, "unknown", claims("user", time.Hour), ecKey))
+	require.Error(t, err)
+
+	// HMAC не принимается, если секрет не настроен
+	_, err = v.Parse(sign(t, jwt.SigningMethodHS256, "", claims("admin", time.Hour), []byte("secret")))
+	require.Error(t, err)
+}
+
+func TestParseJWKSInvalid(t *testing.T) {
+	_, err := ParseJWKS([]byte(`{"keys": []}`))
+	require.Error(t, err)
+
+	_, err = ParseJWKS([]byte(`{"keys": [{"kty": "oct", "kid": "a"}]}`))
+	require.Error(t, err)
+
+	_, err = ParseJWKS([]byte(`{"keys": [{"kty": "EC", "kid": "a", "crv": "P-256", "x": "AQ", "y": "AQ"}]}`))
+	require.Error(t, err)
+}
@@ -0,0 +1,190 @@
+package cache
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// TransportNone инвалидация между репликами выключена
+	TransportNone = "none"
+	// TransportHTTP ключи отправляются POST запросом на адреса остальных реплик
+	TransportHTTP = "http"
+
+	// InvalidatePath путь, на который HTTPTransport отправляет ключи
+	InvalidatePath = "/invalidate"
+	// SecretHeader заголовок с общим секретом реплик
+	SecretHeader = "X-Invalidation-Secret"
+)
+
+// Transport канал инвалидации кэша между репликами. Реплика, удалившая ключи у себя,
+// публикует их, а остальные реплики удаляют их из своего кэша.
+// Свои сообщения реплике не доставляются
+type Transport interface {
+	// Publish рассылает ключи остальным репликам
+	Publish(keys []string) error
+	// Subscribe задает функцию, которая применяет ключи, полученные от других реплик
+	Subscribe(apply func(keys []string))
+}
+
+// MemoryHub канал между репликами внутри одного процесса, используется в тестах
+type MemoryHub struct {
+	mu      sync.RWMutex
+	members []*memoryTransport
+}
+
+type memoryTransport struct {
+	hub   *MemoryHub
+	mu    sync.RWMutex
+	apply func(keys []string)
+}
+
+// Join подключает к каналу новую реплику
+func (h *MemoryHub) Join() Transport {
+	t := &memoryTransport{hub: h}
+
+	h.mu.Lock()
+	h.members = append(h.members, t)
+	h.mu.Unlock()
+
+	return t
+}
+
+func (t *memoryTransport) Publish(keys []string) error {
+	t.hub.mu.RLock()
+	defer t.hub.mu.RUnlock()
+
+	for _, member := range t.hub.members {
+		if member != t {
+			member.deliver(keys)
+		}
+	}
+
+	return nil
+}
+
+func (t *memoryTransport) Subscribe(apply func(keys []string)) {
+	t.mu.Lock()
+	t.apply = apply
+	t.mu.Unlock()
+}
+
+func (t *memoryTransport) deliver(keys []string) {
+	t.mu.RLock()
+	apply := t.apply
+	t.mu.RUnlock()
+
+	if apply != nil {
+		apply(keys)
+	}
+}
+
+// HTTPTransport отправляет ключи POST запросом {"keys": [...]} на InvalidatePath каждой реплики из peers
+// и принимает их от других реплик как http.Handler. Запросы подписываются общим секретом в SecretHeader
+type HTTPTransport struct {
+	peers  []string
+	secret string
+	client *http.Client
+
+	mu    sync.RWMutex
+	apply func(keys []string)
+}
+
+type invalidation struct {
+	Keys []string `json:"keys"`
+}
+
+// NewHTTPTransport создает транспорт для реплик с базовыми адресами peers, например http://banner-2:8182.
+// timeout ограничивает отправку на одну реплику
+func NewHTTPTransport(peers []string, secret string, timeout time.Duration) *HTTPTransport {
+	return &HTTPTransport{
+		peers:  peers,
+		secret: secret,
+		client: &http.Client{Timeout: timeout},
+	}
+}
+
+// Publish отправляет ключи всем репликам параллельно. Недоступные реплики не мешают остальным,
+// их ошибки возвращаются вместе
+func (t *HTTPTransport) Publish(keys []string) error {
+	body, err := json.Marshal(invalidation{Keys: keys})
+	if err != nil {
+		return err
+	}
+
+	errs := make([]error, len(t.peers))
+	var wg sync.WaitGroup
+	for i, peer := range t.peers {
+		wg.Add(1)
+		go func(i int, peer string) {
+			defer wg.Done()
+			errs[i] = t.send(peer, body)
+		}(i, peer)
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+func (t *HTTPTransport) send(peer string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, peer+InvalidatePath, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(SecretHeader, t.secret)
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("invalidate %s: unexpected status %d", peer, resp.StatusCode)
+	}
+
+	return nil
+}
+
+func (t *HTTPTransport) Subscribe(apply func(keys []string)) {
+	t.mu.Lock()
+	t.apply = apply
+	t.mu.Unlock()
+}
+
+// ServeHTTP принимает ключи от другой реплики. Пока секрет не задан, отклоняются все запросы
+func (t *HTTPTransport) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.URL.Path != InvalidatePath {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// без секрета любой, кто достучится до адреса, мог бы сбрасывать кэш реплики, поэтому запросы не принимаются
+	if t.secret == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get(SecretHeader)), []byte(t.secret)) != 1 {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	var msg invalidation
+	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	t.mu.RLock()
+	apply := t.apply
+	t.mu.RUnlock()
+
+	if apply != nil {
+		apply(msg.Keys)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,82 @@
+package cache
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestMemoryHub ключи доставляются всем репликам, кроме отправителя
+func TestMemoryHub(t *testing.T) {
+	var hub MemoryHub
+	a, b, c := hub.Join(), hub.Join(), hub.Join()
+
+	received := map[string][]string{}
+	a.Subscribe(func(keys []string) { received["a"] = keys })
+	b.Subscribe(func(keys []string) { received["b"] = keys })
+
+	require.NoError(t, a.Publish([]string{"1 1", "1 2"}))
+	require.NoError(t, c.Publish([]string{"2 1"}))
+
+	assert.Equal(t, map[string][]string{"a": {"2 1"}, "b": {"2 1"}}, received)
+}
+
+// TestHTTPTransport ключи доходят до реплик-получателей, запросы без секрета отклоняются,
+// а недоступная реплика возвращается ошибкой
+func TestHTTPTransport(t *testing.T) {
+	peer := New(time.Minute, 0)
+	peer.Set("1 1", true, json.RawMessage(`{}`))
+	peer.Set("1 2", true, json.RawMessage(`{}`))
+
+	receiver := NewHTTPTransport(nil, "secret", time.Second)
+	receiver.Subscribe(peer.Delete)
+	server := httptest.NewServer(receiver)
+	t.Cleanup(server.Close)
+
+	sender := NewHTTPTransport([]string{server.URL}, "secret", time.Second)
+	require.NoError(t, sender.Publish([]string{"1 1"}))
+
+	_, _, ok := peer.Get("1 1")
+	assert.False(t, ok)
+	_, _, ok = peer.Get("1 2")
+	assert.True(t, ok)
+
+	resp, err := http.Post(server.URL+InvalidatePath, "application/json", strings.NewReader(`{"keys": ["1 2"]}`))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	_, _, ok = peer.Get("1 2")
+	assert.True(t, ok)
+
+	wrongSecret := NewHTTPTransport([]string{server.URL}, "other", time.Second)
+	assert.Error(t, wrongSecret.Publish([]string{"1 2"}))
+
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	partial := NewHTTPTransport([]string{down.URL, server.URL}, "secret", time.Second)
+	assert.Error(t, partial.Publish([]string{"1 2"}))
+	_, _, ok = peer.Get("1 2")
+	assert.False(t, ok)
+}
+
+// TestHTTPTransportEmptySecret без секрета реплика не принимает ключи, в том числе с пустым заголовком
+func TestHTTPTransportEmptySecret(t *testing.T) {
+	peer := New(time.Minute, 0)
+	peer.Set("1 1", true, json.RawMessage(`{}`))
+
+	receiver := NewHTTPTransport(nil, "", time.Second)
+	receiver.Subscribe(peer.Delete)
+	server := httptest.NewServer(receiver)
+	t.Cleanup(server.Close)
+
+	sender := NewHTTPTransport([]string{server.URL}, "", time.Second)
+	assert.Error(t, sender.Publish([]string{"1 1"}))
+
+	_, _, ok := peer.Get("1 1")
+	assert.True(t, ok)
+}
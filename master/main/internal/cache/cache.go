@@ -1,36 +1,148 @@
 package cache
 
 import (
+	"encoding/json"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 )
 
-type Cache struct {
-	rwMux             sync.RWMutex
-	items             map[string]Item
+// DefaultShards количество сегментов кэша по умолчанию
+const DefaultShards = 32
+
+// Cache кэш баннеров по ключам "фича тег", от которого зависит обработчик.
+// Memory хранит записи в памяти процесса, Redis - в общем для реплик Redis-совместимом сервере
+type Cache interface {
+	Get(key string) (json.RawMessage, bool, bool)
+	// GetStale как Get, но после истечения в течение staleGrace отдает устаревшее значение с fresh = false
+	GetStale(key string) (value json.RawMessage, active, fresh, ok bool)
+	Set(key string, isActive bool, value json.RawMessage)
+	// SetUntil сохраняет значение, которое истекает не позже until
+	SetUntil(key string, isActive bool, value json.RawMessage, until time.Time)
+	Delete(keys []string)
+	Stats() Stats
+	Entries() []Entry
+	// Purge удаляет один ключ, false если ключа не было
+	Purge(key string) bool
+	// Flush удаляет все ключи и возвращает их количество
+	Flush() (removed int)
+	// Generation возвращает поколение фичи, которое входит в ключи ее баннеров. При ошибке
+	// поколение неизвестно, и ключи фичи нельзя ни читать, ни записывать
+	Generation(featureId int) (uint64, error)
+	// NextGeneration увеличивает поколения фич, после чего прежние ключи их баннеров больше не читаются
+	NextGeneration(featureIds []int)
+}
+
+var (
+	_ Cache = (*Memory)(nil)
+	_ Cache = (*Redis)(nil)
+)
+
+// Memory кэш в памяти процесса. Ключи распределяются по сегментам
+// с независимыми блокировками, поэтому запросы к разным ключам не ждут друг друга.
+// Ограничения maxEntries и maxBytes делятся между сегментами поровну, при их превышении
+// политика сегмента выбирает вытесняемые ключи
+type Memory struct {
+	shards            []*shard
+	mask              uint64
 	defaultExpiration time.Duration
+	staleGrace        time.Duration
 	cleanupInterval   time.Duration
-	countGlobal       int
+	shardCount        int
+	maxEntries        int
+	maxBytes          int64
+	policy            PolicyFactory
+	generations       generations
+}
+
+type shard struct {
+	mu         sync.Mutex
+	items      map[string]Item
+	policy     Policy
+	maxEntries int
+	maxBytes   int64
+	bytes      int64
+	stats      Stats
 }
 
+// Item запись кэша. После Expiration значение устарело, но до StaleUntil еще может
+// отдаваться через GetStale, пока оно обновляется
 type Item struct {
-	Value      map[string]string
+	Value      json.RawMessage
 	Count      int
 	Expiration int64
+	StaleUntil int64
 	Active     bool
 }
 
-func New(defaultExpiration, cleanupInterval time.Duration) *Cache {
+// Stats счетчики кэша. Errors - неудачные обращения к внешнему хранилищу кэша, они считаются промахами
+type Stats struct {
+	Hits        uint64 `json:"hits"`
+	StaleHits   uint64 `json:"stale_hits"`
+	Misses      uint64 `json:"misses"`
+	Evictions   uint64 `json:"evictions"`
+	Expirations uint64 `json:"expirations"`
+	Errors      uint64 `json:"errors"`
+	Entries     int    `json:"entries"`
+	Bytes       int64  `json:"bytes"`
+}
+
+// Option дополнительная настройка Memory
+type Option func(c *Memory)
+
+// WithShards задает количество сегментов, оно округляется вверх до степени двойки
+func WithShards(n int) Option {
+	return func(c *Memory) {
+		c.shardCount = n
+	}
+}
+
+// WithMaxEntries ограничивает количество ключей, 0 не ограничивает
+func WithMaxEntries(n int) Option {
+	return func(c *Memory) {
+		c.maxEntries = n
+	}
+}
+
+// WithMaxBytes ограничивает суммарный размер ключей и значений в байтах, 0 не ограничивает
+func WithMaxBytes(n int64) Option {
+	return func(c *Memory) {
+		c.maxBytes = n
+	}
+}
+
+// WithStaleGrace задает, сколько после истечения defaultExpiration значение еще отдается через GetStale.
+// Значения, срок которых ограничен SetUntil, после until не отдаются
+func WithStaleGrace(d time.Duration) Option {
+	return func(c *Memory) {
+		c.staleGrace = d
+	}
+}
+
+// WithPolicy задает политику вытеснения, по умолчанию LRU
+func WithPolicy(policy PolicyFactory) Option {
+	return func(c *Memory) {
+		c.policy = policy
+	}
+}
 
-	items := make(map[string]Item)
+func New(defaultExpiration, cleanupInterval time.Duration, opts ...Option) *Memory {
 
-	cache := Cache{
-		items:             items,
+	cache := Memory{
 		defaultExpiration: defaultExpiration,
 		cleanupInterval:   cleanupInterval,
-		countGlobal:       0,
+		shardCount:        DefaultShards,
+		policy:            func(int) Policy { return NewLRU() },
+		generations:       generations{values: map[int]uint64{}},
 	}
 
+	for _, opt := range opts {
+		opt(&cache)
+	}
+	cache.shards = cache.newShards()
+	cache.mask = uint64(len(cache.shards) - 1)
+
 	if cleanupInterval > 0 {
 		cache.StartGC()
 	}
@@ -38,118 +150,286 @@ func New(defaultExpiration, cleanupInterval time.Duration) *Cache {
 	return &cache
 }
 
-func (c *Cache) Set(key string, isActive bool, value map[string]string) {
-	expiration := time.Now().Add(c.defaultExpiration).UnixNano()
-	c.rwMux.Lock()
+func (c *Memory) newShards() []*shard {
+	size := 1
+	for size < c.shardCount {
+		size <<= 1
+	}
 
-	c.countGlobal++
+	// ограничения округляются вверх, чтобы у каждого сегмента было место хотя бы под один ключ
+	var maxEntries int
+	if c.maxEntries > 0 {
+		maxEntries = (c.maxEntries + size - 1) / size
+	}
+	var maxBytes int64
+	if c.maxBytes > 0 {
+		maxBytes = (c.maxBytes + int64(size) - 1) / int64(size)
+	}
 
-	item, ok := c.items[key]
-	if !ok {
-		c.items[key] = Item{
-			Value:      value,
-			Expiration: expiration,
-			Active:     isActive,
-			Count:      1,
+	shards := make([]*shard, size)
+	for i := range shards {
+		shards[i] = &shard{
+			items:      make(map[string]Item),
+			policy:     c.policy(maxEntries),
+			maxEntries: maxEntries,
+			maxBytes:   maxBytes,
 		}
 	}
-	item.Value = value
-	c.rwMux.Unlock()
-	if len(c.items) >= 20 {
-		if keys := c.expiredKeys(); len(keys) != 0 {
-			c.clearItems(keys)
+
+	return shards
+}
+
+// shard выбирает сегмент ключа по хешу
+func (c *Memory) shard(key string) *shard {
+	return c.shards[hashKey(key)&c.mask]
+}
+
+func (c *Memory) Set(key string, isActive bool, value json.RawMessage) {
+	c.SetUntil(key, isActive, value, time.Time{})
+}
+
+// SetUntil сохраняет значение, которое истекает не позже until.
+// Нулевой until не ограничивает срок жизни сверх defaultExpiration
+func (c *Memory) SetUntil(key string, isActive bool, value json.RawMessage, until time.Time) {
+	expiration := time.Now().Add(c.defaultExpiration).UnixNano()
+	staleUntil := expiration + int64(c.staleGrace)
+	if !until.IsZero() {
+		if !until.After(time.Now()) {
+			return
+		}
+		if until.UnixNano() < staleUntil {
+			staleUntil = until.UnixNano()
+		}
+		if until.UnixNano() < expiration {
+			expiration = until.UnixNano()
 		}
 	}
+
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	item, ok := s.items[key]
+	if ok {
+		s.bytes -= itemSize(key, item)
+		s.policy.Access(key)
+	} else {
+		s.policy.Add(key)
+	}
+	item.Value = value
+	item.Expiration = expiration
+	item.StaleUntil = staleUntil
+	item.Active = isActive
+	s.items[key] = item
+	s.bytes += itemSize(key, item)
+
+	s.evict()
 }
 
-func (c *Cache) Get(key string) (map[string]string, bool, bool) {
+func (c *Memory) Get(key string) (json.RawMessage, bool, bool) {
+	value, active, _, ok := c.get(key, false)
+	return value, active, ok
+}
+
+// GetStale как Get, но в течение staleGrace после истечения отдает устаревшее значение с fresh = false,
+// чтобы вызывающий отдал его и обновил запись
+func (c *Memory) GetStale(key string) (value json.RawMessage, active, fresh, ok bool) {
+	return c.get(key, true)
+}
 
-	c.rwMux.RLock()
+func (c *Memory) get(key string, allowStale bool) (value json.RawMessage, active, fresh, ok bool) {
 
-	defer c.rwMux.RUnlock()
+	s := c.shard(key)
+	s.mu.Lock()
 
-	item, found := c.items[key]
+	defer s.mu.Unlock()
+
+	item, found := s.items[key]
 
 	if !found {
-		return nil, false, false
+		s.stats.Misses++
+		return nil, false, false, false
 	}
 
-	if item.Expiration > 0 {
-		if time.Now().UnixNano() > item.Expiration {
-			return nil, false, false
-		}
+	now := time.Now().UnixNano()
+	if item.StaleUntil > 0 && now > item.StaleUntil {
+		s.remove(key, item)
+		s.stats.Expirations++
+		s.stats.Misses++
+		return nil, false, false, false
+	}
 
+	if item.Expiration > 0 && now > item.Expiration {
+		s.stats.Misses++
+		if !allowStale {
+			return nil, false, false, false
+		}
+		s.stats.StaleHits++
+		return item.Value, item.Active, false, true
 	}
 
 	item.Count++
-	c.countGlobal++
+	s.items[key] = item
+	s.policy.Access(key)
+	s.stats.Hits++
 
-	return item.Value, item.Active, true
+	return item.Value, item.Active, true, true
 }
 
-func (c *Cache) Delete(keys []string) {
-
-	c.rwMux.Lock()
-
-	defer c.rwMux.Unlock()
+func (c *Memory) Delete(keys []string) {
 
-	for _, key := range keys {
-		if _, found := c.items[key]; !found {
-			return
+	for _, k := range keys {
+		s := c.shard(k)
+		s.mu.Lock()
+		if item, ok := s.items[k]; ok {
+			s.remove(k, item)
 		}
+		s.mu.Unlock()
+	}
+}
 
-		delete(c.items, key)
+// Stats возвращает счетчики, просуммированные по сегментам
+func (c *Memory) Stats() Stats {
+	var stats Stats
+
+	for _, s := range c.shards {
+		s.mu.Lock()
+		stats.Hits += s.stats.Hits
+		stats.StaleHits += s.stats.StaleHits
+		stats.Misses += s.stats.Misses
+		stats.Evictions += s.stats.Evictions
+		stats.Expirations += s.stats.Expirations
+		stats.Entries += len(s.items)
+		stats.Bytes += s.bytes
+		s.mu.Unlock()
 	}
+
+	return stats
 }
 
-func (c *Cache) StartGC() {
-	go c.GC()
+// Entry описание ключа кэша для просмотра администратором
+type Entry struct {
+	Key        string    `json:"key"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	StaleUntil time.Time `json:"stale_until"`
+	Hits       int       `json:"hits"`
+	Active     bool      `json:"active"`
+	Bytes      int64     `json:"bytes"`
 }
 
-func (c *Cache) GC() {
+// Entries возвращает ключи, которые еще могут быть отданы, отсортированные по имени
+func (c *Memory) Entries() []Entry {
+	entries := []Entry{}
+	now := time.Now().UnixNano()
 
-	for {
-		select {
-		case <-time.After(c.cleanupInterval):
-			if c.items == nil {
-				return
-			}
-			if keys := c.expiredKeys(); len(keys) != 0 {
-				c.clearItems(keys)
+	for _, s := range c.shards {
+		s.mu.Lock()
+		for k, i := range s.items {
+			if i.StaleUntil > 0 && now > i.StaleUntil {
+				continue
 			}
+			entries = append(entries, Entry{
+				Key:        k,
+				ExpiresAt:  time.Unix(0, i.Expiration).UTC(),
+				StaleUntil: time.Unix(0, i.StaleUntil).UTC(),
+				Hits:       i.Count,
+				Active:     i.Active,
+				Bytes:      itemSize(k, i),
+			})
 		}
+		s.mu.Unlock()
 	}
+
+	sortEntries(entries)
+
+	return entries
+}
+
+func sortEntries(entries []Entry) {
+	slices.SortFunc(entries, func(a, b Entry) int { return strings.Compare(a.Key, b.Key) })
 }
 
-func (c *Cache) expiredKeys() (keys []string) {
-	c.rwMux.RLock()
+// Purge удаляет один ключ, false если ключа не было
+func (c *Memory) Purge(key string) bool {
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	defer c.rwMux.RUnlock()
+	item, ok := s.items[key]
+	if ok {
+		s.remove(key, item)
+	}
+
+	return ok
+}
 
-	for k, i := range c.items {
-		if (time.Now().UnixNano() > i.Expiration && i.Expiration > 0) || !check(i.Count, c.countGlobal) {
-			keys = append(keys, k)
+// Flush удаляет все ключи и возвращает их количество. Счетчики попаданий и промахов и поколения фич сохраняются
+func (c *Memory) Flush() (removed int) {
+	for _, s := range c.shards {
+		s.mu.Lock()
+		for k, i := range s.items {
+			s.remove(k, i)
+			removed++
 		}
-		i.Count = 0
+		s.mu.Unlock()
 	}
-	c.countGlobal = 0
 
-	return
+	return removed
 }
 
-func (c *Cache) clearItems(keys []string) {
+func (c *Memory) StartGC() {
+	go c.GC()
+}
 
-	c.rwMux.Lock()
+func (c *Memory) GC() {
 
-	defer c.rwMux.Unlock()
+	for {
+		select {
+		case <-time.After(c.cleanupInterval):
+			c.deleteExpired()
+		}
+	}
+}
 
-	for _, k := range keys {
+// deleteExpired удаляет ключи, которые истекли и больше не отдаются как устаревшие
+func (c *Memory) deleteExpired() {
+	now := time.Now().UnixNano()
 
-		delete(c.items, k)
+	for _, s := range c.shards {
+		s.mu.Lock()
+		for k, i := range s.items {
+			if i.StaleUntil > 0 && now > i.StaleUntil {
+				s.remove(k, i)
+				s.stats.Expirations++
+			}
+		}
+		s.mu.Unlock()
 	}
 }
 
-func check(count int, globalCount int) bool {
-	checkCount := float64(count) / float64(globalCount)
-	return checkCount >= 0.2
+// evict вытесняет ключи по политике, пока сегмент превышает ограничения
+func (s *shard) evict() {
+	for (s.maxEntries > 0 && len(s.items) > s.maxEntries) || (s.maxBytes > 0 && s.bytes > s.maxBytes) {
+		key, ok := s.policy.Evict()
+		if !ok {
+			return
+		}
+
+		if item, ok := s.items[key]; ok {
+			delete(s.items, key)
+			s.bytes -= itemSize(key, item)
+			s.stats.Evictions++
+		}
+	}
+}
+
+func (s *shard) remove(key string, item Item) {
+	delete(s.items, key)
+	s.bytes -= itemSize(key, item)
+	s.policy.Remove(key)
+}
+
+// itemSize размер записи, учитываемый ограничением maxBytes
+func itemSize(key string, item Item) int64 {
+	return int64(len(key) + len(item.Value))
 }
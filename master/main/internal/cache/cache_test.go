@@ -1,7 +1,11 @@
 package cache
 
 import (
+	"encoding/json"
+	"fmt"
 	"github.com/stretchr/testify/assert"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -13,16 +17,11 @@ const (
 
 // AppCache создание нового кэша
 var AppCache = New(1*time.Minute, 2*time.Minute)
-var AppCache1 = New(1*time.Minute, 2*time.Minute)
 
 // TestGet получить контент по ключу
 func TestGet(t *testing.T) {
 
-	testValue := map[string]string{
-		"test":  "test",
-		"test2": "test2",
-		"test3": "test3",
-	}
+	testValue := json.RawMessage(`{"test": "test", "nested": {"list": [1, 2.5, true, null]}}`)
 
 	AppCache.Set(testKey, true, testValue)
 
@@ -41,43 +40,264 @@ func TestGet(t *testing.T) {
 	}
 }
 
-// Проверка выстеснения
+// TestCache Проверка вытеснения: ключей не больше maxEntries, к которым обращались - остаются
 func TestCache(t *testing.T) {
-	testValue := map[string]int{
-		"a": 1,
-		"b": 1,
-		"c": 1,
-		"d": 1,
-		"e": 1,
-		"f": 1,
-		"g": 1,
-		"h": 1,
-		"i": 1,
-		"j": 1,
-		"k": 1,
-		"l": 1,
-		"m": 1,
-		"n": 1,
-		"o": 1,
-		"p": 1,
-		"q": 50,
-		"r": 50,
-		"s": 50,
-		"t": 50,
+	testMap := json.RawMessage(`{"test": "test", "test2": "test2", "test3": "test3"}`)
+	c := New(time.Minute, 0, WithShards(1), WithMaxEntries(4), WithPolicy(func(int) Policy { return NewLFU() }))
+
+	for _, key := range []string{"q", "r", "s", "t"} {
+		c.Set(key, true, testMap)
+		for i := 0; i < 50; i++ {
+			c.Get(key)
+		}
 	}
-	testMap := map[string]string{
-		"test":  "test",
-		"test2": "test2",
-		"test3": "test3",
+
+	for _, key := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		c.Set(key, true, testMap)
 	}
-	for key := range testValue {
-		AppCache1.Set(key, true, testMap)
+
+	for _, key := range []string{"q", "r", "s", "t"} {
+		_, _, ok := c.Get(key)
+		if !ok {
+			t.Error("Ошибка вытеснения: вытеснен часто запрашиваемый ключ", key)
+		}
 	}
 
-	for key := range testValue {
-		_, _, ok := AppCache1.Get(key)
-		if ok {
-			t.Error("Ошибка вытеснения")
+	stats := c.Stats()
+	assert.Equal(t, 4, stats.Entries)
+	assert.Equal(t, uint64(8), stats.Evictions)
+}
+
+// TestMaxBytes суммарный размер ключей и значений не превышает maxBytes
+func TestMaxBytes(t *testing.T) {
+	c := New(time.Minute, 0, WithShards(1), WithMaxBytes(100))
+
+	value := json.RawMessage(`{"title": "0123456789"}`)
+	for i := 0; i < 10; i++ {
+		c.Set(fmt.Sprintf("%d 1", i), true, value)
+	}
+
+	stats := c.Stats()
+	assert.LessOrEqual(t, stats.Bytes, int64(100))
+	assert.Equal(t, int64(stats.Entries*(3+len(value))), stats.Bytes)
+	assert.Equal(t, uint64(10-stats.Entries), stats.Evictions)
+
+	_, _, ok := c.Get("9 1")
+	assert.True(t, ok)
+	_, _, ok = c.Get("0 1")
+	assert.False(t, ok)
+}
+
+// TestStats попадания, промахи и истечения считаются
+func TestStats(t *testing.T) {
+	c := New(time.Minute, 0)
+
+	c.Set("1 1", true, json.RawMessage(`{}`))
+	c.SetUntil("1 2", true, json.RawMessage(`{}`), time.Now().Add(20*time.Millisecond))
+	c.Get("1 1")
+	c.Get("1 1")
+	c.Get("2 2")
+
+	time.Sleep(30 * time.Millisecond)
+	c.Get("1 2")
+
+	stats := c.Stats()
+	assert.Equal(t, uint64(2), stats.Hits)
+	assert.Equal(t, uint64(2), stats.Misses)
+	assert.Equal(t, uint64(1), stats.Expirations)
+	assert.Equal(t, 1, stats.Entries)
+
+	s := c.shard("1 1")
+	assert.Equal(t, 2, s.items["1 1"].Count)
+}
+
+// TestSetUntil значение не отдается после границы until и перезаписывается повторным Set
+func TestSetUntil(t *testing.T) {
+	c := New(time.Minute, 0)
+
+	c.SetUntil("window", true, json.RawMessage(`{"v": 1}`), time.Now().Add(50*time.Millisecond))
+	c.Set("window", true, json.RawMessage(`{"v": 2}`))
+
+	value, _, ok := c.Get("window")
+	assert.True(t, ok)
+	assert.JSONEq(t, `{"v": 2}`, string(value))
+
+	c.SetUntil("window", true, json.RawMessage(`{"v": 3}`), time.Now().Add(50*time.Millisecond))
+	_, _, ok = c.Get("window")
+	assert.True(t, ok)
+
+	time.Sleep(60 * time.Millisecond)
+	_, _, ok = c.Get("window")
+	assert.False(t, ok)
+
+	c.SetUntil("past", true, json.RawMessage(`{}`), time.Now().Add(-time.Second))
+	_, _, ok = c.Get("past")
+	assert.False(t, ok)
+}
+
+// TestDelete удаляются все найденные ключи, даже если часть ключей отсутствует
+func TestDelete(t *testing.T) {
+	c := New(time.Minute, 0)
+	c.Set("a", true, json.RawMessage(`{}`))
+	c.Set("c", true, json.RawMessage(`{}`))
+
+	c.Delete([]string{"a", "b", "c"})
+
+	_, _, ok := c.Get("a")
+	assert.False(t, ok)
+	_, _, ok = c.Get("c")
+	assert.False(t, ok)
+}
+
+// TestShards количество сегментов округляется до степени двойки, а ключи распределяются по ним
+func TestShards(t *testing.T) {
+	c := New(time.Minute, 0, WithShards(5))
+	assert.Len(t, c.shards, 8)
+
+	used := map[*shard]bool{}
+	for i := 0; i < 16; i++ {
+		key := fmt.Sprintf("%d %d", i, i)
+		c.Set(key, true, json.RawMessage(`{}`))
+		used[c.shard(key)] = true
+
+		_, _, ok := c.Get(key)
+		assert.True(t, ok)
+	}
+	assert.Greater(t, len(used), 1)
+
+	assert.Len(t, New(time.Minute, 0, WithShards(0)).shards, 1)
+}
+
+// TestConcurrentAccess параллельные Set, Get и Delete не теряют значения и не гоняются за данными
+func TestConcurrentAccess(t *testing.T) {
+	c := New(time.Minute, 0)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			key := fmt.Sprintf("%d 1", g)
+			for i := 0; i < 1000; i++ {
+				c.Set(key, true, json.RawMessage(`{}`))
+				_, _, ok := c.Get(key)
+				assert.True(t, ok)
+				if i%100 == 0 {
+					c.Delete([]string{key})
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+}
+
+// benchmarkKeys ключи бенчмарков, кэш не ограничен, поэтому бенчмарк измеряет только блокировки
+var benchmarkKeys = func() []string {
+	keys := make([]string, 16)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("%d %d", i+1, i+1)
+	}
+	return keys
+}()
+
+// Запуск: go test -bench . -cpu 1,2,4,8 ./internal/cache.
+// Сравнивает один сегмент (прежняя единая блокировка) с DefaultShards при разном GOMAXPROCS
+func BenchmarkGet(b *testing.B) {
+	benchmarkShards(b, func(c *Memory, i int) {
+		c.Get(benchmarkKeys[i%len(benchmarkKeys)])
+	})
+}
+
+func BenchmarkSet(b *testing.B) {
+	value := json.RawMessage(`{"title": "some_title"}`)
+	benchmarkShards(b, func(c *Memory, i int) {
+		c.Set(benchmarkKeys[i%len(benchmarkKeys)], true, value)
+	})
+}
+
+// BenchmarkMixed 90% чтений и 10% записей, как у /user_banner
+func BenchmarkMixed(b *testing.B) {
+	value := json.RawMessage(`{"title": "some_title"}`)
+	benchmarkShards(b, func(c *Memory, i int) {
+		key := benchmarkKeys[i%len(benchmarkKeys)]
+		if i%10 == 0 {
+			c.Set(key, true, value)
+			return
 		}
+		c.Get(key)
+	})
+}
+
+func benchmarkShards(b *testing.B, op func(c *Memory, i int)) {
+	for _, shards := range []int{1, DefaultShards} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			c := New(time.Minute, 0, WithShards(shards))
+			for _, key := range benchmarkKeys {
+				c.Set(key, true, json.RawMessage(`{}`))
+			}
+
+			var next atomic.Int64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := int(next.Add(1)) * 7
+				for pb.Next() {
+					op(c, i)
+					i++
+				}
+			})
+		})
 	}
 }
+
+// TestEntriesPurgeFlush ключи видны с числом попаданий, удаляются по одному и целиком
+func TestEntriesPurgeFlush(t *testing.T) {
+	c := New(time.Minute, 0)
+
+	c.Set("2 1", true, json.RawMessage(`{}`))
+	c.Set("1 1", false, json.RawMessage(`{}`))
+	c.Get("2 1")
+
+	entries := c.Entries()
+	assert.Len(t, entries, 2)
+	assert.Equal(t, "1 1", entries[0].Key)
+	assert.False(t, entries[0].Active)
+	assert.Equal(t, 1, entries[1].Hits)
+	assert.Equal(t, int64(5), entries[1].Bytes)
+
+	assert.True(t, c.Purge("1 1"))
+	assert.False(t, c.Purge("1 1"))
+
+	assert.Equal(t, 1, c.Flush())
+	assert.Empty(t, c.Entries())
+	assert.Equal(t, uint64(1), c.Stats().Hits)
+}
+
+// TestGetStale после истечения значение отдается как устаревшее до конца staleGrace, но не после until
+func TestGetStale(t *testing.T) {
+	c := New(20*time.Millisecond, 0, WithStaleGrace(time.Minute))
+
+	c.Set("1 1", true, json.RawMessage(`{"v": 1}`))
+	c.SetUntil("1 2", true, json.RawMessage(`{}`), time.Now().Add(10*time.Millisecond))
+
+	_, _, fresh, ok := c.GetStale("1 1")
+	assert.True(t, ok)
+	assert.True(t, fresh)
+
+	time.Sleep(30 * time.Millisecond)
+
+	value, _, fresh, ok := c.GetStale("1 1")
+	assert.True(t, ok)
+	assert.False(t, fresh)
+	assert.JSONEq(t, `{"v": 1}`, string(value))
+
+	_, _, ok = c.Get("1 1")
+	assert.False(t, ok)
+
+	_, _, _, ok = c.GetStale("1 2")
+	assert.False(t, ok)
+
+	c.Set("1 1", true, json.RawMessage(`{"v": 2}`))
+	_, _, fresh, _ = c.GetStale("1 1")
+	assert.True(t, fresh)
+	assert.Equal(t, uint64(1), c.Stats().StaleHits)
+}
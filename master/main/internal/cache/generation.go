@@ -0,0 +1,62 @@
+package cache
+
+import "sync"
+
+// generations поколения фич, которые входят в ключи их баннеров. Они хранятся отдельно от записей:
+// не вытесняются, не истекают, не учитываются ограничениями и не попадают в Entries
+type generations struct {
+	mu     sync.Mutex
+	values map[int]uint64
+}
+
+func (g *generations) get(featureId int) uint64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.values[featureId]
+}
+
+func (g *generations) next(featureIds []int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for _, featureId := range featureIds {
+		g.values[featureId]++
+	}
+}
+
+// snapshot копия поколений для снимка
+func (g *generations) snapshot() map[int]uint64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	res := make(map[int]uint64, len(g.values))
+	for featureId, generation := range g.values {
+		res[featureId] = generation
+	}
+
+	return res
+}
+
+// restore поднимает поколения до сохраненных в снимке, но не уменьшает их,
+// чтобы ключи, записанные до восстановления, не читались снова
+func (g *generations) restore(values map[int]uint64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for featureId, generation := range values {
+		if generation > g.values[featureId] {
+			g.values[featureId] = generation
+		}
+	}
+}
+
+// Generation возвращает поколение фичи, 0 если его еще не увеличивали. Ошибок у кэша в памяти нет
+func (c *Memory) Generation(featureId int) (uint64, error) {
+	return c.generations.get(featureId), nil
+}
+
+// NextGeneration увеличивает поколения фич. Прежние ключи их баннеров больше не читаются и истекают сами
+func (c *Memory) NextGeneration(featureIds []int) {
+	c.generations.next(featureIds)
+}
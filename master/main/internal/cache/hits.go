@@ -0,0 +1,62 @@
+package cache
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"slices"
+)
+
+// hitCount число попаданий ключа на момент сохранения
+type hitCount struct {
+	Key  string `json:"key"`
+	Hits int    `json:"hits"`
+}
+
+// SaveHits сохраняет в path до limit самых запрашиваемых активных ключей, чтобы после
+// перезапуска прогреть ими кэш. Файл заменяется целиком, поэтому прерванная запись не портит прошлый
+func SaveHits(path string, entries []Entry, limit int) error {
+	hits := make([]hitCount, 0, len(entries))
+	for _, e := range entries {
+		if e.Active && e.Hits > 0 {
+			hits = append(hits, hitCount{Key: e.Key, Hits: e.Hits})
+		}
+	}
+
+	slices.SortStableFunc(hits, func(a, b hitCount) int { return b.Hits - a.Hits })
+	if limit > 0 && len(hits) > limit {
+		hits = hits[:limit]
+	}
+
+	data, err := json.Marshal(hits)
+	if err != nil {
+		return err
+	}
+
+	return writeFile(path, data)
+}
+
+// LoadHits возвращает ключи, сохраненные SaveHits, от самых запрашиваемых.
+// Если файла нет, возвращает пустой список
+func LoadHits(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var hits []hitCount
+	if err = json.Unmarshal(data, &hits); err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, len(hits))
+	for i, h := range hits {
+		keys[i] = h.Key
+	}
+
+	return keys, nil
+}
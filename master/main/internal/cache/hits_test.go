@@ -0,0 +1,34 @@
+package cache
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestSaveLoadHits сохраняются только активные ключи с попаданиями, от самых запрашиваемых, не больше limit
+func TestSaveLoadHits(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hits.json")
+
+	keys, err := LoadHits(path)
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+
+	require.NoError(t, SaveHits(path, []Entry{
+		{Key: "1 1", Hits: 2, Active: true},
+		{Key: "1 2", Hits: 9, Active: true},
+		{Key: "1 3", Hits: 50, Active: false},
+		{Key: "1 4", Hits: 0, Active: true},
+		{Key: "1 5", Hits: 5, Active: true},
+	}, 2))
+
+	keys, err = LoadHits(path)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1 2", "1 5"}, keys)
+
+	require.NoError(t, os.WriteFile(path, []byte("{"), 0o644))
+	_, err = LoadHits(path)
+	assert.Error(t, err)
+}
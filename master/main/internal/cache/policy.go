@@ -0,0 +1,346 @@
+package cache
+
+import (
+	"container/list"
+	"fmt"
+)
+
+const (
+	// PolicyLRU вытесняется ключ, к которому дольше всех не обращались
+	PolicyLRU = "lru"
+	// PolicyLFU вытесняется ключ с наименьшим числом обращений, среди равных - давний
+	PolicyLFU = "lfu"
+	// PolicyTinyLFU W-TinyLFU: новые ключи попадают в небольшое LRU окно и переходят
+	// в основную часть, только если обращались к ним чаще, чем к вытесняемому ключу
+	PolicyTinyLFU = "tinylfu"
+)
+
+// Policy политика вытеснения одного сегмента кэша.
+// Методы вызываются под блокировкой сегмента, поэтому реализации не обязаны быть потокобезопасными
+type Policy interface {
+	// Add отмечает новый ключ
+	Add(key string)
+	// Access отмечает обращение к ключу или его перезапись
+	Access(key string)
+	// Remove забывает ключ, удаленный из кэша не политикой
+	Remove(key string)
+	// Evict выбирает ключ для вытеснения и забывает его, ok = false если ключей нет
+	Evict() (key string, ok bool)
+}
+
+// PolicyFactory создает политику сегмента. capacity - наибольшее число ключей сегмента, 0 если не ограничено
+type PolicyFactory func(capacity int) Policy
+
+// PolicyByName возвращает политику по имени из конфигурации
+func PolicyByName(name string) (PolicyFactory, error) {
+	switch name {
+	case "", PolicyLRU:
+		return func(int) Policy { return NewLRU() }, nil
+	case PolicyLFU:
+		return func(int) Policy { return NewLFU() }, nil
+	case PolicyTinyLFU:
+		return func(capacity int) Policy { return NewTinyLFU(capacity) }, nil
+	default:
+		return nil, fmt.Errorf("unknown cache policy %q", name)
+	}
+}
+
+// lru список ключей от недавних к давним
+type lru struct {
+	order *list.List
+	keys  map[string]*list.Element
+}
+
+func newLRU() *lru {
+	return &lru{order: list.New(), keys: map[string]*list.Element{}}
+}
+
+func (l *lru) Len() int {
+	return l.order.Len()
+}
+
+func (l *lru) Contains(key string) bool {
+	_, ok := l.keys[key]
+	return ok
+}
+
+func (l *lru) Add(key string) {
+	l.keys[key] = l.order.PushFront(key)
+}
+
+func (l *lru) Access(key string) {
+	if e, ok := l.keys[key]; ok {
+		l.order.MoveToFront(e)
+	}
+}
+
+func (l *lru) Remove(key string) {
+	if e, ok := l.keys[key]; ok {
+		l.order.Remove(e)
+		delete(l.keys, key)
+	}
+}
+
+// Oldest возвращает самый давний ключ, не удаляя его
+func (l *lru) Oldest() (string, bool) {
+	e := l.order.Back()
+	if e == nil {
+		return "", false
+	}
+	return e.Value.(string), true
+}
+
+func (l *lru) Evict() (string, bool) {
+	key, ok := l.Oldest()
+	if ok {
+		l.Remove(key)
+	}
+	return key, ok
+}
+
+// NewLRU создает политику LRU
+func NewLRU() Policy {
+	return newLRU()
+}
+
+// lfu ключи сгруппированы по числу обращений, внутри группы от недавних к давним
+type lfu struct {
+	freqs   map[int]*lru
+	keys    map[string]int
+	minFreq int
+}
+
+// NewLFU создает политику LFU
+func NewLFU() Policy {
+	return &lfu{freqs: map[int]*lru{}, keys: map[string]int{}}
+}
+
+func (l *lfu) Add(key string) {
+	l.keys[key] = 1
+	l.bucket(1).Add(key)
+	l.minFreq = 1
+}
+
+func (l *lfu) Access(key string) {
+	freq, ok := l.keys[key]
+	if !ok {
+		return
+	}
+
+	l.freqs[freq].Remove(key)
+	if l.freqs[freq].Len() == 0 {
+		delete(l.freqs, freq)
+		if l.minFreq == freq {
+			l.minFreq++
+		}
+	}
+
+	l.keys[key] = freq + 1
+	l.bucket(freq + 1).Add(key)
+}
+
+func (l *lfu) Remove(key string) {
+	freq, ok := l.keys[key]
+	if !ok {
+		return
+	}
+
+	delete(l.keys, key)
+	l.freqs[freq].Remove(key)
+	if l.freqs[freq].Len() == 0 {
+		delete(l.freqs, freq)
+	}
+}
+
+func (l *lfu) Evict() (string, bool) {
+	if len(l.keys) == 0 {
+		return "", false
+	}
+
+	// после Remove minFreq может указывать на пустую группу
+	for l.freqs[l.minFreq] == nil {
+		l.minFreq++
+	}
+
+	key, _ := l.freqs[l.minFreq].Oldest()
+	l.Remove(key)
+	return key, true
+}
+
+func (l *lfu) bucket(freq int) *lru {
+	b, ok := l.freqs[freq]
+	if !ok {
+		b = newLRU()
+		l.freqs[freq] = b
+	}
+	return b
+}
+
+// tinyLFU W-TinyLFU: окно LRU на 1% емкости и основная часть SLRU (испытательный
+// и защищенный сегменты, 80% основной части). Частоты ключей, включая уже вытесненные,
+// оцениваются по count-min sketch
+type tinyLFU struct {
+	window       *lru
+	probation    *lru
+	protected    *lru
+	sketch       *sketch
+	windowCap    int
+	mainCap      int
+	protectedCap int
+}
+
+// NewTinyLFU создает политику W-TinyLFU для сегмента емкостью capacity ключей.
+// При capacity = 0 основная часть не ограничена, и ключи вытесняются только по объему
+func NewTinyLFU(capacity int) Policy {
+	t := &tinyLFU{
+		window:    newLRU(),
+		probation: newLRU(),
+		protected: newLRU(),
+		windowCap: max(1, capacity/100),
+		sketch:    newSketch(max(capacity, 1024)),
+	}
+	if capacity > 0 {
+		t.mainCap = max(1, capacity-t.windowCap)
+		t.protectedCap = max(1, t.mainCap*8/10)
+	}
+
+	return t
+}
+
+func (t *tinyLFU) Add(key string) {
+	t.sketch.Increment(key)
+	t.window.Add(key)
+}
+
+func (t *tinyLFU) Access(key string) {
+	t.sketch.Increment(key)
+
+	switch {
+	case t.window.Contains(key):
+		t.window.Access(key)
+	case t.probation.Contains(key):
+		t.probation.Remove(key)
+		t.protected.Add(key)
+		if t.protectedCap > 0 && t.protected.Len() > t.protectedCap {
+			demoted, _ := t.protected.Evict()
+			t.probation.Add(demoted)
+		}
+	case t.protected.Contains(key):
+		t.protected.Access(key)
+	}
+}
+
+func (t *tinyLFU) Remove(key string) {
+	t.window.Remove(key)
+	t.probation.Remove(key)
+	t.protected.Remove(key)
+}
+
+func (t *tinyLFU) Evict() (string, bool) {
+	for t.window.Len() > t.windowCap {
+		candidate, _ := t.window.Oldest()
+
+		if t.mainCap == 0 || t.probation.Len()+t.protected.Len() < t.mainCap {
+			t.window.Remove(candidate)
+			t.probation.Add(candidate)
+			continue
+		}
+
+		victim, ok := t.probation.Oldest()
+		if !ok {
+			victim, _ = t.protected.Oldest()
+		}
+
+		// кандидат из окна вытесняет ключ основной части, только если встречался чаще
+		if t.sketch.Estimate(candidate) > t.sketch.Estimate(victim) {
+			t.Remove(victim)
+			t.window.Remove(candidate)
+			t.probation.Add(candidate)
+			return victim, true
+		}
+
+		t.window.Remove(candidate)
+		return candidate, true
+	}
+
+	for _, l := range []*lru{t.probation, t.protected, t.window} {
+		if key, ok := l.Evict(); ok {
+			return key, true
+		}
+	}
+
+	return "", false
+}
+
+// sketch count-min sketch с 4-битными счетчиками. Когда число увеличений достигает
+// 10 * ширину, счетчики делятся пополам, чтобы старая популярность со временем забывалась
+type sketch struct {
+	rows      [4][]uint8
+	mask      uint64
+	additions int
+	resetAt   int
+}
+
+func newSketch(width int) *sketch {
+	size := 1
+	for size < width {
+		size <<= 1
+	}
+
+	s := &sketch{mask: uint64(size - 1), resetAt: 10 * size}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, size)
+	}
+
+	return s
+}
+
+func (s *sketch) Increment(key string) {
+	hash := hashKey(key)
+	for i := range s.rows {
+		idx := s.index(hash, i)
+		if s.rows[i][idx] < 15 {
+			s.rows[i][idx]++
+		}
+	}
+
+	s.additions++
+	if s.additions >= s.resetAt {
+		for i := range s.rows {
+			for j := range s.rows[i] {
+				s.rows[i][j] >>= 1
+			}
+		}
+		s.additions /= 2
+	}
+}
+
+func (s *sketch) Estimate(key string) uint8 {
+	hash := hashKey(key)
+	estimate := uint8(15)
+	for i := range s.rows {
+		estimate = min(estimate, s.rows[i][s.index(hash, i)])
+	}
+
+	return estimate
+}
+
+// index смешивает хеш с номером строки, чтобы строки использовали независимые позиции
+func (s *sketch) index(hash uint64, row int) uint64 {
+	h := hash + uint64(row)*0x9e3779b97f4a7c15
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	return h & s.mask
+}
+
+// hashKey хеш FNV-1a
+func hashKey(key string) uint64 {
+	hash := uint64(14695981039346656037)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint64(key[i])
+		hash *= 1099511628211
+	}
+
+	return hash
+}
@@ -0,0 +1,103 @@
+package cache
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// evictAll возвращает ключи в порядке вытеснения
+func evictAll(p Policy) (keys []string) {
+	for {
+		key, ok := p.Evict()
+		if !ok {
+			return keys
+		}
+		keys = append(keys, key)
+	}
+}
+
+func TestLRU(t *testing.T) {
+	p := NewLRU()
+	for _, key := range []string{"a", "b", "c", "d"} {
+		p.Add(key)
+	}
+	p.Access("a")
+	p.Remove("c")
+
+	assert.Equal(t, []string{"b", "d", "a"}, evictAll(p))
+}
+
+func TestLFU(t *testing.T) {
+	p := NewLFU()
+	for _, key := range []string{"a", "b", "c", "d"} {
+		p.Add(key)
+	}
+	p.Access("a")
+	p.Access("a")
+	p.Access("c")
+	p.Access("d")
+	p.Remove("b")
+
+	// c и d обращались по разу, c раньше стал частым, поэтому вытесняется первым
+	assert.Equal(t, []string{"c", "d", "a"}, evictAll(p))
+
+	p.Add("e")
+	p.Access("e")
+	p.Remove("e")
+	p.Add("f")
+	assert.Equal(t, []string{"f"}, evictAll(p))
+}
+
+// TestTinyLFU частые ключи основной части не вытесняются потоком однократных ключей
+func TestTinyLFU(t *testing.T) {
+	p := NewTinyLFU(100)
+	size := 0
+	add := func(key string) (evicted []string) {
+		p.Add(key)
+		size++
+		for size > 100 {
+			victim, ok := p.Evict()
+			if !ok {
+				break
+			}
+			evicted = append(evicted, victim)
+			size--
+		}
+		return evicted
+	}
+
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("hot %d", i)
+		add(key)
+		for j := 0; j < 5; j++ {
+			p.Access(key)
+		}
+	}
+
+	var evicted []string
+	for i := 0; i < 1000; i++ {
+		evicted = append(evicted, add(fmt.Sprintf("scan %d", i))...)
+	}
+
+	hot := 0
+	for _, key := range evicted {
+		if key[:3] == "hot" {
+			hot++
+		}
+	}
+	assert.LessOrEqual(t, hot, 1)
+	assert.Len(t, evicted, 1000)
+
+}
+
+func TestPolicyByName(t *testing.T) {
+	for _, name := range []string{"", PolicyLRU, PolicyLFU, PolicyTinyLFU} {
+		factory, err := PolicyByName(name)
+		assert.NoError(t, err)
+		assert.NotNil(t, factory(10))
+	}
+
+	_, err := PolicyByName("fifo")
+	assert.Error(t, err)
+}
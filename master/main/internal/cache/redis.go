@@ -0,0 +1,301 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/redis/go-redis/v9"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultRedisPrefix префикс ключей кэша в Redis
+const DefaultRedisPrefix = "banner:"
+
+// redisGenerations ключ после префикса, под которым хранится хеш поколений фич.
+// Ключи баннеров начинаются с номера фичи, поэтому с ним не совпадают
+const redisGenerations = "#generations"
+
+// redisGet читает запись и, если она не истекла, увеличивает ее счетчик попаданий.
+// Возвращает значение, активность и признак свежести
+var redisGet = redis.NewScript(`
+local v = redis.call('HMGET', KEYS[1], 'value', 'active', 'expires')
+if not v[1] then
+	return false
+end
+local fresh = 0
+if tonumber(v[3]) >= tonumber(ARGV[1]) then
+	fresh = 1
+	redis.call('HINCRBY', KEYS[1], 'hits', 1)
+end
+return {v[1], v[2], fresh}
+`)
+
+// Redis кэш в Redis-совместимом сервере, общий для всех реплик. Запись - хеш с полями
+// value, active, expires, stale и hits, а сам ключ удаляется сервером в момент stale.
+// Поколения фич хранятся в одном хеше redisGenerations без срока жизни и не считаются записями.
+// Вытеснением по памяти управляет сервер (maxmemory-policy), поэтому Evictions не считаются.
+// Ошибки сервера не возвращаются вызывающему: чтение считается промахом, запись пропускается.
+// Исключение - Generation: без поколения обработчик обходит кэш
+type Redis struct {
+	client            redis.UniversalClient
+	prefix            string
+	defaultExpiration time.Duration
+	staleGrace        time.Duration
+
+	hits      atomic.Uint64
+	staleHits atomic.Uint64
+	misses    atomic.Uint64
+	errors    atomic.Uint64
+}
+
+// NewRedis создает кэш поверх клиента Redis. Пустой prefix заменяется на DefaultRedisPrefix
+func NewRedis(client redis.UniversalClient, prefix string, defaultExpiration, staleGrace time.Duration) *Redis {
+	if prefix == "" {
+		prefix = DefaultRedisPrefix
+	}
+
+	return &Redis{
+		client:            client,
+		prefix:            prefix,
+		defaultExpiration: defaultExpiration,
+		staleGrace:        staleGrace,
+	}
+}
+
+func (c *Redis) Set(key string, isActive bool, value json.RawMessage) {
+	c.SetUntil(key, isActive, value, time.Time{})
+}
+
+func (c *Redis) SetUntil(key string, isActive bool, value json.RawMessage, until time.Time) {
+	now := time.Now()
+	expiration := now.Add(c.defaultExpiration)
+	staleUntil := expiration.Add(c.staleGrace)
+	if !until.IsZero() {
+		if !until.After(now) {
+			return
+		}
+		if until.Before(staleUntil) {
+			staleUntil = until
+		}
+		if until.Before(expiration) {
+			expiration = until
+		}
+	}
+
+	ctx := context.Background()
+	k := c.prefix + key
+	_, err := c.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, k,
+			"value", string(value),
+			"active", isActive,
+			"expires", expiration.UnixMilli(),
+			"stale", staleUntil.UnixMilli())
+		pipe.PExpireAt(ctx, k, staleUntil)
+		return nil
+	})
+	if err != nil {
+		c.errors.Add(1)
+	}
+}
+
+func (c *Redis) Get(key string) (json.RawMessage, bool, bool) {
+	value, active, _, ok := c.get(key, false)
+	return value, active, ok
+}
+
+func (c *Redis) GetStale(key string) (value json.RawMessage, active, fresh, ok bool) {
+	return c.get(key, true)
+}
+
+func (c *Redis) get(key string, allowStale bool) (value json.RawMessage, active, fresh, ok bool) {
+	res, err := redisGet.Run(context.Background(), c.client, []string{c.prefix + key}, time.Now().UnixMilli()).Slice()
+	if err != nil {
+		if !errors.Is(err, redis.Nil) {
+			c.errors.Add(1)
+		}
+		c.misses.Add(1)
+		return nil, false, false, false
+	}
+
+	content, _ := res[0].(string)
+	activeFlag, _ := res[1].(string)
+	freshFlag, _ := res[2].(int64)
+
+	if freshFlag == 0 {
+		c.misses.Add(1)
+		if !allowStale {
+			return nil, false, false, false
+		}
+		c.staleHits.Add(1)
+		return json.RawMessage(content), activeFlag == "1", false, true
+	}
+
+	c.hits.Add(1)
+	return json.RawMessage(content), activeFlag == "1", true, true
+}
+
+func (c *Redis) Delete(keys []string) {
+	if len(keys) == 0 {
+		return
+	}
+
+	prefixed := make([]string, len(keys))
+	for i, key := range keys {
+		prefixed[i] = c.prefix + key
+	}
+
+	if err := c.client.Del(context.Background(), prefixed...).Err(); err != nil {
+		c.errors.Add(1)
+	}
+}
+
+// Stats возвращает счетчики этой реплики и количество записей, общее для всех реплик. Записи считаются
+// через DBSIZE без обхода ключей, поэтому кэшу нужна отдельная база Redis: в Entries попадают все ее ключи,
+// кроме хеша поколений. Размер записей не считается, Bytes всегда 0
+func (c *Redis) Stats() Stats {
+	ctx := context.Background()
+	var size, generations *redis.IntCmd
+	_, err := c.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		size = pipe.DBSize(ctx)
+		generations = pipe.Exists(ctx, c.prefix+redisGenerations)
+		return nil
+	})
+	if err != nil {
+		c.errors.Add(1)
+	}
+
+	return Stats{
+		Hits:      c.hits.Load(),
+		StaleHits: c.staleHits.Load(),
+		Misses:    c.misses.Load(),
+		Errors:    c.errors.Load(),
+		Entries:   int(size.Val() - generations.Val()),
+	}
+}
+
+func (c *Redis) Entries() []Entry {
+	ctx := context.Background()
+	entries := []Entry{}
+
+	keys, err := c.keys(ctx)
+	if err != nil {
+		c.errors.Add(1)
+		return entries
+	}
+
+	pipe := c.client.Pipeline()
+	cmds := make([]*redis.SliceCmd, len(keys))
+	for i, k := range keys {
+		cmds[i] = pipe.HMGet(ctx, k, "value", "active", "expires", "stale", "hits")
+	}
+	if _, err = pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		c.errors.Add(1)
+		return entries
+	}
+
+	for i, cmd := range cmds {
+		fields := cmd.Val()
+		if len(fields) != 5 || fields[0] == nil {
+			continue
+		}
+
+		value, _ := fields[0].(string)
+		key := strings.TrimPrefix(keys[i], c.prefix)
+		entries = append(entries, Entry{
+			Key:        key,
+			ExpiresAt:  time.UnixMilli(redisInt(fields[2])).UTC(),
+			StaleUntil: time.UnixMilli(redisInt(fields[3])).UTC(),
+			Hits:       int(redisInt(fields[4])),
+			Active:     fields[1] == "1",
+			Bytes:      int64(len(key) + len(value)),
+		})
+	}
+
+	sortEntries(entries)
+
+	return entries
+}
+
+func (c *Redis) Purge(key string) bool {
+	n, err := c.client.Del(context.Background(), c.prefix+key).Result()
+	if err != nil {
+		c.errors.Add(1)
+	}
+
+	return n > 0
+}
+
+// Flush удаляет все ключи кэша с префиксом, в том числе записанные другими репликами
+func (c *Redis) Flush() (removed int) {
+	ctx := context.Background()
+
+	keys, err := c.keys(ctx)
+	if err != nil {
+		c.errors.Add(1)
+		return 0
+	}
+	if len(keys) == 0 {
+		return 0
+	}
+
+	n, err := c.client.Del(ctx, keys...).Result()
+	if err != nil {
+		c.errors.Add(1)
+	}
+
+	return int(n)
+}
+
+// Generation возвращает поколение фичи, общее для всех реплик, и ошибку сервера, если его не удалось прочитать
+func (c *Redis) Generation(featureId int) (uint64, error) {
+	generation, err := c.client.HGet(context.Background(), c.prefix+redisGenerations, strconv.Itoa(featureId)).Uint64()
+	if errors.Is(err, redis.Nil) {
+		return 0, nil
+	}
+	if err != nil {
+		c.errors.Add(1)
+		return 0, err
+	}
+
+	return generation, nil
+}
+
+func (c *Redis) NextGeneration(featureIds []int) {
+	if len(featureIds) == 0 {
+		return
+	}
+
+	ctx := context.Background()
+	_, err := c.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, featureId := range featureIds {
+			pipe.HIncrBy(ctx, c.prefix+redisGenerations, strconv.Itoa(featureId), 1)
+		}
+		return nil
+	})
+	if err != nil {
+		c.errors.Add(1)
+	}
+}
+
+// keys возвращает ключи записей с префиксом кэша, обходя их через SCAN, чтобы не блокировать сервер.
+// Хеш поколений в них не входит
+func (c *Redis) keys(ctx context.Context) (keys []string, err error) {
+	iter := c.client.Scan(ctx, 0, c.prefix+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		if iter.Val() == c.prefix+redisGenerations {
+			continue
+		}
+		keys = append(keys, iter.Val())
+	}
+
+	return keys, iter.Err()
+}
+
+func redisInt(v any) int64 {
+	s, _ := v.(string)
+	n, _ := strconv.ParseInt(s, 10, 64)
+	return n
+}
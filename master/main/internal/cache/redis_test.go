@@ -0,0 +1,169 @@
+package cache
+
+import (
+	"encoding/json"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+// newTestRedis поднимает miniredis и возвращает кэш поверх него вместе с сервером
+func newTestRedis(t *testing.T, defaultExpiration, staleGrace time.Duration) (*Redis, *miniredis.Miniredis) {
+	t.Helper()
+
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+
+	return NewRedis(client, "", defaultExpiration, staleGrace), server
+}
+
+// TestBackends обе реализации Cache ведут себя одинаково
+func TestBackends(t *testing.T) {
+	// wait ждет d; miniredis удаляет ключи по сроку только при сдвиге своих часов
+	backends := map[string]func(t *testing.T) (c Cache, wait func(d time.Duration)){
+		"memory": func(t *testing.T) (Cache, func(time.Duration)) {
+			return New(20*time.Millisecond, 0, WithStaleGrace(time.Minute)), time.Sleep
+		},
+		"redis": func(t *testing.T) (Cache, func(time.Duration)) {
+			c, server := newTestRedis(t, 20*time.Millisecond, time.Minute)
+			return c, func(d time.Duration) {
+				time.Sleep(d)
+				server.FastForward(d)
+			}
+		},
+	}
+
+	for name, newCache := range backends {
+		t.Run(name, func(t *testing.T) {
+			c, wait := newCache(t)
+
+			_, _, ok := c.Get("1 1")
+			assert.False(t, ok)
+
+			c.Set("1 1", true, json.RawMessage(`{"v": 1}`))
+			c.Set("2 1", false, json.RawMessage(`{}`))
+			c.SetUntil("1 2", true, json.RawMessage(`{}`), time.Now().Add(10*time.Millisecond))
+			c.SetUntil("1 3", true, json.RawMessage(`{}`), time.Now().Add(-time.Second))
+
+			value, active, ok := c.Get("1 1")
+			require.True(t, ok)
+			assert.True(t, active)
+			assert.JSONEq(t, `{"v": 1}`, string(value))
+
+			_, active, ok = c.Get("2 1")
+			require.True(t, ok)
+			assert.False(t, active)
+
+			_, _, ok = c.Get("1 3")
+			assert.False(t, ok)
+
+			entries := c.Entries()
+			require.Len(t, entries, 3)
+			assert.Equal(t, "1 1", entries[0].Key)
+			assert.Equal(t, 1, entries[0].Hits)
+			assert.Equal(t, int64(11), entries[0].Bytes)
+
+			wait(30 * time.Millisecond)
+
+			_, _, ok = c.Get("1 1")
+			assert.False(t, ok)
+
+			value, _, fresh, ok := c.GetStale("1 1")
+			require.True(t, ok)
+			assert.False(t, fresh)
+			assert.JSONEq(t, `{"v": 1}`, string(value))
+
+			_, _, _, ok = c.GetStale("1 2")
+			assert.False(t, ok)
+
+			c.Set("1 1", true, json.RawMessage(`{"v": 2}`))
+			value, _, fresh, ok = c.GetStale("1 1")
+			require.True(t, ok)
+			assert.True(t, fresh)
+			assert.JSONEq(t, `{"v": 2}`, string(value))
+
+			c.Delete([]string{"2 1"})
+			_, _, _, ok = c.GetStale("2 1")
+			assert.False(t, ok)
+
+			assert.True(t, c.Purge("1 1"))
+			assert.False(t, c.Purge("1 1"))
+
+			c.Set("3 1", true, json.RawMessage(`{}`))
+			c.Set("3 2", true, json.RawMessage(`{}`))
+			assert.Equal(t, 2, c.Flush())
+			assert.Empty(t, c.Entries())
+
+			// поколения фич не считаются записями и переживают очистку
+			c.NextGeneration([]int{1, 1, 2})
+			assert.Empty(t, c.Entries())
+			assert.Zero(t, c.Flush())
+			for featureId, expected := range map[int]uint64{1: 2, 2: 1, 3: 0} {
+				generation, err := c.Generation(featureId)
+				require.NoError(t, err)
+				assert.Equal(t, expected, generation)
+			}
+
+			stats := c.Stats()
+			assert.Equal(t, uint64(3), stats.Hits)
+			assert.Equal(t, uint64(1), stats.StaleHits)
+			assert.Zero(t, stats.Errors)
+			assert.Zero(t, stats.Entries)
+		})
+	}
+}
+
+// TestRedisShared записи и поколения одной реплики видны другой, а удаление на одной реплике - на всех
+func TestRedisShared(t *testing.T) {
+	server := miniredis.RunT(t)
+	newReplica := func() *Redis {
+		client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+		t.Cleanup(func() { client.Close() })
+		return NewRedis(client, "test:", time.Minute, 0)
+	}
+	a, b := newReplica(), newReplica()
+
+	a.Set("1 1", true, json.RawMessage(`{"v": 1}`))
+	value, _, ok := b.Get("1 1")
+	require.True(t, ok)
+	assert.JSONEq(t, `{"v": 1}`, string(value))
+
+	b.Delete([]string{"1 1"})
+	_, _, ok = a.Get("1 1")
+	assert.False(t, ok)
+
+	a.NextGeneration([]int{1})
+	generation, err := b.Generation(1)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), generation)
+
+	a.Set("1 1", true, json.RawMessage(`{}`))
+	assert.Equal(t, []string{"test:#generations", "test:1 1"}, server.Keys())
+}
+
+// TestRedisErrors при недоступном сервере чтение считается промахом, Generation возвращает ошибку,
+// а ошибки учитываются в Stats
+func TestRedisErrors(t *testing.T) {
+	c, server := newTestRedis(t, time.Minute, 0)
+	c.Set("1 1", true, json.RawMessage(`{}`))
+	c.NextGeneration([]int{1})
+	assert.Equal(t, 1, c.Stats().Entries)
+
+	server.Close()
+
+	_, _, ok := c.Get("1 1")
+	assert.False(t, ok)
+	c.Set("1 2", true, json.RawMessage(`{}`))
+	assert.False(t, c.Purge("1 1"))
+	_, err := c.Generation(1)
+	assert.Error(t, err)
+
+	stats := c.Stats()
+	assert.Equal(t, uint64(1), stats.Misses)
+	assert.Equal(t, uint64(5), stats.Errors)
+	assert.Zero(t, stats.Entries)
+}
@@ -0,0 +1,208 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// SnapshotVersion версия формата снимка. Снимки другой версии не читаются.
+// Во второй версии к записям добавлены поколения фич
+const SnapshotVersion = 2
+
+// snapshotMagic начало файла снимка
+var snapshotMagic = [4]byte{'B', 'C', 'S', 'N'}
+
+var (
+	ErrSnapshotCorrupt = errors.New("cache snapshot is corrupt")
+	ErrSnapshotVersion = errors.New("unsupported cache snapshot version")
+)
+
+// Snapshotter кэш, который сохраняется в снимок при остановке и восстанавливается из него при запуске.
+// Его реализует Memory, а Redis хранит записи на сервере и в снимке не нуждается
+type Snapshotter interface {
+	// WriteSnapshot записывает снимок всех записей со сроками жизни и числом попаданий и поколения фич
+	WriteSnapshot(w io.Writer) error
+	// ReadSnapshot загружает записи из снимка, кроме истекших, и возвращает их количество
+	ReadSnapshot(r io.Reader) (restored int, err error)
+}
+
+var _ Snapshotter = (*Memory)(nil)
+
+// snapshotHeader заголовок снимка, за ним следуют Length байт JSON snapshotPayload
+type snapshotHeader struct {
+	Magic    [4]byte
+	Version  uint32
+	Length   uint64
+	Checksum uint32
+}
+
+// snapshotPayload содержимое снимка: записи и поколения фич, на которые ссылаются их ключи
+type snapshotPayload struct {
+	Items       []snapshotItem `json:"items"`
+	Generations map[int]uint64 `json:"generations"`
+}
+
+type snapshotItem struct {
+	Key        string          `json:"key"`
+	Value      json.RawMessage `json:"value"`
+	Hits       int             `json:"hits"`
+	Expiration int64           `json:"expiration"`
+	StaleUntil int64           `json:"stale_until"`
+	Active     bool            `json:"active"`
+}
+
+// checksum CRC-32C содержимого снимка
+func checksum(data []byte) uint32 {
+	return crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli))
+}
+
+func (c *Memory) WriteSnapshot(w io.Writer) error {
+	items := []snapshotItem{}
+	for _, s := range c.shards {
+		s.mu.Lock()
+		for k, i := range s.items {
+			items = append(items, snapshotItem{
+				Key:        k,
+				Value:      i.Value,
+				Hits:       i.Count,
+				Expiration: i.Expiration,
+				StaleUntil: i.StaleUntil,
+				Active:     i.Active,
+			})
+		}
+		s.mu.Unlock()
+	}
+
+	payload, err := json.Marshal(snapshotPayload{Items: items, Generations: c.generations.snapshot()})
+	if err != nil {
+		return err
+	}
+
+	header := snapshotHeader{
+		Magic:    snapshotMagic,
+		Version:  SnapshotVersion,
+		Length:   uint64(len(payload)),
+		Checksum: checksum(payload),
+	}
+	if err = binary.Write(w, binary.BigEndian, header); err != nil {
+		return err
+	}
+
+	_, err = w.Write(payload)
+	return err
+}
+
+func (c *Memory) ReadSnapshot(r io.Reader) (restored int, err error) {
+	var header snapshotHeader
+	if err = binary.Read(r, binary.BigEndian, &header); err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrSnapshotCorrupt, err)
+	}
+	if header.Magic != snapshotMagic {
+		return 0, fmt.Errorf("%w: bad magic", ErrSnapshotCorrupt)
+	}
+	if header.Version != SnapshotVersion {
+		return 0, fmt.Errorf("%w: %d", ErrSnapshotVersion, header.Version)
+	}
+
+	var payload bytes.Buffer
+	n, err := io.CopyN(&payload, r, int64(header.Length))
+	if err != nil && !errors.Is(err, io.EOF) {
+		return 0, err
+	}
+	if uint64(n) != header.Length || checksum(payload.Bytes()) != header.Checksum {
+		return 0, fmt.Errorf("%w: checksum mismatch", ErrSnapshotCorrupt)
+	}
+
+	var snapshot snapshotPayload
+	if err = json.Unmarshal(payload.Bytes(), &snapshot); err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrSnapshotCorrupt, err)
+	}
+
+	c.generations.restore(snapshot.Generations)
+
+	now := time.Now().UnixNano()
+	for _, i := range snapshot.Items {
+		if i.Expiration > 0 && now > i.Expiration {
+			continue
+		}
+
+		c.restore(i.Key, Item{
+			Value:      i.Value,
+			Count:      i.Hits,
+			Expiration: i.Expiration,
+			StaleUntil: i.StaleUntil,
+			Active:     i.Active,
+		})
+		restored++
+	}
+
+	return restored, nil
+}
+
+// restore добавляет запись из снимка, если ключа еще нет в кэше
+func (c *Memory) restore(key string, item Item) {
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.items[key]; ok {
+		return
+	}
+
+	s.policy.Add(key)
+	s.items[key] = item
+	s.bytes += itemSize(key, item)
+
+	s.evict()
+}
+
+// SaveSnapshot сохраняет снимок кэша в path. Файл заменяется целиком, поэтому прерванная запись не портит прошлый
+func SaveSnapshot(path string, c Snapshotter) error {
+	var buf bytes.Buffer
+	if err := c.WriteSnapshot(&buf); err != nil {
+		return err
+	}
+
+	return writeFile(path, buf.Bytes())
+}
+
+// LoadSnapshot загружает снимок из path. Если файла нет, ничего не загружается
+func LoadSnapshot(path string, c Snapshotter) (restored int, err error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	return c.ReadSnapshot(f)
+}
+
+// writeFile записывает data во временный файл рядом с path и переименовывает его в path
+func writeFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,90 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestSnapshot записи восстанавливаются со сроками жизни и числом попаданий, истекшие отбрасываются, поколения фич сохраняются
+func TestSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.bin")
+
+	c := New(time.Minute, 0)
+	c.Set("1 1", true, json.RawMessage(`{"v": 1}`))
+	c.Set("1 2", false, json.RawMessage(`{}`))
+	c.SetUntil("1 3", true, json.RawMessage(`{}`), time.Now().Add(10*time.Millisecond))
+	c.Get("1 1")
+	c.Get("1 1")
+	c.NextGeneration([]int{1, 1, 2})
+	require.NoError(t, SaveSnapshot(path, c))
+
+	time.Sleep(20 * time.Millisecond)
+
+	restored := New(time.Minute, 0)
+	n, err := LoadSnapshot(path, restored)
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	entries := restored.Entries()
+	require.Len(t, entries, 2)
+	assert.Equal(t, "1 1", entries[0].Key)
+	assert.Equal(t, 2, entries[0].Hits)
+	assert.Equal(t, c.Entries()[0].ExpiresAt, entries[0].ExpiresAt)
+	assert.False(t, entries[1].Active)
+
+	assert.Equal(t, uint64(2), restored.generations.get(1))
+	assert.Equal(t, uint64(1), restored.generations.get(2))
+
+	value, _, ok := restored.Get("1 1")
+	require.True(t, ok)
+	assert.JSONEq(t, `{"v": 1}`, string(value))
+
+	n, err = LoadSnapshot(filepath.Join(t.TempDir(), "missing.bin"), restored)
+	require.NoError(t, err)
+	assert.Zero(t, n)
+}
+
+// TestSnapshotCorrupt поврежденный, обрезанный или чужой версии снимок не загружается
+func TestSnapshotCorrupt(t *testing.T) {
+	c := New(time.Minute, 0)
+	c.Set("1 1", true, json.RawMessage(`{"v": 1}`))
+
+	var buf bytes.Buffer
+	require.NoError(t, c.WriteSnapshot(&buf))
+	data := buf.Bytes()
+
+	flipped := bytes.Clone(data)
+	flipped[len(flipped)-2] ^= 0xff
+
+	otherVersion := bytes.Clone(data)
+	binary.BigEndian.PutUint32(otherVersion[4:], SnapshotVersion+1)
+
+	for name, tc := range map[string]struct {
+		data []byte
+		err  error
+	}{
+		"checksum":  {data: flipped, err: ErrSnapshotCorrupt},
+		"truncated": {data: data[:len(data)-3], err: ErrSnapshotCorrupt},
+		"header":    {data: data[:6], err: ErrSnapshotCorrupt},
+		"magic":     {data: append([]byte("JUNK"), data[4:]...), err: ErrSnapshotCorrupt},
+		"version":   {data: otherVersion, err: ErrSnapshotVersion},
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "cache.bin")
+			require.NoError(t, os.WriteFile(path, tc.data, 0o644))
+
+			restored := New(time.Minute, 0)
+			n, err := LoadSnapshot(path, restored)
+			assert.ErrorIs(t, err, tc.err)
+			assert.Zero(t, n)
+			assert.Empty(t, restored.Entries())
+		})
+	}
+}
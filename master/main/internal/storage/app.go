@@ -4,8 +4,11 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type Query struct {
@@ -14,28 +17,198 @@ type Query struct {
 	Revision  bool `json:"use_last_revision,omitempty"`
 	Limit     int  `json:"limit,omitempty"`
 	Offset    int  `json:"offset,omitempty"`
+	// TagIds теги пользователя, если их несколько, от самого приоритетного. Баннер среди них выбирается по Resolution
+	TagIds     []int      `json:"-"`
+	Resolution Resolution `json:"-"`
 }
 type Banner struct {
-	BannerId  int               `json:"banner_id,omitempty"`
-	TagIds    []int             `json:"tag_ids"`
-	FeatureId int               `json:"feature_id"`
-	Content   map[string]string `json:"content"`
-	IsActive  bool              `json:"is_active"`
-	CreatedAt string            `json:"created_at"`
-	UpdatedAt string            `json:"updated_at"`
+	BannerId  int             `json:"banner_id,omitempty"`
+	TagIds    []int           `json:"tag_ids"`
+	FeatureId int             `json:"feature_id"`
+	Content   json.RawMessage `json:"content"`
+	IsActive  bool            `json:"is_active"`
+	Window
+	// Priority приоритет баннера при выборе среди нескольких тегов пользователя, больше - важнее
+	Priority int `json:"priority"`
+	// IsDefault баннер по умолчанию показывается по тегам фичи, у которых нет своего баннера
+	IsDefault bool   `json:"is_default"`
+	CreatedAt string `json:"created_at"`
+	UpdatedAt string `json:"updated_at"`
 }
+
+// UserBanner баннер пользователя по ключу "фича тег"
+type UserBanner struct {
+	BannerId  int
+	FeatureId int
+	TagId     int
+	Content   string
+	Active    bool
+	Window    Window
+}
+
+const (
+	// ResolveFirst баннер тега, указанного в запросе раньше остальных
+	ResolveFirst = "first"
+	// ResolvePriority баннер с наибольшим приоритетом
+	ResolvePriority = "priority"
+	// ResolveRecent баннер, измененный последним
+	ResolveRecent = "recent"
+)
+
+// Resolution стратегия выбора баннера, когда нескольким тегам пользователя соответствуют разные баннеры фичи
+type Resolution string
+
+// Validate проверяет, что стратегия известна. Пустая стратегия означает ResolveFirst
+func (r Resolution) Validate() error {
+	switch r {
+	case "", ResolveFirst, ResolvePriority, ResolveRecent:
+		return nil
+	default:
+		return fmt.Errorf("unknown tag resolution %q", string(r))
+	}
+}
+
 type BannerUpdate struct {
 	BannerId  int
-	TagIds    []int             `json:"tag_ids,omitempty"`
-	FeatureId int               `json:"feature_id,omitempty"`
-	Content   map[string]string `json:"content,omitempty"`
-	IsActive  bool              `json:"is_active,omitempty"`
+	TagIds    []int           `json:"tag_ids,omitempty"`
+	FeatureId int             `json:"feature_id,omitempty"`
+	Content   json.RawMessage `json:"content,omitempty"`
+	IsActive  *bool           `json:"is_active,omitempty"`
+	WindowUpdate
+	// IsActive, Priority и IsDefault не меняются, если не указаны
+	Priority  *int  `json:"priority,omitempty"`
+	IsDefault *bool `json:"is_default,omitempty"`
 }
 
-func (s *Storage) GetBannerFromStorage(query Query, ctx context.Context) (content string, active bool, err error) {
-	tx, err := s.Db.Begin()
+// ContentChanged сообщает, меняет ли изменение контент: контент не меняется, только если поле content не указано.
+// Указанный контент, в том числе {}, сохраняется как есть
+func (b BannerUpdate) ContentChanged() bool {
+	return len(b.Content) > 0
+}
+
+// OptionalTime граница периода показа в изменении баннера. Set = false, если поле не указано:
+// граница не меняется. Указанный null снимает границу
+type OptionalTime struct {
+	Set   bool
+	Value *time.Time
+}
+
+func (t *OptionalTime) UnmarshalJSON(data []byte) error {
+	t.Set = true
+	if string(data) == "null" {
+		t.Value = nil
+		return nil
+	}
+
+	var value time.Time
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	t.Value = &value
+
+	return nil
+}
+
+func (t OptionalTime) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.Value)
+}
+
+// WindowUpdate изменение периода показа: указанные границы заменяются, остальные остаются прежними
+type WindowUpdate struct {
+	ActiveFrom  OptionalTime `json:"active_from"`
+	ActiveUntil OptionalTime `json:"active_until"`
+}
+
+// Apply возвращает период window с примененным изменением
+func (u WindowUpdate) Apply(window Window) Window {
+	if u.ActiveFrom.Set {
+		window.ActiveFrom = u.ActiveFrom.Value
+	}
+	if u.ActiveUntil.Set {
+		window.ActiveUntil = u.ActiveUntil.Value
+	}
+
+	return window
+}
+
+// Window возвращает новый период, ok = false если изменение задает не обе границы и период зависит от сохраненного
+func (u WindowUpdate) Window() (window Window, ok bool) {
+	return u.Apply(Window{}), u.ActiveFrom.Set && u.ActiveUntil.Set
+}
+
+// ErrEmptyWindow период показа после изменения пустой: active_from не раньше active_until
+var ErrEmptyWindow = errors.New("active_from must be before active_until")
+
+// ErrDefaultConflict у фичи уже есть другой баннер по умолчанию
+var ErrDefaultConflict = errors.New("feature already has a default banner")
+
+// DefaultKey ключ, которым инвалидируются все ключи кэша фичи при изменении ее баннера по умолчанию:
+// он закэширован под ключами тегов, у которых нет своего баннера, и их список заранее неизвестен
+func DefaultKey(featureId int) string {
+	return fmt.Sprintf("%d *", featureId)
+}
+
+// Window период показа баннера. Пустая граница не ограничивает показ с этой стороны
+type Window struct {
+	ActiveFrom  *time.Time `json:"active_from,omitempty"`
+	ActiveUntil *time.Time `json:"active_until,omitempty"`
+}
+
+// Contains проверяет, что момент t входит в период показа
+func (w Window) Contains(t time.Time) bool {
+	return (w.ActiveFrom == nil || !t.Before(*w.ActiveFrom)) && (w.ActiveUntil == nil || t.Before(*w.ActiveUntil))
+}
+
+// Valid проверяет, что период не пустой: active_from раньше active_until, если заданы обе границы
+func (w Window) Valid() bool {
+	return w.ActiveFrom == nil || w.ActiveUntil == nil || w.ActiveFrom.Before(*w.ActiveUntil)
+}
+
+// Next возвращает ближайшую после t границу периода, на которой меняется видимость баннера,
+// или нулевое время, если таких границ больше нет
+func (w Window) Next(t time.Time) time.Time {
+	if w.ActiveFrom != nil && t.Before(*w.ActiveFrom) {
+		return *w.ActiveFrom
+	}
+	if w.ActiveUntil != nil && t.Before(*w.ActiveUntil) {
+		return *w.ActiveUntil
+	}
+
+	return time.Time{}
+}
+
+// args возвращает границы периода как параметры запроса
+func (w Window) args() (from, until any) {
+	if w.ActiveFrom != nil {
+		from = w.ActiveFrom.UTC()
+	}
+	if w.ActiveUntil != nil {
+		until = w.ActiveUntil.UTC()
+	}
+
+	return from, until
+}
+
+// scanWindow заполняет период показа из прочитанных столбцов
+func scanWindow(from, until sql.NullTime) Window {
+	var w Window
+	if from.Valid {
+		w.ActiveFrom = &from.Time
+	}
+	if until.Valid {
+		w.ActiveUntil = &until.Time
+	}
+
+	return w
+}
+
+// GetBannerFromStorage возвращает идентификатор, контент баннера и его период показа.
+// Если у тега нет баннера, возвращается баннер фичи по умолчанию.
+// active учитывает и флаг is_active, и период показа на текущий момент
+func (s *Storage) GetBannerFromStorage(query Query, ctx context.Context) (id int, content string, active bool, window Window, err error) {
+	tx, err := s.readTx(ctx)
 	if err != nil {
-		return "", false, err
+		return 0, "", false, Window{}, err
 	}
 
 	defer func() {
@@ -48,32 +221,216 @@ func (s *Storage) GetBannerFromStorage(query Query, ctx context.Context) (conten
 		}
 		_ = tx.Commit()
 	}()
-	row := s.Db.QueryRowContext(ctx, `SELECT b.content, b.is_active FROM banners b
-		INNER JOIN banner_tags bt ON b.id = bt.banner_id
-		WHERE bt.tag_id = :tagId AND b.feature_id = :featureId`,
+
+	return s.lookupBanner(ctx, tx, query)
+}
+
+// lookupBanner выбирает баннер пользователя по одному или нескольким тегам
+func (s *Storage) lookupBanner(ctx context.Context, e execer, query Query) (id int, content string, active bool, window Window, err error) {
+	if len(query.TagIds) > 1 {
+		return s.resolveBanner(ctx, e, query)
+	}
+
+	row := s.queryRow(ctx, e, `SELECT b.id, b.content, b.is_active, b.active_from, b.active_until FROM banners b
+		LEFT JOIN banner_tags bt ON b.id = bt.banner_id AND bt.tag_id = :tagId
+		WHERE b.feature_id = :featureId AND (bt.tag_id IS NOT NULL OR b.is_default = :isDefault)
+		ORDER BY `+defaultLast+` LIMIT 1`,
 		sql.Named("tagId", query.TagId),
-		sql.Named("featureId", query.FeatureId))
+		sql.Named("featureId", query.FeatureId),
+		sql.Named("isDefault", true))
 
 	var storedData string
 	var isActive bool
+	var from, until sql.NullTime
+
+	err = row.Scan(&id, &storedData, &isActive, &from, &until)
+	if err != nil {
+		return 0, "", false, Window{}, err
+	}
+	window = scanWindow(from, until)
+
+	return id, storedData, isActive && window.Contains(time.Now()), window, nil
+}
+
+// defaultLast порядок, в котором баннер фичи по умолчанию следует за баннерами тегов
+const defaultLast = "CASE WHEN bt.tag_id IS NULL THEN 1 ELSE 0 END"
+
+// resolveBanner выбирает одним запросом баннер фичи для нескольких тегов пользователя.
+// Баннеры тегов упорядочиваются по стратегии query.Resolution, и возвращается первый показываемый сейчас,
+// а если таких нет - первый по порядку. Баннер фичи по умолчанию выбирается, только если у тегов нет своих баннеров
+func (s *Storage) resolveBanner(ctx context.Context, e execer, query Query) (id int, content string, active bool, window Window, err error) {
+	// порядок тегов в запросе - их приоритет, он же разрешает равенство в остальных стратегиях
+	var tagOrder strings.Builder
+	tagOrder.WriteString("CASE bt.tag_id")
+	placeholders := make([]string, len(query.TagIds))
+	args := []any{sql.Named("featureId", query.FeatureId), sql.Named("isDefault", true)}
+	for i, tag := range query.TagIds {
+		name := "tag" + strconv.Itoa(i)
+		placeholders[i] = ":" + name
+		fmt.Fprintf(&tagOrder, " WHEN :%s THEN %d", name, i)
+		args = append(args, sql.Named(name, tag))
+	}
+	tagOrder.WriteString(" END")
+
+	order := tagOrder.String()
+	switch query.Resolution {
+	case ResolvePriority:
+		order = "b.priority DESC, " + order
+	case ResolveRecent:
+		order = "b.updated_at DESC, b.priority DESC, " + order
+	}
+
+	rows, err := s.query(ctx, e, `SELECT b.id, bt.tag_id, b.content, b.is_active, b.active_from, b.active_until FROM banners b
+		LEFT JOIN banner_tags bt ON b.id = bt.banner_id AND bt.tag_id IN (`+strings.Join(placeholders, ", ")+`)
+		WHERE b.feature_id = :featureId AND (bt.tag_id IS NOT NULL OR b.is_default = :isDefault)
+		ORDER BY `+defaultLast+`, `+order, args...)
+	if err != nil {
+		return 0, "", false, Window{}, err
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	found := false
+	for rows.Next() {
+		var bannerID int
+		var tagID sql.NullInt64
+		var storedData string
+		var isActive bool
+		var from, until sql.NullTime
+		if err := rows.Scan(&bannerID, &tagID, &storedData, &isActive, &from, &until); err != nil {
+			return 0, "", false, Window{}, err
+		}
+		// баннер по умолчанию не заменяет выключенные баннеры тегов
+		if found && !tagID.Valid {
+			break
+		}
+		w := scanWindow(from, until)
+		shown := isActive && w.Contains(now)
+
+		if !found || shown {
+			id, content, active, window, found = bannerID, storedData, shown, w, true
+		}
+		if shown {
+			break
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return 0, "", false, Window{}, err
+	}
+	if !found {
+		return 0, "", false, Window{}, sql.ErrNoRows
+	}
+
+	return id, content, active, window, nil
+}
+
+// GetUserBannersFromStorage возвращает баннеры по парам фича и тег из queries одним запросом.
+// Парам без баннера достается баннер фичи по умолчанию, пары без обоих в ответ не попадают.
+// Active учитывает и флаг is_active, и период показа
+func (s *Storage) GetUserBannersFromStorage(queries []Query, ctx context.Context) (banners []UserBanner, err error) {
+	banners = []UserBanner{}
+	if len(queries) == 0 {
+		return banners, nil
+	}
+
+	// баннеры по умолчанию приходят с тегом 0 и подставляются парам своей фичи без баннера
+	var queryBuilder strings.Builder
+	queryBuilder.WriteString(`SELECT b.id, bt.feature_id, bt.tag_id, b.content, b.is_active, b.active_from, b.active_until FROM banner_tags bt
+		INNER JOIN banners b ON b.id = bt.banner_id WHERE `)
+	args := make([]any, 0, 2*len(queries)+1)
+	var features []string
+	for i, q := range queries {
+		if i > 0 {
+			queryBuilder.WriteString(" OR ")
+		}
+		fmt.Fprintf(&queryBuilder, "(bt.feature_id = :feature%d AND bt.tag_id = :tag%d)", i, i)
+		features = append(features, fmt.Sprintf(":feature%d", i))
+		args = append(args,
+			sql.Named("feature"+strconv.Itoa(i), q.FeatureId),
+			sql.Named("tag"+strconv.Itoa(i), q.TagId))
+	}
+	queryBuilder.WriteString(`
+		UNION ALL SELECT b.id, b.feature_id, 0, b.content, b.is_active, b.active_from, b.active_until FROM banners b
+		WHERE b.is_default = :isDefault AND b.feature_id IN (` + strings.Join(features, ", ") + `)`)
+	args = append(args, sql.Named("isDefault", true))
+
+	rows, err := s.query(ctx, s.Db, queryBuilder.String(), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	found := map[[2]int]UserBanner{}
+	for rows.Next() {
+		var banner UserBanner
+		var from, until sql.NullTime
+		if err := rows.Scan(&banner.BannerId, &banner.FeatureId, &banner.TagId, &banner.Content, &banner.Active, &from, &until); err != nil {
+			return nil, err
+		}
+		banner.Window = scanWindow(from, until)
+		banner.Active = banner.Active && banner.Window.Contains(now)
 
-	err = row.Scan(&storedData, &isActive)
+		found[[2]int{banner.FeatureId, banner.TagId}] = banner
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, q := range queries {
+		banner, ok := found[[2]int{q.FeatureId, q.TagId}]
+		if !ok {
+			banner, ok = found[[2]int{q.FeatureId, 0}]
+			banner.TagId = q.TagId
+		}
+		if ok {
+			banners = append(banners, banner)
+		}
+	}
+
+	return banners, nil
+}
+
+// GetActiveKeysFromStorage возвращает ключи кэша "фича тег" баннеров, которые показываются сейчас.
+// Читается не больше limit ключей включенных баннеров, ключи вне периода показа затем отбрасываются
+func (s *Storage) GetActiveKeysFromStorage(limit int, ctx context.Context) (keys []string, err error) {
+	rows, err := s.query(ctx, s.Db, `SELECT bt.feature_id, bt.tag_id, b.active_from, b.active_until FROM banner_tags bt
+		INNER JOIN banners b ON b.id = bt.banner_id
+		WHERE b.is_active = :active
+		ORDER BY bt.feature_id, bt.tag_id LIMIT :limit`,
+		sql.Named("active", true),
+		sql.Named("limit", limit))
 	if err != nil {
-		return "", false, err
+		return nil, err
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	keys = []string{}
+	for rows.Next() {
+		var featureID, tagID int
+		var from, until sql.NullTime
+		if err := rows.Scan(&featureID, &tagID, &from, &until); err != nil {
+			return nil, err
+		}
+
+		if scanWindow(from, until).Contains(now) {
+			keys = append(keys, fmt.Sprintf("%d %d", featureID, tagID))
+		}
 	}
 
-	return storedData, isActive, nil
+	return keys, rows.Err()
 }
 
 func (s *Storage) GetAllBannersFromStorage(query Query, ctx context.Context) (banners []Banner, err error) {
-	tx, err := s.Db.Begin()
+	tx, err := s.readTx(ctx)
 	if err != nil {
 		return nil, err
 	}
 
 	defer func() {
 		if err != nil {
-			err = tx.Rollback()
+			err := tx.Rollback()
 			if err != nil {
 				return
 			}
@@ -83,7 +440,7 @@ func (s *Storage) GetAllBannersFromStorage(query Query, ctx context.Context) (ba
 	}()
 
 	var queryBuilder strings.Builder
-	queryBuilder.WriteString(`SELECT b.id, b.feature_id, b.content, b.is_active, b.created_at, b.updated_at FROM banners b`)
+	queryBuilder.WriteString(`SELECT b.id, b.feature_id, b.content, b.is_active, b.active_from, b.active_until, b.priority, b.is_default, b.created_at, b.updated_at FROM banners b`)
 	if query.TagId != 0 {
 		queryBuilder.WriteString(` JOIN banner_tags bt ON b.id = bt.banner_id WHERE bt.tag_id = :tagId`)
 	}
@@ -97,6 +454,8 @@ func (s *Storage) GetAllBannersFromStorage(query Query, ctx context.Context) (ba
 		queryBuilder.WriteString(` b.feature_id = :featureId`)
 	}
 
+	queryBuilder.WriteString(` ORDER BY b.id`)
+
 	if query.Limit != 0 {
 		queryBuilder.WriteString(` LIMIT :limit`)
 	}
@@ -105,63 +464,56 @@ func (s *Storage) GetAllBannersFromStorage(query Query, ctx context.Context) (ba
 		queryBuilder.WriteString(` OFFSET :offset`)
 	}
 
-	rows, err := s.Db.QueryContext(ctx, queryBuilder.String(),
+	rows, err := s.query(ctx, tx, queryBuilder.String(),
 		sql.Named("featureId", query.FeatureId),
 		sql.Named("tagId", query.TagId),
 		sql.Named("limit", query.Limit),
 		sql.Named("offset", query.Offset))
-
-	var res []Banner
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
 
-	for rows.Next() {
-		var banner Banner
-		var contentJSON string
-		err := rows.Scan(&banner.BannerId, &banner.FeatureId, &contentJSON, &banner.IsActive, &banner.CreatedAt, &banner.UpdatedAt)
-		if err != nil {
-			return nil, err
-		}
-		err = json.Unmarshal([]byte(contentJSON), &banner.Content)
-		if err != nil {
-			return nil, err
-		}
+	res, err := scanBanners(rows)
+	if err != nil {
+		return nil, err
+	}
 
-		var tags []int
-		rowes, err := s.Db.QueryContext(ctx, "SELECT tag_id FROM banner_tags WHERE banner_id = :bannerId",
-			sql.Named("bannerId", banner.BannerId))
+	for i := range res {
+		res[i].TagIds, err = s.tags(ctx, tx, "SELECT tag_id FROM banner_tags WHERE banner_id = :id", res[i].BannerId)
 		if err != nil {
 			return nil, err
 		}
+	}
 
-		for rowes.Next() {
-			var tagID int
-			if err := rowes.Scan(&tagID); err != nil {
-				return nil, err
-			}
-			tags = append(tags, tagID)
-		}
-
-		if err := rows.Err(); err != nil {
-			return nil, err
-		}
-
-		rowes.Close()
+	return res, nil
+}
 
-		banner.TagIds = tags
+// GetBannerByIdFromStorage возвращает текущее состояние баннера с тегами, sql.ErrNoRows если баннера нет
+func (s *Storage) GetBannerByIdFromStorage(id int, ctx context.Context) (banner Banner, err error) {
+	rows, err := s.query(ctx, s.Db, `SELECT id, feature_id, content, is_active, active_from, active_until, priority, is_default, created_at, updated_at FROM banners WHERE id = :id`,
+		sql.Named("id", id))
+	if err != nil {
+		return Banner{}, err
+	}
 
-		res = append(res, banner)
+	res, err := scanBanners(rows)
+	if err != nil {
+		return Banner{}, err
+	}
+	if len(res) == 0 {
+		return Banner{}, sql.ErrNoRows
 	}
+	banner = res[0]
 
-	if err = rows.Err(); err != nil {
-		return nil, err
+	banner.TagIds, err = s.tags(ctx, s.Db, `SELECT tag_id FROM banner_tags WHERE banner_id = :id ORDER BY tag_id`, id)
+	if err != nil {
+		return Banner{}, err
 	}
 
-	return res, nil
+	return banner, nil
 }
 
+// PostBannerToStorage создает баннер с тегами, ErrDefaultConflict если у фичи уже есть баннер по умолчанию
 func (s *Storage) PostBannerToStorage(banner Banner, ctx context.Context) (id int, err error) {
 
 	tx, err := s.Db.Begin()
@@ -170,7 +522,7 @@ func (s *Storage) PostBannerToStorage(banner Banner, ctx context.Context) (id in
 	}
 	defer func() {
 		if err != nil {
-			err = tx.Rollback()
+			err := tx.Rollback()
 			if err != nil {
 				return
 			}
@@ -179,27 +531,32 @@ func (s *Storage) PostBannerToStorage(banner Banner, ctx context.Context) (id in
 		_ = tx.Commit()
 	}()
 
-	contentJSON, err := json.Marshal(banner.Content)
-	if err != nil {
-		return 0, err
+	if banner.IsDefault {
+		err = s.checkDefault(ctx, tx, banner.FeatureId, 0)
+		if err != nil {
+			return 0, err
+		}
 	}
 
-	result, err := tx.ExecContext(ctx, `INSERT INTO banners (feature_id, content, is_active) 
-		VALUES (:featureId, :content, :isActive)`,
-		sql.Named("featureId", banner.FeatureId),
-		sql.Named("content", string(contentJSON)),
-		sql.Named("isActive", banner.IsActive))
-	if err != nil {
-		return 0, err
-	}
+	activeFrom, activeUntil := banner.Window.args()
 
-	idLast, err := result.LastInsertId()
+	var idLast int
+	err = s.queryRow(ctx, tx, `INSERT INTO banners (feature_id, content, is_active, active_from, active_until, priority, is_default)
+		VALUES (:featureId, :content, :isActive, :activeFrom, :activeUntil, :priority, :isDefault) RETURNING id`,
+		sql.Named("featureId", banner.FeatureId),
+		sql.Named("content", string(banner.Content)),
+		sql.Named("isActive", banner.IsActive),
+		sql.Named("activeFrom", activeFrom),
+		sql.Named("activeUntil", activeUntil),
+		sql.Named("priority", banner.Priority),
+		sql.Named("isDefault", banner.IsDefault)).
+		Scan(&idLast)
 	if err != nil {
 		return 0, err
 	}
 
 	for _, tagID := range banner.TagIds {
-		_, err := tx.ExecContext(ctx, `INSERT INTO banner_tags (banner_id, tag_id, feature_id)
+		_, err := s.exec(ctx, tx, `INSERT INTO banner_tags (banner_id, tag_id, feature_id)
 			VALUES (:bannerId, :tagId, :featureId)`,
 			sql.Named("bannerId", idLast),
 			sql.Named("featureId", banner.FeatureId),
@@ -209,17 +566,19 @@ func (s *Storage) PostBannerToStorage(banner Banner, ctx context.Context) (id in
 		}
 	}
 
-	return int(idLast), nil
+	return idLast, nil
 }
 
-func (s *Storage) UpdateBannerInStorage(banner BannerUpdate, ctx context.Context) (err error) {
+// UpdateBannerInStorage сохраняет изменение баннера и возвращает ключи кэша до и после изменения,
+// ErrDefaultConflict если баннер становится баннером по умолчанию фичи, у которой он уже есть
+func (s *Storage) UpdateBannerInStorage(banner BannerUpdate, ctx context.Context) (keys []string, err error) {
 	tx, err := s.Db.Begin()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer func() {
 		if err != nil {
-			err = tx.Rollback()
+			err := tx.Rollback()
 			if err != nil {
 				return
 			}
@@ -228,113 +587,171 @@ func (s *Storage) UpdateBannerInStorage(banner BannerUpdate, ctx context.Context
 		_ = tx.Commit()
 	}()
 
-	contentJSON, err := json.Marshal(banner.Content)
-	if err != nil {
-		return err
+	var content any
+	if banner.ContentChanged() {
+		content = string(banner.Content)
 	}
 
-	var versionCount int
-	err = s.Db.QueryRowContext(ctx, `SELECT COUNT(*) FROM banner_versions WHERE banner_id = :bannerId`, sql.Named("bannerId", banner.BannerId)).
-		Scan(&versionCount)
+	var featureId int
+	var isDefault bool
+	var from, until sql.NullTime
+	err = s.queryRow(ctx, tx, `SELECT feature_id, is_default, active_from, active_until FROM banners WHERE id = :bannerId`, sql.Named("bannerId", banner.BannerId)).
+		Scan(&featureId, &isDefault, &from, &until)
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	if versionCount == 3 {
-		_, err = tx.ExecContext(ctx, `DELETE FROM banner_versions WHERE id = 
-            	(SELECT id FROM banner_versions WHERE banner_id = :bannerId ORDER BY id ASC LIMIT 1)`,
-			sql.Named("bannerId", banner.BannerId))
+	// фича без значения в изменении остается прежней
+	if banner.FeatureId != 0 {
+		featureId = banner.FeatureId
+	}
+	window := banner.WindowUpdate.Apply(scanWindow(from, until))
+	if !window.Valid() {
+		return nil, ErrEmptyWindow
+	}
+	if banner.IsDefault != nil {
+		isDefault = *banner.IsDefault
+	}
+	if isDefault {
+		err = s.checkDefault(ctx, tx, featureId, banner.BannerId)
 		if err != nil {
-			return err
+			return nil, err
 		}
+	}
 
-		_, err = tx.ExecContext(ctx, `DELETE FROM banner_versions_tags WHERE banner_id =
-            	(SELECT id FROM banner_versions WHERE banner_id = :bannerId ORDER BY id ASC LIMIT 1)`,
-			sql.Named("bannerId", banner.BannerId))
-		if err != nil {
-			return err
-		}
+	keys, err = s.bannerKeys(ctx, tx, banner.BannerId)
+	if err != nil {
+		return nil, err
 	}
 
-	var oldBanner Banner
-	err = s.Db.QueryRowContext(ctx, `SELECT * FROM banners WHERE id = :bannerId`, sql.Named("bannerId", banner.BannerId)).
-		Scan(&oldBanner.BannerId, &oldBanner.FeatureId, &oldBanner.Content, &oldBanner.IsActive, &oldBanner.CreatedAt, &oldBanner.UpdatedAt)
+	err = s.saveVersion(ctx, tx, banner.BannerId)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	result, err := tx.ExecContext(ctx, `INSERT INTO banner_versions (banner_id, feature_id, content, is_active, created_at, updated_at) 
-		VALUES (:bannerId, :featureId, :content, :isActive, :created_at, :updated_at)`,
-		sql.Named("bannerId", banner.BannerId),
-		sql.Named("featureId", oldBanner.FeatureId),
-		sql.Named("content", oldBanner.Content),
-		sql.Named("isActive", oldBanner.IsActive),
-		sql.Named("createdAt", oldBanner.CreatedAt),
-		sql.Named("updatedAt", oldBanner.UpdatedAt))
+	activeFrom, activeUntil := window.args()
+
+	_, err = s.exec(ctx, tx, `UPDATE banners
+		SET feature_id = :featureId,
+    		content = COALESCE(:content, content),
+    		is_active = COALESCE(:isActive, is_active),
+			active_from = :activeFrom,
+			active_until = :activeUntil,
+			priority = COALESCE(:priority, priority),
+			is_default = :isDefault,
+			updated_at = CURRENT_TIMESTAMP
+		WHERE id = :bannerId`,
+		sql.Named("featureId", featureId),
+		sql.Named("content", content),
+		sql.Named("isActive", banner.IsActive),
+		sql.Named("activeFrom", activeFrom),
+		sql.Named("activeUntil", activeUntil),
+		sql.Named("priority", banner.Priority),
+		sql.Named("isDefault", isDefault),
+		sql.Named("bannerId", banner.BannerId))
+
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	idLast, err := result.LastInsertId()
+	err = s.updateBannerTags(ctx, tx, banner.BannerId, featureId, banner.TagIds)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	rows, err := s.Db.QueryContext(ctx, `SELECT tag_id FROM banner_tags WHERE banner_id = :bannerId`, sql.Named("bannerId", banner.BannerId))
+	newKeys, err := s.bannerKeys(ctx, tx, banner.BannerId)
 	if err != nil {
+		return nil, err
+	}
+
+	return append(keys, newKeys...), nil
+}
+
+// updateBannerTags заменяет теги баннера на tagIds. Если теги не указаны, прежние теги остаются,
+// но переносятся в фичу featureId вместе с баннером
+func (s *Storage) updateBannerTags(ctx context.Context, tx *sql.Tx, bannerId, featureId int, tagIds []int) error {
+	if tagIds == nil {
+		_, err := s.exec(ctx, tx, `UPDATE banner_tags SET feature_id = :featureId WHERE banner_id = :bannerId`,
+			sql.Named("featureId", featureId),
+			sql.Named("bannerId", bannerId))
 		return err
 	}
-	defer rows.Close()
 
-	for rows.Next() {
-		var tagID int
-		err := rows.Scan(&tagID)
-		if err != nil {
-			return err
-		}
+	_, err := s.exec(ctx, tx, `DELETE FROM banner_tags WHERE banner_id = :bannerId`,
+		sql.Named("bannerId", bannerId))
+	if err != nil {
+		return err
+	}
 
-		_, err = tx.ExecContext(ctx, `INSERT INTO banner_versions_tags (banner_version_id,banner_id, tag_id, feature_id) 
-			VALUES (:bannerVersionId, :bannerId, :tagId, :featureId)`,
-			sql.Named("bannerVersionId", idLast),
-			sql.Named("bannerId", banner.BannerId),
-			sql.Named("tagId", tagID),
-			sql.Named("featureId", oldBanner.FeatureId))
+	for _, tagID := range tagIds {
+		_, err := s.exec(ctx, tx, `INSERT INTO banner_tags (banner_id, tag_id, feature_id) VALUES (:bannerId, :tagId, :featureId)`,
+			sql.Named("bannerId", bannerId),
+			sql.Named("featureId", featureId),
+			sql.Named("tagId", tagID))
 		if err != nil {
 			return err
 		}
 	}
 
-	_, err = s.Db.ExecContext(ctx, `UPDATE banners
-		SET feature_id = COALESCE(NULLIF(:featureId, 0), feature_id),
-    		content = COALESCE(NULLIF(:content, '{}'), content),
-    		is_active = COALESCE(NULLIF(:bannerId, 0), is_active),
-			updated_at = CURRENT_TIMESTAMP
-		WHERE id = :bannerId`,
-		sql.Named("featureId", banner.FeatureId),
-		sql.Named("content", contentJSON),
-		sql.Named("isActive", banner.IsActive),
-		sql.Named("bannerId", banner.BannerId))
+	return nil
+}
 
+// saveVersion сохраняет текущее состояние баннера вместе с тегами в историю версий
+// и применяет к истории баннера политику хранения
+func (s *Storage) saveVersion(ctx context.Context, tx *sql.Tx, bannerId int) (err error) {
+	var oldBanner Banner
+	var oldContent string
+	var oldFrom, oldUntil sql.NullTime
+	err = s.queryRow(ctx, tx, `SELECT id, feature_id, content, is_active, active_from, active_until, priority, is_default, created_at, updated_at FROM banners WHERE id = :bannerId`,
+		sql.Named("bannerId", bannerId)).
+		Scan(&oldBanner.BannerId, &oldBanner.FeatureId, &oldContent, &oldBanner.IsActive, &oldFrom, &oldUntil, &oldBanner.Priority, &oldBanner.IsDefault, &oldBanner.CreatedAt, &oldBanner.UpdatedAt)
 	if err != nil {
 		return err
 	}
+	oldBanner.Window = scanWindow(oldFrom, oldUntil)
 
-	_, err = tx.ExecContext(ctx, `DELETE FROM banner_tags WHERE banner_id = :bannerId`,
-		sql.Named("bannerId", banner.BannerId))
+	oldBanner.TagIds, err = s.tags(ctx, tx, `SELECT tag_id FROM banner_tags WHERE banner_id = :id`, bannerId)
 	if err != nil {
 		return err
 	}
 
-	for _, tagID := range banner.TagIds {
-		_, err := tx.ExecContext(ctx, `INSERT INTO banner_tags (banner_id, tag_id, feature_id) VALUES (:bannerId, :tagId, :featureId)`,
-			sql.Named("bannerId", banner.BannerId),
-			sql.Named("featureId", banner.FeatureId),
-			sql.Named("tagId", tagID))
+	oldFromArg, oldUntilArg := oldBanner.Window.args()
+
+	var idLast int
+	err = s.queryRow(ctx, tx, `INSERT INTO banner_versions (banner_id, feature_id, content, is_active, active_from, active_until, priority, is_default, created_at, updated_at, versioned_at)
+		VALUES (:bannerId, :featureId, :content, :isActive, :activeFrom, :activeUntil, :priority, :isDefault, :createdAt, :updatedAt, :versionedAt) RETURNING id`,
+		sql.Named("bannerId", bannerId),
+		sql.Named("featureId", oldBanner.FeatureId),
+		sql.Named("content", oldContent),
+		sql.Named("isActive", oldBanner.IsActive),
+		sql.Named("activeFrom", oldFromArg),
+		sql.Named("activeUntil", oldUntilArg),
+		sql.Named("priority", oldBanner.Priority),
+		sql.Named("isDefault", oldBanner.IsDefault),
+		sql.Named("createdAt", oldBanner.CreatedAt),
+		sql.Named("updatedAt", oldBanner.UpdatedAt),
+		sql.Named("versionedAt", time.Now().UTC())).
+		Scan(&idLast)
+	if err != nil {
+		return err
+	}
+
+	for _, tagID := range oldBanner.TagIds {
+		_, err = s.exec(ctx, tx, `INSERT INTO banner_versions_tags (banner_version_id,banner_id, tag_id, feature_id)
+			VALUES (:bannerVersionId, :bannerId, :tagId, :featureId)`,
+			sql.Named("bannerVersionId", idLast),
+			sql.Named("bannerId", bannerId),
+			sql.Named("tagId", tagID),
+			sql.Named("featureId", oldBanner.FeatureId))
 		if err != nil {
 			return err
 		}
 	}
 
+	_, err = s.pruneVersions(ctx, tx, bannerId)
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -347,7 +764,7 @@ func (s *Storage) DeleteBannerFromStorage(id int, ctx context.Context) (keys []s
 
 	defer func() {
 		if err != nil {
-			err = tx.Rollback()
+			err := tx.Rollback()
 			if err != nil {
 				return
 			}
@@ -356,45 +773,16 @@ func (s *Storage) DeleteBannerFromStorage(id int, ctx context.Context) (keys []s
 		_ = tx.Commit()
 	}()
 
-	deleteKeys := []string{}
-
-	rowas, err := tx.QueryContext(ctx, `SELECT tag_id,feature_id FROM banner_tags WHERE banner_id = :bannerId`, sql.Named("bannerId", id))
+	var exists int
+	err = s.queryRow(ctx, tx, `SELECT COUNT(*) FROM banners WHERE id = :bannerId`, sql.Named("bannerId", id)).Scan(&exists)
 	if err != nil {
 		return nil, err
 	}
-
-	for rowas.Next() {
-		var tagID, featureID int
-		err := rowas.Scan(&tagID, &featureID)
-		if err != nil {
-			return nil, err
-		}
-
-		key := fmt.Sprintf("%d %d", featureID, tagID)
-		deleteKeys = append(deleteKeys, key)
+	if exists == 0 {
+		return nil, sql.ErrNoRows
 	}
 
-	_, err = tx.ExecContext(ctx, `DELETE FROM banner_versions WHERE banner_id = :bannerId`, sql.Named("bannerId", id))
-	if err != nil {
-		return nil, err
-	}
-
-	_, err = tx.ExecContext(ctx, `DELETE FROM banner_versions_tags WHERE banner_id = :bannerId`, sql.Named("bannerId", id))
-	if err != nil {
-		return nil, err
-	}
-
-	_, err = tx.ExecContext(ctx, `DELETE FROM banners WHERE id = :bannerId`, sql.Named("bannerId", id))
-	if err != nil {
-		return nil, err
-	}
-
-	_, err = tx.ExecContext(ctx, `DELETE FROM banner_tags WHERE banner_id = :bannerId`, sql.Named("bannerId", id))
-	if err != nil {
-		return nil, err
-	}
-
-	return deleteKeys, nil
+	return s.deleteBanners(ctx, tx, []int{id})
 }
 
 func (s *Storage) DeleteBannerFromStorageByFeature(featureId int, ctx context.Context) (keys []string, err error) {
@@ -405,7 +793,7 @@ func (s *Storage) DeleteBannerFromStorageByFeature(featureId int, ctx context.Co
 
 	defer func() {
 		if err != nil {
-			err = tx.Rollback()
+			err := tx.Rollback()
 			if err != nil {
 				return
 			}
@@ -414,71 +802,49 @@ func (s *Storage) DeleteBannerFromStorageByFeature(featureId int, ctx context.Co
 		_ = tx.Commit()
 	}()
 
-	rows, err := tx.QueryContext(ctx, `SELECT id FROM banners WHERE feature_id = :featureId`, sql.Named("featureId", featureId))
+	ids, err := s.tags(ctx, tx, `SELECT id FROM banners WHERE feature_id = :id`, featureId)
 	if err != nil {
 		return nil, err
 	}
 
-	for rows.Next() {
-		var bannerID int
-		err := rows.Scan(&bannerID)
-		if err != nil {
-			return nil, err
-		}
-
-		_, err = tx.ExecContext(ctx, `DELETE FROM banner_versions WHERE banner_id = :bannerID`, sql.Named("bannerID", bannerID))
-		if err != nil {
-			return nil, err
-		}
-
-		_, err = tx.ExecContext(ctx, `DELETE FROM banner_versions_tags WHERE banner_id = :bannerID`, sql.Named("bannerID", bannerID))
-		if err != nil {
-			return nil, err
-		}
-	}
-	rows.Close()
+	return s.deleteBanners(ctx, tx, ids)
+}
 
-	deleteKeys := []string{}
+func (s *Storage) DeleteBannerFromStorageByTag(tag int, ctx context.Context) (keys []string, err error) {
 
-	rowys, err := s.Db.QueryContext(ctx, `SELECT tag_id FROM banner_tags WHERE feature_id = :featureId`, sql.Named("featureId", featureId))
+	tx, err := s.Db.Begin()
 	if err != nil {
 		return nil, err
 	}
 
-	for rowys.Next() {
-		var tagID int
-		err := rows.Scan(&tagID)
+	defer func() {
 		if err != nil {
-			return nil, err
+			err := tx.Rollback()
+			if err != nil {
+				return
+			}
+			return
 		}
-		key := fmt.Sprintf("%d %d", featureId, tagID)
-		deleteKeys = append(deleteKeys, key)
-	}
-	rowys.Close()
-
-	_, err = tx.ExecContext(ctx, `DELETE FROM banners WHERE feature_id = :featureId`, sql.Named("featureId", featureId))
-	if err != nil {
-		return nil, err
-	}
+		_ = tx.Commit()
+	}()
 
-	_, err = tx.ExecContext(ctx, `DELETE FROM banner_tags WHERE feature_id = :featureId`, sql.Named("featureId", featureId))
+	ids, err := s.tags(ctx, tx, `SELECT banner_id FROM banner_tags WHERE tag_id = :id`, tag)
 	if err != nil {
 		return nil, err
 	}
 
-	return deleteKeys, nil
+	return s.deleteBanners(ctx, tx, ids)
 }
 
-func (s *Storage) DeleteBannerFromStorageByTag(tag int, ctx context.Context) (keys []string, err error) {
-
-	tx, err := s.Db.Begin()
+func (s *Storage) GetBannerVersionsFromStorage(id int, ctx context.Context) (banners []Banner, err error) {
+	tx, err := s.readTx(ctx)
 	if err != nil {
 		return nil, err
 	}
 
 	defer func() {
 		if err != nil {
-			err = tx.Rollback()
+			err := tx.Rollback()
 			if err != nil {
 				return
 			}
@@ -487,138 +853,143 @@ func (s *Storage) DeleteBannerFromStorageByTag(tag int, ctx context.Context) (ke
 		_ = tx.Commit()
 	}()
 
-	var deleteKeys []string
+	rows, err := s.query(ctx, tx, "SELECT id, feature_id, content, is_active, active_from, active_until, priority, is_default, created_at, updated_at FROM banner_versions WHERE banner_id = :bannerId ORDER BY id",
+		sql.Named("bannerId", id))
+	if err != nil {
+		return nil, err
+	}
 
-	rows, err := tx.QueryContext(ctx, `
-		SELECT banners.id
-		FROM banners
-		JOIN banner_tags ON banners.id = banner_tags.banner_id
-		WHERE banner_tags.tag_id = :tagId`, sql.Named("tagId", tag))
+	res, err := scanBanners(rows)
 	if err != nil {
 		return nil, err
 	}
 
-	for rows.Next() {
-		var bannerID int
-		err := rows.Scan(&bannerID)
+	for i := range res {
+		res[i].TagIds, err = s.tags(ctx, tx, "SELECT tag_id FROM banner_versions_tags WHERE banner_version_id = :id", res[i].BannerId)
 		if err != nil {
 			return nil, err
 		}
+	}
+
+	return res, nil
+}
+
+// deleteBanners удаляет баннеры вместе с тегами, версиями и черновиками, возвращает ключи кэша затронутых баннеров
+func (s *Storage) deleteBanners(ctx context.Context, tx *sql.Tx, ids []int) (keys []string, err error) {
+	deleteKeys := []string{}
 
-		_, err = tx.ExecContext(ctx, `DELETE FROM banner_versions WHERE banner_id = :bannerID`, sql.Named("bannerID", bannerID))
+	for _, id := range ids {
+		keys, err := s.bannerKeys(ctx, tx, id)
 		if err != nil {
 			return nil, err
 		}
+		deleteKeys = append(deleteKeys, keys...)
 
-		_, err = tx.ExecContext(ctx, `DELETE FROM banner_versions_tags WHERE banner_id = :bannerID`, sql.Named("bannerID", bannerID))
-		if err != nil {
-			return nil, err
+		for _, q := range []string{
+			`DELETE FROM banner_drafts WHERE banner_id = :bannerId`,
+			`DELETE FROM banner_versions_tags WHERE banner_id = :bannerId`,
+			`DELETE FROM banner_versions WHERE banner_id = :bannerId`,
+			`DELETE FROM banner_tags WHERE banner_id = :bannerId`,
+			`DELETE FROM banners WHERE id = :bannerId`,
+		} {
+			_, err = s.exec(ctx, tx, q, sql.Named("bannerId", id))
+			if err != nil {
+				return nil, err
+			}
 		}
 	}
-	rows.Close()
 
-	rowys, err := s.Db.QueryContext(ctx, `SELECT feature_id FROM banner_tags WHERE tag_id = :tagId`, sql.Named("tagId", tag))
-	if err != nil {
+	return deleteKeys, nil
+}
+
+// bannerKeys возвращает ключи кэша "фича тег" текущих тегов баннера,
+// а для баннера по умолчанию еще и DefaultKey его фичи
+func (s *Storage) bannerKeys(ctx context.Context, e execer, id int) (keys []string, err error) {
+	var feature int
+	var isDefault bool
+	err = s.queryRow(ctx, e, `SELECT feature_id, is_default FROM banners WHERE id = :bannerId`, sql.Named("bannerId", id)).
+		Scan(&feature, &isDefault)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
 		return nil, err
 	}
-
-	for rowys.Next() {
-		var featureID int
-		err := rows.Scan(&featureID)
-		if err != nil {
-			return nil, err
-		}
-		key := fmt.Sprintf("%d %d", featureID, tag)
-		deleteKeys = append(deleteKeys, key)
+	if isDefault {
+		keys = append(keys, DefaultKey(feature))
 	}
-	rowys.Close()
 
-	_, err = tx.ExecContext(ctx, `DELETE FROM banners
-		WHERE id IN (
-			SELECT banners.id
-			FROM banners
-			JOIN banner_tags ON banners.id = banner_tags.banner_id
-			WHERE banner_tags.tag_id = :tagId);`,
-		sql.Named("tagId", tag))
+	rows, err := s.query(ctx, e, `SELECT tag_id, feature_id FROM banner_tags WHERE banner_id = :bannerId`, sql.Named("bannerId", id))
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
-	_, err = tx.ExecContext(ctx, `DELETE FROM banner_tags WHERE tag_id = :tagId`, sql.Named("tagId", tag))
-	if err != nil {
-		return nil, err
+	for rows.Next() {
+		var tagID, featureID int
+		if err := rows.Scan(&tagID, &featureID); err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, fmt.Sprintf("%d %d", featureID, tagID))
 	}
 
-	return deleteKeys, nil
+	return keys, rows.Err()
 }
 
-func (s *Storage) GetBannerVersionsFromStorage(id int, ctx context.Context) (banners []Banner, err error) {
-	tx, err := s.Db.Begin()
+// checkDefault возвращает ErrDefaultConflict, если у фичи есть баннер по умолчанию, кроме bannerId
+func (s *Storage) checkDefault(ctx context.Context, e execer, featureId, bannerId int) error {
+	var used int
+	err := s.queryRow(ctx, e, `SELECT COUNT(*) FROM banners WHERE feature_id = :featureId AND is_default = :isDefault AND id <> :bannerId`,
+		sql.Named("featureId", featureId),
+		sql.Named("isDefault", true),
+		sql.Named("bannerId", bannerId)).
+		Scan(&used)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	if used > 0 {
+		return ErrDefaultConflict
 	}
 
-	defer func() {
-		if err != nil {
-			err = tx.Rollback()
-			if err != nil {
-				return
-			}
-			return
-		}
-		_ = tx.Commit()
-	}()
-
-	rows, err := s.Db.QueryContext(ctx, "SELECT id, feature_id, content, is_active, created_at, updated_at FROM banner_versions WHERE banner_id = :bannerId",
-		sql.Named("bannerId", id))
+	return nil
+}
 
-	var res []Banner
+// tags выполняет запрос, возвращающий один целочисленный столбец, например теги баннера
+func (s *Storage) tags(ctx context.Context, e execer, query string, id int) ([]int, error) {
+	rows, err := s.query(ctx, e, query, sql.Named("id", id))
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
+	var res []int
 	for rows.Next() {
-		var banner Banner
-		var contentJSON string
-		err := rows.Scan(&banner.BannerId, &banner.FeatureId, &contentJSON, &banner.IsActive, &banner.CreatedAt, &banner.UpdatedAt)
-		if err != nil {
-			return nil, err
-		}
-		err = json.Unmarshal([]byte(contentJSON), &banner.Content)
-		if err != nil {
+		var v int
+		if err := rows.Scan(&v); err != nil {
 			return nil, err
 		}
+		res = append(res, v)
+	}
 
-		var tags []int
-		rowes, err := s.Db.QueryContext(ctx, "SELECT tag_id FROM banner_versions_tags WHERE banner_version_id = :bannerId",
-			sql.Named("bannerId", banner.BannerId))
-		if err != nil {
-			return nil, err
-		}
+	return res, rows.Err()
+}
 
-		for rowes.Next() {
-			var tagID int
-			if err := rowes.Scan(&tagID); err != nil {
-				return nil, err
-			}
-			tags = append(tags, tagID)
-		}
+// scanBanners читает строки баннеров (или их версий) без тегов и закрывает rows
+func scanBanners(rows *sql.Rows) ([]Banner, error) {
+	defer rows.Close()
 
-		if err := rowes.Err(); err != nil {
+	var res []Banner
+	for rows.Next() {
+		var banner Banner
+		var content string
+		var from, until sql.NullTime
+		err := rows.Scan(&banner.BannerId, &banner.FeatureId, &content, &banner.IsActive, &from, &until, &banner.Priority, &banner.IsDefault, &banner.CreatedAt, &banner.UpdatedAt)
+		if err != nil {
 			return nil, err
 		}
-
-		rowes.Close()
-
-		banner.TagIds = tags
+		banner.Content = json.RawMessage(content)
+		banner.Window = scanWindow(from, until)
 
 		res = append(res, banner)
 	}
 
-	if err = rows.Err(); err != nil {
-		return nil, err
-	}
-
-	return res, nil
+	return res, rows.Err()
 }
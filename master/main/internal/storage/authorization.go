@@ -2,24 +2,200 @@ package sqlite
 
 import (
 	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
+	"errors"
+	"time"
 )
 
-func (s *Storage) CheckToken(token string, ctx context.Context) (role string, err error) {
-	row := s.Db.QueryRowContext(ctx, "SELECT Role FROM Users WHERE Token = :token",
-		sql.Named("token", token))
+// ErrTokenRevoked токен с таким значением уже был выпущен и отозван, выпустить его снова нельзя
+var ErrTokenRevoked = errors.New("token was revoked")
 
-	var roleFromDb bool
+type Token struct {
+	Id        int        `json:"id"`
+	Name      string     `json:"name"`
+	Role      string     `json:"role"`
+	Token     string     `json:"token,omitempty"`
+	CreatedAt string     `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+	// CreatedBy субъект, выпустивший токен, пустой у токенов, выпущенных при запуске
+	CreatedBy string `json:"created_by,omitempty"`
+}
+
+// HashToken возвращает sha256 токена, в базе хранится только он
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CheckToken возвращает роль и идентификатор действующего токена: не отозванного и не истекшего
+func (s *Storage) CheckToken(token string, ctx context.Context) (role string, id int, err error) {
+	row := s.queryRow(ctx, s.Db, `SELECT role, id FROM tokens
+		WHERE token_hash = :hash AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > :now)`,
+		sql.Named("hash", HashToken(token)),
+		sql.Named("now", time.Now().UTC()))
+
+	err = row.Scan(&role, &id)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return role, id, nil
+}
+
+// CreateTokenInStorage сохраняет хэш нового токена token.Token
+func (s *Storage) CreateTokenInStorage(token Token, ctx context.Context) (id int, err error) {
+	var expiresAt any
+	if token.ExpiresAt != nil {
+		expiresAt = token.ExpiresAt.UTC()
+	}
+
+	var createdBy any
+	if token.CreatedBy != "" {
+		createdBy = token.CreatedBy
+	}
+
+	err = s.queryRow(ctx, s.Db, `INSERT INTO tokens (name, role, token_hash, created_at, expires_at, created_by)
+		VALUES (:name, :role, :hash, :createdAt, :expiresAt, :createdBy) RETURNING id`,
+		sql.Named("name", token.Name),
+		sql.Named("role", token.Role),
+		sql.Named("hash", HashToken(token.Token)),
+		sql.Named("createdAt", time.Now().UTC()),
+		sql.Named("expiresAt", expiresAt),
+		sql.Named("createdBy", createdBy)).
+		Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// CountActiveTokensInStorage возвращает количество действующих токенов роли: не отозванных и не истекших
+func (s *Storage) CountActiveTokensInStorage(role string, ctx context.Context) (count int, err error) {
+	err = s.queryRow(ctx, s.Db, `SELECT COUNT(*) FROM tokens
+		WHERE role = :role AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > :now)`,
+		sql.Named("role", role),
+		sql.Named("now", time.Now().UTC())).
+		Scan(&count)
+	if err != nil {
+		return 0, err
+	}
 
-	err = row.Scan(&roleFromDb)
+	return count, nil
+}
+
+// BootstrapTokenInStorage выпускает token, если в хранилище нет ни одного действующего токена его роли.
+// Так при первом запуске создается токен администратора из настроек. created = false, если такой токен уже был.
+// Если token уже был выпущен и отозван, например это опубликованный начальный токен, возвращает ErrTokenRevoked
+func (s *Storage) BootstrapTokenInStorage(token Token, ctx context.Context) (created bool, err error) {
+	active, err := s.CountActiveTokensInStorage(token.Role, ctx)
+	if err != nil {
+		return false, err
+	}
+	if active > 0 {
+		return false, nil
+	}
+
+	var revoked bool
+	err = s.queryRow(ctx, s.Db, `SELECT revoked_at IS NOT NULL FROM tokens WHERE token_hash = :hash`,
+		sql.Named("hash", HashToken(token.Token))).
+		Scan(&revoked)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return false, err
+	}
+	if revoked {
+		return false, ErrTokenRevoked
+	}
+
+	_, err = s.CreateTokenInStorage(token, ctx)
+	if err != nil {
+		// тот же токен могла одновременно выпустить другая реплика
+		if role, _, checkErr := s.CheckToken(token.Token, ctx); checkErr == nil && role == token.Role {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+// GetTokensFromStorage возвращает все токены без их значений
+func (s *Storage) GetTokensFromStorage(ctx context.Context) (tokens []Token, err error) {
+	rows, err := s.query(ctx, s.Db, `SELECT id, name, role, created_at, expires_at, revoked_at, created_by FROM tokens ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var token Token
+		var expiresAt, revokedAt sql.NullTime
+		var createdBy sql.NullString
+		err = rows.Scan(&token.Id, &token.Name, &token.Role, &token.CreatedAt, &expiresAt, &revokedAt, &createdBy)
+		if err != nil {
+			return nil, err
+		}
+		if expiresAt.Valid {
+			token.ExpiresAt = &expiresAt.Time
+		}
+		if revokedAt.Valid {
+			token.RevokedAt = &revokedAt.Time
+		}
+		token.CreatedBy = createdBy.String
+		tokens = append(tokens, token)
+	}
+
+	return tokens, rows.Err()
+}
+
+// GetTokenCreatorFromStorage возвращает субъект, выпустивший токен, пустой если он неизвестен
+func (s *Storage) GetTokenCreatorFromStorage(id int, ctx context.Context) (createdBy string, err error) {
+	var creator sql.NullString
+	err = s.queryRow(ctx, s.Db, `SELECT created_by FROM tokens WHERE id = :id`, sql.Named("id", id)).
+		Scan(&creator)
 	if err != nil {
 		return "", err
 	}
 
-	if !roleFromDb {
-		return "User", nil
+	return creator.String, nil
+}
+
+// RotateTokenInStorage заменяет значение действующего токена, старое значение перестает работать
+func (s *Storage) RotateTokenInStorage(id int, token string, ctx context.Context) (err error) {
+	result, err := s.exec(ctx, s.Db, `UPDATE tokens SET token_hash = :hash WHERE id = :id AND revoked_at IS NULL`,
+		sql.Named("hash", HashToken(token)),
+		sql.Named("id", id))
+	if err != nil {
+		return err
 	}
 
-	return "Admin", nil
+	return expectAffected(result)
+}
+
+// RevokeTokenInStorage отзывает токен
+func (s *Storage) RevokeTokenInStorage(id int, ctx context.Context) (err error) {
+	result, err := s.exec(ctx, s.Db, `UPDATE tokens SET revoked_at = :now WHERE id = :id AND revoked_at IS NULL`,
+		sql.Named("now", time.Now().UTC()),
+		sql.Named("id", id))
+	if err != nil {
+		return err
+	}
+
+	return expectAffected(result)
+}
+
+// expectAffected возвращает sql.ErrNoRows, если запрос не затронул ни одной строки
+func expectAffected(result sql.Result) error {
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
 
+	return nil
 }
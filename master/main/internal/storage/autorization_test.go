@@ -5,7 +5,11 @@ import (
 	"database/sql"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"io"
+	"log/slog"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestAuthorization(t *testing.T) {
@@ -30,32 +34,38 @@ func TestAuthorization(t *testing.T) {
 		},
 		{
 			name:    "Проверка роли админа",
-			token:   "c1c224b03cd9bc7b6a86d77f5dace40191766c485cd55dc48caf9ac873335d6f",
-			role:    "Admin",
+			token:   "admin-secret",
+			role:    "admin",
 			ctx:     context.Background(),
 			errNeed: false,
 		},
 		{
 			name:    "Проверка роли пользователя",
-			token:   "b512d97e7cbf97c273e4db073bbb547aa65a84589227f8f3d9e4a72b9372a24d",
-			role:    "User",
+			token:   "user-secret",
+			role:    "user",
 			ctx:     context.Background(),
 			errNeed: false,
 		},
 	}
 
-	db, err := sql.Open("sqlite", "storage.db")
+	s, err := New(SqliteDriver, filepath.Join(t.TempDir(), "auth.db"), slog.New(slog.NewTextHandler(io.Discard, nil)), context.Background())
 	if err != nil {
 		t.Fatal(err)
 	}
+	for _, token := range []Token{
+		{Name: "admin", Role: "admin", Token: "admin-secret"},
+		{Name: "user", Role: "user", Token: "user-secret"},
+	} {
+		_, err = s.CreateTokenInStorage(token, context.Background())
+		require.NoError(t, err)
+	}
 
 	for _, tt := range tests {
 		tt := tt
 		t.Run(tt.name, func(t *testing.T) {
 			t.Parallel()
-			s := &Storage{Db: db}
 
-			roleTake, err := s.CheckToken(tt.token, tt.ctx)
+			roleTake, _, err := s.CheckToken(tt.token, tt.ctx)
 			if err != nil {
 				if tt.errNeed {
 					require.Error(t, err)
@@ -67,3 +77,156 @@ func TestAuthorization(t *testing.T) {
 		})
 	}
 }
+
+func TestTokenLifecycle(t *testing.T) {
+	ctx := context.Background()
+
+	for driver, s := range testStorages(t) {
+		s := s
+		t.Run(driver, func(t *testing.T) {
+			id, err := s.CreateTokenInStorage(Token{Name: "editor", Role: "user", Token: "secret-1"}, ctx)
+			require.NoError(t, err)
+
+			role, _, err := s.CheckToken("secret-1", ctx)
+			require.NoError(t, err)
+			assert.Equal(t, "user", role)
+
+			require.NoError(t, s.RotateTokenInStorage(id, "secret-2", ctx))
+			_, _, err = s.CheckToken("secret-1", ctx)
+			assert.ErrorIs(t, err, sql.ErrNoRows)
+			_, _, err = s.CheckToken("secret-2", ctx)
+			require.NoError(t, err)
+
+			require.NoError(t, s.RevokeTokenInStorage(id, ctx))
+			_, _, err = s.CheckToken("secret-2", ctx)
+			assert.ErrorIs(t, err, sql.ErrNoRows)
+			assert.ErrorIs(t, s.RevokeTokenInStorage(id, ctx), sql.ErrNoRows)
+
+			expired := time.Now().Add(-time.Minute)
+			_, err = s.CreateTokenInStorage(Token{Name: "old", Role: "admin", Token: "secret-3", ExpiresAt: &expired}, ctx)
+			require.NoError(t, err)
+			_, _, err = s.CheckToken("secret-3", ctx)
+			assert.ErrorIs(t, err, sql.ErrNoRows)
+
+			future := time.Now().Add(time.Hour)
+			_, err = s.CreateTokenInStorage(Token{Name: "new", Role: "admin", Token: "secret-4", ExpiresAt: &future}, ctx)
+			require.NoError(t, err)
+			role, _, err = s.CheckToken("secret-4", ctx)
+			require.NoError(t, err)
+			assert.Equal(t, "admin", role)
+
+			tokens, err := s.GetTokensFromStorage(ctx)
+			require.NoError(t, err)
+			for _, token := range tokens {
+				assert.Empty(t, token.Token)
+				if token.Id == id {
+					assert.NotNil(t, token.RevokedAt)
+				}
+			}
+
+			var plain int
+			err = s.Db.QueryRow(`SELECT COUNT(*) FROM tokens WHERE token_hash LIKE 'secret%'`).Scan(&plain)
+			require.NoError(t, err)
+			assert.Zero(t, plain)
+		})
+	}
+}
+
+func TestBootstrapToken(t *testing.T) {
+	ctx := context.Background()
+
+	for driver, s := range testStorages(t) {
+		s := s
+		t.Run(driver, func(t *testing.T) {
+			count, err := s.CountActiveTokensInStorage("admin", ctx)
+			require.NoError(t, err)
+			assert.Zero(t, count)
+
+			created, err := s.BootstrapTokenInStorage(Token{Name: "bootstrap admin", Role: "admin", Token: "boot-1"}, ctx)
+			require.NoError(t, err)
+			assert.True(t, created)
+
+			created, err = s.BootstrapTokenInStorage(Token{Name: "bootstrap admin", Role: "admin", Token: "boot-1"}, ctx)
+			require.NoError(t, err)
+			assert.False(t, created)
+
+			role, id, err := s.CheckToken("boot-1", ctx)
+			require.NoError(t, err)
+			assert.Equal(t, "admin", role)
+
+			require.NoError(t, s.RevokeTokenInStorage(id, ctx))
+			created, err = s.BootstrapTokenInStorage(Token{Name: "bootstrap admin", Role: "admin", Token: "boot-2"}, ctx)
+			require.NoError(t, err)
+			assert.True(t, created)
+
+			count, err = s.CountActiveTokensInStorage("admin", ctx)
+			require.NoError(t, err)
+			assert.Equal(t, 1, count)
+
+			// отозванный токен не выпускается снова, даже если действующих токенов роли не осталось
+			_, id, err = s.CheckToken("boot-2", ctx)
+			require.NoError(t, err)
+			require.NoError(t, s.RevokeTokenInStorage(id, ctx))
+			_, err = s.BootstrapTokenInStorage(Token{Name: "bootstrap admin", Role: "admin", Token: "boot-1"}, ctx)
+			assert.ErrorIs(t, err, ErrTokenRevoked)
+		})
+	}
+}
+
+func TestRoles(t *testing.T) {
+	ctx := context.Background()
+	from, to := 12, 20
+
+	for driver, s := range testStorages(t) {
+		s := s
+		t.Run(driver, func(t *testing.T) {
+			roles, err := s.GetRolesFromStorage(ctx)
+			require.NoError(t, err)
+			require.Len(t, roles, 2)
+			assert.Equal(t, "admin", roles[0].Name)
+			assert.Len(t, roles[0].Grants, 4)
+			assert.Equal(t, []Grant{{Permission: "read"}}, roles[1].Grants)
+
+			editor := Role{Name: "editor", Grants: []Grant{
+				{Permission: "read"},
+				{Permission: "write", FeatureFrom: &from, FeatureTo: &to},
+			}}
+			require.NoError(t, s.PutRoleToStorage(editor, ctx))
+			require.NoError(t, s.PutRoleToStorage(editor, ctx))
+
+			roles, err = s.GetRolesFromStorage(ctx)
+			require.NoError(t, err)
+			require.Len(t, roles, 3)
+			assert.Equal(t, editor, roles[1])
+
+			write := roles[1].Grants[1]
+			assert.True(t, write.Scoped())
+			assert.True(t, write.Covers(12))
+			assert.True(t, write.Covers(20))
+			assert.False(t, write.Covers(21))
+
+			id, err := s.CreateTokenInStorage(Token{Name: "team", Role: "editor", Token: "editor-1"}, ctx)
+			require.NoError(t, err)
+			assert.ErrorIs(t, s.DeleteRoleFromStorage("editor", ctx), ErrRoleInUse)
+
+			require.NoError(t, s.RevokeTokenInStorage(id, ctx))
+			require.NoError(t, s.DeleteRoleFromStorage("editor", ctx))
+			assert.ErrorIs(t, s.DeleteRoleFromStorage("editor", ctx), sql.ErrNoRows)
+
+			bannerId, err := s.PostBannerToStorage(Banner{FeatureId: 7, TagIds: []int{1, 2}, Content: []byte(`{}`)}, ctx)
+			require.NoError(t, err)
+			_, err = s.PostBannerToStorage(Banner{FeatureId: 3, TagIds: []int{2}, Content: []byte(`{}`)}, ctx)
+			require.NoError(t, err)
+
+			featureId, err := s.GetBannerFeatureFromStorage(bannerId, ctx)
+			require.NoError(t, err)
+			assert.Equal(t, 7, featureId)
+			_, err = s.GetBannerFeatureFromStorage(bannerId+100, ctx)
+			assert.ErrorIs(t, err, sql.ErrNoRows)
+
+			features, err := s.GetTagFeaturesFromStorage(2, ctx)
+			require.NoError(t, err)
+			assert.Equal(t, []int{3, 7}, features)
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+const (
+	// DraftPending черновик ожидает согласования
+	DraftPending = "pending"
+	// DraftApproved черновик согласован и применен к баннеру
+	DraftApproved = "approved"
+	// DraftRejected черновик отклонен
+	DraftRejected = "rejected"
+)
+
+// Draft черновик изменения баннера. Changes хранит тело PATCH /banner/{id} и применяется только после согласования
+type Draft struct {
+	Id         int             `json:"id"`
+	BannerId   int             `json:"banner_id"`
+	Changes    json.RawMessage `json:"changes"`
+	Status     string          `json:"status"`
+	Author     string          `json:"author"`
+	Reviewer   string          `json:"reviewer,omitempty"`
+	Comment    string          `json:"comment,omitempty"`
+	CreatedAt  time.Time       `json:"created_at"`
+	ReviewedAt *time.Time      `json:"reviewed_at,omitempty"`
+}
+
+const draftColumns = `id, banner_id, changes, status, author, reviewer, comment, created_at, reviewed_at`
+
+// CreateDraftInStorage сохраняет черновик в статусе pending
+func (s *Storage) CreateDraftInStorage(draft Draft, ctx context.Context) (created Draft, err error) {
+	draft.Status = DraftPending
+	draft.CreatedAt = time.Now().UTC()
+
+	err = s.queryRow(ctx, s.Db, `INSERT INTO banner_drafts (banner_id, changes, status, author, created_at)
+		VALUES (:bannerId, :changes, :status, :author, :createdAt) RETURNING id`,
+		sql.Named("bannerId", draft.BannerId),
+		sql.Named("changes", string(draft.Changes)),
+		sql.Named("status", draft.Status),
+		sql.Named("author", draft.Author),
+		sql.Named("createdAt", draft.CreatedAt)).
+		Scan(&draft.Id)
+	if err != nil {
+		return Draft{}, err
+	}
+
+	return draft, nil
+}
+
+// GetDraftsFromStorage возвращает черновики баннера, пустой status не фильтрует по статусу
+func (s *Storage) GetDraftsFromStorage(bannerId int, status string, ctx context.Context) (drafts []Draft, err error) {
+	var queryBuilder strings.Builder
+	queryBuilder.WriteString(`SELECT ` + draftColumns + ` FROM banner_drafts WHERE banner_id = :bannerId`)
+	if status != "" {
+		queryBuilder.WriteString(` AND status = :status`)
+	}
+	queryBuilder.WriteString(` ORDER BY id`)
+
+	rows, err := s.query(ctx, s.Db, queryBuilder.String(),
+		sql.Named("bannerId", bannerId),
+		sql.Named("status", status))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	drafts = []Draft{}
+	for rows.Next() {
+		draft, err := scanDraft(rows)
+		if err != nil {
+			return nil, err
+		}
+		drafts = append(drafts, draft)
+	}
+
+	return drafts, rows.Err()
+}
+
+// GetDraftFromStorage возвращает черновик баннера, sql.ErrNoRows если черновик не принадлежит баннеру
+func (s *Storage) GetDraftFromStorage(bannerId, id int, ctx context.Context) (draft Draft, err error) {
+	row := s.queryRow(ctx, s.Db, `SELECT `+draftColumns+` FROM banner_drafts WHERE id = :id AND banner_id = :bannerId`,
+		sql.Named("id", id),
+		sql.Named("bannerId", bannerId))
+
+	return scanDraft(row)
+}
+
+// UpdateDraftStatusInStorage переводит черновик из статуса from в to.
+// sql.ErrNoRows если черновик уже не в статусе from, поэтому один черновик не рассматривается дважды
+func (s *Storage) UpdateDraftStatusInStorage(id int, from, to, reviewer, comment string, ctx context.Context) (err error) {
+	var reviewedAt any
+	if to != DraftPending {
+		reviewedAt = time.Now().UTC()
+	}
+
+	result, err := s.exec(ctx, s.Db, `UPDATE banner_drafts
+		SET status = :to, reviewer = :reviewer, comment = :comment, reviewed_at = :reviewedAt
+		WHERE id = :id AND status = :from`,
+		sql.Named("to", to),
+		sql.Named("reviewer", nullString(reviewer)),
+		sql.Named("comment", nullString(comment)),
+		sql.Named("reviewedAt", reviewedAt),
+		sql.Named("id", id),
+		sql.Named("from", from))
+	if err != nil {
+		return err
+	}
+
+	return expectAffected(result)
+}
+
+// GetFeatureWorkflowFromStorage сообщает, требуют ли изменения баннеров фичи согласования. По умолчанию не требуют
+func (s *Storage) GetFeatureWorkflowFromStorage(featureId int, ctx context.Context) (reviewRequired bool, err error) {
+	err = s.queryRow(ctx, s.Db, `SELECT review_required FROM feature_workflows WHERE feature_id = :featureId`,
+		sql.Named("featureId", featureId)).
+		Scan(&reviewRequired)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+
+	return reviewRequired, err
+}
+
+// PutFeatureWorkflowToStorage включает или выключает согласование изменений баннеров фичи
+func (s *Storage) PutFeatureWorkflowToStorage(featureId int, reviewRequired bool, ctx context.Context) (err error) {
+	_, err = s.exec(ctx, s.Db, `INSERT INTO feature_workflows (feature_id, review_required, updated_at)
+		VALUES (:featureId, :reviewRequired, :now)
+		ON CONFLICT (feature_id) DO UPDATE SET review_required = excluded.review_required, updated_at = excluded.updated_at`,
+		sql.Named("featureId", featureId),
+		sql.Named("reviewRequired", reviewRequired),
+		sql.Named("now", time.Now().UTC()))
+
+	return err
+}
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanDraft(row scanner) (Draft, error) {
+	var draft Draft
+	var changes string
+	var reviewer, comment sql.NullString
+	var reviewedAt sql.NullTime
+
+	err := row.Scan(&draft.Id, &draft.BannerId, &changes, &draft.Status, &draft.Author,
+		&reviewer, &comment, &draft.CreatedAt, &reviewedAt)
+	if err != nil {
+		return Draft{}, err
+	}
+
+	draft.Changes = json.RawMessage(changes)
+	draft.Reviewer = reviewer.String
+	draft.Comment = comment.String
+	if reviewedAt.Valid {
+		t := reviewedAt.Time
+		draft.ReviewedAt = &t
+	}
+
+	return draft, nil
+}
+
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
@@ -0,0 +1,99 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+const (
+	SqliteDriver   = "sqlite"
+	PostgresDriver = "postgres"
+)
+
+// execer общий интерфейс для *sql.DB и *sql.Tx
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+func (s *Storage) exec(ctx context.Context, e execer, query string, args ...any) (sql.Result, error) {
+	query, args = s.bind(query, args)
+	return e.ExecContext(ctx, query, args...)
+}
+
+func (s *Storage) query(ctx context.Context, e execer, query string, args ...any) (*sql.Rows, error) {
+	query, args = s.bind(query, args)
+	return e.QueryContext(ctx, query, args...)
+}
+
+func (s *Storage) queryRow(ctx context.Context, e execer, query string, args ...any) *sql.Row {
+	query, args = s.bind(query, args)
+	return e.QueryRowContext(ctx, query, args...)
+}
+
+// bind переписывает именованные параметры вида :name в позиционные $n,
+// так как драйвер postgres не поддерживает sql.Named
+func (s *Storage) bind(query string, args []any) (string, []any) {
+	if s.Driver != PostgresDriver {
+		return query, args
+	}
+
+	named := make(map[string]any, len(args))
+	for _, arg := range args {
+		if n, ok := arg.(sql.NamedArg); ok {
+			named[n.Name] = n.Value
+		}
+	}
+
+	var b strings.Builder
+	var res []any
+	positions := map[string]int{}
+
+	for i := 0; i < len(query); i++ {
+		ch := query[i]
+
+		if ch == '\'' {
+			end := strings.IndexByte(query[i+1:], '\'')
+			if end < 0 {
+				b.WriteString(query[i:])
+				break
+			}
+			b.WriteString(query[i : i+end+2])
+			i += end + 1
+			continue
+		}
+
+		if ch == ':' && i+1 < len(query) && isIdentStart(query[i+1]) && (i == 0 || query[i-1] != ':') {
+			j := i + 1
+			for j < len(query) && isIdent(query[j]) {
+				j++
+			}
+			name := query[i+1 : j]
+
+			pos, ok := positions[name]
+			if !ok {
+				res = append(res, named[name])
+				pos = len(res)
+				positions[name] = pos
+			}
+			fmt.Fprintf(&b, "$%d", pos)
+			i = j - 1
+			continue
+		}
+
+		b.WriteByte(ch)
+	}
+
+	return b.String(), res
+}
+
+func isIdentStart(ch byte) bool {
+	return ch == '_' || (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z')
+}
+
+func isIdent(ch byte) bool {
+	return isIdentStart(ch) || (ch >= '0' && ch <= '9')
+}
@@ -0,0 +1,290 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"strconv"
+	"time"
+)
+
+// ErrExperimentConflict у пары фича-тег уже есть эксперимент
+var ErrExperimentConflict = errors.New("feature and tag already have an experiment")
+
+// Variant вариант баннера в эксперименте. Доля пользователей, получающих вариант, пропорциональна Weight
+type Variant struct {
+	VariantId int             `json:"variant_id,omitempty"`
+	Name      string          `json:"name"`
+	Content   json.RawMessage `json:"content"`
+	Weight    int             `json:"weight"`
+}
+
+// Experiment A/B эксперимент по паре фича-тег. Пока он включен, пользователь с идентификатором
+// получает вместо баннера пары один из вариантов, всегда один и тот же
+type Experiment struct {
+	ExperimentId int       `json:"experiment_id,omitempty"`
+	FeatureId    int       `json:"feature_id"`
+	TagId        int       `json:"tag_id"`
+	Name         string    `json:"name"`
+	IsActive     bool      `json:"is_active"`
+	Variants     []Variant `json:"variants"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// ExperimentUpdate изменение эксперимента: включение и веса вариантов. Не указанные поля не меняются
+type ExperimentUpdate struct {
+	ExperimentId int       `json:"-"`
+	IsActive     *bool     `json:"is_active,omitempty"`
+	Variants     []Variant `json:"variants,omitempty"`
+}
+
+// Assign выбирает вариант для пользователя по хешу идентификаторов эксперимента и пользователя.
+// Выбор не меняется, пока не меняются веса, ok = false если у всех вариантов нулевой вес
+func (e Experiment) Assign(userId string) (variant Variant, ok bool) {
+	total := 0
+	for _, v := range e.Variants {
+		total += v.Weight
+	}
+	if total <= 0 {
+		return Variant{}, false
+	}
+
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(strconv.Itoa(e.ExperimentId) + ":" + userId))
+	bucket := int(h.Sum64() % uint64(total))
+
+	for _, v := range e.Variants {
+		if bucket < v.Weight {
+			return v, true
+		}
+		bucket -= v.Weight
+	}
+
+	return Variant{}, false
+}
+
+const experimentColumns = `id, feature_id, tag_id, name, is_active, created_at, updated_at`
+
+// PostExperimentToStorage создает эксперимент с вариантами, ErrExperimentConflict если у пары фича-тег он уже есть
+func (s *Storage) PostExperimentToStorage(experiment Experiment, ctx context.Context) (id int, err error) {
+	tx, err := s.Db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err != nil {
+			err := tx.Rollback()
+			if err != nil {
+				return
+			}
+			return
+		}
+		_ = tx.Commit()
+	}()
+
+	var used int
+	err = s.queryRow(ctx, tx, `SELECT COUNT(*) FROM experiments WHERE feature_id = :featureId AND tag_id = :tagId`,
+		sql.Named("featureId", experiment.FeatureId),
+		sql.Named("tagId", experiment.TagId)).
+		Scan(&used)
+	if err != nil {
+		return 0, err
+	}
+	if used > 0 {
+		return 0, ErrExperimentConflict
+	}
+
+	now := time.Now().UTC()
+	err = s.queryRow(ctx, tx, `INSERT INTO experiments (feature_id, tag_id, name, is_active, created_at, updated_at)
+		VALUES (:featureId, :tagId, :name, :isActive, :now, :now) RETURNING id`,
+		sql.Named("featureId", experiment.FeatureId),
+		sql.Named("tagId", experiment.TagId),
+		sql.Named("name", experiment.Name),
+		sql.Named("isActive", experiment.IsActive),
+		sql.Named("now", now)).
+		Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, variant := range experiment.Variants {
+		_, err = s.exec(ctx, tx, `INSERT INTO experiment_variants (experiment_id, name, content, weight)
+			VALUES (:experimentId, :name, :content, :weight)`,
+			sql.Named("experimentId", id),
+			sql.Named("name", variant.Name),
+			sql.Named("content", string(variant.Content)),
+			sql.Named("weight", variant.Weight))
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return id, nil
+}
+
+// GetExperimentsFromStorage возвращает эксперименты с вариантами, featureId = 0 не фильтрует по фиче
+func (s *Storage) GetExperimentsFromStorage(featureId int, ctx context.Context) (experiments []Experiment, err error) {
+	query := `SELECT ` + experimentColumns + ` FROM experiments`
+	if featureId != 0 {
+		query += ` WHERE feature_id = :featureId`
+	}
+
+	rows, err := s.query(ctx, s.Db, query+` ORDER BY id`, sql.Named("featureId", featureId))
+	if err != nil {
+		return nil, err
+	}
+
+	experiments = []Experiment{}
+	for rows.Next() {
+		experiment, err := scanExperiment(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		experiments = append(experiments, experiment)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range experiments {
+		experiments[i].Variants, err = s.variants(ctx, experiments[i].ExperimentId)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return experiments, nil
+}
+
+// GetExperimentFromStorage возвращает эксперимент с вариантами, sql.ErrNoRows если его нет
+func (s *Storage) GetExperimentFromStorage(id int, ctx context.Context) (experiment Experiment, err error) {
+	row := s.queryRow(ctx, s.Db, `SELECT `+experimentColumns+` FROM experiments WHERE id = :id`, sql.Named("id", id))
+
+	experiment, err = scanExperiment(row)
+	if err != nil {
+		return Experiment{}, err
+	}
+
+	experiment.Variants, err = s.variants(ctx, id)
+	if err != nil {
+		return Experiment{}, err
+	}
+
+	return experiment, nil
+}
+
+// UpdateExperimentInStorage включает или выключает эксперимент и меняет веса указанных вариантов.
+// sql.ErrNoRows если эксперимента или одного из вариантов нет
+func (s *Storage) UpdateExperimentInStorage(update ExperimentUpdate, ctx context.Context) (err error) {
+	tx, err := s.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			err := tx.Rollback()
+			if err != nil {
+				return
+			}
+			return
+		}
+		_ = tx.Commit()
+	}()
+
+	var isActive any
+	if update.IsActive != nil {
+		isActive = *update.IsActive
+	}
+
+	result, err := s.exec(ctx, tx, `UPDATE experiments SET is_active = COALESCE(:isActive, is_active), updated_at = :now WHERE id = :id`,
+		sql.Named("isActive", isActive),
+		sql.Named("now", time.Now().UTC()),
+		sql.Named("id", update.ExperimentId))
+	if err != nil {
+		return err
+	}
+	if err = expectAffected(result); err != nil {
+		return err
+	}
+
+	for _, variant := range update.Variants {
+		result, err = s.exec(ctx, tx, `UPDATE experiment_variants SET weight = :weight WHERE id = :variantId AND experiment_id = :experimentId`,
+			sql.Named("weight", variant.Weight),
+			sql.Named("variantId", variant.VariantId),
+			sql.Named("experimentId", update.ExperimentId))
+		if err != nil {
+			return err
+		}
+		if err = expectAffected(result); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DeleteExperimentFromStorage удаляет эксперимент с вариантами, sql.ErrNoRows если его нет
+func (s *Storage) DeleteExperimentFromStorage(id int, ctx context.Context) (err error) {
+	tx, err := s.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			err := tx.Rollback()
+			if err != nil {
+				return
+			}
+			return
+		}
+		_ = tx.Commit()
+	}()
+
+	_, err = s.exec(ctx, tx, `DELETE FROM experiment_variants WHERE experiment_id = :id`, sql.Named("id", id))
+	if err != nil {
+		return err
+	}
+
+	result, err := s.exec(ctx, tx, `DELETE FROM experiments WHERE id = :id`, sql.Named("id", id))
+	if err != nil {
+		return err
+	}
+
+	return expectAffected(result)
+}
+
+// variants возвращает варианты эксперимента в порядке создания
+func (s *Storage) variants(ctx context.Context, experimentId int) (variants []Variant, err error) {
+	rows, err := s.query(ctx, s.Db, `SELECT id, name, content, weight FROM experiment_variants WHERE experiment_id = :id ORDER BY id`,
+		sql.Named("id", experimentId))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	variants = []Variant{}
+	for rows.Next() {
+		var variant Variant
+		var content string
+		if err := rows.Scan(&variant.VariantId, &variant.Name, &content, &variant.Weight); err != nil {
+			return nil, err
+		}
+		variant.Content = json.RawMessage(content)
+		variants = append(variants, variant)
+	}
+
+	return variants, rows.Err()
+}
+
+func scanExperiment(row scanner) (experiment Experiment, err error) {
+	err = row.Scan(&experiment.ExperimentId, &experiment.FeatureId, &experiment.TagId, &experiment.Name, &experiment.IsActive,
+		&experiment.CreatedAt, &experiment.UpdatedAt)
+
+	return experiment, err
+}
@@ -0,0 +1,216 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//go:embed migrations/*/*.sql
+var migrationsFS embed.FS
+
+// ErrSchemaTooNew база данных мигрирована более новой версией приложения
+var ErrSchemaTooNew = errors.New("database schema is newer than the application")
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Migrations возвращает упорядоченный по версии список миграций драйвера.
+// Файлы миграций лежат в migrations/<driver>/<version>_<name>.<up|down>.sql
+func Migrations(driver string) ([]Migration, error) {
+	dir := path.Join("migrations", driver)
+
+	entries, err := migrationsFS.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int]*Migration{}
+	for _, entry := range entries {
+		name := strings.TrimSuffix(entry.Name(), ".sql")
+		base, direction, ok := cutLast(name, ".")
+		if !ok || (direction != "up" && direction != "down") {
+			return nil, fmt.Errorf("bad migration file name %q", entry.Name())
+		}
+
+		num, title, _ := strings.Cut(base, "_")
+		version, err := strconv.Atoi(num)
+		if err != nil {
+			return nil, fmt.Errorf("bad migration file name %q: %w", entry.Name(), err)
+		}
+
+		body, err := migrationsFS.ReadFile(path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: title}
+			byVersion[version] = m
+		}
+
+		if direction == "up" {
+			m.Up = string(body)
+		} else {
+			m.Down = string(body)
+		}
+	}
+
+	res := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		res = append(res, *m)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Version < res[j].Version })
+
+	for i, m := range res {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf("migration %d is missing", i+1)
+		}
+	}
+
+	return res, nil
+}
+
+// SchemaVersion возвращает номер последней примененной миграции
+func (s *Storage) SchemaVersion(ctx context.Context) (version int, err error) {
+	_, err = s.Db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`)
+	if err != nil {
+		return 0, err
+	}
+
+	var v sql.NullInt64
+	err = s.queryRow(ctx, s.Db, `SELECT MAX(version) FROM schema_migrations`).Scan(&v)
+	if err != nil {
+		return 0, err
+	}
+
+	return int(v.Int64), nil
+}
+
+// Migrate применяет все непримененные миграции
+func (s *Storage) Migrate(ctx context.Context) error {
+	migrations, err := Migrations(s.Driver)
+	if err != nil {
+		return err
+	}
+
+	return s.MigrateTo(ctx, len(migrations))
+}
+
+// MigrateTo приводит схему к указанной версии, применяя up или down миграции по порядку.
+// Каждая миграция выполняется в отдельной транзакции
+func (s *Storage) MigrateTo(ctx context.Context, target int) error {
+	migrations, err := Migrations(s.Driver)
+	if err != nil {
+		return err
+	}
+
+	if target < 0 || target > len(migrations) {
+		return fmt.Errorf("unknown schema version %d, latest is %d", target, len(migrations))
+	}
+
+	current, err := s.SchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+
+	if current > len(migrations) {
+		return fmt.Errorf("%w: database version %d, latest known %d", ErrSchemaTooNew, current, len(migrations))
+	}
+
+	for current < target {
+		m := migrations[current]
+		err = s.applyMigration(ctx, m.Up, `INSERT INTO schema_migrations (version) VALUES (:version)`, m.Version)
+		if err != nil {
+			return fmt.Errorf("migration %d_%s up: %w", m.Version, m.Name, err)
+		}
+		current++
+	}
+
+	for current > target {
+		m := migrations[current-1]
+		err = s.applyMigration(ctx, m.Down, `DELETE FROM schema_migrations WHERE version = :version`, m.Version)
+		if err != nil {
+			return fmt.Errorf("migration %d_%s down: %w", m.Version, m.Name, err)
+		}
+		current--
+	}
+
+	return nil
+}
+
+func (s *Storage) applyMigration(ctx context.Context, script, record string, version int) (err error) {
+	tx, err := s.Db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if err != nil {
+			err := tx.Rollback()
+			if err != nil {
+				return
+			}
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	for _, stmt := range splitStatements(script) {
+		_, err = tx.ExecContext(ctx, stmt)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = s.exec(ctx, tx, record, sql.Named("version", version))
+	return err
+}
+
+// splitStatements разбивает скрипт миграции на отдельные запросы по ';' вне строковых литералов
+func splitStatements(script string) []string {
+	var res []string
+	var b strings.Builder
+	inString := false
+
+	for _, ch := range script {
+		switch {
+		case ch == '\'':
+			inString = !inString
+		case ch == ';' && !inString:
+			if stmt := strings.TrimSpace(b.String()); stmt != "" {
+				res = append(res, stmt)
+			}
+			b.Reset()
+			continue
+		}
+		b.WriteRune(ch)
+	}
+
+	if stmt := strings.TrimSpace(b.String()); stmt != "" {
+		res = append(res, stmt)
+	}
+
+	return res
+}
+
+func cutLast(s, sep string) (before, after string, found bool) {
+	if i := strings.LastIndex(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
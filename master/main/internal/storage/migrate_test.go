@@ -0,0 +1,103 @@
+package sqlite
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"testing"
+)
+
+func TestMigrations(t *testing.T) {
+	for _, driver := range []string{SqliteDriver, PostgresDriver} {
+		migrations, err := Migrations(driver)
+		require.NoError(t, err)
+		require.NotEmpty(t, migrations)
+
+		for i, m := range migrations {
+			assert.Equal(t, i+1, m.Version)
+			assert.NotEmpty(t, m.Up, "%s %d up", driver, m.Version)
+			assert.NotEmpty(t, m.Down, "%s %d down", driver, m.Version)
+		}
+	}
+}
+
+func TestMigrateUpDown(t *testing.T) {
+	ctx := context.Background()
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	dbPath := filepath.Join(t.TempDir(), "migrate.db")
+
+	s, err := New(SqliteDriver, dbPath, log, ctx)
+	require.NoError(t, err)
+	defer s.Db.Close()
+
+	migrations, err := Migrations(SqliteDriver)
+	require.NoError(t, err)
+
+	version, err := s.SchemaVersion(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, len(migrations), version)
+
+	_, _, err = s.CheckToken("c1c224b03cd9bc7b6a86d77f5dace40191766c485cd55dc48caf9ac873335d6f", ctx)
+	assert.Error(t, err)
+
+	require.NoError(t, s.MigrateTo(ctx, 0))
+
+	version, err = s.SchemaVersion(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, version)
+
+	_, err = s.Db.Exec(`SELECT COUNT(*) FROM banners`)
+	assert.Error(t, err)
+
+	require.NoError(t, s.Migrate(ctx))
+
+	_, err = s.Db.Exec(`INSERT INTO schema_migrations (version) VALUES (?)`, len(migrations)+1)
+	require.NoError(t, err)
+
+	_, err = New(SqliteDriver, dbPath, log, ctx)
+	assert.ErrorIs(t, err, ErrSchemaTooNew)
+}
+
+// TestMigrateLegacySeeds начальные токены базы прежней версии отзываются, а откат 0012 возвращает их
+func TestMigrateLegacySeeds(t *testing.T) {
+	ctx := context.Background()
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	dbPath := filepath.Join(t.TempDir(), "legacy.db")
+
+	legacy, err := Open(SqliteDriver, dbPath)
+	require.NoError(t, err)
+	_, err = legacy.Db.Exec(`CREATE TABLE Users (Role BOOLEAN, Token TEXT PRIMARY KEY)`)
+	require.NoError(t, err)
+	_, err = legacy.Db.Exec(`INSERT INTO Users (Role, Token) VALUES
+		('true', 'c1c224b03cd9bc7b6a86d77f5dace40191766c485cd55dc48caf9ac873335d6f'),
+		('false', 'b512d97e7cbf97c273e4db073bbb547aa65a84589227f8f3d9e4a72b9372a24d')`)
+	require.NoError(t, err)
+	require.NoError(t, legacy.Db.Close())
+
+	s, err := New(SqliteDriver, dbPath, log, ctx)
+	require.NoError(t, err)
+	defer s.Db.Close()
+
+	tokens, err := s.GetTokensFromStorage(ctx)
+	require.NoError(t, err)
+	require.Len(t, tokens, 2)
+	for _, token := range tokens {
+		assert.NotNil(t, token.RevokedAt, token.Name)
+	}
+
+	_, _, err = s.CheckToken("c1c224b03cd9bc7b6a86d77f5dace40191766c485cd55dc48caf9ac873335d6f", ctx)
+	assert.Error(t, err)
+
+	require.NoError(t, s.MigrateTo(ctx, 11))
+	role, _, err := s.CheckToken("c1c224b03cd9bc7b6a86d77f5dace40191766c485cd55dc48caf9ac873335d6f", ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "admin", role)
+}
+
+func TestSplitStatements(t *testing.T) {
+	stmts := splitStatements("CREATE TABLE a (x TEXT);\n\nINSERT INTO a VALUES ('a;b');\n")
+	assert.Equal(t, []string{"CREATE TABLE a (x TEXT)", "INSERT INTO a VALUES ('a;b')"}, stmts)
+}
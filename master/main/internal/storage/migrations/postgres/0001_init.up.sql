@@ -0,0 +1,47 @@
+CREATE TABLE IF NOT EXISTS banners (
+	id SERIAL PRIMARY KEY,
+	feature_id INTEGER,
+	content TEXT,
+	is_active BOOLEAN,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS banner_tags (
+	id SERIAL PRIMARY KEY,
+	banner_id INTEGER REFERENCES banners(id),
+	tag_id INTEGER,
+	feature_id INTEGER,
+	UNIQUE(tag_id, feature_id)
+);
+
+CREATE TABLE IF NOT EXISTS banner_versions (
+	id SERIAL PRIMARY KEY,
+	banner_id INTEGER REFERENCES banners(id),
+	feature_id INTEGER,
+	content TEXT,
+	is_active BOOLEAN,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS banner_versions_tags (
+	id SERIAL PRIMARY KEY,
+	banner_version_id INTEGER REFERENCES banner_versions(id),
+	banner_id INTEGER,
+	tag_id INTEGER,
+	feature_id INTEGER
+);
+
+CREATE TABLE IF NOT EXISTS Users (
+	Role BOOLEAN,
+	Token TEXT PRIMARY KEY
+);
+
+INSERT INTO Users (Role, Token)
+SELECT role, token FROM (
+	SELECT TRUE AS role, 'c1c224b03cd9bc7b6a86d77f5dace40191766c485cd55dc48caf9ac873335d6f' AS token
+	UNION ALL
+	SELECT FALSE, 'b512d97e7cbf97c273e4db073bbb547aa65a84589227f8f3d9e4a72b9372a24d'
+) seed
+WHERE NOT EXISTS (SELECT 1 FROM Users);
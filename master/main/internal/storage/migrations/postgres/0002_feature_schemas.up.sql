@@ -0,0 +1,6 @@
+CREATE TABLE feature_schemas (
+	feature_id INTEGER PRIMARY KEY,
+	schema TEXT NOT NULL,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,14 @@
+CREATE TABLE Users (
+	Role BOOLEAN,
+	Token TEXT PRIMARY KEY
+);
+
+INSERT INTO Users (Role, Token)
+SELECT TRUE, 'c1c224b03cd9bc7b6a86d77f5dace40191766c485cd55dc48caf9ac873335d6f'
+FROM tokens WHERE token_hash = '68597891389543d8004058d4069db8be0548a3851c169f0bc76343982d65b224';
+
+INSERT INTO Users (Role, Token)
+SELECT FALSE, 'b512d97e7cbf97c273e4db073bbb547aa65a84589227f8f3d9e4a72b9372a24d'
+FROM tokens WHERE token_hash = '68a8c532cc57bfd2b0c47f3c8c760c7cf422053499ae09ab34578c2f86e9df82';
+
+DROP TABLE tokens;
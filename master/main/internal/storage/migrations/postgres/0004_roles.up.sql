@@ -0,0 +1,21 @@
+CREATE TABLE roles (
+	name TEXT PRIMARY KEY
+);
+
+-- право роли, пустые границы feature_from и feature_to не ограничивают фичи
+CREATE TABLE role_grants (
+	id SERIAL PRIMARY KEY,
+	role TEXT NOT NULL,
+	permission TEXT NOT NULL,
+	feature_from INTEGER,
+	feature_to INTEGER,
+	FOREIGN KEY(role) REFERENCES roles(name)
+);
+
+INSERT INTO roles (name) VALUES ('admin');
+INSERT INTO roles (name) VALUES ('user');
+
+INSERT INTO role_grants (role, permission) VALUES ('admin', 'read');
+INSERT INTO role_grants (role, permission) VALUES ('admin', 'write');
+INSERT INTO role_grants (role, permission) VALUES ('admin', 'manage');
+INSERT INTO role_grants (role, permission) VALUES ('user', 'read');
@@ -0,0 +1,7 @@
+ALTER TABLE banner_versions DROP COLUMN active_until;
+
+ALTER TABLE banner_versions DROP COLUMN active_from;
+
+ALTER TABLE banners DROP COLUMN active_until;
+
+ALTER TABLE banners DROP COLUMN active_from;
@@ -0,0 +1,7 @@
+ALTER TABLE banners ADD COLUMN active_from TIMESTAMP;
+
+ALTER TABLE banners ADD COLUMN active_until TIMESTAMP;
+
+ALTER TABLE banner_versions ADD COLUMN active_from TIMESTAMP;
+
+ALTER TABLE banner_versions ADD COLUMN active_until TIMESTAMP;
@@ -0,0 +1 @@
+ALTER TABLE banner_versions DROP COLUMN versioned_at;
@@ -0,0 +1,23 @@
+-- фичи, изменения баннеров которых проходят согласование
+CREATE TABLE feature_workflows (
+	feature_id INTEGER PRIMARY KEY,
+	review_required BOOLEAN NOT NULL,
+	updated_at TIMESTAMP NOT NULL
+);
+
+-- черновик изменения баннера: тело PATCH /banner/{id}, ожидающее согласования
+CREATE TABLE banner_drafts (
+	id SERIAL PRIMARY KEY,
+	banner_id INTEGER NOT NULL REFERENCES banners(id),
+	changes TEXT NOT NULL,
+	status TEXT NOT NULL,
+	author TEXT NOT NULL,
+	reviewer TEXT,
+	comment TEXT,
+	created_at TIMESTAMP NOT NULL,
+	reviewed_at TIMESTAMP
+);
+
+CREATE INDEX banner_drafts_banner_id ON banner_drafts (banner_id, status);
+
+INSERT INTO role_grants (role, permission) VALUES ('admin', 'approve');
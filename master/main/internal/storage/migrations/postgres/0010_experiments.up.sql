@@ -0,0 +1,24 @@
+-- A/B эксперимент: пока он включен, пользователи с идентификатором получают по паре фича-тег один из его вариантов
+CREATE TABLE experiments (
+	id SERIAL PRIMARY KEY,
+	feature_id INTEGER NOT NULL,
+	tag_id INTEGER NOT NULL,
+	name TEXT NOT NULL,
+	is_active BOOLEAN NOT NULL,
+	created_at TIMESTAMP NOT NULL,
+	updated_at TIMESTAMP NOT NULL
+);
+
+-- у пары фича-тег не больше одного эксперимента
+CREATE UNIQUE INDEX experiments_feature_tag ON experiments (feature_id, tag_id);
+
+-- вариант эксперимента со своим контентом, доля пользователей пропорциональна весу
+CREATE TABLE experiment_variants (
+	id SERIAL PRIMARY KEY,
+	experiment_id INTEGER NOT NULL REFERENCES experiments(id),
+	name TEXT NOT NULL,
+	content TEXT NOT NULL,
+	weight INTEGER NOT NULL
+);
+
+CREATE INDEX experiment_variants_experiment_id ON experiment_variants (experiment_id);
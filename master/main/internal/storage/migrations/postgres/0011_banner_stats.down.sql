@@ -0,0 +1 @@
+DROP TABLE banner_stats;
@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS Users;
+DROP TABLE IF EXISTS banner_versions_tags;
+DROP TABLE IF EXISTS banner_versions;
+DROP TABLE IF EXISTS banner_tags;
+DROP TABLE IF EXISTS banners;
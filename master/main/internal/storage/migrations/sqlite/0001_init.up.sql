@@ -0,0 +1,50 @@
+CREATE TABLE IF NOT EXISTS banners (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	feature_id INTEGER,
+	content TEXT,
+	is_active BOOLEAN,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS banner_tags (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	banner_id INTEGER,
+	tag_id INTEGER,
+	feature_id INTEGER,
+	FOREIGN KEY(banner_id) REFERENCES banners(id),
+	UNIQUE(tag_id, feature_id)
+);
+
+CREATE TABLE IF NOT EXISTS banner_versions (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	banner_id INTEGER,
+	feature_id INTEGER,
+	content TEXT,
+	is_active BOOLEAN,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	FOREIGN KEY(banner_id) REFERENCES banners(id)
+);
+
+CREATE TABLE IF NOT EXISTS banner_versions_tags (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	banner_version_id INTEGER,
+	banner_id INTEGER,
+	tag_id INTEGER,
+	feature_id INTEGER,
+	FOREIGN KEY(banner_version_id) REFERENCES banner_versions(id)
+);
+
+CREATE TABLE IF NOT EXISTS Users (
+	Role BOOLEAN,
+	Token TEXT PRIMARY KEY
+);
+
+INSERT INTO Users (Role, Token)
+SELECT role, token FROM (
+	SELECT 'true' AS role, 'c1c224b03cd9bc7b6a86d77f5dace40191766c485cd55dc48caf9ac873335d6f' AS token
+	UNION ALL
+	SELECT 'false', 'b512d97e7cbf97c273e4db073bbb547aa65a84589227f8f3d9e4a72b9372a24d'
+) seed
+WHERE NOT EXISTS (SELECT 1 FROM Users);
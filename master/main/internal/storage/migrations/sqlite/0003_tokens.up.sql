@@ -0,0 +1,20 @@
+CREATE TABLE tokens (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT NOT NULL,
+	role TEXT NOT NULL,
+	token_hash TEXT NOT NULL UNIQUE,
+	created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+	expires_at TIMESTAMP,
+	revoked_at TIMESTAMP
+);
+
+-- токены хранятся только в виде sha256, поэтому переносятся лишь известные начальные токены
+INSERT INTO tokens (name, role, token_hash)
+SELECT 'seed admin', 'admin', '68597891389543d8004058d4069db8be0548a3851c169f0bc76343982d65b224'
+FROM Users WHERE Token = 'c1c224b03cd9bc7b6a86d77f5dace40191766c485cd55dc48caf9ac873335d6f';
+
+INSERT INTO tokens (name, role, token_hash)
+SELECT 'seed user', 'user', '68a8c532cc57bfd2b0c47f3c8c760c7cf422053499ae09ab34578c2f86e9df82'
+FROM Users WHERE Token = 'b512d97e7cbf97c273e4db073bbb547aa65a84589227f8f3d9e4a72b9372a24d';
+
+DROP TABLE Users;
@@ -0,0 +1,3 @@
+DROP TABLE role_grants;
+
+DROP TABLE roles;
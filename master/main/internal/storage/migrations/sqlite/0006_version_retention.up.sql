@@ -0,0 +1,7 @@
+-- момент, когда состояние баннера ушло в историю, по нему работает хранение по возрасту
+ALTER TABLE banner_versions ADD COLUMN versioned_at TIMESTAMP;
+
+UPDATE banner_versions SET versioned_at = updated_at;
+
+-- теги удаленных версий: прежняя очистка искала их по banner_id вместо banner_version_id
+DELETE FROM banner_versions_tags WHERE banner_version_id NOT IN (SELECT id FROM banner_versions);
@@ -0,0 +1,5 @@
+DELETE FROM role_grants WHERE permission = 'approve';
+
+DROP TABLE banner_drafts;
+
+DROP TABLE feature_workflows;
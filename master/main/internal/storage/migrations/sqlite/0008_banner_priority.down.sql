@@ -0,0 +1 @@
+ALTER TABLE banners DROP COLUMN priority;
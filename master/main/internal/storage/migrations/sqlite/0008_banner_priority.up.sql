@@ -0,0 +1 @@
+ALTER TABLE banners ADD COLUMN priority INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,7 @@
+ALTER TABLE banner_versions DROP COLUMN is_default;
+
+ALTER TABLE banner_versions DROP COLUMN priority;
+
+DROP INDEX banners_default_feature;
+
+ALTER TABLE banners DROP COLUMN is_default;
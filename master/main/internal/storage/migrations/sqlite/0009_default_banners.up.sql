@@ -0,0 +1,8 @@
+ALTER TABLE banners ADD COLUMN is_default BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- у фичи не больше одного баннера по умолчанию
+CREATE UNIQUE INDEX banners_default_feature ON banners (feature_id) WHERE is_default;
+
+ALTER TABLE banner_versions ADD COLUMN priority INTEGER NOT NULL DEFAULT 0;
+
+ALTER TABLE banner_versions ADD COLUMN is_default BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1,11 @@
+-- показы и клики баннера за день (UTC), cached - показы, отданные из кэша
+CREATE TABLE banner_stats (
+	banner_id INTEGER NOT NULL,
+	day TEXT NOT NULL,
+	impressions INTEGER NOT NULL DEFAULT 0,
+	cached INTEGER NOT NULL DEFAULT 0,
+	clicks INTEGER NOT NULL DEFAULT 0,
+	PRIMARY KEY (banner_id, day)
+);
+
+CREATE INDEX banner_stats_day ON banner_stats (day);
@@ -0,0 +1,4 @@
+-- начальные токены снова действуют, как до 0012
+UPDATE tokens SET revoked_at = NULL
+WHERE token_hash IN ('68597891389543d8004058d4069db8be0548a3851c169f0bc76343982d65b224',
+	'68a8c532cc57bfd2b0c47f3c8c760c7cf422053499ae09ab34578c2f86e9df82');
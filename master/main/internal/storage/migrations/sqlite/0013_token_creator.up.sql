@@ -0,0 +1,2 @@
+-- субъект, выпустивший токен: token:<id> или jwt:<sub>. Пустой у токенов, выпущенных при запуске
+ALTER TABLE tokens ADD COLUMN created_by TEXT;
@@ -0,0 +1,182 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+)
+
+// ErrRoleInUse роль нельзя удалить, пока на нее выписаны действующие токены
+var ErrRoleInUse = errors.New("role is used by active tokens")
+
+// Grant право роли на диапазон фич [FeatureFrom, FeatureTo].
+// Пустая граница диапазона не ограничивает фичи с этой стороны
+type Grant struct {
+	Permission  string `json:"permission"`
+	FeatureFrom *int   `json:"feature_from,omitempty"`
+	FeatureTo   *int   `json:"feature_to,omitempty"`
+}
+
+type Role struct {
+	Name   string  `json:"name"`
+	Grants []Grant `json:"grants"`
+}
+
+// Covers проверяет, что право распространяется на фичу
+func (g Grant) Covers(featureId int) bool {
+	return (g.FeatureFrom == nil || *g.FeatureFrom <= featureId) && (g.FeatureTo == nil || featureId <= *g.FeatureTo)
+}
+
+// Scoped сообщает, ограничено ли право диапазоном фич
+func (g Grant) Scoped() bool {
+	return g.FeatureFrom != nil || g.FeatureTo != nil
+}
+
+// GetRolesFromStorage возвращает все роли с их правами
+func (s *Storage) GetRolesFromStorage(ctx context.Context) (roles []Role, err error) {
+	rows, err := s.query(ctx, s.Db, `SELECT r.name, g.permission, g.feature_from, g.feature_to
+		FROM roles r LEFT JOIN role_grants g ON g.role = r.name
+		ORDER BY r.name, g.id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		var permission sql.NullString
+		var from, to sql.NullInt64
+		if err = rows.Scan(&name, &permission, &from, &to); err != nil {
+			return nil, err
+		}
+
+		if len(roles) == 0 || roles[len(roles)-1].Name != name {
+			roles = append(roles, Role{Name: name, Grants: []Grant{}})
+		}
+		if !permission.Valid {
+			continue
+		}
+
+		grant := Grant{Permission: permission.String}
+		if from.Valid {
+			v := int(from.Int64)
+			grant.FeatureFrom = &v
+		}
+		if to.Valid {
+			v := int(to.Int64)
+			grant.FeatureTo = &v
+		}
+
+		last := &roles[len(roles)-1]
+		last.Grants = append(last.Grants, grant)
+	}
+
+	return roles, rows.Err()
+}
+
+// PutRoleToStorage создает роль или заменяет все ее права
+func (s *Storage) PutRoleToStorage(role Role, ctx context.Context) (err error) {
+	tx, err := s.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			err := tx.Rollback()
+			if err != nil {
+				return
+			}
+			return
+		}
+		_ = tx.Commit()
+	}()
+
+	_, err = s.exec(ctx, tx, `INSERT INTO roles (name) VALUES (:name) ON CONFLICT (name) DO NOTHING`,
+		sql.Named("name", role.Name))
+	if err != nil {
+		return err
+	}
+
+	_, err = s.exec(ctx, tx, `DELETE FROM role_grants WHERE role = :name`, sql.Named("name", role.Name))
+	if err != nil {
+		return err
+	}
+
+	for _, grant := range role.Grants {
+		var from, to any
+		if grant.FeatureFrom != nil {
+			from = *grant.FeatureFrom
+		}
+		if grant.FeatureTo != nil {
+			to = *grant.FeatureTo
+		}
+
+		_, err = s.exec(ctx, tx, `INSERT INTO role_grants (role, permission, feature_from, feature_to)
+			VALUES (:name, :permission, :from, :to)`,
+			sql.Named("name", role.Name),
+			sql.Named("permission", grant.Permission),
+			sql.Named("from", from),
+			sql.Named("to", to))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DeleteRoleFromStorage удаляет роль, sql.ErrNoRows если роли нет,
+// ErrRoleInUse если на роль выписаны не отозванные токены
+func (s *Storage) DeleteRoleFromStorage(name string, ctx context.Context) (err error) {
+	tx, err := s.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			err := tx.Rollback()
+			if err != nil {
+				return
+			}
+			return
+		}
+		_ = tx.Commit()
+	}()
+
+	var tokens int
+	err = s.queryRow(ctx, tx, `SELECT COUNT(*) FROM tokens WHERE role = :name AND revoked_at IS NULL`,
+		sql.Named("name", name)).Scan(&tokens)
+	if err != nil {
+		return err
+	}
+	if tokens > 0 {
+		return ErrRoleInUse
+	}
+
+	_, err = s.exec(ctx, tx, `DELETE FROM role_grants WHERE role = :name`, sql.Named("name", name))
+	if err != nil {
+		return err
+	}
+
+	result, err := s.exec(ctx, tx, `DELETE FROM roles WHERE name = :name`, sql.Named("name", name))
+	if err != nil {
+		return err
+	}
+
+	return expectAffected(result)
+}
+
+// GetBannerFeatureFromStorage возвращает фичу баннера, sql.ErrNoRows если баннера нет
+func (s *Storage) GetBannerFeatureFromStorage(id int, ctx context.Context) (featureId int, err error) {
+	err = s.queryRow(ctx, s.Db, `SELECT feature_id FROM banners WHERE id = :id`, sql.Named("id", id)).Scan(&featureId)
+	if err != nil {
+		return 0, err
+	}
+
+	return featureId, nil
+}
+
+// GetTagFeaturesFromStorage возвращает фичи баннеров, связанных с тегом
+func (s *Storage) GetTagFeaturesFromStorage(tag int, ctx context.Context) (features []int, err error) {
+	return s.tags(ctx, s.Db, `SELECT DISTINCT feature_id FROM banner_tags WHERE tag_id = :id ORDER BY feature_id`, tag)
+}
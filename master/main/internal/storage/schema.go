@@ -0,0 +1,49 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+)
+
+type FeatureSchema struct {
+	FeatureId int             `json:"feature_id"`
+	Schema    json.RawMessage `json:"schema"`
+	CreatedAt string          `json:"created_at"`
+	UpdatedAt string          `json:"updated_at"`
+}
+
+// GetFeatureSchemaFromStorage возвращает JSON Schema контента баннеров фичи, sql.ErrNoRows если схема не задана
+func (s *Storage) GetFeatureSchemaFromStorage(featureId int, ctx context.Context) (schema FeatureSchema, err error) {
+	var raw string
+	err = s.queryRow(ctx, s.Db, `SELECT feature_id, schema, created_at, updated_at FROM feature_schemas WHERE feature_id = :featureId`,
+		sql.Named("featureId", featureId)).
+		Scan(&schema.FeatureId, &raw, &schema.CreatedAt, &schema.UpdatedAt)
+	if err != nil {
+		return FeatureSchema{}, err
+	}
+	schema.Schema = json.RawMessage(raw)
+
+	return schema, nil
+}
+
+// PutFeatureSchemaToStorage создает или заменяет схему фичи
+func (s *Storage) PutFeatureSchemaToStorage(featureId int, schema json.RawMessage, ctx context.Context) (err error) {
+	_, err = s.exec(ctx, s.Db, `INSERT INTO feature_schemas (feature_id, schema) VALUES (:featureId, :schema)
+		ON CONFLICT (feature_id) DO UPDATE SET schema = excluded.schema, updated_at = CURRENT_TIMESTAMP`,
+		sql.Named("featureId", featureId),
+		sql.Named("schema", string(schema)))
+
+	return err
+}
+
+// DeleteFeatureSchemaFromStorage удаляет схему фичи, sql.ErrNoRows если схемы не было
+func (s *Storage) DeleteFeatureSchemaFromStorage(featureId int, ctx context.Context) (err error) {
+	result, err := s.exec(ctx, s.Db, `DELETE FROM feature_schemas WHERE feature_id = :featureId`,
+		sql.Named("featureId", featureId))
+	if err != nil {
+		return err
+	}
+
+	return expectAffected(result)
+}
@@ -0,0 +1,97 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+)
+
+// DayLayout формат дня в счетчиках баннеров
+const DayLayout = "2006-01-02"
+
+// BannerStat счетчики баннера за день (UTC): показы, из них отданные из кэша, и клики
+type BannerStat struct {
+	BannerId    int    `json:"banner_id"`
+	Day         string `json:"day"`
+	Impressions int64  `json:"impressions"`
+	Cached      int64  `json:"cached"`
+	Clicks      int64  `json:"clicks"`
+}
+
+// AddBannerStatsToStorage прибавляет счетчики к сохраненным одной транзакцией
+func (s *Storage) AddBannerStatsToStorage(stats []BannerStat, ctx context.Context) (err error) {
+	tx, err := s.Db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			err := tx.Rollback()
+			if err != nil {
+				return
+			}
+			return
+		}
+		_ = tx.Commit()
+	}()
+
+	for _, stat := range stats {
+		_, err = s.exec(ctx, tx, `INSERT INTO banner_stats (banner_id, day, impressions, cached, clicks)
+			VALUES (:bannerId, :day, :impressions, :cached, :clicks)
+			ON CONFLICT (banner_id, day) DO UPDATE SET impressions = banner_stats.impressions + excluded.impressions,
+				cached = banner_stats.cached + excluded.cached,
+				clicks = banner_stats.clicks + excluded.clicks`,
+			sql.Named("bannerId", stat.BannerId),
+			sql.Named("day", stat.Day),
+			sql.Named("impressions", stat.Impressions),
+			sql.Named("cached", stat.Cached),
+			sql.Named("clicks", stat.Clicks))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GetBannerStatsFromStorage возвращает счетчики по баннерам и дням с from по to включительно.
+// bannerId = 0 и пустые границы не ограничивают выборку
+func (s *Storage) GetBannerStatsFromStorage(bannerId int, from, to string, ctx context.Context) (stats []BannerStat, err error) {
+	var conditions []string
+	if bannerId != 0 {
+		conditions = append(conditions, `banner_id = :bannerId`)
+	}
+	if from != "" {
+		conditions = append(conditions, `day >= :from`)
+	}
+	if to != "" {
+		conditions = append(conditions, `day <= :to`)
+	}
+
+	var queryBuilder strings.Builder
+	queryBuilder.WriteString(`SELECT banner_id, day, impressions, cached, clicks FROM banner_stats`)
+	if len(conditions) > 0 {
+		queryBuilder.WriteString(` WHERE ` + strings.Join(conditions, ` AND `))
+	}
+	queryBuilder.WriteString(` ORDER BY day, banner_id`)
+
+	rows, err := s.query(ctx, s.Db, queryBuilder.String(),
+		sql.Named("bannerId", bannerId),
+		sql.Named("from", from),
+		sql.Named("to", to))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats = []BannerStat{}
+	for rows.Next() {
+		var stat BannerStat
+		if err := rows.Scan(&stat.BannerId, &stat.Day, &stat.Impressions, &stat.Cached, &stat.Clicks); err != nil {
+			return nil, err
+		}
+		stats = append(stats, stat)
+	}
+
+	return stats, rows.Err()
+}
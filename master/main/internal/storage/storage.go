@@ -3,112 +3,79 @@ package sqlite
 import (
 	"context"
 	"database/sql"
+	"fmt"
+	_ "github.com/jackc/pgx/v5/stdlib"
 	"log/slog"
 	_ "modernc.org/sqlite"
+	"strings"
 )
 
+// sqliteParams параметры подключения к sqlite для параллельных запросов: транзакции изменений сразу берут
+// блокировку на запись, а конкурирующие соединения ждут ее освобождения вместо ошибки SQLITE_BUSY.
+// Транзакции чтения открываются через readTx и блокировку на запись не берут, а журнал WAL
+// позволяет им читать, пока идет запись, и не задерживать ее
+const sqliteParams = "?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_txlock=immediate"
+
 type Storage struct {
-	Db *sql.DB
+	Db        *sql.DB
+	Driver    string
+	Retention Retention
 }
 
-func New(storagePath string, log *slog.Logger, ctx context.Context) (*Storage, error) {
-	db, err := sql.Open("sqlite", storagePath)
-	if err != nil {
-		log.Error("failed to open storage:", err)
-		return nil, err
-	}
+// readTx начинает транзакцию только для чтения. Для sqlite она начинается без IMMEDIATE,
+// поэтому чтения не ждут друг друга и транзакций изменений
+func (s *Storage) readTx(ctx context.Context) (*sql.Tx, error) {
+	return s.Db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+}
 
-	_, err = db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS banners (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		feature_id INTEGER,
-		content TEXT,
-		is_active BOOLEAN,
-		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-	)`)
+// New открывает базу данных и применяет к ней непримененные миграции.
+// Если база мигрирована более новой версией приложения, возвращается ErrSchemaTooNew
+func New(driver, storagePath string, log *slog.Logger, ctx context.Context) (*Storage, error) {
+	s, err := Open(driver, storagePath)
 	if err != nil {
-		log.Error("Ошибка во время создания таблицы banners:", err)
+		log.Error("failed to open storage:", slog.Any("err", err))
 		return nil, err
 	}
 
-	_, err = db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS banner_tags (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		banner_id INTEGER,
-		tag_id INTEGER,
-		feature_id INTEGER,
-		FOREIGN KEY(banner_id) REFERENCES banners(id),
-        UNIQUE(tag_id, feature_id)
-	)`)
+	err = s.Migrate(ctx)
 	if err != nil {
-		log.Error("Ошибка во время создания таблицы banner_tags: ", err)
+		log.Error("Ошибка во время миграции базы данных:", slog.Any("err", err))
+		s.Db.Close()
 		return nil, err
 	}
 
-	_, err = db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS banner_versions (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		banner_id INTEGER,
-		feature_id INTEGER,
-		content TEXT,
-		is_active BOOLEAN,
-		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-		FOREIGN KEY(banner_id) REFERENCES banners(id)
-	)`)
+	version, err := s.SchemaVersion(ctx)
 	if err != nil {
-		log.Error("Ошибка во время создания таблицы banners:", err)
+		log.Error("Ошибка во время чтения версии базы данных:", slog.Any("err", err))
+		s.Db.Close()
 		return nil, err
 	}
+	log.Info("Схема базы данных актуальна", slog.Int("version", version))
 
-	_, err = db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS banner_versions_tags (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		banner_version_id INTEGER,
-		banner_id INTEGER,
-		tag_id INTEGER,
-		feature_id INTEGER,
-		FOREIGN KEY(banner_version_id) REFERENCES banner_versions(id)
-	)`)
-	if err != nil {
-		log.Error("Ошибка во время создания таблицы banner_tags: ", err)
-		return nil, err
+	return s, nil
+}
+
+// Open открывает базу данных выбранного драйвера: sqlite (по умолчанию) или postgres, без миграций.
+// Для postgres в storagePath передается DSN
+func Open(driver, storagePath string) (*Storage, error) {
+	var sqlDriver string
+	switch driver {
+	case "", SqliteDriver:
+		driver, sqlDriver = SqliteDriver, "sqlite"
+	case PostgresDriver:
+		sqlDriver = "pgx"
+	default:
+		return nil, fmt.Errorf("unknown storage driver %q", driver)
 	}
 
-	_, err = db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS Users (
-        Role BOOLEAN,
-        Token TEXT PRIMARY KEY
-    )`)
-	if err != nil {
-		log.Error("Ошибка во время создания таблицы Users: ", err)
-		return nil, err
+	if driver == SqliteDriver && !strings.Contains(storagePath, "?") {
+		storagePath += sqliteParams
 	}
 
-	rows, err := db.QueryContext(ctx, "SELECT COUNT(*) FROM Users")
+	db, err := sql.Open(sqlDriver, storagePath)
 	if err != nil {
-		log.Error("Ошибка во время создания таблицы Users:", err)
 		return nil, err
 	}
 
-	var count int
-	if rows.Next() {
-		if err := rows.Scan(&count); err != nil {
-			log.Error("Ошибка во время создания таблицы Users:", err)
-			return nil, err
-		}
-	}
-	rows.Close()
-
-	if count == 0 {
-		_, err = db.ExecContext(ctx, `INSERT INTO Users (Role, Token) VALUES ('true', 'c1c224b03cd9bc7b6a86d77f5dace40191766c485cd55dc48caf9ac873335d6f')`)
-		if err != nil {
-			log.Error("Ошибка во время добавления роли Admin в таблицу Users: ", err)
-			return nil, err
-		}
-
-		_, err = db.ExecContext(ctx, `INSERT INTO Users (Role, Token) VALUES ('false', 'b512d97e7cbf97c273e4db073bbb547aa65a84589227f8f3d9e4a72b9372a24d')`)
-		if err != nil {
-			log.Error("Ошибка во время добавления роли User в таблицу Users: ", err)
-			return nil, err
-		}
-	}
-
-	return &Storage{Db: db}, nil
+	return &Storage{Db: db, Driver: driver}, nil
 }
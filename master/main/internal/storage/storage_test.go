@@ -0,0 +1,926 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testStorages возвращает хранилища всех доступных драйверов.
+// postgres подключается только если задана переменная окружения POSTGRES_DSN
+func testStorages(t *testing.T) map[string]*Storage {
+	t.Helper()
+
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ctx := context.Background()
+	res := map[string]*Storage{}
+
+	s, err := New(SqliteDriver, filepath.Join(t.TempDir(), "test.db"), log, ctx)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Db.Close() })
+	res[SqliteDriver] = s
+
+	if dsn := os.Getenv("POSTGRES_DSN"); dsn != "" {
+		p, err := New(PostgresDriver, dsn, log, ctx)
+		require.NoError(t, err)
+		for _, q := range []string{
+			"DELETE FROM banner_stats",
+			"DELETE FROM experiment_variants",
+			"DELETE FROM experiments",
+			"DELETE FROM banner_drafts",
+			"DELETE FROM feature_workflows",
+			"DELETE FROM banner_versions_tags",
+			"DELETE FROM banner_versions",
+			"DELETE FROM banner_tags",
+			"DELETE FROM banners",
+			"DELETE FROM feature_schemas",
+			"DELETE FROM tokens",
+			"DELETE FROM role_grants WHERE role NOT IN ('admin', 'user')",
+			"DELETE FROM roles WHERE name NOT IN ('admin', 'user')",
+		} {
+			_, err = p.Db.Exec(q)
+			require.NoError(t, err)
+		}
+		t.Cleanup(func() { p.Db.Close() })
+		res[PostgresDriver] = p
+	}
+
+	return res
+}
+
+func TestBind(t *testing.T) {
+	s := &Storage{Driver: PostgresDriver}
+
+	query, args := s.bind(`SELECT * FROM banners WHERE id = :id AND feature_id = :featureId AND content <> ':skip' OR id = :id`,
+		[]any{sql.Named("featureId", 2), sql.Named("id", 1), sql.Named("unused", 3)})
+
+	assert.Equal(t, `SELECT * FROM banners WHERE id = $1 AND feature_id = $2 AND content <> ':skip' OR id = $1`, query)
+	assert.Equal(t, []any{1, 2}, args)
+
+	s.Driver = SqliteDriver
+	query, args = s.bind(`SELECT :id`, []any{sql.Named("id", 1)})
+	assert.Equal(t, `SELECT :id`, query)
+	assert.Len(t, args, 1)
+}
+
+func TestBannerLifecycle(t *testing.T) {
+	ctx := context.Background()
+
+	for driver, s := range testStorages(t) {
+		s := s
+		t.Run(driver, func(t *testing.T) {
+			id, err := s.PostBannerToStorage(Banner{
+				TagIds:    []int{1, 2},
+				FeatureId: 10,
+				Content:   json.RawMessage(`{"title": "first"}`),
+				IsActive:  true,
+			}, ctx)
+			require.NoError(t, err)
+
+			_, content, active, _, err := s.GetBannerFromStorage(Query{TagId: 2, FeatureId: 10}, ctx)
+			require.NoError(t, err)
+			assert.JSONEq(t, `{"title":"first"}`, content)
+			assert.True(t, active)
+
+			_, err = s.UpdateBannerInStorage(BannerUpdate{
+				BannerId:  id,
+				TagIds:    []int{3},
+				FeatureId: 11,
+				Content:   json.RawMessage(`{"title": "second"}`),
+			}, ctx)
+			require.NoError(t, err)
+
+			banners, err := s.GetAllBannersFromStorage(Query{FeatureId: 11}, ctx)
+			require.NoError(t, err)
+			require.Len(t, banners, 1)
+			assert.Equal(t, []int{3}, banners[0].TagIds)
+			assert.JSONEq(t, `{"title": "second"}`, string(banners[0].Content))
+			assert.True(t, banners[0].IsActive)
+
+			current, err := s.GetBannerByIdFromStorage(id, ctx)
+			require.NoError(t, err)
+			assert.Equal(t, 11, current.FeatureId)
+			assert.Equal(t, []int{3}, current.TagIds)
+
+			versions, err := s.GetBannerVersionsFromStorage(id, ctx)
+			require.NoError(t, err)
+			require.Len(t, versions, 1)
+			assert.Equal(t, 10, versions[0].FeatureId)
+			assert.Equal(t, []int{1, 2}, versions[0].TagIds)
+
+			keys, err := s.DeleteBannerFromStorage(id, ctx)
+			require.NoError(t, err)
+			assert.Equal(t, []string{"11 3"}, keys)
+
+			_, _, _, _, err = s.GetBannerFromStorage(Query{TagId: 3, FeatureId: 11}, ctx)
+			assert.ErrorIs(t, err, sql.ErrNoRows)
+
+			_, err = s.DeleteBannerFromStorage(id, ctx)
+			assert.ErrorIs(t, err, sql.ErrNoRows)
+
+			_, err = s.GetBannerByIdFromStorage(id, ctx)
+			assert.ErrorIs(t, err, sql.ErrNoRows)
+		})
+	}
+}
+
+func TestDeleteByFeatureAndTag(t *testing.T) {
+	ctx := context.Background()
+
+	for driver, s := range testStorages(t) {
+		s := s
+		t.Run(driver, func(t *testing.T) {
+			for _, b := range []Banner{
+				{TagIds: []int{1, 2}, FeatureId: 20, Content: json.RawMessage(`{"a": "1"}`), IsActive: true},
+				{TagIds: []int{1}, FeatureId: 21, Content: json.RawMessage(`{"a": "2"}`), IsActive: true},
+				{TagIds: []int{5}, FeatureId: 21, Content: json.RawMessage(`{"a": "3"}`), IsActive: true},
+			} {
+				_, err := s.PostBannerToStorage(b, ctx)
+				require.NoError(t, err)
+			}
+
+			keys, err := s.DeleteBannerFromStorageByFeature(20, ctx)
+			require.NoError(t, err)
+			assert.ElementsMatch(t, []string{"20 1", "20 2"}, keys)
+
+			keys, err = s.DeleteBannerFromStorageByTag(1, ctx)
+			require.NoError(t, err)
+			assert.Equal(t, []string{"21 1"}, keys)
+
+			banners, err := s.GetAllBannersFromStorage(Query{FeatureId: 21}, ctx)
+			require.NoError(t, err)
+			require.Len(t, banners, 1)
+			assert.Equal(t, []int{5}, banners[0].TagIds)
+		})
+	}
+}
+
+func TestRichContentPreserved(t *testing.T) {
+	ctx := context.Background()
+	content := `{"title": "rich", "nested": {"list": [1, 2.50, true, null], "flag": false},  "n": 1e3}`
+
+	for driver, s := range testStorages(t) {
+		s := s
+		t.Run(driver, func(t *testing.T) {
+			isActive := true
+			id, err := s.PostBannerToStorage(Banner{TagIds: []int{30}, FeatureId: 30, Content: json.RawMessage(content), IsActive: true}, ctx)
+			require.NoError(t, err)
+
+			_, stored, _, _, err := s.GetBannerFromStorage(Query{TagId: 30, FeatureId: 30}, ctx)
+			require.NoError(t, err)
+			assert.Equal(t, content, stored)
+
+			_, err = s.UpdateBannerInStorage(BannerUpdate{BannerId: id, TagIds: []int{30}, FeatureId: 30, IsActive: &isActive}, ctx)
+			require.NoError(t, err)
+
+			_, stored, _, _, err = s.GetBannerFromStorage(Query{TagId: 30, FeatureId: 30}, ctx)
+			require.NoError(t, err)
+			assert.Equal(t, content, stored)
+
+			versions, err := s.GetBannerVersionsFromStorage(id, ctx)
+			require.NoError(t, err)
+			require.Len(t, versions, 1)
+			assert.Equal(t, content, string(versions[0].Content))
+
+			_, err = s.UpdateBannerInStorage(BannerUpdate{BannerId: id, TagIds: []int{30}, FeatureId: 30, Content: json.RawMessage(`{}`), IsActive: &isActive}, ctx)
+			require.NoError(t, err)
+
+			_, stored, _, _, err = s.GetBannerFromStorage(Query{TagId: 30, FeatureId: 30}, ctx)
+			require.NoError(t, err)
+			assert.Equal(t, `{}`, stored)
+		})
+	}
+}
+
+func TestFeatureSchema(t *testing.T) {
+	ctx := context.Background()
+
+	for driver, s := range testStorages(t) {
+		s := s
+		t.Run(driver, func(t *testing.T) {
+			_, err := s.GetFeatureSchemaFromStorage(40, ctx)
+			assert.ErrorIs(t, err, sql.ErrNoRows)
+
+			require.NoError(t, s.PutFeatureSchemaToStorage(40, json.RawMessage(`{"type": "object"}`), ctx))
+			require.NoError(t, s.PutFeatureSchemaToStorage(40, json.RawMessage(`{"type": "array"}`), ctx))
+
+			schema, err := s.GetFeatureSchemaFromStorage(40, ctx)
+			require.NoError(t, err)
+			assert.Equal(t, `{"type": "array"}`, string(schema.Schema))
+
+			require.NoError(t, s.DeleteFeatureSchemaFromStorage(40, ctx))
+			assert.ErrorIs(t, s.DeleteFeatureSchemaFromStorage(40, ctx), sql.ErrNoRows)
+		})
+	}
+}
+
+func TestActivationWindow(t *testing.T) {
+	ctx := context.Background()
+	past, future := time.Now().Add(-time.Hour).Truncate(time.Second), time.Now().Add(time.Hour).Truncate(time.Second)
+
+	for driver, s := range testStorages(t) {
+		s := s
+		t.Run(driver, func(t *testing.T) {
+			isActive := true
+			id, err := s.PostBannerToStorage(Banner{
+				TagIds:    []int{1},
+				FeatureId: 40,
+				Content:   json.RawMessage(`{}`),
+				IsActive:  true,
+				Window:    Window{ActiveFrom: &future},
+			}, ctx)
+			require.NoError(t, err)
+
+			_, _, active, window, err := s.GetBannerFromStorage(Query{TagId: 1, FeatureId: 40}, ctx)
+			require.NoError(t, err)
+			assert.False(t, active)
+			require.NotNil(t, window.ActiveFrom)
+			assert.True(t, future.Equal(*window.ActiveFrom))
+			assert.True(t, future.Equal(window.Next(time.Now())))
+
+			_, err = s.UpdateBannerInStorage(BannerUpdate{
+				BannerId:  id,
+				TagIds:    []int{1},
+				FeatureId: 40,
+				IsActive:  &isActive,
+				WindowUpdate: WindowUpdate{
+					ActiveFrom:  OptionalTime{Set: true, Value: &past},
+					ActiveUntil: OptionalTime{Set: true, Value: &future},
+				},
+			}, ctx)
+			require.NoError(t, err)
+
+			_, _, active, _, err = s.GetBannerFromStorage(Query{TagId: 1, FeatureId: 40}, ctx)
+			require.NoError(t, err)
+			assert.True(t, active)
+
+			banners, err := s.GetAllBannersFromStorage(Query{FeatureId: 40}, ctx)
+			require.NoError(t, err)
+			require.Len(t, banners, 1)
+			require.NotNil(t, banners[0].ActiveUntil)
+			assert.True(t, future.Equal(*banners[0].ActiveUntil))
+
+			versions, err := s.GetBannerVersionsFromStorage(id, ctx)
+			require.NoError(t, err)
+			require.Len(t, versions, 1)
+			require.NotNil(t, versions[0].ActiveFrom)
+			assert.True(t, future.Equal(*versions[0].ActiveFrom))
+			assert.Nil(t, versions[0].ActiveUntil)
+
+			_, err = s.UpdateBannerInStorage(BannerUpdate{BannerId: id, TagIds: []int{1}, FeatureId: 40, IsActive: &isActive}, ctx)
+			require.NoError(t, err)
+
+			_, _, _, window, err = s.GetBannerFromStorage(Query{TagId: 1, FeatureId: 40}, ctx)
+			require.NoError(t, err)
+			require.NotNil(t, window.ActiveFrom)
+			require.NotNil(t, window.ActiveUntil)
+			assert.True(t, past.Equal(*window.ActiveFrom))
+			assert.True(t, future.Equal(*window.ActiveUntil))
+
+			_, err = s.UpdateBannerInStorage(BannerUpdate{
+				BannerId:     id,
+				TagIds:       []int{1},
+				FeatureId:    40,
+				IsActive:     &isActive,
+				WindowUpdate: WindowUpdate{ActiveFrom: OptionalTime{Set: true, Value: &future}},
+			}, ctx)
+			assert.ErrorIs(t, err, ErrEmptyWindow)
+
+			_, err = s.UpdateBannerInStorage(BannerUpdate{
+				BannerId:  id,
+				TagIds:    []int{1},
+				FeatureId: 40,
+				IsActive:  &isActive,
+				WindowUpdate: WindowUpdate{
+					ActiveFrom:  OptionalTime{Set: true},
+					ActiveUntil: OptionalTime{Set: true, Value: &past},
+				},
+			}, ctx)
+			require.NoError(t, err)
+
+			_, _, active, _, err = s.GetBannerFromStorage(Query{TagId: 1, FeatureId: 40}, ctx)
+			require.NoError(t, err)
+			assert.False(t, active)
+		})
+	}
+}
+
+func TestRollback(t *testing.T) {
+	ctx := context.Background()
+
+	for driver, s := range testStorages(t) {
+		s := s
+		t.Run(driver, func(t *testing.T) {
+			id, err := s.PostBannerToStorage(Banner{
+				TagIds:    []int{1, 2},
+				FeatureId: 50,
+				Content:   json.RawMessage(`{"title": "first"}`),
+				IsActive:  true,
+			}, ctx)
+			require.NoError(t, err)
+
+			_, err = s.UpdateBannerInStorage(BannerUpdate{
+				BannerId:  id,
+				TagIds:    []int{3},
+				FeatureId: 51,
+				Content:   json.RawMessage(`{"title": "second"}`),
+			}, ctx)
+			require.NoError(t, err)
+
+			versions, err := s.GetBannerVersionsFromStorage(id, ctx)
+			require.NoError(t, err)
+			require.Len(t, versions, 1)
+
+			_, err = s.RollbackBannerInStorage(id+100, versions[0].BannerId, ctx)
+			assert.ErrorIs(t, err, sql.ErrNoRows)
+
+			keys, err := s.RollbackBannerInStorage(id, versions[0].BannerId, ctx)
+			require.NoError(t, err)
+			assert.ElementsMatch(t, []string{"51 3", "50 1", "50 2"}, keys)
+
+			_, content, active, _, err := s.GetBannerFromStorage(Query{TagId: 2, FeatureId: 50}, ctx)
+			require.NoError(t, err)
+			assert.JSONEq(t, `{"title": "first"}`, content)
+			assert.True(t, active)
+
+			_, _, _, _, err = s.GetBannerFromStorage(Query{TagId: 3, FeatureId: 51}, ctx)
+			assert.ErrorIs(t, err, sql.ErrNoRows)
+
+			versions, err = s.GetBannerVersionsFromStorage(id, ctx)
+			require.NoError(t, err)
+			require.Len(t, versions, 2)
+			assert.Equal(t, 51, versions[1].FeatureId)
+			assert.Equal(t, []int{3}, versions[1].TagIds)
+			assert.JSONEq(t, `{"title": "second"}`, string(versions[1].Content))
+
+			_, err = s.PostBannerToStorage(Banner{TagIds: []int{3}, FeatureId: 51, Content: json.RawMessage(`{}`)}, ctx)
+			require.NoError(t, err)
+
+			_, err = s.RollbackBannerInStorage(id, versions[1].BannerId, ctx)
+			assert.ErrorIs(t, err, ErrTagConflict)
+
+			_, content, _, _, err = s.GetBannerFromStorage(Query{TagId: 1, FeatureId: 50}, ctx)
+			require.NoError(t, err)
+			assert.JSONEq(t, `{"title": "first"}`, content)
+		})
+	}
+}
+
+func TestVersionRetention(t *testing.T) {
+	ctx := context.Background()
+
+	update := func(t *testing.T, s *Storage, id, tag int, times int) {
+		t.Helper()
+		for i := 0; i < times; i++ {
+			_, err := s.UpdateBannerInStorage(BannerUpdate{
+				BannerId:  id,
+				TagIds:    []int{tag},
+				FeatureId: 60 + id,
+				Content:   json.RawMessage(`{"n": ` + strconv.Itoa(i) + `}`),
+			}, ctx)
+			require.NoError(t, err)
+		}
+	}
+
+	for driver, s := range testStorages(t) {
+		s := s
+		t.Run(driver, func(t *testing.T) {
+			first, err := s.PostBannerToStorage(Banner{TagIds: []int{1}, FeatureId: 60, Content: json.RawMessage(`{}`)}, ctx)
+			require.NoError(t, err)
+			second, err := s.PostBannerToStorage(Banner{TagIds: []int{2}, FeatureId: 61, Content: json.RawMessage(`{}`)}, ctx)
+			require.NoError(t, err)
+
+			s.Retention = Retention{Policy: RetentionUnlimited}
+			update(t, s, first, 1, 4)
+
+			versions, err := s.GetBannerVersionsFromStorage(first, ctx)
+			require.NoError(t, err)
+			assert.Len(t, versions, 4)
+
+			s.Retention = Retention{Policy: RetentionCount, MaxCount: 2}
+			update(t, s, second, 2, 3)
+
+			versions, err = s.GetBannerVersionsFromStorage(second, ctx)
+			require.NoError(t, err)
+			require.Len(t, versions, 2)
+			assert.JSONEq(t, `{"n": 1}`, string(versions[1].Content))
+			for _, v := range versions {
+				assert.Equal(t, []int{2}, v.TagIds)
+			}
+
+			// история другого баннера не затрагивается, пока не запрошена общая очистка
+			versions, err = s.GetBannerVersionsFromStorage(first, ctx)
+			require.NoError(t, err)
+			require.Len(t, versions, 4)
+			for _, v := range versions {
+				assert.NotEmpty(t, v.TagIds)
+			}
+
+			removed, err := s.PruneVersionsInStorage(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, int64(2), removed)
+
+			var orphans int
+			err = s.Db.QueryRow(`SELECT COUNT(*) FROM banner_versions_tags WHERE banner_version_id NOT IN (SELECT id FROM banner_versions)`).Scan(&orphans)
+			require.NoError(t, err)
+			assert.Zero(t, orphans)
+
+			s.Retention = Retention{Policy: RetentionAge, MaxAge: time.Hour}
+			_, err = s.exec(ctx, s.Db, `UPDATE banner_versions SET versioned_at = :old WHERE banner_id = :bannerId`,
+				sql.Named("old", time.Now().UTC().Add(-2*time.Hour)),
+				sql.Named("bannerId", first))
+			require.NoError(t, err)
+
+			removed, err = s.PruneVersionsInStorage(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, int64(2), removed)
+
+			versions, err = s.GetBannerVersionsFromStorage(second, ctx)
+			require.NoError(t, err)
+			assert.Len(t, versions, 2)
+		})
+	}
+}
+
+func TestDrafts(t *testing.T) {
+	ctx := context.Background()
+
+	for driver, s := range testStorages(t) {
+		s := s
+		t.Run(driver, func(t *testing.T) {
+			review, err := s.GetFeatureWorkflowFromStorage(60, ctx)
+			require.NoError(t, err)
+			assert.False(t, review)
+
+			require.NoError(t, s.PutFeatureWorkflowToStorage(60, true, ctx))
+			review, err = s.GetFeatureWorkflowFromStorage(60, ctx)
+			require.NoError(t, err)
+			assert.True(t, review)
+
+			id, err := s.PostBannerToStorage(Banner{
+				TagIds:    []int{1},
+				FeatureId: 60,
+				Content:   json.RawMessage(`{"title": "first"}`),
+				IsActive:  true,
+			}, ctx)
+			require.NoError(t, err)
+
+			draft, err := s.CreateDraftInStorage(Draft{BannerId: id, Changes: json.RawMessage(`{"feature_id": 60}`), Author: "token:1"}, ctx)
+			require.NoError(t, err)
+			assert.Equal(t, DraftPending, draft.Status)
+
+			_, err = s.GetDraftFromStorage(id+100, draft.Id, ctx)
+			assert.ErrorIs(t, err, sql.ErrNoRows)
+
+			err = s.UpdateDraftStatusInStorage(draft.Id, DraftPending, DraftApproved, "token:2", "", ctx)
+			require.NoError(t, err)
+
+			err = s.UpdateDraftStatusInStorage(draft.Id, DraftPending, DraftRejected, "token:2", "", ctx)
+			assert.ErrorIs(t, err, sql.ErrNoRows)
+
+			stored, err := s.GetDraftFromStorage(id, draft.Id, ctx)
+			require.NoError(t, err)
+			assert.Equal(t, DraftApproved, stored.Status)
+			assert.Equal(t, "token:2", stored.Reviewer)
+			assert.NotNil(t, stored.ReviewedAt)
+			assert.JSONEq(t, `{"feature_id": 60}`, string(stored.Changes))
+
+			_, err = s.CreateDraftInStorage(Draft{BannerId: id, Changes: json.RawMessage(`{}`), Author: "token:1"}, ctx)
+			require.NoError(t, err)
+
+			drafts, err := s.GetDraftsFromStorage(id, DraftPending, ctx)
+			require.NoError(t, err)
+			assert.Len(t, drafts, 1)
+
+			drafts, err = s.GetDraftsFromStorage(id, "", ctx)
+			require.NoError(t, err)
+			assert.Len(t, drafts, 2)
+
+			_, err = s.DeleteBannerFromStorage(id, ctx)
+			require.NoError(t, err)
+
+			drafts, err = s.GetDraftsFromStorage(id, "", ctx)
+			require.NoError(t, err)
+			assert.Empty(t, drafts)
+		})
+	}
+}
+
+func TestRetentionValidate(t *testing.T) {
+	assert.NoError(t, Retention{}.Validate())
+	assert.NoError(t, Retention{Policy: RetentionUnlimited}.Validate())
+	assert.NoError(t, Retention{Policy: RetentionCount, MaxCount: 3}.Validate())
+	assert.Error(t, Retention{Policy: RetentionCount}.Validate())
+	assert.Error(t, Retention{Policy: RetentionAge}.Validate())
+	assert.Error(t, Retention{Policy: "forever"}.Validate())
+}
+
+// TestActiveKeys ключи прогрева: только включенные баннеры внутри периода показа, не больше limit
+func TestActiveKeys(t *testing.T) {
+	ctx := context.Background()
+	future := time.Now().Add(time.Hour).Truncate(time.Second)
+
+	for driver, s := range testStorages(t) {
+		s := s
+		t.Run(driver, func(t *testing.T) {
+			for _, banner := range []Banner{
+				{TagIds: []int{1, 2}, FeatureId: 50, Content: json.RawMessage(`{}`), IsActive: true},
+				{TagIds: []int{1}, FeatureId: 51, Content: json.RawMessage(`{}`), IsActive: false},
+				{TagIds: []int{1}, FeatureId: 52, Content: json.RawMessage(`{}`), IsActive: true, Window: Window{ActiveFrom: &future}},
+				{TagIds: []int{3}, FeatureId: 53, Content: json.RawMessage(`{}`), IsActive: true},
+			} {
+				_, err := s.PostBannerToStorage(banner, ctx)
+				require.NoError(t, err)
+			}
+
+			keys, err := s.GetActiveKeysFromStorage(10, ctx)
+			require.NoError(t, err)
+			assert.Equal(t, []string{"50 1", "50 2", "53 3"}, keys)
+
+			keys, err = s.GetActiveKeysFromStorage(2, ctx)
+			require.NoError(t, err)
+			assert.Equal(t, []string{"50 1", "50 2"}, keys)
+		})
+	}
+}
+
+// TestUserBanners баннеры по нескольким парам фича и тег читаются одним запросом
+func TestUserBanners(t *testing.T) {
+	ctx := context.Background()
+	future := time.Now().Add(time.Hour).Truncate(time.Second)
+
+	for driver, s := range testStorages(t) {
+		s := s
+		t.Run(driver, func(t *testing.T) {
+			for _, banner := range []Banner{
+				{TagIds: []int{1, 2}, FeatureId: 60, Content: json.RawMessage(`{"v": 1}`), IsActive: true},
+				{TagIds: []int{1}, FeatureId: 61, Content: json.RawMessage(`{"v": 2}`), IsActive: true, Window: Window{ActiveFrom: &future}},
+			} {
+				_, err := s.PostBannerToStorage(banner, ctx)
+				require.NoError(t, err)
+			}
+
+			banners, err := s.GetUserBannersFromStorage([]Query{
+				{FeatureId: 60, TagId: 2},
+				{FeatureId: 61, TagId: 1},
+				{FeatureId: 61, TagId: 2},
+			}, ctx)
+			require.NoError(t, err)
+			require.Len(t, banners, 2)
+
+			byFeature := map[int]UserBanner{}
+			for _, b := range banners {
+				byFeature[b.FeatureId] = b
+			}
+			assert.Equal(t, 2, byFeature[60].TagId)
+			assert.JSONEq(t, `{"v": 1}`, byFeature[60].Content)
+			assert.True(t, byFeature[60].Active)
+			assert.False(t, byFeature[61].Active)
+			require.NotNil(t, byFeature[61].Window.ActiveFrom)
+
+			banners, err = s.GetUserBannersFromStorage(nil, ctx)
+			require.NoError(t, err)
+			assert.Empty(t, banners)
+		})
+	}
+}
+
+// TestResolveBanner баннер для нескольких тегов выбирается одним запросом по стратегии,
+// показываемые баннеры предпочитаются выключенным
+func TestResolveBanner(t *testing.T) {
+	ctx := context.Background()
+
+	for driver, s := range testStorages(t) {
+		s := s
+		t.Run(driver, func(t *testing.T) {
+			ids := map[string]int{}
+			for name, banner := range map[string]Banner{
+				"first":    {TagIds: []int{1}, FeatureId: 70, Content: json.RawMessage(`{"v": "first"}`), IsActive: true},
+				"priority": {TagIds: []int{2}, FeatureId: 70, Content: json.RawMessage(`{"v": "priority"}`), IsActive: true},
+				"inactive": {TagIds: []int{3}, FeatureId: 70, Content: json.RawMessage(`{"v": "inactive"}`), IsActive: false},
+			} {
+				id, err := s.PostBannerToStorage(banner, ctx)
+				require.NoError(t, err)
+				ids[name] = id
+			}
+
+			_, err := s.exec(ctx, s.Db, `UPDATE banners SET priority = 5, updated_at = :updatedAt WHERE id = :id`,
+				sql.Named("updatedAt", time.Now().Add(-time.Hour).UTC()), sql.Named("id", ids["priority"]))
+			require.NoError(t, err)
+
+			resolve := func(resolution Resolution, tags ...int) (string, bool, error) {
+				_, content, active, _, err := s.GetBannerFromStorage(Query{FeatureId: 70, TagId: tags[0], TagIds: tags, Resolution: resolution}, ctx)
+				return content, active, err
+			}
+
+			content, _, err := resolve(ResolveFirst, 3, 1, 2)
+			require.NoError(t, err)
+			assert.JSONEq(t, `{"v": "first"}`, content)
+
+			content, _, err = resolve(ResolveFirst, 2, 1)
+			require.NoError(t, err)
+			assert.JSONEq(t, `{"v": "priority"}`, content)
+
+			content, _, err = resolve(ResolvePriority, 1, 2)
+			require.NoError(t, err)
+			assert.JSONEq(t, `{"v": "priority"}`, content)
+
+			content, _, err = resolve(ResolveRecent, 2, 1)
+			require.NoError(t, err)
+			assert.JSONEq(t, `{"v": "first"}`, content)
+
+			content, active, err := resolve(ResolveFirst, 3, 9)
+			require.NoError(t, err)
+			assert.JSONEq(t, `{"v": "inactive"}`, content)
+			assert.False(t, active)
+
+			_, _, err = resolve(ResolveFirst, 8, 9)
+			assert.ErrorIs(t, err, sql.ErrNoRows)
+		})
+	}
+}
+
+// TestDefaultBanner баннер по умолчанию показывается по тегам без своего баннера, один на фичу,
+// приоритет и признак по умолчанию сохраняются в версиях и не меняются, если не указаны
+func TestDefaultBanner(t *testing.T) {
+	ctx := context.Background()
+
+	for driver, s := range testStorages(t) {
+		s := s
+		t.Run(driver, func(t *testing.T) {
+			isActive := true
+			def, err := s.PostBannerToStorage(Banner{TagIds: []int{5}, FeatureId: 80, Content: json.RawMessage(`{"v": "default"}`), IsActive: true, Priority: 3, IsDefault: true}, ctx)
+			require.NoError(t, err)
+			_, err = s.PostBannerToStorage(Banner{TagIds: []int{1}, FeatureId: 80, Content: json.RawMessage(`{"v": "tag"}`), IsActive: false}, ctx)
+			require.NoError(t, err)
+
+			_, err = s.PostBannerToStorage(Banner{TagIds: []int{2}, FeatureId: 80, Content: json.RawMessage(`{}`), IsDefault: true}, ctx)
+			assert.ErrorIs(t, err, ErrDefaultConflict)
+
+			_, content, active, _, err := s.GetBannerFromStorage(Query{FeatureId: 80, TagId: 9}, ctx)
+			require.NoError(t, err)
+			assert.JSONEq(t, `{"v": "default"}`, content)
+			assert.True(t, active)
+
+			_, content, active, _, err = s.GetBannerFromStorage(Query{FeatureId: 80, TagId: 1}, ctx)
+			require.NoError(t, err)
+			assert.JSONEq(t, `{"v": "tag"}`, content)
+			assert.False(t, active)
+
+			_, content, _, _, err = s.GetBannerFromStorage(Query{FeatureId: 80, TagId: 9, TagIds: []int{9, 1}}, ctx)
+			require.NoError(t, err)
+			assert.JSONEq(t, `{"v": "tag"}`, content)
+
+			_, content, _, _, err = s.GetBannerFromStorage(Query{FeatureId: 80, TagId: 8, TagIds: []int{8, 9}}, ctx)
+			require.NoError(t, err)
+			assert.JSONEq(t, `{"v": "default"}`, content)
+
+			banners, err := s.GetUserBannersFromStorage([]Query{{FeatureId: 80, TagId: 9}, {FeatureId: 81, TagId: 9}}, ctx)
+			require.NoError(t, err)
+			require.Len(t, banners, 1)
+			assert.Equal(t, 9, banners[0].TagId)
+			assert.JSONEq(t, `{"v": "default"}`, banners[0].Content)
+
+			banner, err := s.GetBannerByIdFromStorage(def, ctx)
+			require.NoError(t, err)
+			assert.Equal(t, 3, banner.Priority)
+			assert.True(t, banner.IsDefault)
+
+			notDefault := false
+			keys, err := s.UpdateBannerInStorage(BannerUpdate{BannerId: def, TagIds: []int{5}, FeatureId: 80, IsActive: &isActive, IsDefault: &notDefault}, ctx)
+			require.NoError(t, err)
+			assert.ElementsMatch(t, []string{DefaultKey(80), "80 5", "80 5"}, keys)
+
+			banner, err = s.GetBannerByIdFromStorage(def, ctx)
+			require.NoError(t, err)
+			assert.Equal(t, 3, banner.Priority)
+			assert.False(t, banner.IsDefault)
+
+			_, _, _, _, err = s.GetBannerFromStorage(Query{FeatureId: 80, TagId: 9}, ctx)
+			assert.ErrorIs(t, err, sql.ErrNoRows)
+
+			versions, err := s.GetBannerVersionsFromStorage(def, ctx)
+			require.NoError(t, err)
+			require.Len(t, versions, 1)
+			assert.True(t, versions[0].IsDefault)
+
+			keys, err = s.RollbackBannerInStorage(def, versions[0].BannerId, ctx)
+			require.NoError(t, err)
+			assert.Contains(t, keys, DefaultKey(80))
+
+			_, content, _, _, err = s.GetBannerFromStorage(Query{FeatureId: 80, TagId: 9}, ctx)
+			require.NoError(t, err)
+			assert.JSONEq(t, `{"v": "default"}`, content)
+		})
+	}
+}
+
+// TestExperiments эксперимент один на пару фича-тег, у него меняются включение и веса вариантов
+func TestExperiments(t *testing.T) {
+	ctx := context.Background()
+
+	for driver, s := range testStorages(t) {
+		s := s
+		t.Run(driver, func(t *testing.T) {
+			experiment := Experiment{FeatureId: 90, TagId: 1, Name: "design", IsActive: true, Variants: []Variant{
+				{Name: "a", Content: json.RawMessage(`{"v": "a"}`), Weight: 1},
+				{Name: "b", Content: json.RawMessage(`{"v": "b"}`), Weight: 3},
+			}}
+			id, err := s.PostExperimentToStorage(experiment, ctx)
+			require.NoError(t, err)
+
+			_, err = s.PostExperimentToStorage(experiment, ctx)
+			assert.ErrorIs(t, err, ErrExperimentConflict)
+
+			stored, err := s.GetExperimentFromStorage(id, ctx)
+			require.NoError(t, err)
+			assert.Equal(t, "design", stored.Name)
+			assert.True(t, stored.IsActive)
+			require.Len(t, stored.Variants, 2)
+			assert.JSONEq(t, `{"v": "b"}`, string(stored.Variants[1].Content))
+			assert.Equal(t, 3, stored.Variants[1].Weight)
+
+			inactive := false
+			err = s.UpdateExperimentInStorage(ExperimentUpdate{ExperimentId: id, IsActive: &inactive, Variants: []Variant{{VariantId: stored.Variants[0].VariantId, Weight: 5}}}, ctx)
+			require.NoError(t, err)
+
+			err = s.UpdateExperimentInStorage(ExperimentUpdate{ExperimentId: id, Variants: []Variant{{VariantId: 999, Weight: 1}}}, ctx)
+			assert.ErrorIs(t, err, sql.ErrNoRows)
+
+			experiments, err := s.GetExperimentsFromStorage(90, ctx)
+			require.NoError(t, err)
+			require.Len(t, experiments, 1)
+			assert.False(t, experiments[0].IsActive)
+			assert.Equal(t, 5, experiments[0].Variants[0].Weight)
+			assert.Equal(t, 3, experiments[0].Variants[1].Weight)
+
+			experiments, err = s.GetExperimentsFromStorage(91, ctx)
+			require.NoError(t, err)
+			assert.Empty(t, experiments)
+
+			require.NoError(t, s.DeleteExperimentFromStorage(id, ctx))
+			assert.ErrorIs(t, s.DeleteExperimentFromStorage(id, ctx), sql.ErrNoRows)
+			_, err = s.GetExperimentFromStorage(id, ctx)
+			assert.ErrorIs(t, err, sql.ErrNoRows)
+		})
+	}
+}
+
+// TestExperimentAssign вариант пользователя не меняется между запросами, доли вариантов следуют весам
+func TestExperimentAssign(t *testing.T) {
+	experiment := Experiment{ExperimentId: 7, Variants: []Variant{
+		{VariantId: 1, Weight: 1},
+		{VariantId: 2, Weight: 3},
+		{VariantId: 3, Weight: 0},
+	}}
+
+	counts := map[int]int{}
+	for i := 0; i < 4000; i++ {
+		userId := "user" + strconv.Itoa(i)
+		variant, ok := experiment.Assign(userId)
+		require.True(t, ok)
+		again, _ := experiment.Assign(userId)
+		require.Equal(t, variant.VariantId, again.VariantId)
+		counts[variant.VariantId]++
+	}
+	assert.InDelta(t, 1000, counts[1], 150)
+	assert.InDelta(t, 3000, counts[2], 150)
+	assert.Zero(t, counts[3])
+
+	_, ok := Experiment{Variants: []Variant{{Weight: 0}}}.Assign("user")
+	assert.False(t, ok)
+}
+
+// TestBannerStats счетчики одного баннера за день складываются, выборка ограничивается баннером и днями
+func TestBannerStats(t *testing.T) {
+	ctx := context.Background()
+
+	for driver, s := range testStorages(t) {
+		s := s
+		t.Run(driver, func(t *testing.T) {
+			id, err := s.PostBannerToStorage(Banner{TagIds: []int{1, 2}, FeatureId: 100, Content: json.RawMessage(`{}`), IsActive: true}, ctx)
+			require.NoError(t, err)
+
+			found, _, _, _, err := s.GetBannerFromStorage(Query{FeatureId: 100, TagId: 2}, ctx)
+			require.NoError(t, err)
+			assert.Equal(t, id, found)
+
+			found, _, _, _, err = s.GetBannerFromStorage(Query{FeatureId: 100, TagId: 9, TagIds: []int{9, 1}}, ctx)
+			require.NoError(t, err)
+			assert.Equal(t, id, found)
+
+			banners, err := s.GetUserBannersFromStorage([]Query{{FeatureId: 100, TagId: 1}}, ctx)
+			require.NoError(t, err)
+			require.Len(t, banners, 1)
+			assert.Equal(t, id, banners[0].BannerId)
+
+			_, _, _, _, err = s.GetBannerFromStorage(Query{FeatureId: 100, TagId: 9}, ctx)
+			assert.ErrorIs(t, err, sql.ErrNoRows)
+
+			require.NoError(t, s.AddBannerStatsToStorage([]BannerStat{
+				{BannerId: id, Day: "2024-04-01", Impressions: 3, Cached: 2},
+				{BannerId: id, Day: "2024-04-02", Impressions: 1, Clicks: 1},
+				{BannerId: id + 1, Day: "2024-04-02", Clicks: 4},
+			}, ctx))
+			require.NoError(t, s.AddBannerStatsToStorage([]BannerStat{
+				{BannerId: id, Day: "2024-04-01", Impressions: 2, Cached: 1, Clicks: 1},
+			}, ctx))
+
+			stats, err := s.GetBannerStatsFromStorage(id, "", "", ctx)
+			require.NoError(t, err)
+			assert.Equal(t, []BannerStat{
+				{BannerId: id, Day: "2024-04-01", Impressions: 5, Cached: 3, Clicks: 1},
+				{BannerId: id, Day: "2024-04-02", Impressions: 1, Clicks: 1},
+			}, stats)
+
+			stats, err = s.GetBannerStatsFromStorage(0, "2024-04-02", "2024-04-02", ctx)
+			require.NoError(t, err)
+			require.Len(t, stats, 2)
+			assert.Equal(t, id, stats[0].BannerId)
+			assert.Equal(t, int64(4), stats[1].Clicks)
+
+			stats, err = s.GetBannerStatsFromStorage(0, "", "2024-03-31", ctx)
+			require.NoError(t, err)
+			assert.Empty(t, stats)
+		})
+	}
+}
+
+func TestResolutionValidate(t *testing.T) {
+	for _, r := range []Resolution{"", ResolveFirst, ResolvePriority, ResolveRecent} {
+		assert.NoError(t, r.Validate())
+	}
+	assert.Error(t, Resolution("random").Validate())
+}
+
+// BenchmarkReadsWithWriter параллельные чтения баннеров sqlite, пока другая горутина непрерывно меняет баннер.
+// Чтения идут в транзакциях только для чтения и не ждут блокировки на запись
+func BenchmarkReadsWithWriter(b *testing.B) {
+	for _, writer := range []bool{false, true} {
+		b.Run("writer="+strconv.FormatBool(writer), func(b *testing.B) {
+			ctx := context.Background()
+			log := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+			s, err := New(SqliteDriver, filepath.Join(b.TempDir(), "bench.db"), log, ctx)
+			require.NoError(b, err)
+			defer s.Db.Close()
+
+			const tags = 100
+			isActive := true
+			var id int
+			for tag := 1; tag <= tags; tag++ {
+				id, err = s.PostBannerToStorage(Banner{TagIds: []int{tag}, FeatureId: 1, Content: json.RawMessage(`{"v": 1}`), IsActive: true}, ctx)
+				require.NoError(b, err)
+			}
+
+			stop, done := make(chan struct{}), make(chan struct{})
+			go func() {
+				defer close(done)
+				for i := 0; writer; i++ {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					_, err := s.UpdateBannerInStorage(BannerUpdate{
+						BannerId:  id,
+						TagIds:    []int{tags},
+						FeatureId: 1,
+						Content:   json.RawMessage(`{"v": ` + strconv.Itoa(i) + `}`),
+						IsActive:  &isActive,
+					}, ctx)
+					if err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			}()
+
+			var next atomic.Int64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					tag := int(next.Add(1))%tags + 1
+					if _, _, _, _, err := s.GetBannerFromStorage(Query{FeatureId: 1, TagId: tag}, ctx); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+			b.StopTimer()
+
+			close(stop)
+			<-done
+		})
+	}
+}
@@ -0,0 +1,220 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	// RetentionUnlimited история версий не ограничивается
+	RetentionUnlimited = "unlimited"
+	// RetentionCount хранятся последние MaxCount версий каждого баннера
+	RetentionCount = "count"
+	// RetentionAge хранятся версии моложе MaxAge
+	RetentionAge = "age"
+)
+
+// Retention политика хранения истории версий. Пустая политика не ограничивает историю
+type Retention struct {
+	Policy   string
+	MaxCount int
+	MaxAge   time.Duration
+}
+
+// Validate проверяет, что параметры политики заданы
+func (r Retention) Validate() error {
+	switch r.Policy {
+	case "", RetentionUnlimited:
+	case RetentionCount:
+		if r.MaxCount < 1 {
+			return fmt.Errorf("version retention %q requires max_count >= 1", r.Policy)
+		}
+	case RetentionAge:
+		if r.MaxAge <= 0 {
+			return fmt.Errorf("version retention %q requires positive max_age", r.Policy)
+		}
+	default:
+		return fmt.Errorf("unknown version retention %q", r.Policy)
+	}
+
+	return nil
+}
+
+// ErrTagConflict пара фича-тег уже принадлежит другому баннеру
+var ErrTagConflict = errors.New("feature and tag are already used by another banner")
+
+// RollbackBannerInStorage восстанавливает фичу, контент, активность, период показа, приоритет, признак баннера
+// по умолчанию и теги баннера из версии versionId. Текущее состояние баннера сохраняется как новая версия.
+// Возвращает ключи кэша до и после отката, sql.ErrNoRows если версия не принадлежит баннеру,
+// ErrTagConflict если теги версии заняты другим баннером, ErrDefaultConflict если у фичи версии уже есть баннер по умолчанию
+func (s *Storage) RollbackBannerInStorage(id, versionId int, ctx context.Context) (keys []string, err error) {
+	tx, err := s.Db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			err := tx.Rollback()
+			if err != nil {
+				return
+			}
+			return
+		}
+		_ = tx.Commit()
+	}()
+
+	var version Banner
+	var content string
+	var from, until sql.NullTime
+	err = s.queryRow(ctx, tx, `SELECT feature_id, content, is_active, active_from, active_until, priority, is_default FROM banner_versions
+		WHERE id = :versionId AND banner_id = :bannerId`,
+		sql.Named("versionId", versionId),
+		sql.Named("bannerId", id)).
+		Scan(&version.FeatureId, &content, &version.IsActive, &from, &until, &version.Priority, &version.IsDefault)
+	if err != nil {
+		return nil, err
+	}
+	version.Window = scanWindow(from, until)
+
+	version.TagIds, err = s.tags(ctx, tx, `SELECT tag_id FROM banner_versions_tags WHERE banner_version_id = :id`, versionId)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, tagID := range version.TagIds {
+		var used int
+		err = s.queryRow(ctx, tx, `SELECT COUNT(*) FROM banner_tags WHERE feature_id = :featureId AND tag_id = :tagId AND banner_id <> :bannerId`,
+			sql.Named("featureId", version.FeatureId),
+			sql.Named("tagId", tagID),
+			sql.Named("bannerId", id)).
+			Scan(&used)
+		if err != nil {
+			return nil, err
+		}
+		if used > 0 {
+			return nil, ErrTagConflict
+		}
+	}
+
+	if version.IsDefault {
+		err = s.checkDefault(ctx, tx, version.FeatureId, id)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	keys, err = s.bannerKeys(ctx, tx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.saveVersion(ctx, tx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	activeFrom, activeUntil := version.Window.args()
+
+	_, err = s.exec(ctx, tx, `UPDATE banners
+		SET feature_id = :featureId,
+			content = :content,
+			is_active = :isActive,
+			active_from = :activeFrom,
+			active_until = :activeUntil,
+			priority = :priority,
+			is_default = :isDefault,
+			updated_at = CURRENT_TIMESTAMP
+		WHERE id = :bannerId`,
+		sql.Named("featureId", version.FeatureId),
+		sql.Named("content", content),
+		sql.Named("isActive", version.IsActive),
+		sql.Named("activeFrom", activeFrom),
+		sql.Named("activeUntil", activeUntil),
+		sql.Named("priority", version.Priority),
+		sql.Named("isDefault", version.IsDefault),
+		sql.Named("bannerId", id))
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = s.exec(ctx, tx, `DELETE FROM banner_tags WHERE banner_id = :bannerId`, sql.Named("bannerId", id))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, tagID := range version.TagIds {
+		_, err = s.exec(ctx, tx, `INSERT INTO banner_tags (banner_id, tag_id, feature_id) VALUES (:bannerId, :tagId, :featureId)`,
+			sql.Named("bannerId", id),
+			sql.Named("featureId", version.FeatureId),
+			sql.Named("tagId", tagID))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	newKeys, err := s.bannerKeys(ctx, tx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(keys, newKeys...), nil
+}
+
+// PruneVersionsInStorage применяет политику хранения к истории всех баннеров, возвращает число удаленных версий
+func (s *Storage) PruneVersionsInStorage(ctx context.Context) (removed int64, err error) {
+	tx, err := s.Db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err != nil {
+			err := tx.Rollback()
+			if err != nil {
+				return
+			}
+			return
+		}
+		_ = tx.Commit()
+	}()
+
+	return s.pruneVersions(ctx, tx, 0)
+}
+
+// pruneVersions удаляет версии сверх политики хранения вместе с их тегами.
+// bannerId = 0 применяет политику ко всем баннерам
+func (s *Storage) pruneVersions(ctx context.Context, e execer, bannerId int) (removed int64, err error) {
+	var cond string
+	switch s.Retention.Policy {
+	case RetentionCount:
+		cond = `(SELECT COUNT(*) FROM banner_versions newer
+			WHERE newer.banner_id = banner_versions.banner_id AND newer.id > banner_versions.id) >= :keep`
+	case RetentionAge:
+		cond = `versioned_at < :cutoff`
+	default:
+		return 0, nil
+	}
+	if bannerId > 0 {
+		cond += ` AND banner_id = :bannerId`
+	}
+
+	args := []any{
+		sql.Named("keep", s.Retention.MaxCount),
+		sql.Named("cutoff", time.Now().UTC().Add(-s.Retention.MaxAge)),
+		sql.Named("bannerId", bannerId),
+	}
+
+	_, err = s.exec(ctx, e, `DELETE FROM banner_versions_tags WHERE banner_version_id IN (SELECT id FROM banner_versions WHERE `+cond+`)`, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := s.exec(ctx, e, `DELETE FROM banner_versions WHERE `+cond, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
@@ -0,0 +1,218 @@
+package tracking
+
+import (
+	sqlite "avito-testovoe/internal/storage"
+	"context"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Kind вид события баннера
+type Kind int
+
+const (
+	// Impression показ баннера пользователю
+	Impression Kind = iota
+	// Click клик пользователя по баннеру
+	Click
+)
+
+// flushTimeout наибольшая длительность записи одной пачки счетчиков в хранилище
+const flushTimeout = 10 * time.Second
+
+// Event событие баннера BannerId. FeatureId и TagId ключ запроса, по которому показан баннер:
+// при нескольких тегах пользователя это первый из них, у клика тег неизвестен и равен 0.
+// FromCache отмечает показ, отданный из кэша
+type Event struct {
+	Kind      Kind
+	BannerId  int
+	FeatureId int
+	TagId     int
+	FromCache bool
+	Time      time.Time
+}
+
+// Store хранилище, в которое Writer записывает счетчики
+type Store interface {
+	AddBannerStatsToStorage(stats []sqlite.BannerStat, ctx context.Context) (err error)
+}
+
+// Writer буферизованная запись событий баннеров. Record не блокирует обработку запроса:
+// события попадают в буфер, а фоновая горутина пачками складывает их в счетчики по баннерам и дням.
+// Пачка записывается, когда набралось batchSize событий или прошел interval. Если буфер полон, событие отбрасывается
+type Writer struct {
+	store     Store
+	log       *slog.Logger
+	events    chan Event
+	batchSize int
+	interval  time.Duration
+
+	dropped  atomic.Int64
+	reported int64
+	started  sync.Once
+	once     sync.Once
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// New создает Writer с буфером на buffer событий. Запись начинается после Start
+func New(store Store, log *slog.Logger, buffer, batchSize int, interval time.Duration) *Writer {
+	if buffer <= 0 {
+		buffer = 1
+	}
+	if batchSize <= 0 {
+		batchSize = 1
+	}
+	if interval <= 0 {
+		interval = time.Second
+	}
+
+	return &Writer{
+		store:     store,
+		log:       log,
+		events:    make(chan Event, buffer),
+		batchSize: batchSize,
+		interval:  interval,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+// Start запускает фоновую запись событий. Повторный Start и Start после Close ничего не делают
+func (w *Writer) Start() {
+	w.started.Do(func() {
+		go w.run()
+	})
+}
+
+// Record добавляет событие в буфер, не дожидаясь записи. ok = false если буфер полон и событие отброшено
+func (w *Writer) Record(e Event) (ok bool) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	select {
+	case w.events <- e:
+		return true
+	default:
+		w.dropped.Add(1)
+		return false
+	}
+}
+
+// Dropped количество событий, отброшенных из-за полного буфера
+func (w *Writer) Dropped() int64 {
+	return w.dropped.Load()
+}
+
+// Close останавливает запись и дожидается, пока в хранилище попадут события, уже принятые Record.
+// События, записанные после Close, остаются в буфере и теряются. Если Start не вызывался, Close сразу возвращается
+func (w *Writer) Close() {
+	w.started.Do(func() {
+		close(w.done)
+	})
+	w.once.Do(func() {
+		close(w.stop)
+	})
+	<-w.done
+}
+
+func (w *Writer) run() {
+	defer close(w.done)
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	batch := make([]Event, 0, w.batchSize)
+	for {
+		select {
+		case e := <-w.events:
+			batch = append(batch, e)
+			if len(batch) >= w.batchSize {
+				w.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			w.flush(batch)
+			batch = batch[:0]
+		case <-w.stop:
+			for {
+				select {
+				case e := <-w.events:
+					batch = append(batch, e)
+				default:
+					w.flush(batch)
+					return
+				}
+			}
+		}
+	}
+}
+
+// flush складывает события пачки в счетчики по баннерам и дням (UTC) и прибавляет их к сохраненным.
+// События без баннера пропускаются
+func (w *Writer) flush(batch []Event) {
+	if len(batch) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), flushTimeout)
+	defer cancel()
+
+	type statKey struct {
+		bannerId int
+		day      string
+	}
+	stats := map[statKey]*sqlite.BannerStat{}
+	var order []statKey
+	skipped := 0
+
+	for _, e := range batch {
+		if e.BannerId == 0 {
+			skipped++
+			continue
+		}
+
+		key := statKey{bannerId: e.BannerId, day: e.Time.UTC().Format(sqlite.DayLayout)}
+		stat, found := stats[key]
+		if !found {
+			stat = &sqlite.BannerStat{BannerId: key.bannerId, Day: key.day}
+			stats[key] = stat
+			order = append(order, key)
+		}
+		switch e.Kind {
+		case Impression:
+			stat.Impressions++
+			if e.FromCache {
+				stat.Cached++
+			}
+		case Click:
+			stat.Clicks++
+		}
+	}
+
+	rows := make([]sqlite.BannerStat, 0, len(order))
+	for _, key := range order {
+		rows = append(rows, *stats[key])
+	}
+
+	if len(rows) > 0 {
+		if err := w.store.AddBannerStatsToStorage(rows, ctx); err != nil {
+			w.log.Error("Ошибка записи счетчиков баннеров:", slog.Any("err", err), slog.Int("events", len(batch)))
+			return
+		}
+	}
+
+	attrs := []any{slog.Int("events", len(batch)), slog.Int("rows", len(rows))}
+	if skipped > 0 {
+		attrs = append(attrs, slog.Int("skipped", skipped))
+	}
+	// отброшенные события сообщаются один раз, в логе ближайшей записанной пачки
+	if dropped := w.dropped.Load(); dropped > w.reported {
+		attrs = append(attrs, slog.Int64("dropped", dropped-w.reported))
+		w.reported = dropped
+	}
+	w.log.Info("Записаны счетчики баннеров", attrs...)
+}
@@ -0,0 +1,116 @@
+package tracking
+
+import (
+	sqlite "avito-testovoe/internal/storage"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeStore запоминает записанные счетчики
+type fakeStore struct {
+	mu      sync.Mutex
+	batches [][]sqlite.BannerStat
+}
+
+func (s *fakeStore) AddBannerStatsToStorage(stats []sqlite.BannerStat, ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.batches = append(s.batches, stats)
+	return nil
+}
+
+func (s *fakeStore) written() [][]sqlite.BannerStat {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.batches
+}
+
+func testLog() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+// TestWriterAggregates события пачки складываются по баннерам и дням, события без баннера пропускаются
+func TestWriterAggregates(t *testing.T) {
+	store := &fakeStore{}
+	w := New(store, testLog(), 100, 100, time.Hour)
+	w.Start()
+
+	day := time.Date(2024, 4, 1, 23, 0, 0, 0, time.UTC)
+	for _, e := range []Event{
+		{Kind: Impression, BannerId: 10, FromCache: true, Time: day},
+		{Kind: Impression, BannerId: 10, Time: day},
+		{Kind: Click, BannerId: 10, Time: day},
+		{Kind: Click, BannerId: 20, Time: day.Add(2 * time.Hour)},
+		{Kind: Impression, Time: day},
+	} {
+		assert.True(t, w.Record(e))
+	}
+	w.Close()
+
+	batches := store.written()
+	require.Len(t, batches, 1)
+	assert.Equal(t, []sqlite.BannerStat{
+		{BannerId: 10, Day: "2024-04-01", Impressions: 2, Cached: 1, Clicks: 1},
+		{BannerId: 20, Day: "2024-04-02", Clicks: 1},
+	}, batches[0])
+}
+
+// TestWriterBatchSize пачка записывается, как только набралось batchSize событий, не дожидаясь интервала
+func TestWriterBatchSize(t *testing.T) {
+	store := &fakeStore{}
+	w := New(store, testLog(), 100, 2, time.Hour)
+	w.Start()
+	defer w.Close()
+
+	w.Record(Event{Kind: Click, BannerId: 1})
+	w.Record(Event{Kind: Click, BannerId: 1})
+
+	assert.Eventually(t, func() bool { return len(store.written()) == 1 }, time.Second, 5*time.Millisecond)
+}
+
+// TestWriterDrops при полном буфере Record не блокируется, а отбрасывает событие
+func TestWriterDrops(t *testing.T) {
+	store := &fakeStore{}
+	w := New(store, testLog(), 1, 10, time.Hour)
+
+	assert.True(t, w.Record(Event{Kind: Click, BannerId: 1}))
+	assert.False(t, w.Record(Event{Kind: Click, BannerId: 1}))
+	assert.Equal(t, int64(1), w.Dropped())
+
+	w.Start()
+	w.Close()
+
+	batches := store.written()
+	require.Len(t, batches, 1)
+	assert.Equal(t, int64(1), batches[0][0].Clicks)
+}
+
+// TestWriterCloseWithoutStart Close без Start не блокируется, а Start после Close не запускает запись
+func TestWriterCloseWithoutStart(t *testing.T) {
+	store := &fakeStore{}
+	w := New(store, testLog(), 10, 10, time.Hour)
+	w.Record(Event{Kind: Click, BannerId: 1})
+
+	closed := make(chan struct{})
+	go func() {
+		w.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close без Start заблокировался")
+	}
+
+	w.Start()
+	w.Close()
+	assert.Empty(t, store.written())
+}